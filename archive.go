@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Formats of the archive mode, also the suffix of the archive objects
+const (
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveSuffix returns the suffix of the archive objects of format
+func archiveSuffix(format string) string {
+	return "." + format
+}
+
+// archiveObjectName returns the object of the archive of the configured
+// directory dir
+func archiveObjectName(pathBase, dir string) string {
+	name := buildObjectName(pathBase, dir)
+
+	if conf.PathMode != pathModeAbsolute {
+		name = pathBase + "/" + filepath.Base(filepath.Clean(dir))
+	}
+
+	return name + archiveSuffix(conf.Archive)
+}
+
+// archiveFiles walks dir and returns the files of its archive
+func archiveFiles(ctx context.Context, dir string) ([]string, error) {
+	saved := filesToCopy
+	filesToCopy = nil
+
+	defer func() { filesToCopy = saved }()
+
+	info, err := os.Stat(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory")
+	}
+
+	if err := walkPath(ctx, dir, dir, info, nil, nil); err != nil {
+		return nil, err
+	}
+
+	return filesToCopy, nil
+}
+
+// writeArchive writes the files found under dir to w as a tar, gzipped
+// when gz is set, with their paths relative to dir, modes and mtimes.
+// Recorded symlinks are stored as links
+func writeArchive(w io.Writer, dir string, files []string, gz bool) (int64, error) {
+	var size int64
+	var gw *gzip.Writer
+
+	if gz {
+		gw = gzip.NewWriter(w)
+		w = gw
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, path := range files {
+		info, err := os.Lstat(path)
+
+		if os.IsNotExist(err) {
+			logWarning("File \"%s\" not found", path)
+			continue
+		}
+
+		if err != nil {
+			return size, fmt.Errorf("os.Lstat: %w", err)
+		}
+
+		link := ""
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if conf.Symlinks == symlinksRecord {
+				if link, err = os.Readlink(path); err != nil {
+					return size, fmt.Errorf("os.Readlink: %w", err)
+				}
+			} else if info, err = os.Stat(path); err != nil {
+				return size, fmt.Errorf("os.Stat: %w", err)
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+
+		if err != nil {
+			return size, fmt.Errorf("tar.FileInfoHeader: %w", err)
+		}
+
+		rel, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return size, err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return size, fmt.Errorf("tar.WriteHeader: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		f, err := os.Open(path)
+
+		if err != nil {
+			return size, fmt.Errorf("os.Open: %w", err)
+		}
+
+		// The header holds the size, so a file that grew is cut there
+		n, err := io.CopyN(tw, f, hdr.Size)
+		f.Close()
+		size += n
+
+		if err != nil {
+			return size, fmt.Errorf("File \"%s\": %w", path, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return size, fmt.Errorf("tar.Close: %w", err)
+	}
+
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return size, fmt.Errorf("gzip.Close: %w", err)
+		}
+	}
+
+	return size, nil
+}
+
+// archiveDirectory streams the archive of dir to dest without staging it
+// on disk. Archives have no known length to resume from, so they are not
+// retried and uploadTimeout doesn't apply to them
+func archiveDirectory(ctx context.Context, dest *bucketClient, pathBase, dir string, files []string) manifestEntry {
+	entry := manifestEntry{File: dir, Object: archiveObjectName(pathBase, dir)}
+
+	pr, pw := io.Pipe()
+	sizes := make(chan int64, 1)
+
+	go func() {
+		size, err := writeArchive(pw, dir, files, conf.Archive == archiveTarGz)
+		sizes <- size
+		pw.CloseWithError(err)
+	}()
+
+	var r io.Reader = pr
+
+	if uploadLimiter != nil {
+		r = &rateLimitedReader{ctx: ctx, r: pr, limiter: uploadLimiter}
+	}
+
+	opts := dest.objectOptions()
+	opts.Metadata = map[string]string{}
+
+	for k, v := range customMetadata {
+		opts.Metadata[k] = v
+	}
+
+	opts.Metadata["x-archive"] = conf.Archive
+	opts.Metadata["x-source-host"] = sourceHost
+	opts.ContentType = "application/x-tar"
+	opts.ChunkSize = conf.ChunkSizeMB << 20
+	opts.NoTimeout = true
+	opts.Hash = sha256.New()
+
+	if conf.Archive == archiveTarGz {
+		opts.ContentType = "application/gzip"
+	}
+
+	crc, err := dest.backend.Upload(ctx, entry.Object, r, opts)
+
+	// Unblocks the archive writer when the upload stopped first
+	pr.CloseWithError(errors.New("upload stopped"))
+	entry.Size = <-sizes
+
+	if err != nil {
+		entry.fail(err)
+		return entry
+	}
+
+	entry.Status, entry.CRC32C = statusCopied, fmt.Sprintf("%08x", crc)
+	entry.SHA256 = hex.EncodeToString(opts.Hash.Sum(nil))
+
+	return entry
+}
+
+// archiveDirectories uploads every configured directory as a single
+// archive to every destination and returns the number of archives that
+// failed in any of them. The backup ends like the one of the files, each
+// archive being one of its files
+func archiveDirectories(ctx context.Context) int {
+	var dests []*bucketClient
+
+	for _, d := range conf.GoogleCloud {
+		dest := newClient(ctx, d)
+		defer dest.Close()
+
+		dests = append(dests, dest)
+	}
+
+	preflightAll(ctx, dests)
+
+	currentTime := time.Now()
+	pathBase := backupPrefix(currentTime)
+
+	walkedDirs = expandDirectories(conf.Directories)
+
+	events.OnStart(pathBase)
+
+	// The archives are the files of the report
+	archives := 0
+
+	for _, d := range walkedDirs {
+		dir := d.Path
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		files, err := archiveFiles(ctx, dir)
+
+		if os.IsNotExist(err) {
+			logWarning("Dir \"%s\" not found", dir)
+			continue
+		}
+
+		if err != nil {
+			logError("Dir \"%s\": %s", dir, err)
+			totalFilesError.inc()
+
+			continue
+		}
+
+		status := statusCopied
+		size := int64(0)
+		archives++
+
+		for _, dest := range dests {
+			entry := archiveDirectory(ctx, dest, pathBase, dir, files)
+			size = entry.Size
+			holdObject(ctx, dest, &entry)
+			fileEvent(dest.NameBucket, entry)
+
+			dest.entries = append(dest.entries, entry)
+
+			if entry.Status == statusError {
+				dest.filesError++
+				status = statusError
+			} else {
+				dest.filesOK++
+			}
+		}
+
+		if status == statusError {
+			totalFilesError.inc()
+			totalBytesError.add(size)
+		} else {
+			totalFilesOK.inc()
+			totalBytesOK.add(size)
+		}
+	}
+
+	writeManifests(ctx, dests, pathBase, currentTime, totalFilesError.get() == 0 && ctx.Err() == nil)
+
+	elapsed := time.Since(currentTime)
+
+	if ctx.Err() != nil {
+		logWarning("Backup interrupted: %s", ctx.Err())
+	}
+
+	logSummary("Backup finished", []summaryField{
+		{"Total files archived", "filesToCopy", totalFilesToCopy},
+		{"Total bytes archived", "bytesToCopy", byteCount(totalBytesToCopy)},
+		{"Total archives copied", "archivesCopied", totalFilesOK.get()},
+		{"Total archives with errors", "archivesError", totalFilesError.get()},
+		{"Copy files took", "elapsed", elapsed.String()},
+	}, destinationSummaries(dests))
+
+	report := runReport{
+		Prefix:      pathBase,
+		Started:     currentTime.Format(time.RFC3339),
+		Duration:    elapsed.Round(time.Second).String(),
+		FilesToCopy: archives,
+		FilesCopied: int(totalFilesOK.get()),
+		FilesError:  int(totalFilesError.get()),
+		BytesCopied: totalBytesOK.get(),
+		Failed:      totalFilesError.get() > 0 || ctx.Err() != nil,
+	}
+
+	finishRun(ctx, dests, currentTime, elapsed, report, "")
+
+	return int(totalFilesError.get())
+}
+
+// isArchive reports whether the object was written by the archive mode
+func isArchive(attrs *storage.ObjectAttrs) bool {
+	_, ok := attrs.Metadata["x-archive"]
+
+	return ok
+}
+
+// throughSymlink reports whether a directory between root and path is a
+// symlink
+func throughSymlink(root, path string) (bool, error) {
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+
+	if err != nil || rel == "." {
+		return false, err
+	}
+
+	dir := root
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("os.Lstat: %w", err)
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// extractArchive restores the files of the archive object into the
+// directory target. Existing files are kept, with a warning, unless force
+// is set
+func extractArchive(ctx context.Context, dest *bucketClient, attrs *storage.ObjectAttrs, target string) (bool, error) {
+	rc, err := dest.object(attrs.Name).NewReader(ctx)
+
+	if err != nil {
+		return false, fmt.Errorf("Object.NewReader: %w", err)
+	}
+
+	defer rc.Close()
+
+	var r io.Reader = rc
+
+	if attrs.Metadata["x-archive"] == archiveTarGz {
+		gr, err := gzip.NewReader(rc)
+
+		if err != nil {
+			return false, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+
+		defer gr.Close()
+
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	root := filepath.Clean(target)
+
+	for {
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			return true, nil
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("tar.Next: %w", err)
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(hdr.Name))
+
+		if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return false, fmt.Errorf("archive entry \"%s\" is outside the destination", hdr.Name)
+		}
+
+		// A symlink of the archive, or one already there, would take what's
+		// written below it out of the destination
+		if through, err := throughSymlink(root, path); err != nil {
+			return false, err
+		} else if through {
+			return false, fmt.Errorf("archive entry \"%s\" is below a symlink", hdr.Name)
+		}
+
+		if !force {
+			if _, err := os.Lstat(path); err == nil {
+				logEvent(levelWarning, logFields{File: path, Object: attrs.Name},
+					fmt.Sprintf("File \"%s\" already exists, use -force to overwrite it", path))
+				continue
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return false, fmt.Errorf("os.MkdirAll: %w", err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			os.Remove(path)
+
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return false, fmt.Errorf("os.Symlink: %w", err)
+			}
+		case tar.TypeReg:
+			// With -force, the file replaces a symlink instead of writing
+			// to its target
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(path); err != nil {
+					return false, fmt.Errorf("os.Remove: %w", err)
+				}
+			}
+
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+			if err != nil {
+				return false, fmt.Errorf("os.OpenFile: %w", err)
+			}
+
+			_, err = io.Copy(f, tr)
+
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+
+			if err != nil {
+				return false, fmt.Errorf("File \"%s\": %w", path, err)
+			}
+
+			if err := os.Chmod(path, hdr.FileInfo().Mode().Perm()); err != nil {
+				return false, fmt.Errorf("os.Chmod: %w", err)
+			}
+
+			if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+				return false, fmt.Errorf("os.Chtimes: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readTar returns the headers and the contents of the tar in data, by name
+func readTar(t *testing.T, data []byte, gz bool) (map[string]*tar.Header, map[string]string) {
+	t.Helper()
+
+	var r io.Reader = bytes.NewReader(data)
+
+	if gz {
+		zr, err := gzip.NewReader(r)
+
+		if err != nil {
+			t.Fatalf("archive is not gzipped: %v", err)
+		}
+
+		r = zr
+	}
+
+	headers, contents := map[string]*tar.Header{}, map[string]string{}
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("reading the archive: %v", err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		headers[hdr.Name], contents[hdr.Name] = hdr, string(content)
+	}
+
+	return headers, contents
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, format := range []string{archiveTar, archiveTarGz} {
+		t.Run(format, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			src := t.TempDir()
+			paths := []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"}
+
+			makeTree(t, src, paths...)
+
+			private := filepath.Join(src, "sub", "b.txt")
+			mtime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+
+			if err := os.Chmod(private, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chtimes(private, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			loadTestConf(t, backupConf(src, "pathMode: relative", "archive: "+format))
+
+			if errs := archiveDirectories(context.Background()); errs != 0 {
+				t.Fatalf("archiveDirectories = %d errors, want 0", errs)
+			}
+
+			prefix := backupPrefixOf(f, testBucket)
+			base := filepath.Base(src)
+
+			// One object for the whole directory
+			name := prefix + "/" + base + archiveSuffix(format)
+
+			if got := backedUp(f, testBucket); len(got) != 1 || got[0] != base+archiveSuffix(format) {
+				t.Fatalf("objects = %v, want only %s", got, name)
+			}
+
+			headers, contents := readTar(t, f.object(testBucket, name).Data, format == archiveTarGz)
+
+			var names []string
+
+			for name, content := range contents {
+				names = append(names, name)
+
+				if content != name {
+					t.Errorf("%s holds %q", name, content)
+				}
+			}
+
+			sort.Strings(names)
+
+			if !equalStrings(names, paths) {
+				t.Errorf("archive holds %v, want %v", names, paths)
+			}
+
+			if hdr := headers["sub/b.txt"]; hdr == nil || hdr.FileInfo().Mode().Perm() != 0600 || !hdr.ModTime.Equal(mtime) {
+				t.Errorf("header of sub/b.txt = %+v, want mode 0600 and mtime %s", hdr, mtime)
+			}
+
+			// Restoring extracts the archive into the directory
+			restorePrefix = prefix
+			restoreDest = t.TempDir()
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles = %d failures, want 0", failed)
+			}
+
+			checkTree(t, filepath.Join(restoreDest, base), paths...)
+
+			info, err := os.Stat(filepath.Join(restoreDest, base, "sub", "b.txt"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime) {
+				t.Errorf("restored sub/b.txt has mode %v and mtime %s", info.Mode().Perm(), info.ModTime())
+			}
+		})
+	}
+}
+
+func TestArchiveFinishesTheRun(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	src := t.TempDir()
+
+	makeTree(t, src, "a.txt", "sub/b.txt")
+
+	url, bodies := newWebhook(t, http.StatusOK)
+
+	loadTestConf(t, backupConf(src, "pathMode: relative", "archive: "+archiveTarGz, "summary: true", "notify: {webhookURL: "+url+"}"))
+	summaryOut = filepath.Join(t.TempDir(), "summary.json")
+
+	h := &recordingHandler{files: map[string]manifestEntry{}}
+	events = h
+
+	if errs := archiveDirectories(context.Background()); errs != 0 {
+		t.Fatalf("archiveDirectories = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	for _, name := range []string{manifestName, checksumsName, summaryName} {
+		if f.object(testBucket, prefix+"/"+name) == nil {
+			t.Errorf("no %s in the bucket, got %v", name, f.names(testBucket, ""))
+		}
+	}
+
+	archive := filepath.Base(src) + archiveSuffix(archiveTarGz)
+
+	if obj := f.object(testBucket, prefix+"/"+checksumsName); obj != nil && !strings.HasSuffix(string(obj.Data), "  "+archive+"\n") {
+		t.Errorf("checksums = %q, want the archive %s", obj.Data, archive)
+	}
+
+	if _, err := os.Stat(summaryOut); err != nil {
+		t.Errorf("-summary-out: %v", err)
+	}
+
+	if len(*bodies) != 1 {
+		t.Errorf("webhook called %d times, want 1", len(*bodies))
+	}
+
+	if len(h.events) != 3 || h.events[0] != "start" || h.events[2] != "complete" {
+		t.Errorf("events = %v, want start, the archive and complete", h.events)
+	}
+
+	if h.report.Prefix != prefix || h.report.FilesToCopy != 1 || h.report.FilesCopied != 1 || h.report.Failed {
+		t.Errorf("report = %+v", h.report)
+	}
+}
+
+func TestExtractArchiveThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+
+	tests := map[string][]*tar.Header{
+		"below a symlink of the archive": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+		"over a symlink of the archive": {
+			{Name: "evil.txt", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "evil.txt")},
+			{Name: "evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		},
+	}
+
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+
+			for _, hdr := range headers {
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+
+				if hdr.Typeflag == tar.TypeReg {
+					tw.Write([]byte("evil"))
+				}
+			}
+
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f.put(testBucket, fakeObject{Name: "p/dir.tar", Data: buf.Bytes(), Metadata: map[string]string{"x-archive": archiveTar}})
+
+			loadTestConf(t, backupConf(t.TempDir()))
+
+			// -force would otherwise replace the symlink's target
+			force = true
+
+			dest := newClient(context.Background(), conf.GoogleCloud[0])
+			defer dest.Close()
+
+			attrs, err := dest.object("p/dir.tar").Attrs(context.Background())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extractArchive(context.Background(), dest, attrs, filepath.Join(t.TempDir(), "dir"))
+
+			if _, err := os.Stat(filepath.Join(outside, "evil.txt")); err == nil {
+				t.Errorf("evil.txt written outside the destination")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Providers of the destinations
+const (
+	providerGCS = "gcs"
+	providerS3  = "s3"
+)
+
+// Backend is the object store behind a destination. The walk, the workers
+// and the summaries only go through it, the features specific to GCS use
+// the storage client of the destination
+type Backend interface {
+	// Upload writes r, compressed and with the settings of opts, to the
+	// object name and returns the CRC32C of the bytes stored
+	Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error)
+
+	// List calls fn with every object under prefix. With a delimiter, the
+	// names are cut after the first delimiter past prefix and each of those
+	// common prefixes is passed once, with only its name
+	List(ctx context.Context, prefix, delimiter string, fn func(obj objectInfo) error) error
+
+	// Delete removes the object name, which may be missing already
+	Delete(ctx context.Context, name string) error
+
+	// Exists reports whether the object name is there
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+// objectInfo is an object passed by Backend.List. The stores that don't
+// list them leave the checksum, the encoding and the metadata empty
+type objectInfo struct {
+	Name            string
+	Size            int64
+	CRC32C          uint32
+	HasCRC32C       bool
+	ContentEncoding string
+	Metadata        map[string]string
+}
+
+// gcsBackend is the Backend of the GCS destinations
+type gcsBackend struct {
+	b *bucketClient
+}
+
+func (g gcsBackend) Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error) {
+	return writeObject(ctx, g.b.object(name), r, opts)
+}
+
+func (g gcsBackend) List(ctx context.Context, prefix, delimiter string, fn func(obj objectInfo) error) error {
+	it := g.b.bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
+
+	for {
+		attrs, err := it.Next()
+
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		obj := objectInfo{Name: attrs.Prefix}
+
+		if attrs.Prefix == "" {
+			obj = objectInfo{
+				Name:            attrs.Name,
+				Size:            attrs.Size,
+				CRC32C:          attrs.CRC32C,
+				HasCRC32C:       true,
+				ContentEncoding: attrs.ContentEncoding,
+				Metadata:        attrs.Metadata,
+			}
+		}
+
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+}
+
+func (g gcsBackend) Delete(ctx context.Context, name string) error {
+	err := g.b.object(name).Delete(ctx)
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (g gcsBackend) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := g.b.object(name).Attrs(ctx)
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// isDirName reports whether a name passed by List is a common prefix
+func isDirName(name, delimiter string) bool {
+	return delimiter != "" && strings.HasSuffix(name, delimiter)
+}
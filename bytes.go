@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/time/rate"
+)
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseBytes parses a size such as "512", "10MB" or "1.5GiB"
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+
+	if i == -1 {
+		i = len(s)
+	}
+
+	number, err := strconv.ParseFloat(s[:i], 64)
+
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size \"%s\"", s)
+	}
+
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in size \"%s\"", s)
+	}
+
+	return int64(number * float64(unit)), nil
+}
+
+// byteCount is a number of bytes, printed with humanBytes in the text
+// summary and as a plain number in json
+type byteCount int64
+
+func (n byteCount) String() string {
+	return humanBytes(int64(n))
+}
+
+// humanBytes formats n with the largest binary unit that keeps it above 1
+func humanBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// newUploadLimiter returns a limiter allowing bytesPerSecond, with a burst
+// small enough to keep the rate smooth
+func newUploadLimiter(bytesPerSecond int64) *rate.Limiter {
+	burst := bytesPerSecond
+
+	if burst > 1<<20 {
+		burst = 1 << 20
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst))
+}
+
+// rateLimitedReader throttles reads through a limiter shared by all workers,
+// so the aggregate rate stays under the limit
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.limiter.Burst() {
+		p = p[:l.limiter.Burst()]
+	}
+
+	n, err := l.r.Read(p)
+
+	if n > 0 {
+		if werr := l.limiter.WaitN(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
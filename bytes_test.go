@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"10MB":    10 * 1000 * 1000,
+		"10 mb":   10 * 1000 * 1000,
+		"1.5GiB":  3 << 29,
+		"2KiB":    2048,
+		" 1 TB  ": 1000 * 1000 * 1000 * 1000,
+	}
+
+	for s, want := range tests {
+		if got, err := parseBytes(s); err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "-1", "10XB", "1.2.3"} {
+		if _, err := parseBytes(s); err == nil {
+			t.Errorf("parseBytes(%q) gave no error", s)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:             "0 B",
+		1:             "1 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		1 << 20:       "1.0 MiB",
+		1<<30 - 1<<29: "512.0 MiB",
+		1 << 30:       "1.0 GiB",
+		1 << 40:       "1.0 TiB",
+		1 << 50:       "1.0 PiB",
+		1 << 60:       "1.0 EiB",
+		math.MaxInt64: "8.0 EiB",
+	}
+
+	for n, want := range tests {
+		if got := humanBytes(n); got != want {
+			t.Errorf("humanBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestBytesTotals(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+
+	var sizeOK int64
+
+	for i, size := range []int{0, 1, 1000, 70000} {
+		data := bytes.Repeat([]byte{'x'}, size)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, "ok-"+string(rune('a'+i))), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		sizeOK += int64(size)
+	}
+
+	failed := filepath.Join(dir, "failed")
+
+	if err := ioutil.WriteFile(failed, make([]byte, 1234), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(failed)) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	if got := totalBytesOK.get(); got != sizeOK {
+		t.Errorf("totalBytesOK = %d, want %d", got, sizeOK)
+	}
+
+	if got := totalBytesError.get(); got != 1234 {
+		t.Errorf("totalBytesError = %d, want 1234", got)
+	}
+
+	if totalBytesToCopy != sizeOK+1234 {
+		t.Errorf("totalBytesToCopy = %d, want %d", totalBytesToCopy, sizeOK+1234)
+	}
+
+	// The objects hold the bytes counted
+	var stored int64
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	for _, name := range backedUp(f, testBucket) {
+		stored += int64(len(f.object(testBucket, prefix+"/"+name).Data))
+	}
+
+	if stored != sizeOK {
+		t.Errorf("the objects of the files hold %d bytes, want %d", stored, sizeOK)
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	const bytesPerSecond = 50000
+
+	limiter := newUploadLimiter(bytesPerSecond)
+	data := make([]byte, bytesPerSecond)
+
+	var wg sync.WaitGroup
+
+	started := time.Now()
+
+	// Two readers share the limit: the burst goes at once, the other
+	// bytesPerSecond bytes take a second
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			r := &rateLimitedReader{ctx: context.Background(), r: bytes.NewReader(data), limiter: limiter}
+
+			if n, err := io.Copy(ioutil.Discard, r); err != nil || n != int64(len(data)) {
+				t.Errorf("read %d bytes: %v", n, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if elapsed := time.Since(started); elapsed < 900*time.Millisecond {
+		t.Errorf("%d bytes read in %v, want at least a second", 2*len(data), elapsed)
+	}
+}
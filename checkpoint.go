@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the checkpoint of a running backup is saved
+const checkpointInterval = 10 * time.Second
+
+// checkpoint records the files of a backup already done, so an interrupted
+// backup can be resumed with -resume. Done holds the manifest entries of
+// each file, one per destination, to write them to the manifest of the
+// resumed run
+type checkpoint struct {
+	mutex sync.Mutex
+	path  string
+	dirty bool
+
+	Prefix string                     `json:"prefix"`
+	Done   map[string][]manifestEntry `json:"done"`
+}
+
+// checkpointPath returns the state file of the backup prefix, under
+// stateDir or the user cache directory
+func checkpointPath(prefix string) string {
+	dir := conf.StateDir
+
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+
+		if err != nil {
+			cache = os.TempDir()
+		}
+
+		dir = filepath.Join(cache, "gcs-backup")
+	}
+
+	return filepath.Join(dir, strings.ReplaceAll(prefix, "/", "_")+".json")
+}
+
+// loadCheckpoint reads the checkpoint of the backup prefix, empty when it
+// has none
+func loadCheckpoint(prefix string) (*checkpoint, error) {
+	c := &checkpoint{path: checkpointPath(prefix), Prefix: prefix, Done: map[string][]manifestEntry{}}
+
+	data, err := ioutil.ReadFile(c.path)
+
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+
+	if err != nil {
+		return c, fmt.Errorf("Reading checkpoint: %w", err)
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return c, fmt.Errorf("Parsing checkpoint \"%s\": %w", c.path, err)
+	}
+
+	if c.Done == nil {
+		c.Done = map[string][]manifestEntry{}
+	}
+
+	return c, nil
+}
+
+// done returns the entries of path when a previous run finished it in the
+// dests destinations
+func (c *checkpoint) done(path string, dests int) ([]manifestEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries, ok := c.Done[path]
+
+	return entries, ok && len(entries) == dests
+}
+
+// markDone records path with its entries in every destination
+func (c *checkpoint) markDone(path string, entries []manifestEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Done[path] = entries
+	c.dirty = true
+}
+
+// save writes the checkpoint when it changed since the last save. The file
+// is replaced by a rename, so a crash leaves either the old or the new one
+func (c *checkpoint) save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c)
+
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	tmp := c.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("Writing checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// keepSaving saves the checkpoint every checkpointInterval until ctx is done
+func (c *checkpoint) keepSaving(ctx context.Context) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				logWarning("Saving checkpoint: %s", err)
+			}
+		}
+	}
+}
+
+// remove deletes the checkpoint of a backup that completed
+func (c *checkpoint) remove() error {
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// listObjects returns the objects of dest under the backup prefix by name,
+// for -resume-on-partial
+func listObjects(ctx context.Context, dest *bucketClient, prefix string) (map[string]objectInfo, error) {
+	objects := map[string]objectInfo{}
+
+	err := dest.backend.List(ctx, strings.TrimSuffix(prefix, "/")+"/", "", func(obj objectInfo) error {
+		objects[obj.Name] = obj
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+// objectComplete reports whether obj, written from a file with info through
+// the transforms p, still holds the file, whose CRC32C is crc. Its x-size
+// and x-mtime must be those of the file, and an object stored as is must
+// have its CRC32C too. The S3 listings have no metadata, so their objects
+// are never taken as complete
+func objectComplete(obj objectInfo, info os.FileInfo, p pipeline, crc uint32) bool {
+	current := fileMetadata(info)
+
+	if obj.Metadata["x-size"] != current["x-size"] || obj.Metadata["x-mtime"] != current["x-mtime"] {
+		return false
+	}
+
+	// Transformed objects hold other bytes than the file
+	return len(p) > 0 || (obj.HasCRC32C && obj.CRC32C == crc && obj.Size == info.Size())
+}
+
+// fileChecksums returns the CRC32C of the content of path and its SHA-256
+// in hex
+func fileChecksums(path string) (uint32, string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return 0, "", fmt.Errorf("os.Open: %w", err)
+	}
+
+	defer f.Close()
+
+	crc := crc32.New(crc32cTable)
+	sha := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(crc, sha), f); err != nil {
+		return 0, "", fmt.Errorf("io.Copy: %w", err)
+	}
+
+	return crc.Sum32(), hex.EncodeToString(sha.Sum(nil)), nil
+}
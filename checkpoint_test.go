@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	resetState(t)
+	conf.StateDir = filepath.Join(t.TempDir(), "state")
+
+	const prefix = "hosts/web-1/2024-01-02_03-04-05"
+
+	c, err := loadCheckpoint(prefix)
+
+	if err != nil || len(c.Done) != 0 {
+		t.Fatalf("loadCheckpoint without a file = %+v, %v", c, err)
+	}
+
+	if filepath.Dir(c.path) != conf.StateDir || strings.Contains(filepath.Base(c.path), "/") {
+		t.Errorf("checkpoint path %s, want a file of stateDir", c.path)
+	}
+
+	entries := []manifestEntry{{File: "/a", Object: prefix + "/a", Status: statusCopied, CRC32C: "0000abcd"}}
+	c.markDone("/a", entries)
+
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaced by a rename, nothing else left behind
+	files, _ := ioutil.ReadDir(conf.StateDir)
+
+	if len(files) != 1 {
+		t.Errorf("state dir holds %d files, want 1", len(files))
+	}
+
+	loaded, err := loadCheckpoint(prefix)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if done, ok := loaded.done("/a", 1); !ok || done[0] != entries[0] {
+		t.Errorf("done(/a) = %+v, %v, want %+v", done, ok, entries)
+	}
+
+	// Done in only one of two destinations
+	if _, ok := loaded.done("/a", 2); ok {
+		t.Error("done(/a) with 2 destinations, want false")
+	}
+
+	if _, ok := loaded.done("/b", 1); ok {
+		t.Error("done(/b), want false")
+	}
+
+	if err := loaded.remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loaded.remove(); err != nil {
+		t.Errorf("removing a removed checkpoint: %v", err)
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	resetState(t)
+	conf.StateDir = t.TempDir()
+
+	if err := ioutil.WriteFile(checkpointPath("p"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadCheckpoint("p")
+
+	if err == nil || !strings.Contains(err.Error(), "Parsing checkpoint") {
+		t.Errorf("loadCheckpoint = %v, want a parsing error", err)
+	}
+
+	// The backup starts over with an empty one
+	if c == nil || len(c.Done) != 0 {
+		t.Errorf("checkpoint = %+v, want an empty one", c)
+	}
+}
+
+func TestResumeSkipsDoneFiles(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 4)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[2])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	data, err := ioutil.ReadFile(checkpointPath(prefix))
+
+	if err != nil {
+		t.Fatalf("no checkpoint of the incomplete backup: %v", err)
+	}
+
+	// Resumed with the same state
+	f.failUpload = nil
+	loadTestConf(t, backupConf(dir))
+
+	if err := ioutil.WriteFile(checkpointPath(prefix), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resumePrefix = prefix
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("resumed copyFiles = %d errors, want 0", errs)
+	}
+
+	for i, file := range files {
+		want := 1
+
+		if i == 2 {
+			want = 2
+		}
+
+		if n := f.count("UPLOAD", prefix+"/"+absoluteObjectPath(file)); n != want {
+			t.Errorf("%s uploaded %d times, want %d", file, n, want)
+		}
+	}
+
+	if skipped := totalFilesSkipped.get(); skipped != 3 {
+		t.Errorf("totalFilesSkipped = %d, want 3", skipped)
+	}
+
+	// The manifest of the resumed run has every file
+	m := readManifest(t, f, testBucket, prefix)
+
+	if len(m.Files) != len(files) {
+		t.Errorf("manifest has %d entries, want %d", len(m.Files), len(files))
+	}
+
+	for _, entry := range m.Files {
+		if entry.Status != statusCopied {
+			t.Errorf("%s is %s, want %s", entry.File, entry.Status, statusCopied)
+		}
+	}
+
+	if _, err := os.Stat(checkpointPath(prefix)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint of the completed backup left: %v", err)
+	}
+}
+
+func TestObjectComplete(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	data := []byte("the content of the file")
+
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crc := crc32.Checksum(data, crc32cTable)
+	complete := objectInfo{Size: info.Size(), CRC32C: crc, HasCRC32C: true, Metadata: fileMetadata(info)}
+
+	// object returns complete with change applied
+	object := func(change func(obj *objectInfo)) objectInfo {
+		obj := complete
+		obj.Metadata = map[string]string{}
+
+		for k, v := range complete.Metadata {
+			obj.Metadata[k] = v
+		}
+
+		change(&obj)
+
+		return obj
+	}
+
+	gzipped := pipeline{compressGzip}
+
+	tests := []struct {
+		name string
+		obj  objectInfo
+		p    pipeline
+		want bool
+	}{
+		{"complete", complete, nil, true},
+		{"truncated", object(func(obj *objectInfo) { obj.Size, obj.CRC32C = 10, crc32.Checksum(data[:10], crc32cTable) }), nil, false},
+		{"larger", object(func(obj *objectInfo) { obj.Size++ }), nil, false},
+		{"of a file of another size", object(func(obj *objectInfo) { obj.Metadata["x-size"] = "5" }), nil, false},
+		{"of an older file", object(func(obj *objectInfo) { obj.Metadata["x-mtime"] = "2020-01-01T00:00:00Z" }), nil, false},
+		{"other content of the same size", object(func(obj *objectInfo) { obj.CRC32C++ }), nil, false},
+		{"without a CRC32C", object(func(obj *objectInfo) { obj.HasCRC32C = false }), nil, false},
+		{"without metadata", object(func(obj *objectInfo) { obj.Metadata = nil }), nil, false},
+		// A compressed object has other bytes, its metadata tells
+		{"compressed", object(func(obj *objectInfo) { obj.Size, obj.CRC32C = 7, 1 }), gzipped, true},
+		{"compressed of another size", object(func(obj *objectInfo) { obj.Metadata["x-size"] = "5" }), gzipped, false},
+	}
+
+	for _, test := range tests {
+		if got := objectComplete(test.obj, info, test.p, crc); got != test.want {
+			t.Errorf("%s: objectComplete = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResumeOnPartial(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 5)
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	object := func(file string) string { return prefix + "/" + absoluteObjectPath(file) }
+
+	// What an interrupted run and the changes since leave: a truncated
+	// object, a missing one, a file with another size and one with other
+	// content of the same size and modification time
+	f.mutex.Lock()
+	obj := f.buckets[testBucket].objects[object(files[1])]
+	obj.Data = obj.Data[:len(obj.Data)/2]
+	delete(f.buckets[testBucket].objects, object(files[2]))
+	f.mutex.Unlock()
+
+	if err := ioutil.WriteFile(files[3], []byte("a longer content than before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(files[4])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(files[4], []byte(strings.ToUpper(files[4])), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(files[4], info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	loadTestConf(t, backupConf(dir))
+	resumePrefix, resumeOnPartial = prefix, true
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("resumed copyFiles = %d errors, want 0", errs)
+	}
+
+	// Only the complete object is kept
+	for i, file := range files {
+		want := 2
+
+		if i == 0 {
+			want = 1
+		}
+
+		if n := f.count("UPLOAD", object(file)); n != want {
+			t.Errorf("%s uploaded %d times, want %d", file, n, want)
+		}
+
+		data, _ := ioutil.ReadFile(file)
+
+		if obj := f.object(testBucket, object(file)); obj == nil || string(obj.Data) != string(data) {
+			t.Errorf("object of %s doesn't hold the file", file)
+		}
+	}
+
+	entries := map[string]manifestEntry{}
+
+	for _, entry := range readManifest(t, f, testBucket, prefix).Files {
+		entries[entry.File] = entry
+	}
+
+	if kept := entries[files[0]]; kept.Status != statusUnchanged || kept.CRC32C == "" || kept.SHA256 == "" {
+		t.Errorf("manifest entry of the kept object = %+v", kept)
+	}
+
+	// The kept file can be checked with the others
+	sum, _ := fileHash(files[0])
+	checksums := f.object(testBucket, prefix+"/"+checksumsName)
+
+	if checksums == nil || !strings.Contains(string(checksums.Data), sum+"  "+absoluteObjectPath(files[0])+"\n") {
+		t.Errorf("%s without the kept file", checksumsName)
+	}
+}
+
+func TestResumeOnPartialNeedsResume(t *testing.T) {
+	if err := parseTestConf(t, backupConf(t.TempDir())); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, code := runMain(t, "-config", fileConf, "-resume-on-partial"); code != 1 || !strings.Contains(out, "-resume-on-partial needs -resume") {
+		t.Errorf("exit status %d, want 1: %s", code, out)
+	}
+}
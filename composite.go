@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Most sources a single compose request takes
+const maxComposeParts = 32
+
+// Smallest size of a file uploaded in parts, and their number
+var (
+	compositeThreshold int64
+	compositeParts     int
+)
+
+// useComposite reports whether a file of size bytes, going through the
+// transforms p, is uploaded in parts. Transformed files are streamed, so
+// they never are
+func useComposite(size int64, p pipeline) bool {
+	return compositeThreshold > 0 && size >= compositeThreshold && len(p) == 0
+}
+
+// partName returns the name of the temporary object of part i of object
+func partName(object string, i int) string {
+	return fmt.Sprintf("%s.part-%02d", object, i)
+}
+
+// writePart uploads part of the file to the object name, with the retries
+// of writeObject
+func writePart(ctx context.Context, dest *bucketClient, name string, part *io.SectionReader, opts objectOptions) error {
+	var r io.Reader = part
+
+	if uploadLimiter != nil {
+		r = &rateLimitedReader{ctx: ctx, r: part, limiter: uploadLimiter}
+	}
+
+	for attempt := 0; ; attempt++ {
+		_, err := writeObject(ctx, dest.object(name), r, opts)
+
+		if err == nil || attempt >= conf.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		logWarning("Part \"%s\" failed, retrying (%d/%d): %v", name, attempt+1, conf.MaxRetries, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(attempt)):
+		}
+
+		if _, err := part.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("Seek: %w", err)
+		}
+	}
+}
+
+// compositeUpload uploads the file f of size bytes to object as
+// compositeParts parts at once, composes them into object and deletes
+// them. The CRC32C of the composed object is checked against the one of
+// the file, read alongside the parts. It returns the CRC32C, the SHA-256
+// and the number of bytes of the file read
+func compositeUpload(ctx context.Context, dest *bucketClient, f *os.File, size int64, object string, opts objectOptions) (uint32, string, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	partSize := (size + int64(compositeParts) - 1) / int64(compositeParts)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	var sources []*storage.ObjectHandle
+
+	fail := func(err error) {
+		mutex.Lock()
+
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+
+		mutex.Unlock()
+	}
+
+	partOpts := dest.objectOptions()
+	partOpts.ChunkSize = chunkSize(partSize)
+
+	for i := 0; int64(i)*partSize < size; i++ {
+		name := partName(object, i)
+		sources = append(sources, dest.object(name))
+		offset := int64(i) * partSize
+		n := partSize
+
+		if offset+n > size {
+			n = size - offset
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if err := writePart(ctx, dest, name, io.NewSectionReader(f, offset, n), partOpts); err != nil {
+				fail(fmt.Errorf("part \"%s\": %w", name, err))
+			}
+		}()
+	}
+
+	// The parts are deleted whatever happens to the compose
+	defer func() {
+		for _, src := range sources {
+			if err := src.Delete(context.WithoutCancel(ctx)); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+				logWarning("Deleting part \"%s\": %s", src.ObjectName(), err)
+			}
+		}
+	}()
+
+	// The checksums of the whole file, read once more next to the parts and
+	// within the rate limit like them
+	var whole io.Reader = io.NewSectionReader(f, 0, size)
+
+	if uploadLimiter != nil {
+		whole = &rateLimitedReader{ctx: ctx, r: whole, limiter: uploadLimiter}
+	}
+
+	crc := crc32.New(crc32cTable)
+	sha := sha256.New()
+	read, err := io.Copy(io.MultiWriter(crc, sha), whole)
+
+	if err != nil {
+		fail(fmt.Errorf("io.Copy: %w", err))
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return 0, "", 0, firstErr
+	}
+
+	composer := dest.object(object).ComposerFrom(sources...)
+	composer.Metadata = opts.Metadata
+	composer.ContentType = opts.ContentType
+	composer.StorageClass = opts.StorageClass
+	composer.KMSKeyName = opts.KMSKeyName
+	composer.PredefinedACL = opts.PredefinedACL
+	composer.CRC32C, composer.SendCRC32C = crc.Sum32(), true
+
+	attrs, err := composer.Run(ctx)
+
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("Composer.Run: %w", err)
+	}
+
+	if attrs.CRC32C != crc.Sum32() {
+		discardObject(ctx, dest.object(object), attrs.Generation)
+		return 0, "", 0, fmt.Errorf("%w: local crc32c %08x, composed %08x", errChecksumMismatch, crc.Sum32(), attrs.CRC32C)
+	}
+
+	return crc.Sum32(), hex.EncodeToString(sha.Sum(nil)), read, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLargeFile writes size random bytes to dir/name and returns its path
+// and content
+func writeLargeFile(t *testing.T, dir, name string, size int) (string, []byte) {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	path := filepath.Join(dir, name)
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, data
+}
+
+func TestCompositeUpload(t *testing.T) {
+	const parts = 4
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	large, data := writeLargeFile(t, dir, "large.bin", 1<<20+123)
+	small, _ := writeLargeFile(t, dir, "small.bin", 1000)
+
+	loadTestConf(t, backupConf(dir, "compositeThreshold: 256KiB", "compositeParts: 4"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	name := prefix + "/" + absoluteObjectPath(large)
+	obj := f.object(testBucket, name)
+
+	if obj == nil {
+		t.Fatalf("no composed object, got %v", f.names(testBucket, ""))
+	}
+
+	if !bytes.Equal(obj.Data, data) {
+		t.Errorf("composed object of %d bytes differs from the file of %d", len(obj.Data), len(data))
+	}
+
+	if n := f.count("COMPOSE", name); n != 1 {
+		t.Errorf("%d composes, want 1", n)
+	}
+
+	if n := f.count("UPLOAD", name); n != 0 {
+		t.Errorf("%d uploads of the whole file, want 0", n)
+	}
+
+	// Every part is uploaded once, then deleted
+	for i := 0; i < parts; i++ {
+		part := partName(name, i)
+
+		if n := f.count("UPLOAD", part); n != 1 {
+			t.Errorf("%d uploads of %s, want 1", n, part)
+		}
+
+		if n := f.count(http.MethodDelete, part); n != 1 {
+			t.Errorf("%d deletes of %s, want 1", n, part)
+		}
+	}
+
+	if leftover := f.names(testBucket, name+".part-"); len(leftover) != 0 {
+		t.Errorf("parts left behind: %v", leftover)
+	}
+
+	// Files under the threshold are uploaded whole
+	smallName := prefix + "/" + absoluteObjectPath(small)
+
+	if f.count("UPLOAD", smallName) != 1 || f.count("COMPOSE", smallName) != 0 {
+		t.Errorf("small file not uploaded whole")
+	}
+}
+
+func TestCompositeUploadFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(f *fakeGCS)
+		wantErr string
+	}{
+		{"part refused", func(f *fakeGCS) {
+			f.failUpload = func(bucket, name string) int {
+				if strings.HasSuffix(name, ".part-02") {
+					return http.StatusForbidden
+				}
+
+				return 0
+			}
+		}, "part-02"},
+		{"corrupted part", func(f *fakeGCS) {
+			f.corrupt = func(name string) bool { return strings.HasSuffix(name, ".part-01") }
+		}, "part-01"},
+		// GCS rejects it for the CRC32C sent with it
+		{"corrupted compose", func(f *fakeGCS) {
+			f.corrupt = func(name string) bool { return strings.HasSuffix(name, "large.bin") }
+		}, "composer.run"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			test.setup(f)
+
+			dir := t.TempDir()
+			large, _ := writeLargeFile(t, dir, "large.bin", 1<<20)
+
+			loadTestConf(t, backupConf(dir, "compositeThreshold: 256KiB", "compositeParts: 4", "maxRetries: 0"))
+			runLog = new(bytes.Buffer)
+
+			if errs := copyFiles(context.Background()); errs != 1 {
+				t.Fatalf("copyFiles = %d errors, want 1", errs)
+			}
+
+			if !strings.Contains(strings.ToLower(runLog.String()), test.wantErr) {
+				t.Errorf("log without %q:\n%s", test.wantErr, runLog)
+			}
+
+			// The parts are cleaned up whatever went wrong
+			name := backupPrefixOf(f, testBucket) + "/" + absoluteObjectPath(large)
+
+			if leftover := f.names(testBucket, name+".part-"); len(leftover) != 0 {
+				t.Errorf("parts left behind: %v", leftover)
+			}
+
+			if f.object(testBucket, name) != nil {
+				t.Errorf("object %s left behind", name)
+			}
+		})
+	}
+}
+
+func TestUseComposite(t *testing.T) {
+	resetState(t)
+	compositeThreshold, compositeParts = 100, 4
+
+	tests := []struct {
+		size int64
+		p    pipeline
+		want bool
+	}{
+		{99, nil, false},
+		{100, nil, true},
+		{1 << 30, nil, true},
+		{1 << 30, pipeline{compressGzip}, false},
+	}
+
+	for _, test := range tests {
+		if got := useComposite(test.size, test.p); got != test.want {
+			t.Errorf("useComposite(%d, %v) = %v, want %v", test.size, test.p, got, test.want)
+		}
+	}
+
+	compositeThreshold = 0
+
+	if useComposite(1<<30, nil) {
+		t.Error("composite upload without a threshold")
+	}
+}
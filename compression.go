@@ -0,0 +1,139 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression is the format files are compressed with before the upload
+type compression string
+
+const (
+	compressNone compression = "none"
+	compressGzip compression = "gzip"
+	compressZstd compression = "zstd"
+)
+
+// parseCompression accepts a format or, as in the original boolean
+// setting, true for gzip and false for none
+func parseCompression(s string) (compression, error) {
+	switch s {
+	case "", "false", string(compressNone):
+		return compressNone, nil
+	case "true", string(compressGzip):
+		return compressGzip, nil
+	case string(compressZstd):
+		return compressZstd, nil
+	}
+
+	return "", fmt.Errorf("unknown compression \"%s\", use gzip, zstd or none", s)
+}
+
+func (c *compression) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := parseCompression(s)
+
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+
+	return nil
+}
+
+// String, Set and IsBoolFlag make compression a flag that can be given
+// alone for gzip, as before, or with a format
+func (c *compression) String() string {
+	return string(*c)
+}
+
+func (c *compression) Set(s string) error {
+	parsed, err := parseCompression(s)
+
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+
+	return nil
+}
+
+func (c *compression) IsBoolFlag() bool {
+	return true
+}
+
+// suffix returns the extension of the object names of files compressed
+// with c
+func (c compression) suffix() string {
+	switch c {
+	case compressGzip:
+		return ".gz"
+	case compressZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// encoding returns the Content-Encoding of the objects compressed with c
+func (c compression) encoding() string {
+	switch c {
+	case compressGzip, compressZstd:
+		return string(c)
+	}
+
+	return ""
+}
+
+// newWriter returns a writer compressing into w, which must be closed to
+// flush it
+func (c compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case compressGzip:
+		return gzip.NewWriter(w), nil
+	case compressZstd:
+		return zstd.NewWriter(w)
+	}
+
+	return nil, fmt.Errorf("no writer for compression \"%s\"", c)
+}
+
+// encodingCompression returns the compression of an object with the
+// Content-Encoding encoding
+func encodingCompression(encoding string) compression {
+	switch encoding {
+	case "gzip":
+		return compressGzip
+	case "zstd":
+		return compressZstd
+	}
+
+	return compressNone
+}
+
+// decompressReader returns the content of an object with the
+// Content-Encoding encoding read from r. GCS already decompresses gzip
+// objects on download, zstd ones are decompressed here
+func decompressReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	if encodingCompression(encoding) != compressZstd {
+		return io.NopCloser(r), nil
+	}
+
+	d, err := zstd.NewReader(r)
+
+	if err != nil {
+		return nil, fmt.Errorf("zstd.NewReader: %w", err)
+	}
+
+	return d.IOReadCloser(), nil
+}
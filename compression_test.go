@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressedUploadRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("a line of a log that compresses well\n", 1000))
+
+	tests := []struct {
+		compress   string
+		suffix     string
+		decompress func([]byte) ([]byte, error)
+	}{
+		{"gzip", ".gz", func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+
+			if err != nil {
+				return nil, err
+			}
+
+			return ioutil.ReadAll(r)
+		}},
+		{"zstd", ".zst", func(data []byte) ([]byte, error) {
+			r, err := zstd.NewReader(bytes.NewReader(data))
+
+			if err != nil {
+				return nil, err
+			}
+
+			defer r.Close()
+
+			return ioutil.ReadAll(r)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.compress, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			path := filepath.Join(dir, "app.log")
+
+			if err := ioutil.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			loadTestConf(t, backupConf(dir, "compress: "+test.compress))
+
+			if errs := copyFiles(context.Background()); errs != 0 {
+				t.Fatalf("copyFiles = %d errors, want 0", errs)
+			}
+
+			name := backupPrefixOf(f, testBucket) + "/" + absoluteObjectPath(path) + test.suffix
+			obj := f.object(testBucket, name)
+
+			if obj == nil {
+				t.Fatalf("no object %s, got %v", name, f.names(testBucket, ""))
+			}
+
+			if obj.ContentEncoding != test.compress {
+				t.Errorf("Content-Encoding = %q, want %q", obj.ContentEncoding, test.compress)
+			}
+
+			if len(obj.Data) >= len(content) {
+				t.Errorf("object of %d bytes, not smaller than the %d of the file", len(obj.Data), len(content))
+			}
+
+			data, err := test.decompress(obj.Data)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, content) {
+				t.Error("decompressed object differs from the file")
+			}
+		})
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := map[string]compression{
+		"":      compressNone,
+		"false": compressNone,
+		"none":  compressNone,
+		"true":  compressGzip,
+		"gzip":  compressGzip,
+		"zstd":  compressZstd,
+	}
+
+	for s, want := range tests {
+		if got, err := parseCompression(s); err != nil || got != want {
+			t.Errorf("parseCompression(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+
+	if _, err := parseCompression("bzip2"); err == nil {
+		t.Error("parseCompression(bzip2) gave no error")
+	}
+}
+
+func TestCompressionFormatsRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat("2024-01-02 15:04:05 GET /index.html 200\n", 5000))
+
+	tests := []struct {
+		compress string
+		suffix   string
+		encoding string
+	}{
+		{"none", "", ""},
+		{"gzip", ".gz", "gzip"},
+		{"zstd", ".zst", "zstd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.compress, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			src := t.TempDir()
+
+			if err := ioutil.WriteFile(filepath.Join(src, "access.log"), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			prefix := backUp(t, f, src, "pathMode: relative", "compress: "+test.compress)
+			base := filepath.Base(src)
+
+			obj := f.object(testBucket, prefix+"/"+base+"/access.log"+test.suffix)
+
+			if obj == nil {
+				t.Fatalf("no object with the suffix %q, got %v", test.suffix, f.names(testBucket, prefix))
+			}
+
+			if obj.ContentEncoding != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", obj.ContentEncoding, test.encoding)
+			}
+
+			// The restore finds the format from the object and drops the suffix
+			restorePrefix = prefix
+			restoreDest = t.TempDir()
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles = %d failures, want 0", failed)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(restoreDest, base, "access.log"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, content) {
+				t.Errorf("restored %d bytes that differ from the %d of the file", len(data), len(content))
+			}
+		})
+	}
+
+	if _, err := compressNone.newWriter(ioutil.Discard); err == nil {
+		t.Error("compression none gave a writer")
+	}
+}
@@ -0,0 +1,999 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Configuration struct {
+	Directories []Directory `yaml:"directories"`
+	Concurrency int         `yaml:"concurrency"`
+	// Tune the workers busy at once, up to concurrency, by the throughput
+	AutoConcurrency bool `yaml:"autoConcurrency"`
+	// Files the walk can get ahead of the upload workers
+	QueueSize  int `yaml:"queueSize"`
+	MaxRetries int `yaml:"maxRetries"`
+	// Abort the backup on the first file that fails, not only on the
+	// errors that doom all of them
+	FailFast bool `yaml:"failFast"`
+	// Abort the backup when this many files in a row fail in a bucket, "0"
+	// disables it
+	MaxConsecutiveFailures int `yaml:"maxConsecutiveFailures"`
+	// Abort the backup when more files than this fail, a count or a
+	// percentage of the files to copy such as "5%"
+	MaxFileErrors string `yaml:"maxFileErrors"`
+	// Upload once more the files that changed while they were uploaded
+	RetryChanged bool `yaml:"retryChanged"`
+	// Copy every file to a temporary file and upload that copy, once it's
+	// known the file didn't change while it was copied
+	Stage bool `yaml:"stage"`
+	// Don't upload the files of zero bytes, which the manifest lists as
+	// skipped
+	SkipEmptyFiles bool `yaml:"skipEmptyFiles"`
+	// Don't write a probe object to check the buckets before a backup
+	SkipWriteProbe bool `yaml:"skipWriteProbe"`
+	// Objects written at the same time across all workers and
+	// destinations, 0 means unlimited
+	MaxInflight int      `yaml:"maxInflight"`
+	Include     []string `yaml:"include"`
+	Exclude     []string `yaml:"exclude"`
+	// Files with more include and exclude patterns, one per line
+	IncludeFrom string `yaml:"includeFrom"`
+	ExcludeFrom string `yaml:"excludeFrom"`
+	// What happens to the entries of directories that are files: backup
+	// or skip
+	FileEntries string `yaml:"fileEntries"`
+	// Only files with these extensions are backed up, any case, all when empty
+	Extensions []string `yaml:"extensions"`
+	// Keep only the text or only the binary files
+	Content     string      `yaml:"content"`
+	Compress    compression `yaml:"compress"`
+	ChunkSizeMB int         `yaml:"chunkSizeMB"`
+	// Stages the files go through before the upload, in order: compress
+	// and encrypt, with the base64 32-byte key clientKey
+	Transforms []string `yaml:"transforms"`
+	ClientKey  string   `yaml:"clientKey"`
+	// Files from this size up are uploaded as compositeParts parts at once
+	// and composed in GCS
+	CompositeThreshold string `yaml:"compositeThreshold"`
+	CompositeParts     int    `yaml:"compositeParts"`
+	// How object paths are derived: absolute, relative or flatten
+	PathMode string `yaml:"pathMode"`
+	// What happens when two files get the same object path: error, skip
+	// or suffix. flattenCollisions is its former name
+	Collisions        string `yaml:"collisions"`
+	FlattenCollisions string `yaml:"flattenCollisions"`
+	// Content type by file extension, over the detected one
+	ContentTypes map[string]string `yaml:"contentTypes"`
+	Incremental  bool              `yaml:"incremental"`
+	// Skip the files with the size and mtime of the previous manifest
+	OnlyChanged bool `yaml:"onlyChanged"`
+	// Skip the files modified before the start of the latest backup
+	NewerThanBackup bool `yaml:"newerThanBackup"`
+	// Copy the objects of the files unchanged since the latest backup
+	// within GCS instead of uploading them
+	CompareWithLatest bool `yaml:"compareWithLatest"`
+	// Upload each directory as a single tar or tar.gz object
+	Archive string `yaml:"archive"`
+	// Upload each content once per backup, copying the object for the
+	// other files with the same content
+	Dedup bool `yaml:"dedup"`
+	// How symlinks are handled: skip, follow or record
+	Symlinks string `yaml:"symlinks"`
+	// Sizes such as "1KB" or "2GiB"
+	MinSize string `yaml:"minSize"`
+	MaxSize string `yaml:"maxSize"`
+	// Time such as "2024-01-02" or "2024-01-02T15:04:05Z"
+	ModifiedSince string `yaml:"modifiedSince"`
+	// Duration such as "7d" or "36h"
+	ModifiedWithin string `yaml:"modifiedWithin"`
+	// Identifier of this host, the hostname when empty
+	SourceHost string `yaml:"sourceHost"`
+	// Prefix of the objects with {hostname}, {date}, {time} and {env}
+	// placeholders, the timestamp when empty
+	PrefixTemplate string `yaml:"prefixTemplate"`
+	// Go layout of the timestamp prefix, 2006-01-02_15-04-05 by default
+	TimestampFormat string `yaml:"timestampFormat"`
+	// IANA name of the time zone of the timestamps, such as UTC or
+	// Europe/Madrid, the local one by default
+	Timezone string `yaml:"timezone"`
+	// Namespace of the backups in the bucket, before their prefix
+	BasePrefix string `yaml:"basePrefix"`
+	// Metadata of every object, values with the same placeholders as
+	// prefixTemplate
+	Metadata map[string]string `yaml:"metadata"`
+	// Environment variable read for the {env} placeholder
+	PrefixEnvVar string `yaml:"prefixEnvVar"`
+	// Directory of the checkpoints of the running backups, the user cache
+	// directory by default
+	StateDir string `yaml:"stateDir"`
+	// Directory of the temporary files, such as the staged copies, the
+	// system one by default
+	TempDir string `yaml:"tempDir"`
+	// Retention of every object after its upload, in Unlocked (default) or
+	// Locked mode, and a temporary hold on it
+	HoldUntil     string `yaml:"holdUntil"`
+	RetentionMode string `yaml:"retentionMode"`
+	TemporaryHold bool   `yaml:"temporaryHold"`
+	// Predefined ACL of every object, such as publicRead. Buckets with
+	// uniform bucket-level access don't take it
+	ObjectACL string `yaml:"objectACL"`
+	// Upload the result of a backup as <prefix>/summary.json
+	Summary bool `yaml:"summary"`
+	// Upload the lines printed during a backup as <prefix>/run.log
+	RunLog bool `yaml:"runLog"`
+	// Backups older than this are deleted by the prune mode
+	RetentionDays int `yaml:"retentionDays"`
+	// Upload rate in bytes per second such as "10MB", "0" means unlimited
+	RateLimit string `yaml:"rateLimit"`
+	// Longest random wait, such as "10m", before a backup starts
+	StartupJitter string `yaml:"startupJitter"`
+	// Duration such as "30m" after which the backup stops cleanly
+	MaxDuration string `yaml:"maxDuration"`
+	// Go duration such as "5m", "0" disables the timeout
+	UploadTimeout string        `yaml:"uploadTimeout"`
+	GoogleCloud   Destinations  `yaml:"googleCloud"`
+	Notify        NotifyConfig  `yaml:"notify"`
+	Metrics       MetricsConfig `yaml:"metrics"`
+	// Lifecycle rules added to the GCS buckets when they don't have them
+	BucketLifecycle LifecycleConfig `yaml:"bucketLifecycle"`
+}
+
+// configErrors are all the problems found in a configuration
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// -config value that reads the configuration from stdin
+const confStdin = "-"
+
+// Bounds of reading the configuration from stdin or a URL
+const (
+	maxConfSize      = 1 << 20
+	confFetchTimeout = 30 * time.Second
+)
+
+// isConfURL reports whether the configuration is fetched over HTTP(S)
+func isConfURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// checkFileConf checks the configuration file, the other sources are only
+// checked once read
+func checkFileConf() error {
+	if fileConf == confStdin || isConfURL(fileConf) {
+		return nil
+	}
+
+	info, err := os.Stat(fileConf)
+
+	if os.IsNotExist(err) {
+		return fmt.Errorf("File \"%s\" not found", fileConf)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		return fmt.Errorf("File \"%s\" is empty", fileConf)
+	}
+
+	return nil
+}
+
+// readLimited reads r, failing when it holds more than maxConfSize bytes
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxConfSize+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxConfSize {
+		return nil, fmt.Errorf("configuration is larger than %s", byteCount(maxConfSize))
+	}
+
+	return data, nil
+}
+
+// fetchConf downloads the configuration at url
+func fetchConf(url string) ([]byte, error) {
+	client := &http.Client{Timeout: confFetchTimeout}
+	resp, err := client.Get(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET \"%s\": %s", url, resp.Status)
+	}
+
+	return readLimited(resp.Body)
+}
+
+// readConf returns the configuration from the file, stdin or URL given
+// by -config
+func readConf() ([]byte, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case fileConf == confStdin:
+		data, err = readLimited(os.Stdin)
+	case isConfURL(fileConf):
+		data, err = fetchConf(fileConf)
+	default:
+		data, err = ioutil.ReadFile(fileConf)
+	}
+
+	if err == nil && len(data) == 0 {
+		err = fmt.Errorf("configuration \"%s\" is empty", fileConf)
+	}
+
+	return data, err
+}
+
+// readPatternFile returns the patterns of the file name, one per line,
+// without the blank lines and the # comments
+func readPatternFile(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, nil
+}
+
+// loadConf reads the configuration into conf and applies the flags on top
+// of it
+func loadConf() error {
+	yamlFile, err := readConf()
+
+	if err != nil {
+		return fmt.Errorf("Reading file configuration: %w", err)
+	}
+
+	// Defaults for the settings where zero is a meaningful value
+	conf.MaxRetries = 3
+	conf.ChunkSizeMB = 16
+	conf.MaxConsecutiveFailures = 20
+	conf.CompositeParts = 8
+	conf.QueueSize = defaultQueueSize
+
+	err = yaml.Unmarshal(yamlFile, &conf)
+
+	if err != nil {
+		return fmt.Errorf("Parsing configuration: %w", err)
+	}
+
+	// The flag beats the configuration, which beats the default
+	if concurrency != 0 {
+		conf.Concurrency = concurrency
+	}
+
+	if conf.Concurrency == 0 {
+		conf.Concurrency = runtime.NumCPU() * 2
+	}
+
+	if isFlagSet("fail-fast") {
+		conf.FailFast = failFast
+	}
+
+	if isFlagSet("auto-concurrency") {
+		conf.AutoConcurrency = autoConcurrency
+	}
+
+	if isFlagSet("queue-size") {
+		conf.QueueSize = queueSize
+	}
+
+	if isFlagSet("max-retries") {
+		conf.MaxRetries = maxRetries
+	}
+
+	if isFlagSet("compress") {
+		conf.Compress = compress
+	}
+
+	if isFlagSet("incremental") {
+		conf.Incremental = incremental
+	}
+
+	if isFlagSet("max-file-errors") {
+		conf.MaxFileErrors = maxFileErrorsFlag
+	}
+
+	if isFlagSet("only-changed") {
+		conf.OnlyChanged = onlyChanged
+	}
+
+	if isFlagSet("compare-with-latest") {
+		conf.CompareWithLatest = compareWithLatest
+	}
+
+	if isFlagSet("newer-than-backup") {
+		conf.NewerThanBackup = newerThanBackup
+	}
+
+	if isFlagSet("rate-limit") {
+		conf.RateLimit = rateLimit
+	}
+
+	if isFlagSet("upload-timeout") {
+		conf.UploadTimeout = uploadTimeout.String()
+	}
+
+	if len(onlyDirs) > 0 {
+		if conf.Directories, err = selectDirectories(conf.Directories, onlyDirs); err != nil {
+			return fmt.Errorf("-only-dir: %w", err)
+		}
+	}
+
+	if isFlagSet("include-from") {
+		conf.IncludeFrom = includeFrom
+	}
+
+	if isFlagSet("exclude-from") {
+		conf.ExcludeFrom = excludeFrom
+	}
+
+	// The patterns of the files come after the inline ones
+	if conf.IncludeFrom != "" {
+		patterns, err := readPatternFile(conf.IncludeFrom)
+
+		if err != nil {
+			return fmt.Errorf("Reading includeFrom: %w", err)
+		}
+
+		conf.Include = append(conf.Include, patterns...)
+	}
+
+	if conf.ExcludeFrom != "" {
+		patterns, err := readPatternFile(conf.ExcludeFrom)
+
+		if err != nil {
+			return fmt.Errorf("Reading excludeFrom: %w", err)
+		}
+
+		conf.Exclude = append(conf.Exclude, patterns...)
+	}
+
+	if conf.Symlinks == "" {
+		conf.Symlinks = symlinksSkip
+	}
+
+	if conf.RetentionMode == "" {
+		conf.RetentionMode = retentionUnlocked
+	}
+
+	if conf.FileEntries == "" {
+		conf.FileEntries = fileEntriesBackup
+	}
+
+	if conf.TimestampFormat == "" {
+		conf.TimestampFormat = pathBaseLayout
+	}
+
+	if conf.BucketLifecycle.TransitionClass == "" {
+		conf.BucketLifecycle.TransitionClass = "COLDLINE"
+	}
+
+	if conf.PathMode == "" {
+		conf.PathMode = pathModeAbsolute
+	}
+
+	if conf.Collisions == "" {
+		conf.Collisions = conf.FlattenCollisions
+	}
+
+	if conf.Collisions == "" {
+		conf.Collisions = collisionError
+	}
+
+	// Extensions are matched lowercase with the leading dot
+	contentTypes := map[string]string{}
+
+	for ext, contentType := range conf.ContentTypes {
+		contentTypes["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = contentType
+	}
+
+	conf.ContentTypes = contentTypes
+
+	for i, ext := range conf.Extensions {
+		conf.Extensions[i] = "." + strings.TrimPrefix(strings.ToLower(ext), ".")
+	}
+
+	conf.BasePrefix = cleanPrefix(conf.BasePrefix)
+
+	setSecrets()
+
+	return nil
+}
+
+// validateConf checks conf, sets the settings derived from it and returns
+// every problem found
+func validateConf() []error {
+	var errs []error
+	var err error
+
+	// loadConf can run more than once in a process, as the tests do, and
+	// the filters of the previous configuration would still be there
+	contentFilters = nil
+
+	// The placeholders below need it
+	if sourceHost, err = resolveSourceHost(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if conf.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be at least 1, got %d", conf.Concurrency))
+	}
+
+	if conf.QueueSize < 1 {
+		errs = append(errs, fmt.Errorf("queueSize must be at least 1, got %d", conf.QueueSize))
+	}
+
+	if conf.MaxConsecutiveFailures < 0 {
+		errs = append(errs, fmt.Errorf("maxConsecutiveFailures must not be negative, got %d", conf.MaxConsecutiveFailures))
+	}
+
+	if conf.MaxFileErrors != "" {
+		s := strings.TrimSpace(conf.MaxFileErrors)
+		maxFileErrorsPercent = strings.HasSuffix(s, "%")
+
+		n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+
+		if err != nil || n < 0 || (maxFileErrorsPercent && n > 100) || (!maxFileErrorsPercent && n != float64(int64(n))) {
+			errs = append(errs, fmt.Errorf("maxFileErrors \"%s\" is not a count or a percentage such as 5%%", conf.MaxFileErrors))
+		} else {
+			maxFileErrors = n
+		}
+	}
+
+	if conf.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("maxRetries must not be negative, got %d", conf.MaxRetries))
+	} else if conf.MaxRetries > maxRetryLimit {
+		errs = append(errs, fmt.Errorf("maxRetries must be at most %d, got %d", maxRetryLimit, conf.MaxRetries))
+	}
+
+	if conf.MaxInflight < 0 {
+		errs = append(errs, fmt.Errorf("maxInflight must not be negative, got %d", conf.MaxInflight))
+	} else if conf.MaxInflight > 0 {
+		inflight = make(chan struct{}, conf.MaxInflight)
+	}
+
+	if conf.UploadTimeout != "" {
+		timeout, err := time.ParseDuration(conf.UploadTimeout)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("uploadTimeout: %w", err))
+		} else if timeout < 0 {
+			errs = append(errs, fmt.Errorf("uploadTimeout must not be negative, got %v", timeout))
+		} else {
+			uploadTimeout = timeout
+		}
+	}
+
+	if conf.Content != "" && conf.Content != contentText && conf.Content != contentBinary {
+		errs = append(errs, fmt.Errorf("unknown content \"%s\", use %s or %s", conf.Content, contentText, contentBinary))
+	} else if filter := contentFilterFor(conf.Content); filter != nil {
+		contentFilters = append(contentFilters, filter)
+	}
+
+	if conf.ObjectACL != "" && !containsString(objectACLs, conf.ObjectACL) {
+		errs = append(errs, fmt.Errorf("unknown objectACL \"%s\", use one of %s", conf.ObjectACL, strings.Join(objectACLs, ", ")))
+	}
+
+	if conf.HoldUntil != "" {
+		d, err := parseDuration(conf.HoldUntil)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("holdUntil: %w", err))
+		} else if d <= 0 {
+			errs = append(errs, fmt.Errorf("holdUntil must be positive, got %v", d))
+		} else {
+			holdFor = d
+		}
+	}
+
+	if conf.RetentionMode != retentionUnlocked && conf.RetentionMode != retentionLocked {
+		errs = append(errs, fmt.Errorf("unknown retentionMode \"%s\", use %s or %s", conf.RetentionMode, retentionUnlocked, retentionLocked))
+	}
+
+	if conf.StartupJitter != "" && !isFlagSet("startup-jitter") {
+		d, err := parseDuration(conf.StartupJitter)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("startupJitter: %w", err))
+		} else {
+			startupJitter = d
+		}
+	}
+
+	if startupJitter < 0 {
+		errs = append(errs, fmt.Errorf("startupJitter must not be negative, got %v", startupJitter))
+	}
+
+	if conf.MaxDuration != "" && !isFlagSet("deadline") {
+		d, err := parseDuration(conf.MaxDuration)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("maxDuration: %w", err))
+		} else {
+			maxDuration = d
+		}
+	}
+
+	if maxDuration < 0 {
+		errs = append(errs, fmt.Errorf("maxDuration must not be negative, got %v", maxDuration))
+	}
+
+	if conf.RateLimit != "" {
+		bytesPerSecond, err := parseBytes(conf.RateLimit)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rateLimit: %w", err))
+		} else if bytesPerSecond > 0 {
+			uploadLimiter = newUploadLimiter(bytesPerSecond)
+		}
+	}
+
+	// Whole MiB are always a multiple of the 256 KiB GCS requires
+	if conf.ChunkSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("chunkSizeMB must not be negative, got %d", conf.ChunkSizeMB))
+	}
+
+	for _, dir := range conf.Directories {
+		for _, pattern := range expandBraces(dir.Path) {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("invalid directory pattern \"%s\": %w", dir.Path, err))
+				break
+			}
+		}
+
+		if dir.StorageClass != "" && !containsString(storageClasses, dir.StorageClass) {
+			errs = append(errs, fmt.Errorf("directory \"%s\": unknown storageClass \"%s\", use one of %s", dir.Path, dir.StorageClass, strings.Join(storageClasses, ", ")))
+		}
+
+		for _, pattern := range append(dir.Include, dir.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("directory \"%s\": invalid pattern \"%s\": %w", dir.Path, pattern, err))
+			}
+		}
+	}
+
+	for _, pattern := range append(conf.Include, conf.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid pattern \"%s\": %w", pattern, err))
+		}
+	}
+
+	if _, err := path.Match(onlyMatch, ""); err != nil {
+		errs = append(errs, fmt.Errorf("invalid -match pattern \"%s\": %w", onlyMatch, err))
+	}
+
+	if !containsString([]string{symlinksSkip, symlinksFollow, symlinksRecord}, conf.Symlinks) {
+		errs = append(errs, fmt.Errorf("unknown symlinks policy \"%s\", use skip, follow or record", conf.Symlinks))
+	}
+
+	if !containsString([]string{fileEntriesBackup, fileEntriesSkip}, conf.FileEntries) {
+		errs = append(errs, fmt.Errorf("unknown fileEntries \"%s\", use backup or skip", conf.FileEntries))
+	}
+
+	if !containsString([]string{pathModeAbsolute, pathModeRelative, pathModeFlatten}, conf.PathMode) {
+		errs = append(errs, fmt.Errorf("unknown pathMode \"%s\", use absolute, relative or flatten", conf.PathMode))
+	}
+
+	if !containsString([]string{collisionError, collisionSkip, collisionSuffix}, conf.Collisions) {
+		errs = append(errs, fmt.Errorf("unknown collisions \"%s\", use error, skip or suffix", conf.Collisions))
+	}
+
+	if conf.Archive != "" && conf.Archive != archiveTar && conf.Archive != archiveTarGz {
+		errs = append(errs, fmt.Errorf("unknown archive format \"%s\", use tar or tar.gz", conf.Archive))
+	}
+
+	stages := map[string]bool{}
+
+	for _, name := range conf.Transforms {
+		if name != transformCompress && name != transformEncrypt {
+			errs = append(errs, fmt.Errorf("unknown transform \"%s\", use compress or encrypt", name))
+		} else if stages[name] {
+			errs = append(errs, fmt.Errorf("transform \"%s\" is given twice", name))
+		}
+
+		stages[name] = true
+	}
+
+	if len(conf.Transforms) > 0 && !stages[transformCompress] && conf.Compress.encoding() != "" {
+		errs = append(errs, fmt.Errorf("compress is set but transforms has no compress stage"))
+	}
+
+	// The key is also what restores the encrypted objects
+	clientKey = nil
+
+	if conf.ClientKey != "" || os.Getenv(clientKeyEnv) != "" {
+		if clientKey, err = parseClientKey(conf.ClientKey); err != nil {
+			errs = append(errs, err)
+		}
+	} else if stages[transformEncrypt] {
+		errs = append(errs, fmt.Errorf("the encrypt transform needs clientKey or %s", clientKeyEnv))
+	}
+
+	if stages[transformEncrypt] && conf.Archive != "" {
+		errs = append(errs, fmt.Errorf("archives aren't encrypted, transforms only apply to files"))
+	}
+
+	if conf.MinSize != "" {
+		if minSize, err = parseBytes(conf.MinSize); err != nil {
+			errs = append(errs, fmt.Errorf("minSize: %w", err))
+		}
+	}
+
+	if conf.MaxSize != "" {
+		if maxSize, err = parseBytes(conf.MaxSize); err != nil {
+			errs = append(errs, fmt.Errorf("maxSize: %w", err))
+		}
+	}
+
+	if conf.CompositeThreshold != "" {
+		if compositeThreshold, err = parseBytes(conf.CompositeThreshold); err != nil {
+			errs = append(errs, fmt.Errorf("compositeThreshold: %w", err))
+		}
+	}
+
+	if conf.CompositeParts < 2 || conf.CompositeParts > maxComposeParts {
+		errs = append(errs, fmt.Errorf("compositeParts must be between 2 and %d, got %d", maxComposeParts, conf.CompositeParts))
+	} else {
+		compositeParts = conf.CompositeParts
+	}
+
+	if maxSize > 0 && maxSize < minSize {
+		errs = append(errs, fmt.Errorf("maxSize %s is smaller than minSize %s", conf.MaxSize, conf.MinSize))
+	}
+
+	if conf.ModifiedSince != "" {
+		if modifiedAfter, err = parseTime(conf.ModifiedSince); err != nil {
+			errs = append(errs, fmt.Errorf("modifiedSince: %w", err))
+		}
+	}
+
+	if conf.ModifiedWithin != "" {
+		within, err := parseDuration(conf.ModifiedWithin)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("modifiedWithin: %w", err))
+		} else if within <= 0 {
+			err = fmt.Errorf("modifiedWithin must be positive, got %v", within)
+			errs = append(errs, err)
+		}
+
+		// Both bounds apply, so the later one wins
+		if cutoff := time.Now().Add(-within); err == nil && cutoff.After(modifiedAfter) {
+			modifiedAfter = cutoff
+		}
+	}
+
+	// The templates below are rendered in the time zone too
+	prefixLocation = time.Local
+
+	if conf.Timezone != "" {
+		if prefixLocation, err = time.LoadLocation(conf.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("timezone: %w", err))
+			prefixLocation = time.Local
+		}
+	}
+
+	if err := checkTimestampFormat(conf.TimestampFormat); err != nil {
+		errs = append(errs, fmt.Errorf("timestampFormat: %w", err))
+	}
+
+	if conf.PrefixTemplate != "" {
+		prefix, err := renderPrefix(conf.PrefixTemplate, time.Now())
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("prefixTemplate: %w", err))
+		} else if prefix == "" {
+			errs = append(errs, fmt.Errorf("prefixTemplate \"%s\" renders an empty prefix", conf.PrefixTemplate))
+		}
+	}
+
+	// The latest backup is found by the time in its prefix
+	if conf.NewerThanBackup && (conf.PrefixTemplate != "" || conf.Incremental) {
+		errs = append(errs, fmt.Errorf("newerThanBackup needs the timestamp prefixes, not prefixTemplate or incremental"))
+	}
+
+	if conf.CompareWithLatest && (conf.PrefixTemplate != "" || conf.Incremental) {
+		errs = append(errs, fmt.Errorf("compareWithLatest needs the timestamp prefixes, not prefixTemplate or incremental"))
+	}
+
+	customMetadata = map[string]string{}
+
+	for k, v := range conf.Metadata {
+		expanded, err := expandPlaceholders(v, time.Now())
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metadata \"%s\": %w", k, err))
+		}
+
+		customMetadata[k] = expanded
+	}
+
+	if conf.TempDir != "" {
+		if info, err := os.Stat(conf.TempDir); err != nil {
+			errs = append(errs, fmt.Errorf("tempDir: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("tempDir \"%s\" is not a directory", conf.TempDir))
+		}
+	}
+
+	if conf.RetentionDays < 0 {
+		errs = append(errs, fmt.Errorf("retentionDays must not be negative, got %d", conf.RetentionDays))
+	}
+
+	if l := conf.BucketLifecycle; l.DeleteAfterDays < 0 || l.TransitionAfterDays < 0 {
+		errs = append(errs, fmt.Errorf("bucketLifecycle: deleteAfterDays and transitionAfterDays must not be negative"))
+	} else if l.DeleteAfterDays > 0 && l.DeleteAfterDays <= l.TransitionAfterDays {
+		errs = append(errs, fmt.Errorf("bucketLifecycle: deleteAfterDays %d must be after transitionAfterDays %d", l.DeleteAfterDays, l.TransitionAfterDays))
+	}
+
+	if !containsString(storageClasses, conf.BucketLifecycle.TransitionClass) {
+		errs = append(errs, fmt.Errorf("bucketLifecycle: unknown transitionClass \"%s\", use one of %s", conf.BucketLifecycle.TransitionClass, strings.Join(storageClasses, ", ")))
+	}
+
+	if _, err := parseNotifyTemplate(conf.Notify); err != nil {
+		errs = append(errs, fmt.Errorf("notify template: %w", err))
+	}
+
+	if len(conf.GoogleCloud) == 0 {
+		errs = append(errs, fmt.Errorf("no destination in googleCloud"))
+	}
+
+	s3 := false
+
+	for _, d := range conf.GoogleCloud {
+		if err := validateDestination(d); err != nil {
+			errs = append(errs, fmt.Errorf("destination \"%s\": %w", d.NameBucket, err))
+		}
+
+		s3 = s3 || d.isS3()
+	}
+
+	if s3 {
+		errs = append(errs, s3Conflicts()...)
+	}
+
+	return errs
+}
+
+// s3Conflicts returns an error for every setting that only works with GCS
+// destinations
+func s3Conflicts() []error {
+	var errs []error
+
+	settings := []struct {
+		name string
+		set  bool
+	}{
+		{"compositeThreshold", compositeThreshold > 0},
+		{"holdUntil", holdFor > 0},
+		{"temporaryHold", conf.TemporaryHold},
+		{"objectACL", conf.ObjectACL != ""},
+		{"bucketLifecycle", len(lifecycleRules()) > 0},
+		{"dedup", conf.Dedup},
+		{"compareWithLatest", conf.CompareWithLatest},
+		// Whether a backup completed is read from its manifest
+		{"newerThanBackup", conf.NewerThanBackup},
+		{"incremental", conf.Incremental},
+		// The previous manifest is read from the bucket without -previous-manifest
+		{"onlyChanged", conf.OnlyChanged && previousManifestPath == ""},
+	}
+
+	for _, s := range settings {
+		if s.set {
+			errs = append(errs, fmt.Errorf("%s needs GCS destinations, not provider s3", s.name))
+		}
+	}
+
+	return errs
+}
+
+// parseFileConf loads and validates the configuration, the error is a
+// configErrors when the file was read but has invalid settings
+func parseFileConf() error {
+	if err := checkFileConf(); err != nil {
+		return err
+	}
+
+	if err := loadConf(); err != nil {
+		return err
+	}
+
+	if errs := validateConf(); len(errs) > 0 {
+		return configErrors(errs)
+	}
+
+	return nil
+}
+
+// logConfError logs err, one line per problem when it holds several
+func logConfError(err error) {
+	var errs configErrors
+
+	if !errors.As(err, &errs) {
+		logError("%s", err)
+		return
+	}
+
+	for _, err := range errs {
+		logError("%s", err)
+	}
+}
+
+// reportValidation loads and validates the configuration without running
+// anything, printing every problem found, and returns the exit status
+func reportValidation() int {
+	err := checkFileConf()
+
+	if err == nil {
+		err = loadConf()
+	}
+
+	if err != nil {
+		logError("%s", err)
+		return 1
+	}
+
+	for _, d := range expandDirectories(conf.Directories) {
+		dir := d.Path
+		info, err := os.Stat(dir)
+
+		if err != nil {
+			logWarning("Dir \"%s\": %s", dir, err)
+		} else if info.Mode().IsRegular() && conf.FileEntries != fileEntriesSkip {
+			logInfo("Dir \"%s\" is a file, backed up on its own", dir)
+		} else if !info.IsDir() {
+			logWarning("Dir \"%s\" is not a directory, skipped", dir)
+		}
+	}
+
+	errs := validateConf()
+
+	if len(errs) > 0 {
+		logConfError(configErrors(errs))
+		logError("Configuration \"%s\" has %d errors", fileConf, len(errs))
+		return 1
+	}
+
+	logEvent(levelOK, logFields{File: fileConf}, fmt.Sprintf("Configuration \"%s\" is valid", fileConf))
+
+	return 0
+}
+
+// parseDuration parses a Go duration, also accepting a number of days such
+// as "7d"
+func parseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("invalid duration \"%s\"", s)
+		}
+
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// parseTime parses an RFC 3339 time or a date in local time
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time \"%s\", use 2006-01-02 or RFC 3339", s)
+	}
+
+	return t, nil
+}
+
+// Characters a timestamp prefix can't have: the separator of the object
+// paths, and what breaks the paths of the restored files on some systems
+const hostileChars = `/\:*?"<>|`
+
+// checkTimestampFormat checks that the Go layout layout makes a prefix
+// that changes with every second, is parsed back as the same time and is
+// safe in a path. Two backups with the same prefix would overwrite each
+// other
+func checkTimestampFormat(layout string) error {
+	t := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	s := t.Format(layout)
+
+	if s == "" {
+		return fmt.Errorf("\"%s\" doesn't change with the time", layout)
+	}
+
+	later := []struct {
+		unit string
+		t    time.Time
+	}{
+		{"year", t.AddDate(1, 0, 0)},
+		{"month", t.AddDate(0, 1, 0)},
+		{"day", t.AddDate(0, 0, 1)},
+		{"hour", t.Add(time.Hour)},
+		{"minute", t.Add(time.Minute)},
+		{"second", t.Add(time.Second)},
+	}
+
+	for _, l := range later {
+		if s == l.t.Format(layout) {
+			return fmt.Errorf("\"%s\" is the same one %s later, backups that close would share the prefix", layout, l.unit)
+		}
+	}
+
+	// A 12-hour clock without AM/PM, within the same day
+	if morning := t.Add(-12 * time.Hour); morning.Format(layout) == s {
+		return fmt.Errorf("\"%s\" is the same 12 hours later, it needs the hour of the day or PM", layout)
+	}
+
+	for _, r := range s {
+		if strings.ContainsRune(hostileChars, r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("\"%s\" makes \"%s\", which has %q", layout, s, r)
+		}
+	}
+
+	parsed, err := time.Parse(layout, s)
+
+	if err != nil {
+		return fmt.Errorf("\"%s\" can't be parsed back: %w", layout, err)
+	}
+
+	// Prune and the latest backup go by the time parsed
+	if !parsed.Equal(t) {
+		return fmt.Errorf("\"%s\" parses \"%s\" back as %s instead of %s", layout, s, parsed.Format(time.RFC3339), t.Format(time.RFC3339))
+	}
+
+	return nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseTestConf resets the state and parses the configuration yaml, with
+// the state and temporary files of the run in directories of the test
+func parseTestConf(t *testing.T, yaml string) error {
+	t.Helper()
+
+	resetState(t)
+
+	dir := t.TempDir()
+	yaml += fmt.Sprintf("\nstateDir: %q\ntempDir: %q\nskipWriteProbe: true\n", dir, dir)
+	fileConf = filepath.Join(dir, "conf.yaml")
+
+	if err := ioutil.WriteFile(fileConf, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return parseFileConf()
+}
+
+// wantConfError checks that err mentions want
+func wantConfError(t *testing.T, err error, want string) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("no error, want one with %q", want)
+	}
+
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q, want one with %q", err, want)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	dir := t.TempDir()
+
+	loadTestConf(t, backupConf(dir))
+
+	if want := runtime.NumCPU() * 2; conf.Concurrency != want {
+		t.Errorf("default concurrency = %d, want %d", conf.Concurrency, want)
+	}
+
+	loadTestConf(t, backupConf(dir, "concurrency: 3"))
+
+	if conf.Concurrency != 3 {
+		t.Errorf("concurrency = %d, want the 3 of the configuration", conf.Concurrency)
+	}
+
+	// The configuration is still the one with 3
+	concurrency = 5
+
+	if err := loadConf(); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Concurrency != 5 {
+		t.Errorf("concurrency = %d, want the 5 of the flag", conf.Concurrency)
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "concurrency: -1")), "concurrency must be at least 1")
+}
+
+func TestUploadTimeout(t *testing.T) {
+	dir := t.TempDir()
+
+	loadTestConf(t, backupConf(dir))
+
+	if uploadTimeout != 50*time.Second {
+		t.Errorf("default uploadTimeout = %v, want 50s", uploadTimeout)
+	}
+
+	for setting, want := range map[string]time.Duration{"5m": 5 * time.Minute, "0": 0, "1h30m": 90 * time.Minute} {
+		loadTestConf(t, backupConf(dir, "uploadTimeout: "+setting))
+
+		if uploadTimeout != want {
+			t.Errorf("uploadTimeout %s = %v, want %v", setting, uploadTimeout, want)
+		}
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "uploadTimeout: soon")), "uploadTimeout")
+	wantConfError(t, parseTestConf(t, backupConf(dir, "uploadTimeout: -1s")), "uploadTimeout must not be negative")
+}
+
+func TestRateLimit(t *testing.T) {
+	dir := t.TempDir()
+
+	loadTestConf(t, backupConf(dir, "rateLimit: 0"))
+
+	if uploadLimiter != nil {
+		t.Error("rateLimit 0 set a limiter")
+	}
+
+	loadTestConf(t, backupConf(dir, "rateLimit: 10MB"))
+
+	if uploadLimiter == nil || uploadLimiter.Limit() != 10*1000*1000 {
+		t.Errorf("rateLimit 10MB gave the limiter %v", uploadLimiter)
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "rateLimit: fast")), "rateLimit")
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"7d":   7 * 24 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"90m":  90 * time.Minute,
+	}
+
+	for s, want := range tests {
+		if got, err := parseDuration(s); err != nil || got != want {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"d", "7days", "soon"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%q) gave no error", s)
+		}
+	}
+}
+
+func TestInvalidConfigurations(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{"no bucket", fmt.Sprintf("directories: [%q]\ngoogleCloud:\n  storageClass: COLDLINE\n", dir), []string{"nameBucket is required"}},
+		{"bad duration", backupConf(dir, "uploadTimeout: 5 minutes"), []string{"uploadTimeout"}},
+		{"bad size", backupConf(dir, "maxSize: 2 bytes"), []string{"maxSize"}},
+		{"bad pattern", backupConf(dir, "exclude: ['[']"), []string{"invalid pattern \"[\""}},
+		{"bad maxFileErrors", backupConf(dir, "maxFileErrors: 120%"), []string{"maxFileErrors \"120%\""}},
+		{"several errors", backupConf(dir, "concurrency: -2", "queueSize: -1", "collisions: panic"), []string{
+			"concurrency must be at least 1, got -2",
+			"queueSize must be at least 1, got -1",
+			"collisions",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := parseTestConf(t, test.yaml)
+
+			for _, want := range test.want {
+				wantConfError(t, err, want)
+			}
+		})
+	}
+}
+
+func TestReportValidation(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := parseTestConf(t, backupConf(dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := reportValidation(); code != 0 {
+		t.Errorf("reportValidation of a valid configuration = %d, want 0", code)
+	}
+
+	// A missing directory is only a warning, the errors fail it
+	file := fileConf
+	missing := filepath.Join(dir, "missing")
+
+	if err := ioutil.WriteFile(file, []byte(backupConf(missing, "concurrency: -1")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resetState(t)
+	fileConf = file
+	logThreshold = levelWarning
+	runLog = new(bytes.Buffer)
+
+	if code := reportValidation(); code != 1 {
+		t.Errorf("reportValidation of an invalid configuration = %d, want 1", code)
+	}
+
+	for _, want := range []string{"[WARNING] Dir \"" + missing, "[ERROR] concurrency must be at least 1", "has 1 errors"} {
+		if !strings.Contains(runLog.String(), want) {
+			t.Errorf("report without %q:\n%s", want, runLog)
+		}
+	}
+
+	if out, code := runMain(t, "-validate", "-config", file); code != 1 || !strings.Contains(out, "concurrency must be at least 1") {
+		t.Errorf("-validate exited with %d: %s", code, out)
+	}
+}
+
+func TestConfigErrorsAreReturned(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.yaml")
+	broken := filepath.Join(dir, "broken.yaml")
+
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(broken, []byte("directories: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{filepath.Join(dir, "missing.yaml"), "not found"},
+		{empty, "is empty"},
+		{broken, "Parsing configuration"},
+	}
+
+	for _, test := range tests {
+		resetState(t)
+		fileConf = test.file
+
+		wantConfError(t, parseFileConf(), test.want)
+	}
+
+	if err := parseTestConf(t, backupConf(dir)); err != nil {
+		t.Errorf("parseFileConf of a valid configuration: %v", err)
+	}
+}
+
+// sourceConf is a configuration of dir with the state and temporary files
+// of the run in directories of the test, as parseTestConf writes it
+func sourceConf(t *testing.T, dir string, extra ...string) string {
+	state := t.TempDir()
+
+	return backupConf(dir, extra...) + fmt.Sprintf("\nstateDir: %q\ntempDir: %q\nskipWriteProbe: true\n", state, state)
+}
+
+func TestConfigFromStdin(t *testing.T) {
+	dir := t.TempDir()
+
+	resetState(t)
+	setStdin(t, []byte(sourceConf(t, dir, "concurrency: 3")))
+	fileConf = confStdin
+
+	if err := parseFileConf(); err != nil {
+		t.Fatalf("parseFileConf: %v", err)
+	}
+
+	if len(conf.Directories) != 1 || conf.Directories[0].Path != dir || conf.Concurrency != 3 {
+		t.Errorf("configuration from stdin = %v and concurrency %d", conf.Directories, conf.Concurrency)
+	}
+
+	// Validated like a file
+	resetState(t)
+	setStdin(t, []byte(sourceConf(t, dir, "concurrency: -1")))
+	fileConf = confStdin
+
+	wantConfError(t, parseFileConf(), "concurrency must be at least 1")
+
+	resetState(t)
+	setStdin(t, nil)
+	fileConf = confStdin
+
+	wantConfError(t, parseFileConf(), "configuration \"-\" is empty")
+}
+
+func TestConfigFromURL(t *testing.T) {
+	dir := t.TempDir()
+	confs := map[string]string{
+		"/ok.yaml":      sourceConf(t, dir, "concurrency: 5"),
+		"/invalid.yaml": sourceConf(t, dir, "concurrency: -1"),
+		"/large.yaml":   sourceConf(t, dir) + "#" + strings.Repeat("x", maxConfSize),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf, ok := confs[r.URL.Path]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Write([]byte(conf))
+	}))
+	defer server.Close()
+
+	resetState(t)
+	fileConf = server.URL + "/ok.yaml"
+
+	if err := parseFileConf(); err != nil {
+		t.Fatalf("parseFileConf: %v", err)
+	}
+
+	if len(conf.Directories) != 1 || conf.Directories[0].Path != dir || conf.Concurrency != 5 {
+		t.Errorf("configuration from the URL = %v and concurrency %d", conf.Directories, conf.Concurrency)
+	}
+
+	tests := map[string]string{
+		"/invalid.yaml": "concurrency must be at least 1",
+		"/large.yaml":   "configuration is larger than",
+		"/missing.yaml": "404 Not Found",
+	}
+
+	for path, want := range tests {
+		resetState(t)
+		fileConf = server.URL + path
+
+		wantConfError(t, parseFileConf(), want)
+	}
+
+	// Paths are still read as files
+	if isConfURL("/etc/gcs-backup.yaml") || !isConfURL("https://example.com/conf.yaml") {
+		t.Error("isConfURL doesn't tell URLs from paths")
+	}
+}
+
+func TestReadPatternFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "patterns")
+	data := "# logs of every kind\n*.log\n\n   \n  *.tmp  \r\n#*.txt\ncache/**\n"
+
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := readPatternFile(file)
+
+	if err != nil {
+		t.Fatalf("readPatternFile: %v", err)
+	}
+
+	if want := []string{"*.log", "*.tmp", "cache/**"}; !equalStrings(patterns, want) {
+		t.Errorf("readPatternFile = %q, want %q", patterns, want)
+	}
+
+	if _, err := readPatternFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readPatternFile of a missing file succeeded")
+	}
+}
+
+func TestPatternFiles(t *testing.T) {
+	dir := t.TempDir()
+	patterns := t.TempDir()
+
+	makeTree(t, dir, "a.txt", "b.log", "keep.log", "c.tmp", "d.csv", "cache/e.txt")
+
+	includeFile := filepath.Join(patterns, "include")
+	excludeFile := filepath.Join(patterns, "exclude")
+
+	if err := ioutil.WriteFile(includeFile, []byte("# and the logs\n*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(excludeFile, []byte("cache\n\n*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The patterns of the files add to the inline ones, and an exclude
+	// wins over an include wherever it comes from
+	got := walkedFiles(t, dir, backupConf(dir,
+		`include: ["*.txt", "*.tmp", "keep.log"]`,
+		`exclude: ["*.tmp"]`,
+		fmt.Sprintf("includeFrom: %q", includeFile),
+		fmt.Sprintf("excludeFrom: %q", excludeFile)))
+
+	if want := []string{"a.txt"}; !equalStrings(got, want) {
+		t.Errorf("walked %v, want %v", got, want)
+	}
+
+	if want := []string{"*.txt", "*.tmp", "keep.log", "*.log"}; !equalStrings(conf.Include, want) {
+		t.Errorf("include = %q, want %q", conf.Include, want)
+	}
+
+	if want := []string{"*.tmp", "cache", "*.log"}; !equalStrings(conf.Exclude, want) {
+		t.Errorf("exclude = %q, want %q", conf.Exclude, want)
+	}
+
+	// Only from the files
+	got = walkedFiles(t, dir, backupConf(dir, fmt.Sprintf("includeFrom: %q", includeFile)))
+
+	if want := []string{"b.log", "keep.log"}; !equalStrings(got, want) {
+		t.Errorf("walked %v with only includeFrom, want %v", got, want)
+	}
+
+	if err := parseTestConf(t, backupConf(dir, "excludeFrom: /missing/patterns")); err == nil || !strings.Contains(err.Error(), "Reading excludeFrom") {
+		t.Errorf("parseFileConf with a missing excludeFrom = %v", err)
+	}
+
+	// The flags
+	if err := parseTestConf(t, backupConf(dir, `exclude: ["*.csv"]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runMain(t, "-plan", "-config", fileConf, "-exclude-from", excludeFile)
+
+	if code != 0 {
+		t.Fatalf("exit status %d, want 0: %s", code, out)
+	}
+
+	for _, name := range []string{"a.txt", "c.tmp"} {
+		if !strings.Contains(out, filepath.Join(dir, name)) {
+			t.Errorf("plan without %s:\n%s", name, out)
+		}
+	}
+
+	for _, name := range []string{"b.log", "d.csv", "cache"} {
+		if strings.Contains(out, filepath.Join(dir, name)) {
+			t.Errorf("plan with %s:\n%s", name, out)
+		}
+	}
+}
+
+func TestCheckTimestampFormat(t *testing.T) {
+	tests := []struct {
+		layout string
+		want   string
+	}{
+		{pathBaseLayout, ""},
+		{"20060102T150405Z0700", ""},
+		{"2006.01.02-15h04m05s", ""},
+		{"2006-01-02_15-04-05.000", ""},
+		{"2006/01/02_15-04-05", "which has '/'"},
+		{"2006-01-02T15:04:05", "which has ':'"},
+		{"Jan 2 2006 15-04-05", "which has ' '"},
+		{"2006-01-02", "one hour later"},
+		{"2006-01-02_15-04", "one second later"},
+		{"15-04-05", "one year later"},
+		{"backup", "one year later"},
+		{"2006-Jan-02_15-04-05_Monday_Z07", ""},
+		{"2006-01-02_03-04-05PM", ""},
+		{"2006-01-02_03-04-05", "same 12 hours later"},
+		{"2006-01-02_3-04-05", "same 12 hours later"},
+		{"06-01-02_15-04-05", ""},
+		{"2006-01-02_15-04-05.0", ""},
+	}
+
+	for _, test := range tests {
+		err := checkTimestampFormat(test.layout)
+
+		if test.want == "" && err != nil {
+			t.Errorf("checkTimestampFormat(%q) = %v", test.layout, err)
+		}
+
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("checkTimestampFormat(%q) = %v, want an error with %q", test.layout, err, test.want)
+		}
+	}
+}
+
+func TestTimezoneConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "timezone: Mars/Olympus_Mons")), "timezone: unknown time zone Mars/Olympus_Mons")
+	wantConfError(t, parseTestConf(t, backupConf(dir, "timestampFormat: '2006-01-02 15:04:05'")), "timestampFormat:")
+
+	loadTestConf(t, backupConf(dir, "timezone: America/New_York"))
+
+	if prefixLocation.String() != "America/New_York" || conf.TimestampFormat != pathBaseLayout {
+		t.Errorf("location %v and format %q, want America/New_York and the default", prefixLocation, conf.TimestampFormat)
+	}
+
+	// The local time by default
+	loadTestConf(t, backupConf(dir))
+
+	if prefixLocation != time.Local {
+		t.Errorf("location %v without timezone, want the local one", prefixLocation)
+	}
+}
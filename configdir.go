@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// configFiles returns the *.yaml and *.yml files of dir, sorted by name
+func configFiles(dir string) ([]string, error) {
+	var files []string
+
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, matches...)
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// childArgs returns the flags given to this run, except the ones that pick
+// the configuration, followed by -config file
+func childArgs(file string) []string {
+	var args []string
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "config-dir" {
+			return
+		}
+
+		// Repeated flags are passed as they were given
+		if list, ok := f.Value.(*dirList); ok {
+			for _, v := range *list {
+				args = append(args, fmt.Sprintf("-%s=%s", f.Name, v))
+			}
+
+			return
+		}
+
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+	})
+
+	return append(append(args, "-config="+file), flag.Args()...)
+}
+
+// runConfigDir runs this program once for every configuration of dir, one
+// after the other, each with its own state, and returns the highest exit
+// status among them. With -fail-fast it stops at the first one that fails
+func runConfigDir(ctx context.Context, dir string) int {
+	files, err := configFiles(dir)
+
+	if err != nil {
+		logError("Reading -config-dir: %s", err)
+		return 1
+	}
+
+	if len(files) == 0 {
+		logError("No *.yaml files in \"%s\"", dir)
+		return 1
+	}
+
+	self, err := os.Executable()
+
+	if err != nil {
+		logError("os.Executable: %s", err)
+		return 1
+	}
+
+	started := time.Now()
+	code, failed, run := 0, 0, 0
+
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+
+		logInfo("Running the configuration \"%s\"", file)
+
+		cmd := exec.CommandContext(ctx, self, childArgs(file)...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+		// The run gets the chance to write its manifest, as with SIGINT
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+
+		fileStarted := time.Now()
+		status := 0
+		err := cmd.Run()
+		run++
+
+		var exitErr *exec.ExitError
+
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			logError("Running \"%s\": %s", file, err)
+			status = 1
+		}
+
+		if status > code {
+			code = status
+		}
+
+		if status == 0 {
+			logEvent(levelOK, logFields{File: file}, fmt.Sprintf("Configuration \"%s\" finished in %s", file, time.Since(fileStarted)))
+			continue
+		}
+
+		failed++
+		logEvent(levelError, logFields{File: file}, fmt.Sprintf("Configuration \"%s\" failed with exit status %d", file, status))
+
+		if failFast || status == 130 {
+			break
+		}
+	}
+
+	if ctx.Err() != nil && code == 0 {
+		code = exitCode(ctx, 0)
+	}
+
+	logSummary("Config directory finished", []summaryField{
+		{"Total configurations", "configs", len(files)},
+		{"Total configurations run", "configsRun", run},
+		{"Total configurations failed", "configsFailed", failed},
+		{"Exit status", "exitStatus", code},
+		{"Config directory took", "elapsed", time.Since(started).String()},
+	}, nil)
+
+	return code
+}
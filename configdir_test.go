@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"b.yml", "a.yaml", "c.yaml", "notes.txt", "d.yaml.bak"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := configFiles(dir)
+
+	if err != nil {
+		t.Fatalf("configFiles: %v", err)
+	}
+
+	var names []string
+
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+
+	if want := []string{"a.yaml", "b.yml", "c.yaml"}; !equalStrings(names, want) {
+		t.Errorf("configFiles = %v, want %v", names, want)
+	}
+}
+
+// writeConfigDir writes a configuration per bucket to a new directory,
+// each backing up its own files, and an invalid one as b.yaml
+func writeConfigDir(t *testing.T, buckets ...string) string {
+	t.Helper()
+
+	confDir := t.TempDir()
+
+	for _, bucket := range buckets {
+		dir, state := t.TempDir(), t.TempDir()
+		writeFiles(t, dir, 2)
+
+		yaml := fmt.Sprintf("directories:\n  - %q\ngoogleCloud:\n  nameBucket: %s\nstateDir: %q\ntempDir: %q\nskipWriteProbe: true\n", dir, bucket, state, state)
+
+		if err := ioutil.WriteFile(filepath.Join(confDir, bucket+".yaml"), []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(confDir, "b.yaml"), []byte("directories: []\nconcurrency: -1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return confDir
+}
+
+func TestConfigDir(t *testing.T) {
+	t.Run("every configuration runs", func(t *testing.T) {
+		f := newFakeGCS(t, "a", "c")
+		confDir := writeConfigDir(t, "a", "c")
+
+		out, code := runMain(t, "-config-dir", confDir)
+
+		// The highest exit status, the one of the invalid configuration
+		if code != 1 {
+			t.Fatalf("exit status %d, want 1: %s", code, out)
+		}
+
+		for _, bucket := range []string{"a", "c"} {
+			if got := len(backedUp(f, bucket)); got != 2 {
+				t.Errorf("%d files backed up to %s, want 2: %s", got, bucket, out)
+			}
+		}
+
+		for _, want := range []string{"Total configurations run: 3", "Total configurations failed: 1", "b.yaml\" failed with exit status 1"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output without %q: %s", want, out)
+			}
+		}
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		f := newFakeGCS(t, "a", "c")
+		confDir := writeConfigDir(t, "a", "c")
+
+		out, code := runMain(t, "-config-dir", confDir, "-fail-fast")
+
+		if code != 1 {
+			t.Fatalf("exit status %d, want 1: %s", code, out)
+		}
+
+		if got := len(backedUp(f, "a")); got != 2 {
+			t.Errorf("%d files backed up to a, want 2", got)
+		}
+
+		if got := f.names("c", ""); len(got) != 0 {
+			t.Errorf("objects %v in c, after the configuration that failed", got)
+		}
+
+		if !strings.Contains(out, "Total configurations run: 2") {
+			t.Errorf("output without the 2 configurations run: %s", out)
+		}
+	})
+
+	t.Run("all succeed", func(t *testing.T) {
+		newFakeGCS(t, "a", "c")
+		confDir := writeConfigDir(t, "a", "c")
+
+		if err := os.Remove(filepath.Join(confDir, "b.yaml")); err != nil {
+			t.Fatal(err)
+		}
+
+		if out, code := runMain(t, "-config-dir", confDir); code != 0 {
+			t.Errorf("exit status %d, want 0: %s", code, out)
+		}
+	})
+
+	t.Run("empty directory", func(t *testing.T) {
+		if out, code := runMain(t, "-config-dir", t.TempDir()); code != 1 || !strings.Contains(out, "No *.yaml files") {
+			t.Errorf("exit status %d, want 1 and no files: %s", code, out)
+		}
+	})
+
+	t.Run("with -config", func(t *testing.T) {
+		if out, code := runMain(t, "-config-dir", t.TempDir(), "-config", "x.yaml"); code != 1 || !strings.Contains(out, "can't be used together") {
+			t.Errorf("exit status %d, want 1: %s", code, out)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// Kinds of files kept by the content setting
+const (
+	contentText   = "text"
+	contentBinary = "binary"
+)
+
+// Bytes read from the start of a file to sniff its content
+const sniffSize = 8000
+
+// contentFilter reports whether the file path, which starts with head, is
+// backed up
+type contentFilter func(path string, head []byte) bool
+
+// Filters applied to the files found by the walk, after the patterns and
+// the other filters. A file is backed up when all of them accept it
+var contentFilters []contentFilter
+
+// isBinary reports whether head looks like the start of a binary file: it
+// holds a NUL byte or isn't valid UTF-8. A rune cut at the end of head
+// doesn't count
+func isBinary(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true
+	}
+
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+
+	return !utf8.Valid(head)
+}
+
+// contentFilterFor returns the built-in filter of the content setting, or
+// nil when every file is kept
+func contentFilterFor(content string) contentFilter {
+	switch content {
+	case contentText:
+		return func(path string, head []byte) bool { return !isBinary(head) }
+	case contentBinary:
+		return func(path string, head []byte) bool { return isBinary(head) }
+	}
+
+	return nil
+}
+
+// passesContent reads the start of the file path and reports whether the
+// content filters accept it, counting the files filtered out. Files that
+// can't be read are kept, so their error shows up in the backup
+func passesContent(path string) bool {
+	if len(contentFilters) == 0 {
+		return true
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		return true
+	}
+
+	defer f.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(f, head)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return true
+	}
+
+	for _, filter := range contentFilters {
+		if !filter(path, head[:n]) {
+			walkMutex.Lock()
+			totalFilesFilterContent++
+			walkMutex.Unlock()
+
+			return false
+		}
+	}
+
+	return true
+}
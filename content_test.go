@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Samples of the start of files of each kind
+var (
+	textSamples = map[string][]byte{
+		"empty":      {},
+		"ascii":      []byte("#!/bin/sh\necho hello\n"),
+		"utf-8":      []byte("café, naïve, 日本語\n"),
+		"cut rune":   []byte("日本語")[:7],
+		"yaml":       []byte("backupDirs:\n  - /var/www\n"),
+		"crlf lines": []byte("a,b\r\nc,d\r\n"),
+	}
+	binarySamples = map[string][]byte{
+		"png":     {0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0, 0, 0, 0x0d},
+		"gzip":    {0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00},
+		"nul":     []byte("text until\x00here"),
+		"latin-1": []byte("caf\xe9 cr\xe8me br\xfbl\xe9e"),
+		"elf":     append([]byte("\x7fELF\x02\x01\x01"), make([]byte, 9)...),
+	}
+)
+
+func TestIsBinary(t *testing.T) {
+	for name, head := range textSamples {
+		if isBinary(head) {
+			t.Errorf("%s sample is binary", name)
+		}
+	}
+
+	for name, head := range binarySamples {
+		if !isBinary(head) {
+			t.Errorf("%s sample isn't binary", name)
+		}
+	}
+}
+
+func TestContentFilter(t *testing.T) {
+	dir := t.TempDir()
+	var text, binary []string
+
+	for name, head := range textSamples {
+		if len(head) == 0 {
+			continue
+		}
+
+		name = strings.ReplaceAll(name, " ", "-") + ".txt"
+		text = append(text, name)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), head, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, head := range binarySamples {
+		name += ".bin"
+		binary = append(binary, name)
+
+		if err := ioutil.WriteFile(filepath.Join(dir, name), head, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A NUL past the sniffed bytes isn't seen
+	late := append(bytes.Repeat([]byte("a"), sniffSize), 0)
+	text = append(text, "late-nul.txt")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "late-nul.txt"), late, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(text)
+	sort.Strings(binary)
+
+	if got, want := walkedFiles(t, dir, backupConf(dir, "content: text")), text; !equalStrings(got, want) {
+		t.Errorf("content text kept %v, want %v", got, want)
+	}
+
+	if totalFilesFilterContent != len(binary) {
+		t.Errorf("%d files filtered out by content, want %d", totalFilesFilterContent, len(binary))
+	}
+
+	if got, want := walkedFiles(t, dir, backupConf(dir, "content: binary")), binary; !equalStrings(got, want) {
+		t.Errorf("content binary kept %v, want %v", got, want)
+	}
+
+	if got := walkedFiles(t, dir, backupConf(dir)); len(got) != len(text)+len(binary) {
+		t.Errorf("without content kept %d files, want %d", len(got), len(text)+len(binary))
+	}
+
+	// Any other predicate can be plugged in
+	contentFilters = []contentFilter{func(path string, head []byte) bool {
+		return bytes.HasPrefix(head, []byte{0x1f, 0x8b})
+	}}
+
+	if !passesContent(filepath.Join(dir, "gzip.bin")) || passesContent(filepath.Join(dir, "png.bin")) {
+		t.Error("the gzip predicate doesn't keep only the gzip file")
+	}
+
+	// Unreadable files are kept so the backup reports them
+	if !passesContent(filepath.Join(dir, "missing")) {
+		t.Error("a missing file is filtered out")
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "content: images")), "unknown content \"images\"")
+}
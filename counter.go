@@ -0,0 +1,23 @@
+package main
+
+import "sync/atomic"
+
+// counter is a total updated by the workers without a lock
+type counter struct {
+	n int64
+}
+
+// add adds delta to the counter
+func (c *counter) add(delta int64) {
+	atomic.AddInt64(&c.n, delta)
+}
+
+// inc adds one to the counter
+func (c *counter) inc() {
+	c.add(1)
+}
+
+// get returns the current value of the counter
+func (c *counter) get() int64 {
+	return atomic.LoadInt64(&c.n)
+}
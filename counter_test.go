@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounterUnderContention(t *testing.T) {
+	const goroutines, increments = 64, 10000
+
+	var files, bytes counter
+	var wg sync.WaitGroup
+
+	wg.Add(goroutines)
+
+	for i := 0; i < goroutines; i++ {
+		go func(size int64) {
+			defer wg.Done()
+
+			for j := 0; j < increments; j++ {
+				files.inc()
+				bytes.add(size)
+
+				// Read while the others write
+				if files.get() < 0 {
+					t.Error("negative count")
+				}
+			}
+		}(int64(i))
+	}
+
+	wg.Wait()
+
+	if got := files.get(); got != goroutines*increments {
+		t.Errorf("files = %d, want %d", got, goroutines*increments)
+	}
+
+	// The sizes 0 to goroutines-1, increments times each
+	if got, want := bytes.get(), int64(goroutines*(goroutines-1)/2*increments); got != want {
+		t.Errorf("bytes = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// dedupEntry is the first file of a backup seen with some content, done is
+// closed once its upload finished
+type dedupEntry struct {
+	done   chan struct{}
+	object string
+	ok     bool
+}
+
+// dedupIndex holds the content of the files of a backup uploaded to one
+// destination, by SHA-256
+type dedupIndex struct {
+	mutex   sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{entries: map[string]*dedupEntry{}}
+}
+
+// claim returns the entry of hash and whether the caller is the first to
+// ask for it, in which case it must upload the file and call finish
+func (d *dedupIndex) claim(hash string) (*dedupEntry, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if e, ok := d.entries[hash]; ok {
+		return e, false
+	}
+
+	e := &dedupEntry{done: make(chan struct{})}
+	d.entries[hash] = e
+
+	return e, true
+}
+
+// finish records the outcome of the upload of the first file to object
+func (e *dedupEntry) finish(object string, ok bool) {
+	e.object, e.ok = object, ok
+	close(e.done)
+}
+
+// fileHash returns the SHA-256 of the content of path in hex
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %w", err)
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("io.Copy: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyDuplicate waits for the upload of the first file with the same
+// content as path and copies its object to entry.Object within GCS instead
+// of uploading path again. It reports false when the first upload failed,
+// so path has to be uploaded after all
+func copyDuplicate(ctx context.Context, dest *bucketClient, e *dedupEntry, path string, info os.FileInfo, entry *manifestEntry) (bool, error) {
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	if !e.ok {
+		return false, nil
+	}
+
+	logEvent(levelDebug, logFields{File: path, Bucket: dest.NameBucket, Object: entry.Object},
+		fmt.Sprintf("File \"%s\" has the content of \"%s\", copying the object", path, e.object))
+
+	if err := copyObject(ctx, dest, e.object, path, info, entry); err != nil {
+		return false, err
+	}
+
+	entry.DuplicateOf = e.object
+
+	return true, nil
+}
+
+// copyFromLatest copies the object of path in the latest backup of dest to
+// entry.Object within GCS when it still has the size and modification time
+// of the file, and reports false when path has to be uploaded instead. The
+// SHA-256 of the file comes from the manifest of the latest backup or,
+// when it doesn't have it, from reading the file
+func copyFromLatest(ctx context.Context, dest *bucketClient, pathBase, path string, info os.FileInfo, entry *manifestEntry) (bool, error) {
+	src := dest.latest + strings.TrimPrefix(entry.Object, pathBase)
+	unchanged, err := objectUnchanged(ctx, dest.object(src), info)
+
+	if err != nil || !unchanged {
+		return false, err
+	}
+
+	sum := ""
+
+	if prev, ok := dest.latestEntries[path]; ok && sameAsPrevious(prev, info) {
+		sum = prev.SHA256
+	}
+
+	if sum == "" {
+		if sum, err = fileHash(path); err != nil {
+			return false, err
+		}
+	}
+
+	logEvent(levelDebug, logFields{File: path, Bucket: dest.NameBucket, Object: entry.Object},
+		fmt.Sprintf("File \"%s\" is unchanged since \"%s\", copying the object", path, src))
+
+	if err := copyObject(ctx, dest, src, path, info, entry); err != nil {
+		return false, err
+	}
+
+	entry.SHA256 = sum
+
+	return true, nil
+}
+
+// copyObject copies the object src of dest to entry.Object within GCS,
+// with the attributes an upload of path would give it
+func copyObject(ctx context.Context, dest *bucketClient, src, path string, info os.FileInfo, entry *manifestEntry) error {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+
+	defer f.Close()
+
+	contentType, err := detectContentType(path, f)
+
+	if err != nil {
+		return err
+	}
+
+	// The attributes given replace the ones of the original object
+	copier := dest.object(entry.Object).CopierFrom(dest.object(src))
+	copier.Metadata = pipelineFor(path).metadata(objectMetadata(path, info))
+	copier.ContentType = contentType
+	copier.StorageClass = dest.StorageClass
+	copier.DestinationKMSKeyName = dest.KMSKeyName
+	copier.PredefinedACL = conf.ObjectACL
+
+	if class := storageClassFor(path); class != "" {
+		copier.StorageClass = class
+	}
+
+	copier.ContentEncoding = pipelineFor(path).encoding()
+
+	attrs, err := copier.Run(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Copier.Run: %w", err)
+	}
+
+	entry.Status, entry.CRC32C = statusCopied, fmt.Sprintf("%08x", attrs.CRC32C)
+
+	return nil
+}
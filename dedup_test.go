@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupIndexClaim(t *testing.T) {
+	d := newDedupIndex()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	firsts := map[string]int{}
+
+	for i := 0; i < 50; i++ {
+		hash := []string{"a", "b"}[i%2]
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			e, first := d.claim(hash)
+
+			if first {
+				mutex.Lock()
+				firsts[hash]++
+				mutex.Unlock()
+
+				e.finish("object-"+hash, true)
+				return
+			}
+
+			<-e.done
+
+			if e.object != "object-"+hash || !e.ok {
+				t.Errorf("entry of %s = %q, %v", hash, e.object, e.ok)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firsts["a"] != 1 || firsts["b"] != 1 {
+		t.Errorf("first claims = %v, want one of each hash", firsts)
+	}
+}
+
+// writeDuplicates writes n files with the same content and one other file
+// in dir, and returns them
+func writeDuplicates(t *testing.T, dir string, n int) (dups []string, other string) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		dups = append(dups, filepath.Join(dir, "dup-"+string(rune('a'+i))))
+	}
+
+	other = filepath.Join(dir, "other")
+
+	for _, file := range append([]string{other}, dups...) {
+		content := "the same content"
+
+		if file == other {
+			content = "other content"
+		}
+
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dups, other
+}
+
+func TestDedupCopiesTheDuplicates(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	dups, other := writeDuplicates(t, dir, 5)
+
+	loadTestConf(t, backupConf(dir, "concurrency: 4", "dedup: true"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	uploads, copies := 0, 0
+
+	for _, file := range dups {
+		name := prefix + "/" + absoluteObjectPath(file)
+		uploads += f.count("UPLOAD", name)
+		copies += f.count("COPY", name)
+
+		if obj := f.object(testBucket, name); obj == nil || string(obj.Data) != "the same content" {
+			t.Errorf("object of %s = %+v", file, obj)
+		}
+	}
+
+	if uploads != 1 || copies != len(dups)-1 {
+		t.Errorf("%d uploads and %d copies of the duplicates, want 1 and %d", uploads, copies, len(dups)-1)
+	}
+
+	if n := f.count("UPLOAD", prefix+"/"+absoluteObjectPath(other)); n != 1 {
+		t.Errorf("other file uploaded %d times, want 1", n)
+	}
+
+	// The manifest maps every copy to the uploaded object
+	var uploaded string
+	var references []manifestEntry
+
+	for _, entry := range readManifest(t, f, testBucket, prefix).Files {
+		if entry.SHA256 == "" {
+			t.Errorf("no sha256 of %s", entry.File)
+		}
+
+		if !strings.Contains(entry.File, "dup-") {
+			continue
+		}
+
+		if entry.DuplicateOf == "" {
+			uploaded = entry.Object
+		} else {
+			references = append(references, entry)
+		}
+	}
+
+	for _, entry := range references {
+		if entry.DuplicateOf != uploaded {
+			t.Errorf("%s is a duplicate of %q, want %q", entry.File, entry.DuplicateOf, uploaded)
+		}
+	}
+
+	if len(references) != len(dups)-1 {
+		t.Errorf("%d references, want %d", len(references), len(dups)-1)
+	}
+}
+
+func TestDedupUploadsWhenTheFirstFails(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	dups, _ := writeDuplicates(t, dir, 3)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(dups[0])) {
+			return http.StatusForbidden
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir, "concurrency: 1", "dedup: true"))
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	for _, file := range dups[1:] {
+		name := prefix + "/" + absoluteObjectPath(file)
+
+		if f.count("COPY", name) != 0 || f.object(testBucket, name) == nil {
+			t.Errorf("%s wasn't uploaded after the first upload failed", file)
+		}
+	}
+}
+
+// movePrefix renames the objects of bucket under the prefix from to the
+// prefix to
+func movePrefix(f *fakeGCS, bucket, from, to string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	objects := f.buckets[bucket].objects
+
+	for name, obj := range objects {
+		if strings.HasPrefix(name, from+"/") {
+			delete(objects, name)
+			obj.Name = to + strings.TrimPrefix(name, from)
+			objects[obj.Name] = obj
+		}
+	}
+}
+
+func TestCompareWithLatest(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 4)
+
+	// The latest backup, an hour ago
+	latest := backUp(t, f, dir)
+	older := backupPrefix(time.Now().Add(-time.Hour))
+	movePrefix(f, testBucket, latest, older)
+
+	// One file changed since and the object of another one is gone
+	if err := ioutil.WriteFile(files[1], []byte("changed since the latest backup"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mutex.Lock()
+	delete(f.buckets[testBucket].objects, older+"/"+absoluteObjectPath(files[2]))
+	f.requests = nil
+	f.mutex.Unlock()
+
+	loadTestConf(t, backupConf(dir, "compareWithLatest: true"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	var prefix string
+
+	for _, name := range f.names(testBucket, "") {
+		if strings.HasSuffix(name, "/"+manifestName) && !strings.HasPrefix(name, older+"/") {
+			prefix = strings.TrimSuffix(name, "/"+manifestName)
+		}
+	}
+
+	copied := map[string]bool{files[0]: true, files[3]: true}
+	entries := map[string]manifestEntry{}
+
+	for _, entry := range readManifest(t, f, testBucket, prefix).Files {
+		entries[entry.File] = entry
+	}
+
+	for _, file := range files {
+		name := prefix + "/" + absoluteObjectPath(file)
+		data, _ := ioutil.ReadFile(file)
+
+		if obj := f.object(testBucket, name); obj == nil || string(obj.Data) != string(data) {
+			t.Errorf("object of %s missing or stale", file)
+		}
+
+		copies, uploads := f.count("COPY", name), f.count("UPLOAD", name)
+
+		if copied[file] && (copies != 1 || uploads != 0) {
+			t.Errorf("%s: %d copies and %d uploads, want a copy from the latest backup", file, copies, uploads)
+		}
+
+		if !copied[file] && (copies != 0 || uploads != 1) {
+			t.Errorf("%s: %d copies and %d uploads, want an upload", file, copies, uploads)
+		}
+
+		entry := entries[file]
+
+		if entry.Status != statusCopied || entry.Object != name {
+			t.Errorf("manifest entry %+v", entry)
+		}
+
+		if sum, _ := fileHash(file); copied[file] && entry.SHA256 != sum {
+			t.Errorf("SHA-256 of %s = %q, want %q", file, entry.SHA256, sum)
+		}
+	}
+
+	// The latest backup is left as it was
+	if got := len(backedUp(f, testBucket)); got != 4+3 {
+		t.Errorf("%d files in the bucket, want 4 plus the 3 left of the latest backup", got)
+	}
+}
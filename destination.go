@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Storage classes accepted in storageClass
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// Predefined ACLs accepted in objectACL
+var objectACLs = []string{"authenticatedRead", "bucketOwnerFullControl", "bucketOwnerRead", "private", "projectPrivate", "publicRead"}
+
+// Environment variable with the base64 customer-supplied encryption key,
+// which takes precedence over encryptionKey
+const encryptionKeyEnv = "GCS_BACKUP_ENCRYPTION_KEY"
+
+// Environment variable with the host of a GCS emulator. The storage client
+// sends every request there, without credentials
+const emulatorHostEnv = "STORAGE_EMULATOR_HOST"
+
+// Format of a Cloud KMS key name
+var kmsKeyNameRegexp = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// Destination is a bucket where the backup is written
+type Destination struct {
+	// gcs (default) or s3 for an S3-compatible store
+	Provider     string `yaml:"provider"`
+	NameBucket   string `yaml:"nameBucket"`
+	PathJSONKey  string `yaml:"pathJsonKey"`
+	StorageClass string `yaml:"storageClass"`
+	KMSKeyName   string `yaml:"kmsKeyName"`
+	// Base64 AES-256 customer-supplied encryption key
+	EncryptionKey string `yaml:"encryptionKey"`
+	// JSON API endpoint instead of the global one, e.g. a regional endpoint
+	// or an emulator, and whether to send no credentials to it
+	Endpoint  string `yaml:"endpoint"`
+	Anonymous bool   `yaml:"anonymous"`
+	// Region of an S3 bucket, also part of the request signatures
+	Region string `yaml:"region"`
+}
+
+// isS3 reports whether d is an S3-compatible bucket
+func (d Destination) isS3() bool {
+	return d.Provider == providerS3
+}
+
+// Destinations accepts either a single destination, as in the original
+// configuration format, or a list of them
+type Destinations []Destination
+
+func (d *Destinations) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []Destination
+
+	if err := unmarshal(&list); err == nil {
+		*d = list
+		return nil
+	}
+
+	var single Destination
+
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+
+	*d = Destinations{single}
+
+	return nil
+}
+
+// bucketClient reaches the bucket of a destination and keeps its results
+// for the current run
+type bucketClient struct {
+	Destination
+
+	// The storage client and bucket are nil for S3 destinations, which
+	// only have the backend
+	backend Backend
+	client  *storage.Client
+	bucket  *storage.BucketHandle
+	key     []byte
+	dedup   *dedupIndex
+
+	// Entries of the previous manifest by file, with -only-changed
+	previous map[string]manifestEntry
+
+	// Prefix of the latest backup and the entries of its manifest by file,
+	// with compareWithLatest
+	latest        string
+	latestEntries map[string]manifestEntry
+
+	// Objects already under the resumed prefix, with -resume-on-partial
+	partial map[string]objectInfo
+
+	entries    []manifestEntry
+	filesOK    int
+	filesError int
+
+	// Files that failed in a row, reset by any success
+	failuresInRow int
+}
+
+// encryptionKey returns the decoded customer-supplied encryption key of d,
+// or nil when there is none. The key itself never shows up in the errors
+func encryptionKey(d Destination) ([]byte, error) {
+	encoded := os.Getenv(encryptionKeyEnv)
+
+	if encoded == "" {
+		encoded = d.EncryptionKey
+	}
+
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64")
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// validateDestination checks the settings of d
+func validateDestination(d Destination) error {
+	if d.NameBucket == "" {
+		return fmt.Errorf("nameBucket is required")
+	}
+
+	if d.Provider != "" && d.Provider != providerGCS && d.Provider != providerS3 {
+		return fmt.Errorf("unknown provider \"%s\", use gcs or s3", d.Provider)
+	}
+
+	if d.Endpoint != "" {
+		if u, err := url.Parse(d.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("endpoint \"%s\" is not an absolute URL", d.Endpoint)
+		}
+	}
+
+	if d.isS3() {
+		return validateS3Destination(d)
+	}
+
+	if d.StorageClass != "" && !containsString(storageClasses, d.StorageClass) {
+		return fmt.Errorf("unknown storageClass \"%s\", use one of %s", d.StorageClass, strings.Join(storageClasses, ", "))
+	}
+
+	if d.KMSKeyName != "" && !kmsKeyNameRegexp.MatchString(d.KMSKeyName) {
+		return fmt.Errorf("kmsKeyName \"%s\" is not like projects/P/locations/L/keyRings/R/cryptoKeys/K", d.KMSKeyName)
+	}
+
+	key, err := encryptionKey(d)
+
+	if err != nil {
+		return err
+	}
+
+	if key != nil && d.KMSKeyName != "" {
+		return fmt.Errorf("kmsKeyName and a customer-supplied encryption key can't be used together")
+	}
+
+	// Credentials come from the inline JSON, then the key file and, without
+	// any of them, Application Default Credentials
+	if os.Getenv(emulatorHostEnv) != "" || d.Anonymous {
+		return nil
+	}
+
+	if creds := os.Getenv(credentialsJSONEnv); creds != "" {
+		if !json.Valid([]byte(creds)) {
+			return fmt.Errorf("environment variable %s does not contain valid JSON", credentialsJSONEnv)
+		}
+	} else if d.PathJSONKey != "" {
+		info, err := os.Stat(d.PathJSONKey)
+
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file pathJsonKey \"%s\" not found", d.PathJSONKey)
+		}
+
+		if err != nil {
+			return fmt.Errorf("file pathJsonKey: %w", err)
+		}
+
+		if info.Size() == 0 {
+			return fmt.Errorf("file pathJsonKey \"%s\" is empty", d.PathJSONKey)
+		}
+	}
+
+	return nil
+}
+
+// validateS3Destination checks the settings of the S3 destination d, which
+// can't have the ones specific to GCS
+func validateS3Destination(d Destination) error {
+	if d.Region == "" {
+		return fmt.Errorf("region is required with provider s3")
+	}
+
+	if d.StorageClass != "" || d.KMSKeyName != "" || d.EncryptionKey != "" || d.PathJSONKey != "" || d.Anonymous {
+		return fmt.Errorf("storageClass, kmsKeyName, encryptionKey, pathJsonKey and anonymous are only for GCS")
+	}
+
+	if os.Getenv(s3AccessKeyEnv) == "" || os.Getenv(s3SecretKeyEnv) == "" {
+		return fmt.Errorf("provider s3 needs the environment variables %s and %s", s3AccessKeyEnv, s3SecretKeyEnv)
+	}
+
+	return nil
+}
+
+// clientOptions returns the options used to build the storage client of d
+func clientOptions(d Destination) []option.ClientOption {
+	var opts []option.ClientOption
+
+	// The client itself points to the emulator and drops the credentials
+	if os.Getenv(emulatorHostEnv) != "" {
+		return nil
+	}
+
+	if d.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(d.Endpoint))
+	}
+
+	if d.Anonymous {
+		opts = append(opts, option.WithoutAuthentication())
+	} else if creds := os.Getenv(credentialsJSONEnv); creds != "" {
+		opts = append(opts, option.WithCredentialsJSON([]byte(creds)))
+	} else if d.PathJSONKey != "" {
+		opts = append(opts, option.WithCredentialsFile(d.PathJSONKey))
+	}
+
+	return opts
+}
+
+// credentialSource describes where the client credentials of d come from
+func credentialSource(d Destination) string {
+	if d.isS3() {
+		return "credentials from " + s3AccessKeyEnv
+	}
+
+	if host := os.Getenv(emulatorHostEnv); host != "" {
+		return fmt.Sprintf("no credentials, emulator at \"%s\"", host)
+	}
+
+	if d.Anonymous {
+		return "no credentials"
+	}
+
+	if os.Getenv(credentialsJSONEnv) != "" {
+		return "credentials from " + credentialsJSONEnv
+	}
+
+	if d.PathJSONKey != "" {
+		return fmt.Sprintf("key file \"%s\"", d.PathJSONKey)
+	}
+
+	return "Application Default Credentials"
+}
+
+// newClient creates the storage client of d or exits when it can't
+func newClient(ctx context.Context, d Destination) *bucketClient {
+	if d.isS3() {
+		return &bucketClient{Destination: d, backend: newS3Backend(d), dedup: newDedupIndex()}
+	}
+
+	client, err := storage.NewClient(ctx, clientOptions(d)...)
+
+	if err != nil {
+		logError("Creating client for \"%s\" with %s: %s", d.NameBucket, credentialSource(d), err)
+		exit(1)
+	}
+
+	// Already validated by parseFileConf
+	key, _ := encryptionKey(d)
+
+	b := &bucketClient{Destination: d, client: client, bucket: client.Bucket(d.NameBucket), key: key, dedup: newDedupIndex()}
+	b.backend = gcsBackend{b}
+
+	return b
+}
+
+// preflight checks that the bucket of b exists and, unless skipWriteProbe
+// is set, that the probe object can be written to it. The probe is deleted
+// right after, with a warning when that isn't allowed. S3 buckets are only
+// checked by the probe
+func (b *bucketClient) preflight(ctx context.Context, probe string) error {
+	var apiErr *googleapi.Error
+
+	if b.bucket != nil {
+		// Writers may not be allowed to read the bucket attributes, the
+		// probe tells then whether the bucket is there
+		attrs, err := b.bucket.Attrs(ctx)
+
+		if errors.Is(err, storage.ErrBucketNotExist) {
+			return fmt.Errorf("bucket does not exist")
+		} else if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden) {
+			return fmt.Errorf("Bucket.Attrs: %w", err)
+		}
+
+		if attrs != nil && attrs.UniformBucketLevelAccess.Enabled && conf.ObjectACL != "" {
+			return fmt.Errorf("objectACL %s can't be set, the bucket has uniform bucket-level access", conf.ObjectACL)
+		}
+	}
+
+	if conf.SkipWriteProbe {
+		return nil
+	}
+
+	opts := b.objectOptions()
+	opts.ContentType = "text/plain"
+
+	if _, err := b.backend.Upload(ctx, probe, strings.NewReader("gcs-backup preflight\n"), opts); err != nil {
+		return fmt.Errorf("writing the probe object \"%s\": %w", probe, err)
+	}
+
+	if ok, err := b.backend.Exists(ctx, probe); err == nil && !ok {
+		return fmt.Errorf("the probe object \"%s\" was written but isn't there", probe)
+	}
+
+	if err := b.backend.Delete(ctx, probe); err != nil {
+		logWarning("Deleting the probe object \"%s\" of \"%s\": %s", probe, b.NameBucket, err)
+	}
+
+	return nil
+}
+
+// object returns the handle of the object name, with the customer-supplied
+// encryption key when there is one
+func (b *bucketClient) object(name string) *storage.ObjectHandle {
+	obj := b.bucket.Object(name)
+
+	if b.key != nil {
+		obj = obj.Key(b.key)
+	}
+
+	return obj
+}
+
+// objectOptions returns the settings every object written to b gets
+func (b *bucketClient) objectOptions() objectOptions {
+	return objectOptions{
+		StorageClass:  b.StorageClass,
+		KMSKeyName:    b.KMSKeyName,
+		PredefinedACL: conf.ObjectACL,
+	}
+}
+
+// Close releases the client
+func (b *bucketClient) Close() error {
+	if b.client == nil {
+		return nil
+	}
+
+	return b.client.Close()
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsWithoutKeyFile(t *testing.T) {
+	t.Setenv(emulatorHostEnv, "")
+	t.Setenv(credentialsJSONEnv, "")
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.json")
+
+	if err := ioutil.WriteFile(key, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		d          Destination
+		wantErr    string
+		wantOpts   int
+		wantSource string
+	}{
+		{"no key file", Destination{NameBucket: "b"}, "", 0, "Application Default Credentials"},
+		{"key file", Destination{NameBucket: "b", PathJSONKey: key}, "", 1, "key file"},
+		{"missing key file", Destination{NameBucket: "b", PathJSONKey: filepath.Join(dir, "missing.json")}, "not found", 1, "key file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateDestination(test.d)
+
+			if test.wantErr == "" && err != nil {
+				t.Errorf("validateDestination: %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("validateDestination = %v, want an error with %q", err, test.wantErr)
+			}
+
+			if opts := clientOptions(test.d); len(opts) != test.wantOpts {
+				t.Errorf("clientOptions gave %d options, want %d", len(opts), test.wantOpts)
+			}
+
+			if source := credentialSource(test.d); !strings.HasPrefix(source, test.wantSource) {
+				t.Errorf("credentialSource = %q, want %q", source, test.wantSource)
+			}
+		})
+	}
+}
+
+func TestConfigurationWithoutKeyFile(t *testing.T) {
+	t.Setenv(emulatorHostEnv, "")
+	t.Setenv(credentialsJSONEnv, "")
+
+	if err := parseTestConf(t, backupConf(t.TempDir())); err != nil {
+		t.Errorf("parseFileConf without pathJsonKey: %v", err)
+	}
+}
+
+func TestCredentialSourcePrecedence(t *testing.T) {
+	t.Setenv(emulatorHostEnv, "")
+
+	key := filepath.Join(t.TempDir(), "key.json")
+
+	if err := ioutil.WriteFile(key, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		env        string
+		d          Destination
+		wantErr    string
+		wantSource string
+	}{
+		{"inline JSON", `{"type":"service_account"}`, Destination{NameBucket: "b"}, "", "credentials from " + credentialsJSONEnv},
+		{"inline JSON over key file", `{"type":"service_account"}`, Destination{NameBucket: "b", PathJSONKey: key}, "", "credentials from " + credentialsJSONEnv},
+		{"invalid inline JSON", `{"type":`, Destination{NameBucket: "b", PathJSONKey: key}, credentialsJSONEnv, "credentials from " + credentialsJSONEnv},
+		{"key file", "", Destination{NameBucket: "b", PathJSONKey: key}, "", "key file"},
+		{"missing key file", "", Destination{NameBucket: "b", PathJSONKey: filepath.Join(filepath.Dir(key), "none.json")}, "pathJsonKey", "key file"},
+		{"ADC", "", Destination{NameBucket: "b"}, "", "Application Default Credentials"},
+		{"anonymous", `{"type":`, Destination{NameBucket: "b", Anonymous: true}, "", "no credentials"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv(credentialsJSONEnv, test.env)
+
+			err := validateDestination(test.d)
+
+			if test.wantErr == "" && err != nil {
+				t.Errorf("validateDestination: %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("validateDestination = %v, want an error with %q", err, test.wantErr)
+			}
+
+			if source := credentialSource(test.d); !strings.HasPrefix(source, test.wantSource) {
+				t.Errorf("credentialSource = %q, want %q", source, test.wantSource)
+			}
+		})
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	prefix := backUp(t, f, dir, "  storageClass: NEARLINE")
+
+	for _, file := range files {
+		obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(file))
+
+		if obj == nil || obj.StorageClass != "NEARLINE" {
+			t.Errorf("object of %s = %+v, want storage class NEARLINE", file, obj)
+		}
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "  storageClass: FROZEN")), "unknown storageClass \"FROZEN\"")
+}
+
+func TestSummaryOfSeveralDestinations(t *testing.T) {
+	const drBucket = "dr-bucket"
+
+	f := newFakeGCS(t, testBucket, drBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	f.failUpload = func(bucket, name string) int {
+		if bucket == drBucket && strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, fmt.Sprintf("directories: [%q]\ngoogleCloud:\n  - nameBucket: %s\n  - nameBucket: %s\n", dir, testBucket, drBucket))
+
+	logFormat = "json"
+	runLog = new(bytes.Buffer)
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Errorf("copyFiles = %d errors, want 1", errs)
+	}
+
+	if copied := totalFilesOK.get(); copied != 2 {
+		t.Errorf("totalFilesOK = %d, want the 2 files copied to both buckets", copied)
+	}
+
+	var summary map[string]interface{}
+
+	for _, entry := range logLines(t) {
+		if entry["summary"] != nil {
+			summary = entry["summary"].(map[string]interface{})
+		}
+	}
+
+	got, _ := json.Marshal(summary["destinations"])
+	want := `[{"bucket":"test-bucket","filesCopied":3,"filesError":0},{"bucket":"dr-bucket","filesCopied":2,"filesError":1}]`
+
+	if string(got) != want {
+		t.Errorf("destinations = %s, want %s", got, want)
+	}
+
+	for _, bucket := range []string{testBucket, drBucket} {
+		if backupPrefixOf(f, bucket) == "" {
+			t.Errorf("no manifest in %s", bucket)
+		}
+	}
+}
+
+func TestKMSKeyName(t *testing.T) {
+	const key = "projects/p/locations/europe-west1/keyRings/backups/cryptoKeys/files"
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 1)
+
+	prefix := backUp(t, f, dir, "  kmsKeyName: "+key)
+
+	if obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(files[0])); obj == nil || obj.KMSKeyName != key {
+		t.Errorf("object = %+v, want the KMS key %s", obj, key)
+	}
+
+	for _, bad := range []string{"files", "projects/p/keyRings/backups/cryptoKeys/files", "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"} {
+		wantConfError(t, parseTestConf(t, backupConf(dir, "  kmsKeyName: "+bad)), "kmsKeyName")
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	other := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+
+	tests := []struct {
+		name    string
+		env     string
+		conf    string
+		want    []byte
+		wantErr string
+	}{
+		{"none", "", "", nil, ""},
+		{"configuration", "", encoded, key, ""},
+		{"environment over configuration", encoded, other, key, ""},
+		{"short key", "", base64.StdEncoding.EncodeToString(key[:16]), nil, "must be 32 bytes, got 16"},
+		{"not base64", "", "not-base64!", nil, "not valid base64"},
+	}
+
+	for _, test := range tests {
+		t.Setenv(encryptionKeyEnv, test.env)
+
+		got, err := encryptionKey(Destination{EncryptionKey: test.conf})
+
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: error %v, want one with %q", test.name, err, test.wantErr)
+			}
+
+			continue
+		}
+
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: encryptionKey = %x, %v, want %x", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestEncryptionKeyRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	encoded := base64.StdEncoding.EncodeToString(key)
+	sum := sha256.Sum256(key)
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+
+	makeTree(t, dir, "secret.txt")
+
+	prefix := backUp(t, f, dir, "  encryptionKey: "+encoded, "pathMode: relative")
+	name := prefix + "/" + filepath.Base(dir) + "/secret.txt"
+
+	if obj := f.object(testBucket, name); obj == nil || obj.KeySHA256 != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("object = %+v, want one written with the key", obj)
+	}
+
+	// Restored with the key of the configuration
+	logFormat = "json"
+	runLog = new(bytes.Buffer)
+	restorePrefix = prefix
+	restoreDest = t.TempDir()
+
+	if failed := restoreFiles(context.Background()); failed != 0 {
+		t.Fatalf("restoreFiles = %d failures, want 0", failed)
+	}
+
+	checkTree(t, filepath.Join(restoreDest, filepath.Base(dir)), "secret.txt")
+
+	logError("Object with key %s", encoded)
+
+	if strings.Contains(runLog.String(), encoded) {
+		t.Error("the key was logged")
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+
+	// Only the endpoint points to the fake
+	t.Setenv(emulatorHostEnv, "")
+	t.Setenv(credentialsJSONEnv, "")
+
+	endpoint := f.server.URL + "/storage/v1/"
+	d := Destination{NameBucket: testBucket, Endpoint: endpoint, Anonymous: true}
+
+	if err := validateDestination(d); err != nil {
+		t.Fatalf("validateDestination: %v", err)
+	}
+
+	if source := credentialSource(d); source != "no credentials" {
+		t.Errorf("credentialSource = %q, want no credentials", source)
+	}
+
+	resetState(t)
+
+	dest := newClient(context.Background(), d)
+	defer dest.Close()
+
+	if _, err := dest.backend.Upload(context.Background(), "probe", strings.NewReader("data"), dest.objectOptions()); err != nil {
+		t.Fatalf("Upload through the endpoint: %v", err)
+	}
+
+	if obj := f.object(testBucket, "probe"); obj == nil || string(obj.Data) != "data" {
+		t.Errorf("object = %+v, want the upload in the fake", obj)
+	}
+
+	for _, bad := range []string{"localhost:4443", "/storage/v1", "http://"} {
+		if err := validateDestination(Destination{NameBucket: testBucket, Endpoint: bad}); err == nil || !strings.Contains(err.Error(), "is not an absolute URL") {
+			t.Errorf("validateDestination of endpoint %q = %v", bad, err)
+		}
+	}
+}
+
+func TestEmulatorHost(t *testing.T) {
+	t.Setenv(emulatorHostEnv, "localhost:4443")
+	t.Setenv(credentialsJSONEnv, "")
+
+	// A key file that doesn't exist isn't read
+	d := Destination{NameBucket: testBucket, PathJSONKey: "/missing/key.json"}
+
+	if err := validateDestination(d); err != nil {
+		t.Errorf("validateDestination with an emulator: %v", err)
+	}
+
+	if opts := clientOptions(d); len(opts) != 0 {
+		t.Errorf("clientOptions gave %d options, want none", len(opts))
+	}
+
+	if source := credentialSource(d); source != `no credentials, emulator at "localhost:4443"` {
+		t.Errorf("credentialSource = %q", source)
+	}
+}
+
+// probeRequests returns the requests of f on preflight probe objects
+func probeRequests(f *fakeGCS) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var probes []string
+
+	for _, r := range f.requests {
+		if strings.Contains(r, ".preflight-") {
+			probes = append(probes, strings.Fields(r)[0])
+		}
+	}
+
+	return probes
+}
+
+func TestPreflight(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("writable bucket", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		loadTestConf(t, backupConf(t.TempDir(), "basePrefix: web-1"))
+		conf.SkipWriteProbe = false
+
+		if err := newClient(ctx, conf.GoogleCloud[0]).preflight(ctx, withBasePrefix(".preflight-1")); err != nil {
+			t.Fatalf("preflight: %v", err)
+		}
+
+		// The probe is written, checked and deleted
+		if got := probeRequests(f); len(got) != 3 || got[2] != "DELETE" {
+			t.Errorf("requests on the probe = %v, want its write, read and delete", got)
+		}
+
+		if names := f.names(testBucket, ""); len(names) != 0 {
+			t.Errorf("objects left behind: %v", names)
+		}
+	})
+
+	t.Run("missing bucket", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		loadTestConf(t, backupConf(t.TempDir()))
+		conf.SkipWriteProbe = false
+
+		d := conf.GoogleCloud[0]
+		d.NameBucket = "missing"
+
+		err := newClient(ctx, d).preflight(ctx, ".preflight-1")
+
+		if err == nil || err.Error() != "bucket does not exist" {
+			t.Errorf("preflight = %v, want the bucket does not exist", err)
+		}
+
+		if got := probeRequests(f); len(got) != 0 {
+			t.Errorf("requests on the probe = %v, want none", got)
+		}
+	})
+
+	t.Run("write refused", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		f.failUpload = func(bucket, name string) int { return 403 }
+
+		loadTestConf(t, backupConf(t.TempDir()))
+		conf.SkipWriteProbe = false
+
+		err := newClient(ctx, conf.GoogleCloud[0]).preflight(ctx, ".preflight-1")
+
+		if err == nil || !strings.Contains(err.Error(), "writing the probe object \".preflight-1\"") {
+			t.Errorf("preflight = %v, want the probe not written", err)
+		}
+
+		// Skipping the probe only checks the bucket
+		conf.SkipWriteProbe = true
+
+		if err := newClient(ctx, conf.GoogleCloud[0]).preflight(ctx, ".preflight-2"); err != nil {
+			t.Errorf("preflight without the probe: %v", err)
+		}
+	})
+}
+
+func TestMissingBucketFailsEarly(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 10)
+
+	yaml := fmt.Sprintf("directories:\n  - %q\ngoogleCloud:\n  nameBucket: missing\n", dir)
+
+	if err := parseTestConf(t, yaml); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runMain(t, "-config", fileConf)
+
+	if code != 1 || !strings.Contains(out, "Bucket \"missing\" can't take the backup: bucket does not exist") {
+		t.Errorf("exit status %d, want 1 and the missing bucket: %s", code, out)
+	}
+
+	// Nothing is uploaded before the bucket is known to be there
+	for _, r := range f.requests {
+		if strings.HasPrefix(r, "UPLOAD ") || strings.HasPrefix(r, "RESUMABLE ") {
+			t.Errorf("request %q after the missing bucket", r)
+		}
+	}
+}
+
+func TestObjectACL(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	loadTestConf(t, backupConf(dir, "objectACL: publicRead"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	for _, file := range files {
+		obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(file))
+
+		if obj == nil {
+			t.Fatalf("no object of %s", file)
+		}
+
+		if obj.PredefinedACL != "publicRead" {
+			t.Errorf("object of %s uploaded with the ACL %q, want publicRead", file, obj.PredefinedACL)
+		}
+	}
+
+	// Without objectACL the bucket default applies
+	f = newFakeGCS(t, testBucket)
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if obj := f.object(testBucket, backupPrefixOf(f, testBucket)+"/"+absoluteObjectPath(files[0])); obj == nil || obj.PredefinedACL != "" {
+		t.Errorf("object uploaded with an ACL without objectACL: %+v", obj)
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "objectACL: everyone")), "unknown objectACL \"everyone\"")
+}
+
+func TestObjectACLWithUniformAccess(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeGCS(t, testBucket)
+	f.buckets[testBucket].uniform = true
+
+	loadTestConf(t, backupConf(t.TempDir(), "objectACL: publicRead"))
+
+	err := newClient(ctx, conf.GoogleCloud[0]).preflight(ctx, ".preflight-1")
+
+	if err == nil || !strings.Contains(err.Error(), "objectACL publicRead can't be set, the bucket has uniform bucket-level access") {
+		t.Errorf("preflight = %v, want the uniform access conflict", err)
+	}
+
+	loadTestConf(t, backupConf(t.TempDir()))
+
+	if err := newClient(ctx, conf.GoogleCloud[0]).preflight(ctx, ".preflight-1"); err != nil {
+		t.Errorf("preflight without objectACL: %v", err)
+	}
+}
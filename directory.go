@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Directory is one entry of directories: a path, or a mapping with the
+// path and settings for the files under it that override the global ones
+type Directory struct {
+	Path         string       `yaml:"path"`
+	Compress     *compression `yaml:"compress"`
+	StorageClass string       `yaml:"storageClass"`
+	// Added to the global patterns
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// UnmarshalYAML accepts either a plain path, as in the original
+// configuration format, or a mapping
+func (d *Directory) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+
+	if err := unmarshal(&path); err == nil {
+		*d = Directory{Path: path}
+		return nil
+	}
+
+	// Without the methods of Directory, so this doesn't recurse
+	type plain Directory
+
+	var p plain
+
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+
+	*d = Directory(p)
+
+	return nil
+}
+
+// dirList is a flag that can be given several times, such as -only-dir
+type dirList []string
+
+func (l *dirList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *dirList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// coversDir reports whether dir is the path of entry or one of the paths
+// its patterns match
+func coversDir(entry Directory, dir string) bool {
+	dir = filepath.Clean(dir)
+
+	for _, pattern := range expandBraces(entry.Path) {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), dir); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectDirectories returns the entries of the directories only, which must
+// be covered by entries. Each one gets the settings of its entry
+func selectDirectories(entries []Directory, only []string) ([]Directory, error) {
+	var selected []Directory
+
+outer:
+	for _, dir := range only {
+		for _, entry := range entries {
+			if coversDir(entry, dir) {
+				d := entry
+				d.Path = filepath.Clean(dir)
+				selected = append(selected, d)
+
+				continue outer
+			}
+		}
+
+		return nil, fmt.Errorf("\"%s\" is not one of the directories", dir)
+	}
+
+	return selected, nil
+}
+
+// Directories being walked, with their patterns expanded. Set before the
+// first file is queued and only read afterwards
+var walkedDirs []Directory
+
+// directoryFor returns the walked directory path is under, the closest one
+// when they are nested, or nil
+func directoryFor(path string) *Directory {
+	var found *Directory
+
+	for i := range walkedDirs {
+		dir := filepath.Clean(walkedDirs[i].Path)
+
+		if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			continue
+		}
+
+		if found == nil || len(dir) > len(filepath.Clean(found.Path)) {
+			found = &walkedDirs[i]
+		}
+	}
+
+	return found
+}
+
+// compressionFor returns the compression of the file path, as set for its
+// directory or globally
+func compressionFor(path string) compression {
+	if d := directoryFor(path); d != nil && d.Compress != nil {
+		return *d.Compress
+	}
+
+	return conf.Compress
+}
+
+// storageClassFor returns the storage class the directory of path sets, or
+// "" to keep the one of the destination
+func storageClassFor(path string) string {
+	if d := directoryFor(path); d != nil {
+		return d.StorageClass
+	}
+
+	return ""
+}
+
+// patternsFor returns the include and exclude patterns of the files under
+// the directory root, the global ones plus the ones of root
+func patternsFor(root string) ([]string, []string) {
+	include, exclude := conf.Include, conf.Exclude
+
+	if d := directoryFor(filepath.Clean(root)); d != nil {
+		include = append(include[:len(include):len(include)], d.Include...)
+		exclude = append(exclude[:len(exclude):len(exclude)], d.Exclude...)
+	}
+
+	return include, exclude
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirectoryShapes(t *testing.T) {
+	yaml := `directories:
+  - /srv/plain
+  - path: /srv/logs
+    compress: gzip
+    storageClass: COLDLINE
+    exclude: ['*.tmp']
+  - path: /srv/raw
+    compress: false
+googleCloud:
+  nameBucket: test-bucket
+`
+	loadTestConf(t, yaml)
+
+	if len(conf.Directories) != 3 {
+		t.Fatalf("directories = %+v, want 3", conf.Directories)
+	}
+
+	plain, logs, raw := conf.Directories[0], conf.Directories[1], conf.Directories[2]
+
+	if plain.Path != "/srv/plain" || plain.Compress != nil || plain.StorageClass != "" || plain.Exclude != nil {
+		t.Errorf("plain entry = %+v, want only the path", plain)
+	}
+
+	if logs.Path != "/srv/logs" || logs.Compress == nil || *logs.Compress != compressGzip || logs.StorageClass != "COLDLINE" || !equalStrings(logs.Exclude, []string{"*.tmp"}) {
+		t.Errorf("mapping entry = %+v", logs)
+	}
+
+	if raw.Compress == nil || *raw.Compress != compressNone {
+		t.Errorf("compress: false = %v, want %v", raw.Compress, compressNone)
+	}
+}
+
+func TestDirectoryOverrides(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	root := t.TempDir()
+	makeTree(t, root, "logs/a.log", "logs/b.tmp", "docs/c.txt", "docs/d.tmp")
+
+	logs, docs := filepath.Join(root, "logs"), filepath.Join(root, "docs")
+
+	yaml := fmt.Sprintf(`directories:
+  - %q
+  - path: %q
+    compress: gzip
+    storageClass: COLDLINE
+    exclude: ['*.tmp']
+googleCloud:
+  nameBucket: test-bucket
+  storageClass: NEARLINE
+`, docs, logs)
+
+	loadTestConf(t, yaml)
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	object := func(path, suffix string) *fakeObject {
+		return f.object(testBucket, prefix+"/"+absoluteObjectPath(path)+suffix)
+	}
+
+	// The settings of the logs entry
+	if obj := object(filepath.Join(logs, "a.log"), ".gz"); obj == nil || obj.ContentEncoding != "gzip" || obj.StorageClass != "COLDLINE" {
+		t.Errorf("object of logs/a.log = %+v, want gzipped in COLDLINE", obj)
+	}
+
+	if obj := object(filepath.Join(logs, "b.tmp"), ""); obj != nil {
+		t.Error("logs/b.tmp copied despite the exclude of its entry")
+	}
+
+	// The global ones elsewhere
+	if obj := object(filepath.Join(docs, "c.txt"), ""); obj == nil || obj.ContentEncoding != "" || obj.StorageClass != "NEARLINE" {
+		t.Errorf("object of docs/c.txt = %+v, want as is in NEARLINE", obj)
+	}
+
+	if obj := object(filepath.Join(docs, "d.tmp"), ""); obj == nil {
+		t.Error("docs/d.tmp excluded by the entry of another directory")
+	}
+}
+
+func TestSelectDirectories(t *testing.T) {
+	logs := Directory{Path: "/srv/logs", StorageClass: "COLDLINE"}
+	apps := Directory{Path: "/srv/{app,web}-*"}
+	entries := []Directory{{Path: "/srv/docs"}, logs, apps}
+
+	selected, err := selectDirectories(entries, []string{"/srv/logs/", "/srv/web-1"})
+
+	if err != nil {
+		t.Fatalf("selectDirectories: %v", err)
+	}
+
+	// Each one with the settings of its entry
+	if len(selected) != 2 || selected[0].Path != "/srv/logs" || selected[0].StorageClass != "COLDLINE" || selected[1].Path != "/srv/web-1" {
+		t.Errorf("selectDirectories = %+v", selected)
+	}
+
+	for _, dir := range []string{"/srv/other", "/srv", "/srv/logs/sub"} {
+		if _, err := selectDirectories(entries, []string{"/srv/docs", dir}); err == nil {
+			t.Errorf("selectDirectories with %s succeeded", dir)
+		}
+	}
+}
+
+func TestOnlyDirAndMatch(t *testing.T) {
+	newFakeGCS(t, testBucket)
+	root := t.TempDir()
+	makeTree(t, root, "docs/a.txt", "docs/b.log", "logs/c.txt", "app-1/d.txt", "app-1/e.log", "app-2/f.txt")
+
+	yaml := fmt.Sprintf("directories:\n  - %q\n  - %q\n  - %q\ngoogleCloud:\n  nameBucket: %s\n",
+		filepath.Join(root, "docs"), filepath.Join(root, "logs"), filepath.Join(root, "app-*"), testBucket)
+
+	if err := parseTestConf(t, yaml); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"docs/a.txt", "docs/b.log", "logs/c.txt", "app-1/d.txt", "app-1/e.log", "app-2/f.txt"}},
+		{[]string{"-only-dir", filepath.Join(root, "docs")}, []string{"docs/a.txt", "docs/b.log"}},
+		{[]string{"-only-dir", filepath.Join(root, "logs"), "-only-dir", filepath.Join(root, "app-1")}, []string{"logs/c.txt", "app-1/d.txt", "app-1/e.log"}},
+		{[]string{"-match", "*.txt"}, []string{"docs/a.txt", "logs/c.txt", "app-1/d.txt", "app-2/f.txt"}},
+		{[]string{"-only-dir", filepath.Join(root, "app-1"), "-match", "*.log"}, []string{"app-1/e.log"}},
+	}
+
+	for _, test := range tests {
+		out, code := runMain(t, append([]string{"-plan", "-config", fileConf}, test.args...)...)
+
+		if code != 0 {
+			t.Fatalf("%v: exit status %d, want 0: %s", test.args, code, out)
+		}
+
+		var got []string
+
+		for _, rel := range tests[0].want {
+			if strings.Contains(out, `"file": "`+filepath.Join(root, rel)+`"`) {
+				got = append(got, rel)
+			}
+		}
+
+		if !equalStrings(got, test.want) {
+			t.Errorf("%v: planned %v, want %v", test.args, got, test.want)
+		}
+	}
+
+	for _, args := range [][]string{{"-only-dir", filepath.Join(root, "other")}, {"-match", "[x"}} {
+		if out, code := runMain(t, append([]string{"-plan", "-config", fileConf}, args...)...); code != 1 {
+			t.Errorf("%v: exit status %d, want 1: %s", args, code, out)
+		}
+	}
+}
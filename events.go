@@ -0,0 +1,49 @@
+package main
+
+// EventHandler observes a backup run. The file events come from the
+// workers, so the methods must be safe to call concurrently
+type EventHandler interface {
+	// OnStart is called before the walk with the prefix of the backup
+	OnStart(prefix string)
+	// OnFileUploaded is called for each file copied, changed while it was
+	// copied, unchanged or skipped in each bucket, i.e. every file that
+	// didn't fail. Skipped files are the empty ones left out by
+	// skipEmptyFiles and those that stopped being regular files
+	OnFileUploaded(bucket string, entry manifestEntry)
+	// OnFileFailed is called for each file that failed or disappeared in
+	// each bucket
+	OnFileFailed(bucket string, entry manifestEntry)
+	// OnComplete is called once the manifests are written
+	OnComplete(report runReport)
+}
+
+// logHandler is the default handler, printing the result of every file
+type logHandler struct{}
+
+func (logHandler) OnStart(prefix string) {
+	logDebug("Backup \"%s\" started", prefix)
+}
+
+func (logHandler) OnFileUploaded(bucket string, entry manifestEntry) {
+	logEntryResult(entry, bucket)
+}
+
+func (logHandler) OnFileFailed(bucket string, entry manifestEntry) {
+	logEntryResult(entry, bucket)
+}
+
+func (logHandler) OnComplete(report runReport) {}
+
+// Handler of the events of the backup
+var events EventHandler = logHandler{}
+
+// fileEvent sends the result of a file in bucket to the handler, every
+// status but the failures goes to OnFileUploaded
+func fileEvent(bucket string, entry manifestEntry) {
+	if entry.Status == statusError || entry.Status == statusMissing {
+		events.OnFileFailed(bucket, entry)
+		return
+	}
+
+	events.OnFileUploaded(bucket, entry)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingHandler keeps the events of a run, in order
+type recordingHandler struct {
+	mutex  sync.Mutex
+	events []string
+	prefix string
+	files  map[string]manifestEntry
+	report runReport
+}
+
+func (h *recordingHandler) OnStart(prefix string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events = append(h.events, "start")
+	h.prefix = prefix
+}
+
+func (h *recordingHandler) OnFileUploaded(bucket string, entry manifestEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events = append(h.events, "uploaded")
+	h.files[bucket+":"+entry.File] = entry
+}
+
+func (h *recordingHandler) OnFileFailed(bucket string, entry manifestEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events = append(h.events, "failed")
+	h.files[bucket+":"+entry.File] = entry
+}
+
+func (h *recordingHandler) OnComplete(report runReport) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.events = append(h.events, "complete")
+	h.report = report
+}
+
+func TestEventHandler(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[2])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	h := &recordingHandler{files: map[string]manifestEntry{}}
+	events = h
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	// The order of the files is up to the workers
+	if len(h.events) != 5 || h.events[0] != "start" || h.events[4] != "complete" {
+		t.Fatalf("events = %v, want start, the files and complete", h.events)
+	}
+
+	kinds := append([]string(nil), h.events[1:4]...)
+	sort.Strings(kinds)
+
+	if !equalStrings(kinds, []string{"failed", "uploaded", "uploaded"}) {
+		t.Errorf("file events = %v, want 2 uploaded and 1 failed", h.events[1:4])
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	if h.prefix != prefix {
+		t.Errorf("OnStart prefix = %q, want %q", h.prefix, prefix)
+	}
+
+	for i, file := range files {
+		entry := h.files[testBucket+":"+file]
+		want := statusCopied
+
+		if i == 2 {
+			want = statusError
+		}
+
+		if entry.Status != want || entry.Object != prefix+"/"+absoluteObjectPath(file) || entry.Size != int64(len(file)) {
+			t.Errorf("event of %s = %+v, want %s", file, entry, want)
+		}
+	}
+
+	if failed := h.files[testBucket+":"+files[2]]; !strings.Contains(failed.Error, "403") {
+		t.Errorf("error of the failed file = %q", failed.Error)
+	}
+
+	if r := h.report; r.Prefix != prefix || r.FilesToCopy != 3 || r.FilesCopied != 2 || r.FilesError != 1 || !r.Failed {
+		t.Errorf("OnComplete report = %+v", r)
+	}
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObject is an object stored by fakeGCS
+type fakeObject struct {
+	Name            string
+	Data            []byte
+	ContentType     string
+	ContentEncoding string
+	StorageClass    string
+	KMSKeyName      string
+	KeySHA256       string
+	Metadata        map[string]string
+	Created         time.Time
+	Generation      int64
+	TemporaryHold   bool
+	RetentionMode   string
+	RetainUntil     time.Time
+	PredefinedACL   string
+
+	// CRC32C sent with the upload, which the data must have
+	sentCRC32C string
+}
+
+// fakeBucket is a bucket of fakeGCS
+type fakeBucket struct {
+	objects   map[string]*fakeObject
+	uniform   bool
+	lifecycle json.RawMessage
+	metagen   int64
+}
+
+// fakeGCS is the part of the GCS JSON and XML APIs the storage client uses,
+// in memory. The client reaches it through STORAGE_EMULATOR_HOST
+type fakeGCS struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mutex   sync.Mutex
+	buckets map[string]*fakeBucket
+	uploads map[string]*fakeUpload
+	nextID  int
+
+	// Called with the bucket and the name of every object uploaded, a
+	// non-zero status fails the upload with it
+	failUpload func(bucket, name string) int
+
+	// Called with the name of every object uploaded before it's stored
+	onUpload func(name string)
+
+	// Called with the name of every object uploaded or composed, true
+	// flips a bit of the data stored, so its CRC32C isn't the one of the
+	// data sent
+	corrupt func(name string) bool
+
+	// Requests served, of any kind
+	served int
+
+	// Requests served for the objects, as "METHOD name", with READ for the
+	// downloads, UPLOAD, RESUMABLE for the start of the resumable uploads,
+	// COPY and COMPOSE
+	requests []string
+}
+
+// fakeUpload is a resumable upload in progress
+type fakeUpload struct {
+	bucket string
+	object fakeObject
+	data   []byte
+}
+
+// newFakeGCS starts a fake with the buckets given, which the storage
+// clients of the test use until it ends
+func newFakeGCS(t *testing.T, buckets ...string) *fakeGCS {
+	f := &fakeGCS{t: t, buckets: map[string]*fakeBucket{}, uploads: map[string]*fakeUpload{}}
+
+	for _, name := range buckets {
+		f.buckets[name] = &fakeBucket{objects: map[string]*fakeObject{}, metagen: 1}
+	}
+
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	t.Setenv(emulatorHostEnv, f.server.URL)
+
+	return f
+}
+
+// put stores an object directly
+func (f *fakeGCS) put(bucket string, obj fakeObject) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if obj.Created.IsZero() {
+		obj.Created = time.Now()
+	}
+
+	f.nextID++
+	obj.Generation = int64(f.nextID)
+	f.buckets[bucket].objects[obj.Name] = &obj
+}
+
+// object returns a copy of the object name of bucket, or nil
+func (f *fakeGCS) object(bucket, name string) *fakeObject {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	obj, ok := f.buckets[bucket].objects[name]
+
+	if !ok {
+		return nil
+	}
+
+	c := *obj
+
+	return &c
+}
+
+// names returns the sorted names of the objects of bucket under prefix
+func (f *fakeGCS) names(bucket, prefix string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var names []string
+
+	for name := range f.buckets[bucket].objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// count returns how many requests were served for the object name with method
+func (f *fakeGCS) count(method, name string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n := 0
+
+	for _, r := range f.requests {
+		if r == method+" "+name {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (f *fakeGCS) record(method, name string) {
+	f.mutex.Lock()
+	f.requests = append(f.requests, method+" "+name)
+	f.mutex.Unlock()
+}
+
+// fakeCRC32C returns the CRC32C of data as the API encodes it
+func fakeCRC32C(data []byte) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(data, crc32cTable))
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// resource returns the JSON resource of obj in bucket
+func (obj *fakeObject) resource(bucket string) map[string]interface{} {
+	r := map[string]interface{}{
+		"kind":            "storage#object",
+		"name":            obj.Name,
+		"bucket":          bucket,
+		"size":            strconv.Itoa(len(obj.Data)),
+		"crc32c":          fakeCRC32C(obj.Data),
+		"contentType":     obj.ContentType,
+		"contentEncoding": obj.ContentEncoding,
+		"storageClass":    obj.StorageClass,
+		"metadata":        obj.Metadata,
+		"generation":      strconv.FormatInt(obj.Generation, 10),
+		"metageneration":  "1",
+		"timeCreated":     obj.Created.UTC().Format(time.RFC3339Nano),
+		"updated":         obj.Created.UTC().Format(time.RFC3339Nano),
+		"temporaryHold":   obj.TemporaryHold,
+	}
+
+	if obj.RetentionMode != "" {
+		r["retention"] = map[string]interface{}{
+			"mode":            obj.RetentionMode,
+			"retainUntilTime": obj.RetainUntil.UTC().Format(time.RFC3339Nano),
+		}
+	}
+
+	return r
+}
+
+// objectFields are the fields of an object resource sent by the client
+type objectFields struct {
+	Name            string            `json:"name"`
+	ContentType     string            `json:"contentType"`
+	ContentEncoding string            `json:"contentEncoding"`
+	StorageClass    string            `json:"storageClass"`
+	Metadata        map[string]string `json:"metadata"`
+	CRC32C          string            `json:"crc32c"`
+	TemporaryHold   *bool             `json:"temporaryHold"`
+	Retention       *struct {
+		Mode            string `json:"mode"`
+		RetainUntilTime string `json:"retainUntilTime"`
+	} `json:"retention"`
+}
+
+func (o objectFields) object() fakeObject {
+	return fakeObject{
+		Name:            o.Name,
+		ContentType:     o.ContentType,
+		ContentEncoding: o.ContentEncoding,
+		StorageClass:    o.StorageClass,
+		Metadata:        o.Metadata,
+		sentCRC32C:      o.CRC32C,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": http.StatusText(status)},
+	})
+}
+
+// segments splits the escaped path p into its unescaped segments
+func segments(p string) []string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+
+	for i, part := range parts {
+		if s, err := url.PathUnescape(part); err == nil {
+			parts[i] = s
+		}
+	}
+
+	return parts
+}
+
+func (f *fakeGCS) serve(w http.ResponseWriter, r *http.Request) {
+	parts := segments(r.URL.EscapedPath())
+
+	f.mutex.Lock()
+	f.served++
+	f.mutex.Unlock()
+
+	switch {
+	case len(parts) >= 5 && parts[0] == "upload" && parts[1] == "storage":
+		f.serveUpload(w, r, parts[4])
+	case len(parts) >= 3 && parts[0] == "storage" && parts[1] == "v1" && parts[2] == "b":
+		f.serveJSON(w, r, parts[3:])
+	case len(parts) >= 2:
+		f.serveDownload(w, r, parts[0], strings.Join(parts[1:], "/"))
+	default:
+		writeError(w, http.StatusNotFound)
+	}
+}
+
+// serveDownload serves the content of an object, as the XML API does
+func (f *fakeGCS) serveDownload(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	f.record("READ", name)
+
+	f.mutex.Lock()
+	b, ok := f.buckets[bucket]
+	var obj *fakeObject
+
+	if ok {
+		obj = b.objects[name]
+	}
+
+	f.mutex.Unlock()
+
+	if obj == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Objects with a customer-supplied key are only read with it
+	if obj.KeySHA256 != r.Header.Get("X-Goog-Encryption-Key-Sha256") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := obj.Data
+
+	// Gzip objects are decompressed for the clients that don't accept
+	// them compressed, the others are served as stored
+	if obj.ContentEncoding == "gzip" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+	} else if obj.ContentEncoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+
+		if err == nil {
+			data, err = ioutil.ReadAll(zr)
+		}
+
+		if err != nil {
+			writeError(w, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.Generation, 10))
+	w.Header().Set("X-Goog-Hash", "crc32c="+fakeCRC32C(obj.Data))
+
+	if obj.ContentEncoding != "" {
+		w.Header().Set("X-Goog-Stored-Content-Encoding", obj.ContentEncoding)
+	}
+
+	for k, v := range obj.Metadata {
+		w.Header().Set("X-Goog-Meta-"+k, v)
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// serveUpload serves the multipart and resumable uploads
+func (f *fakeGCS) serveUpload(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+
+	if id := q.Get("upload_id"); id != "" {
+		f.serveChunk(w, r, id)
+		return
+	}
+
+	switch q.Get("uploadType") {
+	case "multipart":
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+
+		mr := multipart.NewReader(r.Body, params["boundary"])
+
+		var fields objectFields
+		var data []byte
+
+		for i := 0; ; i++ {
+			part, err := mr.NextPart()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				writeError(w, http.StatusBadRequest)
+				return
+			}
+
+			if i == 0 {
+				err = json.NewDecoder(part).Decode(&fields)
+			} else {
+				if fields.ContentType == "" {
+					fields.ContentType = part.Header.Get("Content-Type")
+				}
+
+				data, err = ioutil.ReadAll(part)
+			}
+
+			if err != nil {
+				writeError(w, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if fields.Name == "" {
+			fields.Name = q.Get("name")
+		}
+
+		obj := fields.object()
+		obj.Data = data
+		obj.KMSKeyName = q.Get("kmsKeyName")
+		obj.PredefinedACL = q.Get("predefinedAcl")
+		obj.KeySHA256 = r.Header.Get("X-Goog-Encryption-Key-Sha256")
+		f.store(w, bucket, obj)
+	case "resumable":
+		var fields objectFields
+
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+
+		if fields.Name == "" {
+			fields.Name = q.Get("name")
+		}
+
+		if fields.ContentType == "" {
+			fields.ContentType = r.Header.Get("X-Upload-Content-Type")
+		}
+
+		f.record("RESUMABLE", fields.Name)
+
+		f.mutex.Lock()
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		obj := fields.object()
+		obj.KMSKeyName = q.Get("kmsKeyName")
+		obj.PredefinedACL = q.Get("predefinedAcl")
+		obj.KeySHA256 = r.Header.Get("X-Goog-Encryption-Key-Sha256")
+		f.uploads[id] = &fakeUpload{bucket: bucket, object: obj}
+		f.mutex.Unlock()
+
+		w.Header().Set("Location", fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s", f.server.URL, bucket, id))
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusBadRequest)
+	}
+}
+
+// serveChunk takes a chunk of a resumable upload, storing the object with
+// the last one
+func (f *fakeGCS) serveChunk(w http.ResponseWriter, r *http.Request, id string) {
+	data, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	upload, ok := f.uploads[id]
+
+	if ok {
+		upload.data = append(upload.data, data...)
+	}
+
+	f.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	// bytes 0-99/*, bytes 100-199/200 or bytes */200
+	total := -1
+	contentRange := r.Header.Get("Content-Range")
+
+	if i := strings.LastIndex(contentRange, "/"); i >= 0 && contentRange[i+1:] != "*" {
+		total, _ = strconv.Atoi(contentRange[i+1:])
+	}
+
+	if total < 0 || len(upload.data) < total {
+		if len(upload.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+		}
+
+		// The clients that ask for it get the 308 of an incomplete
+		// upload as a 200 with the status in a header
+		if r.Header.Get("X-GUploader-No-308") == "yes" {
+			w.Header().Set("X-Http-Status-Code-Override", "308")
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusPermanentRedirect)
+		}
+
+		return
+	}
+
+	f.mutex.Lock()
+	delete(f.uploads, id)
+	f.mutex.Unlock()
+
+	obj := upload.object
+	obj.Data = upload.data
+	f.store(w, upload.bucket, obj)
+}
+
+// store saves obj in bucket and replies with its resource, unless
+// failUpload fails it
+func (f *fakeGCS) store(w http.ResponseWriter, bucket string, obj fakeObject) {
+	f.record("UPLOAD", obj.Name)
+
+	if f.failUpload != nil {
+		if status := f.failUpload(bucket, obj.Name); status != 0 {
+			writeError(w, status)
+			return
+		}
+	}
+
+	if f.onUpload != nil {
+		f.onUpload(obj.Name)
+	}
+
+	if f.corrupt != nil && len(obj.Data) > 0 && f.corrupt(obj.Name) {
+		obj.Data = append([]byte(nil), obj.Data...)
+		obj.Data[0] ^= 1
+	}
+
+	// GCS checks the CRC32C sent with the upload
+	if obj.sentCRC32C != "" && obj.sentCRC32C != fakeCRC32C(obj.Data) {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	f.mutex.Lock()
+	b, ok := f.buckets[bucket]
+	f.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	// Buckets with uniform bucket-level access refuse the ACLs
+	if b.uniform && obj.PredefinedACL != "" {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	f.put(bucket, obj)
+	writeJSON(w, http.StatusOK, f.object(bucket, obj.Name).resource(bucket))
+}
+
+// serveJSON serves the JSON API under /storage/v1/b
+func (f *fakeGCS) serveJSON(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	f.mutex.Lock()
+	b, ok := f.buckets[parts[0]]
+	f.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	bucket := parts[0]
+
+	switch {
+	case len(parts) == 1:
+		f.serveBucket(w, r, bucket, b)
+	case len(parts) == 2 && parts[1] == "o":
+		f.serveList(w, r, bucket)
+	case len(parts) >= 8 && parts[len(parts)-5] == "rewriteTo":
+		f.serveRewrite(w, r, bucket, strings.Join(parts[2:len(parts)-5], "/"), parts[len(parts)-3], parts[len(parts)-1])
+	case len(parts) >= 4 && parts[len(parts)-1] == "compose":
+		f.serveCompose(w, r, bucket, strings.Join(parts[2:len(parts)-1], "/"))
+	case len(parts) >= 3 && parts[1] == "o":
+		f.serveObject(w, r, bucket, strings.Join(parts[2:], "/"))
+	default:
+		writeError(w, http.StatusNotFound)
+	}
+}
+
+func (f *fakeGCS) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, b *fakeBucket) {
+	if r.Method == http.MethodPatch {
+		var update struct {
+			Lifecycle json.RawMessage `json:"lifecycle"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+
+		f.mutex.Lock()
+
+		// The update is lost when the bucket changed since it was read
+		if match := r.URL.Query().Get("ifMetagenerationMatch"); match != "" && match != strconv.FormatInt(b.metagen, 10) {
+			f.mutex.Unlock()
+			writeError(w, http.StatusPreconditionFailed)
+			return
+		}
+
+		b.lifecycle = update.Lifecycle
+		b.metagen++
+		f.mutex.Unlock()
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	resource := map[string]interface{}{
+		"kind":           "storage#bucket",
+		"name":           bucket,
+		"metageneration": strconv.FormatInt(b.metagen, 10),
+		"iamConfiguration": map[string]interface{}{
+			"uniformBucketLevelAccess": map[string]interface{}{"enabled": b.uniform},
+		},
+	}
+
+	if b.lifecycle != nil {
+		resource["lifecycle"] = b.lifecycle
+	}
+
+	writeJSON(w, http.StatusOK, resource)
+}
+
+// serveList lists the objects with prefix, delimiter and matchGlob, in a
+// single page
+func (f *fakeGCS) serveList(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	prefix, delimiter, glob := q.Get("prefix"), q.Get("delimiter"), q.Get("matchGlob")
+
+	items := []interface{}{}
+	prefixes := []string{}
+	seen := map[string]bool{}
+
+	for _, name := range f.names(bucket, prefix) {
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, p)
+				}
+
+				continue
+			}
+		}
+
+		if glob != "" && !matchGlob(glob, name) {
+			continue
+		}
+
+		if obj := f.object(bucket, name); obj != nil {
+			items = append(items, obj.resource(bucket))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#objects", "items": items, "prefixes": prefixes})
+}
+
+// matchGlob matches the globs of the list queries, where * doesn't cross a /
+func matchGlob(glob, name string) bool {
+	ok, _ := path.Match(glob, name)
+	return ok
+}
+
+func (f *fakeGCS) serveObject(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	f.record(r.Method, name)
+
+	obj := f.object(bucket, name)
+
+	if obj == nil {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, obj.resource(bucket))
+	case http.MethodDelete:
+		if gen := r.URL.Query().Get("ifGenerationMatch"); gen != "" && gen != strconv.FormatInt(obj.Generation, 10) {
+			writeError(w, http.StatusPreconditionFailed)
+			return
+		}
+
+		f.mutex.Lock()
+		delete(f.buckets[bucket].objects, name)
+		f.mutex.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var fields objectFields
+
+		if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+			writeError(w, http.StatusBadRequest)
+			return
+		}
+
+		f.mutex.Lock()
+		stored := f.buckets[bucket].objects[name]
+
+		if fields.TemporaryHold != nil {
+			stored.TemporaryHold = *fields.TemporaryHold
+		}
+
+		if fields.Retention != nil {
+			stored.RetentionMode = fields.Retention.Mode
+			stored.RetainUntil, _ = time.Parse(time.RFC3339Nano, fields.Retention.RetainUntilTime)
+		}
+
+		if fields.Metadata != nil {
+			stored.Metadata = fields.Metadata
+		}
+
+		c := *stored
+		f.mutex.Unlock()
+
+		writeJSON(w, http.StatusOK, c.resource(bucket))
+	default:
+		writeError(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// serveRewrite copies src to the object dst of bucket dstBucket in one go
+func (f *fakeGCS) serveRewrite(w http.ResponseWriter, r *http.Request, bucket, src, dstBucket, dst string) {
+	f.record("COPY", dst)
+
+	obj := f.object(bucket, src)
+
+	if obj == nil {
+		writeError(w, http.StatusNotFound)
+		return
+	}
+
+	var fields objectFields
+
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	copied := *obj
+	copied.Name = dst
+	copied.Created = time.Time{}
+	copied.TemporaryHold, copied.RetentionMode = false, ""
+
+	if fields.Metadata != nil {
+		copied.Metadata = fields.Metadata
+	}
+
+	if fields.ContentType != "" {
+		copied.ContentType = fields.ContentType
+	}
+
+	if fields.StorageClass != "" {
+		copied.StorageClass = fields.StorageClass
+	}
+
+	copied.ContentEncoding = fields.ContentEncoding
+	f.put(dstBucket, copied)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"done":                true,
+		"objectSize":          strconv.Itoa(len(copied.Data)),
+		"totalBytesRewritten": strconv.Itoa(len(copied.Data)),
+		"resource":            f.object(dstBucket, dst).resource(dstBucket),
+	})
+}
+
+// serveCompose concatenates the sources into dst
+func (f *fakeGCS) serveCompose(w http.ResponseWriter, r *http.Request, bucket, dst string) {
+	f.record("COMPOSE", dst)
+
+	var req struct {
+		Destination   objectFields `json:"destination"`
+		SourceObjects []struct {
+			Name string `json:"name"`
+		} `json:"sourceObjects"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	composed := req.Destination.object()
+	composed.Name = dst
+
+	for _, src := range req.SourceObjects {
+		obj := f.object(bucket, src.Name)
+
+		if obj == nil {
+			writeError(w, http.StatusNotFound)
+			return
+		}
+
+		composed.Data = append(composed.Data, obj.Data...)
+	}
+
+	if f.corrupt != nil && len(composed.Data) > 0 && f.corrupt(dst) {
+		composed.Data[0] ^= 1
+	}
+
+	if composed.sentCRC32C != "" && composed.sentCRC32C != fakeCRC32C(composed.Data) {
+		writeError(w, http.StatusBadRequest)
+		return
+	}
+
+	f.put(bucket, composed)
+	writeJSON(w, http.StatusOK, f.object(bucket, dst).resource(bucket))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the files with the ignore rules of their directory
+const ignoreFileName = ".gcsbackupignore"
+
+// ignoreRule is one line of an ignore file, with the semantics of
+// .gitignore
+type ignoreRule struct {
+	// Directory of the ignore file, relative to the walked directory
+	base    string
+	pattern string
+	negate  bool
+	dirOnly bool
+	// Matched against the path from base instead of the name at any depth
+	anchored bool
+}
+
+// parseIgnoreLine returns the rule of a line of the ignore file in the
+// directory base, or false for blank lines and comments
+func parseIgnoreLine(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate, line = true, line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+
+	// A slash at the start or in the middle anchors the pattern
+	if strings.Contains(line, "/") {
+		rule.anchored, line = true, strings.TrimLeft(line, "/")
+	}
+
+	rule.pattern = line
+
+	return rule, line != ""
+}
+
+// readIgnoreFile returns the rules of the ignore file of the directory dir,
+// found at base relative to the walked directory, or none when it has no
+// ignore file
+func readIgnoreFile(dir, base string) ([]ignoreRule, error) {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreLine(base, scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// ignored reports whether the slash separated path rel, relative to the
+// walked directory, is ignored by rules, the rules of its parent
+// directories from the top. The last rule that matches wins, so deeper
+// ignore files override the ones above them
+func ignored(rules []ignoreRule, rel string, isDir bool) bool {
+	result := false
+
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		sub := rel
+
+		// Rules only apply below the directory of their ignore file
+		if rule.base != "." {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+
+			sub = rel[len(rule.base)+1:]
+		}
+
+		var match bool
+
+		if rule.anchored {
+			match = matchSegments(strings.Split(rule.pattern, "/"), strings.Split(sub, "/"))
+		} else {
+			match, _ = path.Match(rule.pattern, path.Base(sub))
+		}
+
+		if match {
+			result = !rule.negate
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ignoreRule
+		ok   bool
+	}{
+		{"", ignoreRule{}, false},
+		{"   ", ignoreRule{}, false},
+		{"# a comment", ignoreRule{}, false},
+		{"*.log", ignoreRule{base: "sub", pattern: "*.log"}, true},
+		{"*.log  ", ignoreRule{base: "sub", pattern: "*.log"}, true},
+		{"!keep.log", ignoreRule{base: "sub", pattern: "keep.log", negate: true}, true},
+		{"cache/", ignoreRule{base: "sub", pattern: "cache", dirOnly: true}, true},
+		{"/build", ignoreRule{base: "sub", pattern: "build", anchored: true}, true},
+		{"docs/*.pdf", ignoreRule{base: "sub", pattern: "docs/*.pdf", anchored: true}, true},
+		{`\#hash`, ignoreRule{base: "sub", pattern: "#hash"}, true},
+		{`\!bang`, ignoreRule{base: "sub", pattern: "!bang"}, true},
+		{"/", ignoreRule{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseIgnoreLine("sub", test.line)
+
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("parseIgnoreLine(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	rule := func(base, line string) ignoreRule {
+		r, _ := parseIgnoreLine(base, line)
+		return r
+	}
+
+	rules := []ignoreRule{
+		rule(".", "*.log"),
+		rule(".", "tmp/"),
+		rule(".", "/secret.txt"),
+		rule("app", "!keep.log"),
+		rule("app", "/build"),
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"error.log", false, true},
+		{"deep/down/error.log", false, true},
+		{"app/keep.log", false, false},
+		{"app/sub/keep.log", false, false},
+		{"other/keep.log", false, true},
+		{"tmp", true, true},
+		{"app/tmp", true, true},
+		{"tmp", false, false},
+		{"secret.txt", false, true},
+		{"app/secret.txt", false, false},
+		{"app/build", true, true},
+		{"app/sub/build", true, false},
+		{"build", true, false},
+		{"main.go", false, false},
+	}
+
+	for _, test := range tests {
+		if got := ignored(rules, test.rel, test.isDir); got != test.want {
+			t.Errorf("ignored(%q, dir %v) = %v, want %v", test.rel, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreFilesInTheWalk(t *testing.T) {
+	dir := t.TempDir()
+
+	makeTree(t, dir,
+		"main.go", "debug.log", "notes.txt",
+		"node_modules/pkg/index.js",
+		"app/app.go", "app/app.log", "app/keep.log",
+		"app/cache/blob", "app/tmp/scratch",
+		"app/lib/lib.go", "app/lib/lib.log", "app/lib/generated.go",
+		"docs/guide.md", "docs/cache/page.html",
+	)
+
+	ignores := map[string]string{
+		".":       "# top level\n*.log\nnode_modules/\ncache/\n",
+		"app":     "!keep.log\n/tmp/\n",
+		"app/lib": "generated.go\n!*.log\n",
+	}
+
+	for sub, content := range ignores {
+		if err := ioutil.WriteFile(filepath.Join(dir, sub, ignoreFileName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := walkedFiles(t, dir, backupConf(dir))
+
+	// Ignore files are backed up like any other file
+	want := []string{
+		".gcsbackupignore",
+		"app/.gcsbackupignore", "app/app.go", "app/keep.log",
+		"app/lib/.gcsbackupignore", "app/lib/lib.go", "app/lib/lib.log",
+		"docs/guide.md",
+		"main.go", "notes.txt",
+	}
+
+	if !equalStrings(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
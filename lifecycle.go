@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// LifecycleConfig is the lifecycle rules every GCS destination is given at
+// the start of a backup, so the bucket enforces the retention itself. The
+// rules only match the objects under basePrefix when it's set
+type LifecycleConfig struct {
+	// Objects older than this are deleted, 0 means never
+	DeleteAfterDays int `yaml:"deleteAfterDays"`
+	// Objects older than this move to transitionClass, COLDLINE by default
+	TransitionAfterDays int    `yaml:"transitionAfterDays"`
+	TransitionClass     string `yaml:"transitionClass"`
+}
+
+// lifecycleRules returns the rules of conf.BucketLifecycle
+func lifecycleRules() []storage.LifecycleRule {
+	var rules []storage.LifecycleRule
+	var prefixes []string
+
+	if conf.BasePrefix != "" {
+		prefixes = []string{conf.BasePrefix + "/"}
+	}
+
+	l := conf.BucketLifecycle
+
+	if l.TransitionAfterDays > 0 {
+		rules = append(rules, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: l.TransitionClass},
+			Condition: storage.LifecycleCondition{AgeInDays: int64(l.TransitionAfterDays), MatchesPrefix: prefixes},
+		})
+	}
+
+	if l.DeleteAfterDays > 0 {
+		rules = append(rules, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: int64(l.DeleteAfterDays), MatchesPrefix: prefixes},
+		})
+	}
+
+	return rules
+}
+
+// sameRule reports whether the rule a of the bucket is the rule b, in the
+// settings lifecycleRules uses
+func sameRule(a, b storage.LifecycleRule) bool {
+	return a.Action.Type == b.Action.Type &&
+		strings.EqualFold(a.Action.StorageClass, b.Action.StorageClass) &&
+		a.Condition.AgeInDays == b.Condition.AgeInDays &&
+		strings.Join(a.Condition.MatchesPrefix, "\n") == strings.Join(b.Condition.MatchesPrefix, "\n") &&
+		len(a.Condition.MatchesSuffix) == 0 && len(a.Condition.MatchesStorageClasses) == 0
+}
+
+// missingRules returns the rules of desired that current doesn't have
+func missingRules(current, desired []storage.LifecycleRule) []storage.LifecycleRule {
+	var missing []storage.LifecycleRule
+
+	for _, rule := range desired {
+		found := false
+
+		for _, c := range current {
+			if sameRule(c, rule) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, rule)
+		}
+	}
+
+	return missing
+}
+
+// describeRule returns rule as shown in the log
+func describeRule(rule storage.LifecycleRule) string {
+	action := "delete"
+
+	if rule.Action.Type == storage.SetStorageClassAction {
+		action = "move to " + rule.Action.StorageClass
+	}
+
+	s := fmt.Sprintf("%s after %d days", action, rule.Condition.AgeInDays)
+
+	if len(rule.Condition.MatchesPrefix) > 0 {
+		s += fmt.Sprintf(" under \"%s\"", rule.Condition.MatchesPrefix[0])
+	}
+
+	return s
+}
+
+// applyLifecycle adds the rules of conf.BucketLifecycle the bucket of b
+// doesn't have yet, keeping its other rules. The update only goes through
+// when nobody changed the bucket since it was read
+func (b *bucketClient) applyLifecycle(ctx context.Context) error {
+	desired := lifecycleRules()
+
+	if len(desired) == 0 || b.bucket == nil {
+		return nil
+	}
+
+	attrs, err := b.bucket.Attrs(ctx)
+
+	if err != nil {
+		return fmt.Errorf("Bucket.Attrs: %w", err)
+	}
+
+	missing := missingRules(attrs.Lifecycle.Rules, desired)
+
+	if len(missing) == 0 {
+		logDebug("Bucket \"%s\" has the lifecycle rules already", b.NameBucket)
+		return nil
+	}
+
+	rules := append(attrs.Lifecycle.Rules[:len(attrs.Lifecycle.Rules):len(attrs.Lifecycle.Rules)], missing...)
+	bucket := b.bucket.If(storage.BucketConditions{MetagenerationMatch: attrs.MetaGeneration})
+
+	if _, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &storage.Lifecycle{Rules: rules}}); err != nil {
+		return fmt.Errorf("Bucket.Update: %w", err)
+	}
+
+	for _, rule := range missing {
+		logInfo("Added the lifecycle rule \"%s\" to bucket \"%s\"", describeRule(rule), b.NameBucket)
+	}
+
+	return nil
+}
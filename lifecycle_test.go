@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestMissingRules(t *testing.T) {
+	deleteRule := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{AgeInDays: 30},
+	}
+
+	coldline := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+		Condition: storage.LifecycleCondition{AgeInDays: 7},
+	}
+
+	withPrefix := deleteRule
+	withPrefix.Condition.MatchesPrefix = []string{"backups/"}
+
+	withSuffix := deleteRule
+	withSuffix.Condition.MatchesSuffix = []string{".log"}
+
+	lowercase := coldline
+	lowercase.Action.StorageClass = "coldline"
+
+	tests := []struct {
+		name    string
+		current []storage.LifecycleRule
+		want    int
+	}{
+		{"no rules", nil, 2},
+		{"both rules", []storage.LifecycleRule{coldline, deleteRule}, 0},
+		{"one of them", []storage.LifecycleRule{deleteRule}, 1},
+		{"the class in another case", []storage.LifecycleRule{lowercase, deleteRule}, 0},
+		{"only under a prefix", []storage.LifecycleRule{withPrefix, coldline}, 1},
+		{"only for a suffix", []storage.LifecycleRule{withSuffix, coldline}, 1},
+	}
+
+	for _, test := range tests {
+		if got := missingRules(test.current, []storage.LifecycleRule{coldline, deleteRule}); len(got) != test.want {
+			t.Errorf("%s: %d rules missing, want %d", test.name, len(got), test.want)
+		}
+	}
+}
+
+// bucketRules returns the lifecycle rules of bucket in f
+func bucketRules(t *testing.T, f *fakeGCS, bucket string) []map[string]interface{} {
+	t.Helper()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var lifecycle struct {
+		Rule []map[string]interface{} `json:"rule"`
+	}
+
+	if f.buckets[bucket].lifecycle == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(f.buckets[bucket].lifecycle, &lifecycle); err != nil {
+		t.Fatal(err)
+	}
+
+	return lifecycle.Rule
+}
+
+func TestApplyLifecycle(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeGCS(t, testBucket)
+
+	// A rule of its own the bucket keeps
+	f.buckets[testBucket].lifecycle = json.RawMessage(`{"rule":[{"action":{"type":"Delete"},"condition":{"age":365,"matchesPrefix":["logs/"]}}]}`)
+	metagen := f.buckets[testBucket].metagen
+
+	loadTestConf(t, backupConf(t.TempDir(), "basePrefix: backups", "bucketLifecycle:\n  deleteAfterDays: 30\n  transitionAfterDays: 7"))
+
+	dest := newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	if err := dest.applyLifecycle(ctx); err != nil {
+		t.Fatalf("applyLifecycle: %v", err)
+	}
+
+	rules := bucketRules(t, f, testBucket)
+
+	if len(rules) != 3 {
+		t.Fatalf("rules %v, want the one of the bucket and 2 more", rules)
+	}
+
+	for _, rule := range rules[1:] {
+		condition := rule["condition"].(map[string]interface{})
+
+		if prefixes, _ := condition["matchesPrefix"].([]interface{}); len(prefixes) != 1 || prefixes[0] != "backups/" {
+			t.Errorf("rule %v not under the base prefix", rule)
+		}
+	}
+
+	// Once they're there the bucket isn't updated again
+	if err := dest.applyLifecycle(ctx); err != nil {
+		t.Fatalf("applyLifecycle again: %v", err)
+	}
+
+	if updates := f.buckets[testBucket].metagen - metagen; updates != 1 || len(bucketRules(t, f, testBucket)) != 3 {
+		t.Errorf("bucket updated %d times, want once", updates)
+	}
+
+	// Nor without rules
+	loadTestConf(t, backupConf(t.TempDir()))
+
+	dest = newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	if err := dest.applyLifecycle(ctx); err != nil || f.buckets[testBucket].metagen != metagen+1 {
+		t.Errorf("applyLifecycle without rules = %v, with %d updates", err, f.buckets[testBucket].metagen-metagen)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// listRow describes one backup, or one object when listing a single backup
+type listRow struct {
+	Name    string
+	Objects int
+	Bytes   int64
+	Created time.Time
+}
+
+// listRows groups the objects under prefix by their first path segment
+// below it, or returns one row per object when objects is set. Created is
+// the creation time of the earliest object of the row
+func listRows(ctx context.Context, bucket *storage.BucketHandle, prefix string, objects bool) ([]listRow, error) {
+	rows := map[string]*listRow{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	for {
+		attrs, err := it.Next()
+
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(attrs.Name, prefix)
+
+		if !objects {
+			name = strings.SplitN(name, "/", 2)[0]
+		}
+
+		row, ok := rows[name]
+
+		if !ok {
+			row = &listRow{Name: name, Created: attrs.Created}
+			rows[name] = row
+		}
+
+		row.Objects++
+		row.Bytes += attrs.Size
+
+		if attrs.Created.Before(row.Created) {
+			row.Created = attrs.Created
+		}
+	}
+
+	sorted := make([]listRow, 0, len(rows))
+
+	for _, row := range rows {
+		sorted = append(sorted, *row)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted, nil
+}
+
+// listBackupsTable prints the backups of the first destination with their
+// object count, size and creation time, or the objects of the backup
+// restorePrefix when given, and returns the number of errors
+func listBackupsTable(ctx context.Context) int {
+	dest := newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	prefix := withBasePrefix("")
+
+	if restorePrefix != "" {
+		prefix = strings.TrimSuffix(restorePrefix, "/") + "/"
+	}
+
+	rows, err := listRows(ctx, dest.bucket, prefix, restorePrefix != "")
+
+	if err != nil {
+		logError("Listing objects: %s", err)
+		return 1
+	}
+
+	if logFormat == "json" {
+		for _, row := range rows {
+			writeEntry(os.Stdout, logEntry{
+				Time:  time.Now().Format(time.RFC3339),
+				Level: levelNames[levelInfo][1],
+				Msg:   prefix + row.Name,
+				Summary: map[string]interface{}{
+					"name":    prefix + row.Name,
+					"objects": row.Objects,
+					"bytes":   row.Bytes,
+					"created": row.Created.Format(time.RFC3339),
+				},
+			})
+		}
+
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "PREFIX"
+
+	if restorePrefix != "" {
+		header = "OBJECT"
+	}
+
+	fmt.Fprintf(w, "%s\tOBJECTS\tSIZE\tCREATED\n", header)
+
+	var objects int
+	var size int64
+
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", prefix+row.Name, row.Objects, humanBytes(row.Bytes), row.Created.Local().Format(time.RFC3339))
+
+		objects += row.Objects
+		size += row.Bytes
+	}
+
+	fmt.Fprintf(w, "TOTAL\t%d\t%s\t\n", objects, humanBytes(size))
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	w.Flush()
+
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putLayout stores two backups of testBucket under base, the first with
+// objects created a minute apart
+func putLayout(f *fakeGCS, base string, created time.Time) {
+	f.put(testBucket, fakeObject{Name: base + "2024-01-01_00-00-00/a.txt", Data: make([]byte, 100), Created: created.Add(time.Minute)})
+	f.put(testBucket, fakeObject{Name: base + "2024-01-01_00-00-00/sub/b.txt", Data: make([]byte, 2000), Created: created})
+	f.put(testBucket, fakeObject{Name: base + "2024-01-02_00-00-00/a.txt", Data: make([]byte, 1<<20), Created: created.Add(24 * time.Hour)})
+}
+
+func TestListRows(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	created := time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC)
+
+	putLayout(f, "", created)
+	f.put(testBucket, fakeObject{Name: "other/2024-01-03_00-00-00/c.txt", Data: []byte("c"), Created: created})
+
+	loadTestConf(t, backupConf(t.TempDir()))
+
+	dest := newClient(context.Background(), conf.GoogleCloud[0])
+	defer dest.Close()
+
+	rows, err := listRows(context.Background(), dest.bucket, "2024-", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []listRow{
+		{"01-01_00-00-00", 2, 2100, created},
+		{"01-02_00-00-00", 1, 1 << 20, created.Add(24 * time.Hour)},
+	}
+
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %+v, want %+v", rows, want)
+	}
+
+	for i, row := range rows {
+		if row.Name != want[i].Name || row.Objects != want[i].Objects || row.Bytes != want[i].Bytes || !row.Created.Equal(want[i].Created) {
+			t.Errorf("row %d = %+v, want %+v", i, row, want[i])
+		}
+	}
+
+	// The objects of a single backup
+	rows, err = listRows(context.Background(), dest.bucket, "2024-01-01_00-00-00/", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0].Name != "a.txt" || rows[1].Name != "sub/b.txt" || rows[1].Bytes != 2000 {
+		t.Errorf("objects = %+v", rows)
+	}
+}
+
+func TestListBackupsTable(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	created := time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC)
+
+	putLayout(f, "web-1/", created)
+
+	loadTestConf(t, backupConf(t.TempDir(), "basePrefix: web-1"))
+
+	logFormat = "json"
+	runLog = new(bytes.Buffer)
+
+	if errs := listBackupsTable(context.Background()); errs != 0 {
+		t.Fatalf("listBackupsTable = %d errors, want 0", errs)
+	}
+
+	var names []string
+
+	for _, entry := range logLines(t) {
+		row := entry["summary"].(map[string]interface{})
+		names = append(names, row["name"].(string))
+
+		if row["name"] == "web-1/2024-01-01_00-00-00" && (row["objects"] != 2.0 || row["bytes"] != 2100.0 || row["created"] != created.Format(time.RFC3339)) {
+			t.Errorf("row = %v", row)
+		}
+	}
+
+	if want := []string{"web-1/2024-01-01_00-00-00", "web-1/2024-01-02_00-00-00"}; !equalStrings(names, want) {
+		t.Errorf("backups = %v, want %v", names, want)
+	}
+
+	// The objects of the backup given by -prefix in a table
+	logFormat = "text"
+	restorePrefix = "web-1/2024-01-01_00-00-00"
+
+	var errs int
+
+	table := captureStdout(t, func() {
+		errs = listBackupsTable(context.Background())
+	})
+
+	if errs != 0 {
+		t.Fatalf("listBackupsTable -prefix = %d errors, want 0", errs)
+	}
+
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "OBJECT") || !strings.HasPrefix(lines[2], restorePrefix+"/sub/b.txt") || !strings.HasPrefix(lines[3], "TOTAL") {
+		t.Fatalf("table =\n%s", table)
+	}
+
+	if fields := strings.Fields(lines[3]); fields[1] != "2" || fields[2] != "2.1" {
+		t.Errorf("total = %q, want 2 objects of 2.1 KiB", lines[3])
+	}
+}
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	return captureOutput(t, &os.Stdout, fn)
+}
+
+// captureOutput returns what fn writes to the file *f, stdout or stderr
+func captureOutput(t *testing.T, f **os.File, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := *f
+	*f = w
+
+	out := make(chan string)
+
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+
+	fn()
+
+	*f = saved
+	w.Close()
+
+	return <-out
+}
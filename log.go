@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelOK
+	levelWarning
+	levelError
+)
+
+// Prefix of each level in text format and its name in json format
+var levelNames = map[logLevel][2]string{
+	levelDebug:   {"DEBUG", "debug"},
+	levelInfo:    {"INFO", "info"},
+	levelOK:      {"OK", "info"},
+	levelWarning: {"WARNING", "warning"},
+	levelError:   {"ERROR", "error"},
+}
+
+// logFields are the machine readable details of a message
+type logFields struct {
+	File   string `json:"file,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Object string `json:"object,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type logEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	logFields
+	Summary map[string]interface{} `json:"summary,omitempty"`
+}
+
+// summaryField is one counter of the summary printed at the end of a run
+type summaryField struct {
+	Label string // Shown in text format
+	Key   string // Key in json format
+	Value interface{}
+}
+
+// destinationSummary holds the counters of one destination of a run
+type destinationSummary struct {
+	Bucket      string `json:"bucket"`
+	FilesCopied int    `json:"filesCopied"`
+	FilesError  int    `json:"filesError"`
+}
+
+var (
+	// "text" or "json"
+	logFormat string
+
+	// Messages below this level are dropped, set by -quiet and -verbose
+	logThreshold = levelInfo
+
+	// Set while a progress line is drawn in the terminal
+	clearLine bool
+
+	// Copy of every line printed during a backup, uploaded as runLogName
+	// when runLog is enabled. Guarded by logMutex
+	runLog *bytes.Buffer
+
+	logMutex sync.Mutex
+)
+
+// Name of the log of the run under the backup prefix
+const runLogName = "run.log"
+
+// emit writes s, with the secrets masked, to w and to runLog. The caller
+// holds logMutex
+func emit(w io.Writer, s []byte) {
+	s = redact(s)
+	w.Write(s)
+
+	if runLog != nil {
+		runLog.Write(s)
+	}
+}
+
+// logOutput returns where the messages of level go: the warnings and the
+// errors to stderr, so 2>errors.log keeps only the problems, and the rest
+// with the summary to stdout
+func logOutput(level logLevel) io.Writer {
+	// stdout holds the plan
+	if level >= levelWarning || planOnly {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+func writeEntry(w io.Writer, entry logEntry) {
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":"encoding log entry: %s"}`, err))
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	emit(w, append(line, '\n'))
+}
+
+// logEvent prints msg at level. In text format the fields are expected to
+// be part of msg already, in json format they are separate keys
+func logEvent(level logLevel, fields logFields, msg string) {
+	if level < logThreshold {
+		return
+	}
+
+	w := logOutput(level)
+
+	if logFormat != "json" {
+		logMutex.Lock()
+		defer logMutex.Unlock()
+
+		if clearLine {
+			fmt.Fprint(os.Stdout, "\r\033[K")
+		}
+
+		emit(w, []byte(fmt.Sprintf("[%s] %s\n", levelNames[level][0], msg)))
+		return
+	}
+
+	writeEntry(w, logEntry{
+		Time:      time.Now().Format(time.RFC3339),
+		Level:     levelNames[level][1],
+		Msg:       msg,
+		logFields: fields,
+	})
+}
+
+func logDebug(format string, args ...interface{}) {
+	logEvent(levelDebug, logFields{}, fmt.Sprintf(format, args...))
+}
+
+func logInfo(format string, args ...interface{}) {
+	logEvent(levelInfo, logFields{}, fmt.Sprintf(format, args...))
+}
+
+func logWarning(format string, args ...interface{}) {
+	logEvent(levelWarning, logFields{}, fmt.Sprintf(format, args...))
+}
+
+func logError(format string, args ...interface{}) {
+	logEvent(levelError, logFields{}, fmt.Sprintf(format, args...))
+}
+
+// logSummary prints the summary of a run, one line per field in text format
+// or a single entry in json format, followed by the counters of each
+// destination when given
+func logSummary(msg string, fields []summaryField, dests []destinationSummary) {
+	if logFormat != "json" {
+		var b strings.Builder
+
+		fmt.Fprintf(&b, "\n\n%s\n", versionString())
+
+		for _, f := range fields {
+			fmt.Fprintf(&b, "%s: %v \n", f.Label, f.Value)
+		}
+
+		for _, d := range dests {
+			fmt.Fprintf(&b, "Bucket %s: %d copied, %d with errors \n", d.Bucket, d.FilesCopied, d.FilesError)
+		}
+
+		logMutex.Lock()
+		defer logMutex.Unlock()
+
+		emit(os.Stdout, []byte(b.String()))
+		return
+	}
+
+	summary := map[string]interface{}{"version": version}
+
+	for _, f := range fields {
+		summary[f.Key] = f.Value
+	}
+
+	if len(dests) > 0 {
+		summary["destinations"] = dests
+	}
+
+	writeEntry(os.Stdout, logEntry{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   levelNames[levelInfo][1],
+		Msg:     msg,
+		Summary: summary,
+	})
+}
+
+// writeRunLog uploads the lines printed so far to <pathBase>/run.log. It
+// does nothing unless runLog is enabled
+func writeRunLog(ctx context.Context, dest *bucketClient, pathBase string) error {
+	logMutex.Lock()
+
+	if runLog == nil {
+		logMutex.Unlock()
+		return nil
+	}
+
+	data := append([]byte(nil), runLog.Bytes()...)
+	logMutex.Unlock()
+
+	opts := dest.objectOptions()
+	opts.ContentType = "text/plain"
+
+	_, err := dest.backend.Upload(ctx, pathBase+"/"+runLogName, bytes.NewReader(data), opts)
+
+	return err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// logLines decodes the lines of runLog written in json format
+func logLines(t *testing.T) []map[string]interface{} {
+	t.Helper()
+
+	var lines []map[string]interface{}
+
+	for _, line := range strings.Split(strings.TrimSpace(runLog.String()), "\n") {
+		var entry map[string]interface{}
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+
+		lines = append(lines, entry)
+	}
+
+	return lines
+}
+
+func TestJSONLogEvents(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	logFormat = "json"
+	logThreshold = levelInfo
+	runLog = new(bytes.Buffer)
+
+	copyFiles(context.Background())
+
+	var ok, failed, summary map[string]interface{}
+
+	for _, entry := range logLines(t) {
+		for _, key := range []string{"time", "level", "msg"} {
+			if _, found := entry[key]; !found {
+				t.Errorf("entry %v without %s", entry, key)
+			}
+		}
+
+		switch {
+		case entry["file"] == files[0] && entry["level"] == "info" && entry["object"] != nil:
+			ok = entry
+		case entry["file"] == files[1] && entry["level"] == "error":
+			failed = entry
+		case entry["summary"] != nil:
+			summary = entry
+		}
+	}
+
+	if ok == nil {
+		t.Error("no event for the file copied")
+	} else if !strings.HasSuffix(ok["object"].(string), absoluteObjectPath(files[0])) || ok["error"] != nil {
+		t.Errorf("event of the file copied = %v", ok)
+	}
+
+	if failed == nil {
+		t.Error("no error event for the file that failed")
+	} else if failed["object"] == nil || !strings.Contains(failed["error"].(string), "403") {
+		t.Errorf("event of the file that failed = %v", failed)
+	}
+
+	if summary == nil {
+		t.Fatal("no summary")
+	}
+
+	fields := summary["summary"].(map[string]interface{})
+
+	if fields["filesCopied"] != 1.0 || fields["filesError"] != 1.0 || fields["version"] != version {
+		t.Errorf("summary = %v", fields)
+	}
+}
+
+func TestQuietAndVerbose(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	tests := []struct {
+		flag    string
+		want    []string
+		notWant []string
+	}{
+		{"-quiet", []string{"[ERROR]", "Total files with errors: 1"}, []string{"[OK]", "[INFO]", "[DEBUG]"}},
+		{"", []string{"[OK]", "[ERROR]", "Total files with errors: 1"}, []string{"[DEBUG]"}},
+		{"-verbose", []string{"[DEBUG]", "[OK]", "[ERROR]", "Total files with errors: 1"}, nil},
+	}
+
+	for _, test := range tests {
+		// A state of its own, the runs can get the same prefix
+		if err := parseTestConf(t, backupConf(dir)); err != nil {
+			t.Fatal(err)
+		}
+
+		args := []string{"-config", fileConf}
+
+		if test.flag != "" {
+			args = append(args, test.flag)
+		}
+
+		out, code := runMain(t, args...)
+
+		if code != 2 {
+			t.Errorf("%q: exit status %d, want 2: %s", test.flag, code, out)
+		}
+
+		for _, want := range test.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%q: output without %q:\n%s", test.flag, want, out)
+			}
+		}
+
+		for _, notWant := range test.notWant {
+			if strings.Contains(out, notWant) {
+				t.Errorf("%q: output with %q:\n%s", test.flag, notWant, out)
+			}
+		}
+	}
+
+	if out, code := runMain(t, "-config", fileConf, "-quiet", "-verbose"); code != 1 || !strings.Contains(out, "can't be used together") {
+		t.Errorf("-quiet -verbose exited with %d: %s", code, out)
+	}
+}
+
+func TestRunLogObject(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		files := writeFiles(t, dir, 3)
+
+		f.failUpload = func(bucket, name string) int {
+			if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+				return 403
+			}
+
+			return 0
+		}
+
+		if err := parseTestConf(t, backupConf(dir, fmt.Sprintf("runLog: %v", enabled))); err != nil {
+			t.Fatal(err)
+		}
+
+		if out, code := runMain(t, "-config", fileConf); code != 2 {
+			t.Fatalf("exit status %d, want 2: %s", code, out)
+		}
+
+		prefix := backupPrefixOf(f, testBucket)
+		obj := f.object(testBucket, prefix+"/"+runLogName)
+
+		if !enabled {
+			if obj != nil {
+				t.Errorf("%s written without runLog", runLogName)
+			}
+
+			continue
+		}
+
+		if obj == nil {
+			t.Fatalf("no %s", runLogName)
+		}
+
+		want := []string{
+			"[OK] File \"" + prefix + "/" + absoluteObjectPath(files[0]) + "\" copied successfully",
+			"[ERROR] File \"" + files[1] + "\"",
+			"Total files copied: 2",
+			"Total files with errors: 1",
+		}
+
+		for _, line := range want {
+			if !bytes.Contains(obj.Data, []byte(line)) {
+				t.Errorf("%s without %q:\n%s", runLogName, line, obj.Data)
+			}
+		}
+	}
+}
+
+func TestLogStreams(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	yaml := fmt.Sprintf("directories:\n  - %q\n  - %q\ngoogleCloud:\n  nameBucket: %s\n", dir, missing, testBucket)
+
+	if err := parseTestConf(t, yaml); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr, code := runMainStreams(t, "-config", fileConf)
+
+	if code != 2 {
+		t.Fatalf("exit status %d, want 2:\n%s%s", code, stdout, stderr)
+	}
+
+	// Only the problems in stderr, everything else in stdout
+	for _, want := range []string{"[OK]", "[INFO]", "Total files with errors: 1"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout without %q:\n%s", want, stdout)
+		}
+
+		if strings.Contains(stderr, want) {
+			t.Errorf("stderr with %q:\n%s", want, stderr)
+		}
+	}
+
+	for _, want := range []string{"[ERROR]", "[WARNING]", files[1], "Dir \"" + missing + "\" not found"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("stderr without %q:\n%s", want, stderr)
+		}
+	}
+
+	for _, notWant := range []string{"[ERROR]", "[WARNING]"} {
+		if strings.Contains(stdout, notWant) {
+			t.Errorf("stdout with %q:\n%s", notWant, stdout)
+		}
+	}
+}
@@ -1,257 +1,2526 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"math"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
-	"google.golang.org/api/option"
-	"gopkg.in/yaml.v2"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
 )
 
-type Configuration struct {
-	Directories []string `yaml:"directories"`
-	GoogleCloud struct {
-		NameBucket  string `yaml:"nameBucket"`
-		PathJSONKey string `yaml:"pathJsonKey"`
-	} `yaml:"googleCloud"`
-}
+// Modes of the retention set by holdUntil
+const (
+	retentionUnlocked = "Unlocked"
+	retentionLocked   = "Locked"
+)
+
+// Prefix used instead of the timestamp by incremental backups, so unchanged
+// files can be found again by the next run
+const incrementalPrefix = "incremental"
+
+// Symlink policies
+const (
+	symlinksSkip   = "skip"
+	symlinksFollow = "follow"
+	symlinksRecord = "record"
+)
+
+// How object paths are derived from the local paths
+const (
+	pathModeAbsolute = "absolute"
+	pathModeRelative = "relative"
+	pathModeFlatten  = "flatten"
+)
+
+// What happens to the entries of directories that are files
+const (
+	fileEntriesBackup = "backup"
+	fileEntriesSkip   = "skip"
+)
+
+// What happens when two files would get the same object path
+const (
+	collisionError  = "error"
+	collisionSkip   = "skip"
+	collisionSuffix = "suffix"
+)
+
+// Returned by objectPath for a file found again through another directory
+var errAlreadyQueued = errors.New("already queued")
+
+// Returned by objectPath for a file whose object path is taken, with the
+// skip collision strategy
+var errCollisionSkipped = errors.New("skipped")
+
+// Environment variable with the service account key as inline JSON
+const credentialsJSONEnv = "GOOGLE_APPLICATION_CREDENTIALS_JSON"
+
+// Environment variable with the identifier of the host the backups come
+// from, which takes precedence over sourceHost
+const sourceHostEnv = "GCS_BACKUP_SOURCE_HOST"
+
+// Layout of the timestamp used as prefix for every object of a backup,
+// unless timestampFormat is set
+const pathBaseLayout = "2006-01-02_15-04-05"
+
+// Time zone of the timestamp prefixes and the {date} and {time}
+// placeholders, set by validateConf
+var prefixLocation = time.Local
+
+// Files the walk can get ahead of the upload workers by default. The walk
+// waits for them when they fall that far behind
+const defaultQueueSize = 4096
+
+// Directories walked at the same time
+const walkers = 4
+
+// Longest wait between two attempts of an upload, and most retries allowed
+const (
+	maxBackoff    = 30 * time.Second
+	maxRetryLimit = 100
+)
+
+// Build information, set with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
 
 var (
-	fileConf         string
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errFileChanged      = errors.New("file changed during the upload")
+)
+
+var (
+	fileConf          string
+	configDir         string
+	failFast          bool
+	concurrency       int
+	autoConcurrency   bool
+	queueSize         int
+	includeFrom       string
+	onlyDirs          dirList
+	onlyMatch         string
+	excludeFrom       string
+	maxRetries        int
+	maxFileErrorsFlag string
+	dryRun            bool
+	planOnly          bool
+	showVersion       bool
+	quiet             bool
+	fromStdin         bool
+	objectName        string
+	stdinContentType  string
+	verbose           bool
+	validateOnly      bool
+	listOnly          bool
+	mode              string
+	restorePrefix     string
+	resumePrefix      string
+	restoreDest       string
+	force             bool
+	compress          compression
+	incremental       bool
+	onlyChanged       bool
+	compareWithLatest bool
+	resumeOnPartial   bool
+	newerThanBackup   bool
+
+	// Only files modified after it are copied, and it's touched when the
+	// backup succeeds
+	sinceFile string
+
+	// Local file that gets the summary of the backup as JSON
+	summaryOut string
+
+	// Manifest -only-changed compares with instead of the newest one of
+	// the bucket
+	previousManifestPath string
+	rateLimit            string
+	uploadLimiter        *rate.Limiter
+	showProgress         bool
+	progressInterval     time.Duration
+	uploadTimeout        time.Duration
+	maxDuration          time.Duration
+	startupJitter        time.Duration
+
+	// Set when the backup stopped on a fatal error, too many failures in a
+	// row or failFast
+	aborted bool
+
+	// Failed files allowed by maxFileErrors, a percentage of the files to
+	// copy when maxFileErrorsPercent is set
+	maxFileErrors        float64
+	maxFileErrorsPercent bool
+
+	// Retention period of the objects from holdUntil, zero means none
+	holdFor time.Duration
+
+	// Holds a slot for every object being written when maxInflight is set
+	inflight         chan struct{}
 	conf             Configuration
 	totalFilesToCopy int
+	totalBytesToCopy int64
 	filesToCopy      []string
 
-	totalFilesOK    int
-	totalFilesError int
+	// Guards the lists and counters of the walk across the directories
+	// walked at the same time
+	walkMutex sync.Mutex
+
+	// When set, the walk sends the files to copy to fileQueue instead of
+	// collecting them in filesToCopy
+	fileQueue    chan<- string
+	walkProgress *progress
+
+	// Object path of each file to copy when pathMode isn't absolute, and
+	// the file that took each object path. The workers read objectPaths
+	// while the walk fills it
+	objectPaths      = map[string]string{}
+	objectPathsMutex sync.Mutex
+	takenPaths       = map[string]string{}
+
+	// Bounds applied during the walk, zero means unbounded
+	minSize       int64
+	maxSize       int64
+	modifiedAfter time.Time
+
+	// Configured metadata of every object, placeholders expanded
+	customMetadata map[string]string
+
+	// Workers busy at once at the end of the backup
+	concurrencyUsed int
+
+	// Identifier of this host in the metadata and the prefixes
+	sourceHost string
+
+	// Updated by the workers as they finish each file
+	totalFilesOK      counter
+	totalFilesError   counter
+	totalFilesSkipped counter
+	totalFilesChanged counter
+
+	// Updated by the walk under walkMutex
+	totalFilesFilterSize int
+	totalFilesFilterAge  int
+	totalFilesFilterExt  int
+
+	totalFilesFilterContent int
+	totalFilesEmpty         int
+	totalFilesSpecial       int
+
+	// Bytes of the files copied and of the files that failed
+	totalBytesOK    counter
+	totalBytesError counter
 )
 
-func usage() {
-	fmt.Printf("Usage: %s -conf fileconf.yaml\n", path.Base(os.Args[0]))
-	os.Exit(1)
+// isFlagSet reports whether the flag name was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
 }
 
-func checkFileConf() {
-	info, err := os.Stat(fileConf)
+// versionString describes the running build
+func versionString() string {
+	return fmt.Sprintf("%s %s (commit %s, built %s)", path.Base(os.Args[0]), version, commit, date)
+}
 
-	if os.IsNotExist(err) {
-		fmt.Printf("[ERROR] File \"%s\" not found\n", fileConf)
-		os.Exit(1)
+// containsString reports whether s is one of values
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
 	}
 
-	if info.Size() == 0 {
-		fmt.Printf("[ERROR] File \"%s\" is empty\n", fileConf)
-		os.Exit(1)
+	return false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s -conf fileconf.yaml\n", path.Base(os.Args[0]))
+	exit(1)
+}
+
+// matchPattern reports whether the slash separated relative path rel matches
+// pattern. A pattern without "/" is matched against the base name only and
+// "**" matches any number of directories
+func matchPattern(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
 	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
 }
 
-func parseFileConf() {
-	yamlFile, err := ioutil.ReadFile(fileConf)
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
 
-	if err != nil {
-		fmt.Printf("[ERROR] Reading file configuration: %s\n", err)
-		os.Exit(1)
+		if len(parts) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+
+		pattern, parts = pattern[1:], parts[1:]
 	}
 
-	err = yaml.Unmarshal(yamlFile, &conf)
+	return len(parts) == 0
+}
 
-	if err != nil {
-		fmt.Printf("[ERROR] Parsing configuration: %s\n", err)
-		os.Exit(1)
+// matchAny reports whether rel matches any of the patterns
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, rel) {
+			return true
+		}
 	}
 
-	info, err := os.Stat(conf.GoogleCloud.PathJSONKey)
+	return false
+}
 
-	if os.IsNotExist(err) {
-		fmt.Printf("[ERROR] File pathJsonKey \"%s\" not found\n", conf.GoogleCloud.PathJSONKey)
-		os.Exit(1)
+// specialKind describes the type of a file with mode that isn't regular
+func specialKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+
+	return "special file"
+}
+
+// skipSpecial counts and reports the file path with info found by the
+// walk, which isn't backed up since it isn't a regular file
+func skipSpecial(path string, info os.FileInfo) {
+	walkMutex.Lock()
+	totalFilesSpecial++
+	walkMutex.Unlock()
+
+	logEvent(levelWarning, logFields{File: path}, fmt.Sprintf("Skipping the %s \"%s\"", specialKind(info.Mode()), path))
+	filteredOut(path, 0, "special")
+}
+
+// filteredBy returns the filter that leaves out a file with info, among
+// extension, size and age, or "" when it passes all of them, counting the
+// files filtered out
+func filteredBy(info os.FileInfo) string {
+	walkMutex.Lock()
+	defer walkMutex.Unlock()
+
+	if len(conf.Extensions) > 0 && !containsString(conf.Extensions, strings.ToLower(filepath.Ext(info.Name()))) {
+		totalFilesFilterExt++
+		return "extension"
 	}
 
-	if info.Size() == 0 {
-		fmt.Printf("[ERROR] File pathJsonKey \"%s\" is empty\n", conf.GoogleCloud.PathJSONKey)
-		os.Exit(1)
+	if info.Size() < minSize || (maxSize > 0 && info.Size() > maxSize) {
+		totalFilesFilterSize++
+		return "size"
 	}
+
+	if info.ModTime().Before(modifiedAfter) {
+		totalFilesFilterAge++
+		return "age"
+	}
+
+	return ""
 }
 
-func getFilesToCopy() {
-	for i := range conf.Directories {
-		_, err := os.Stat(conf.Directories[i])
+// addFileToCopy queues path, found under root with info, for the backup.
+// A symlink recorded by symlinks record is stored as an empty object, so
+// it counts as no bytes and isn't an empty file. It gives up waiting for
+// the workers when ctx is done
+func addFileToCopy(ctx context.Context, root, path string, info os.FileInfo) error {
+	var size int64
 
-		if os.IsNotExist(err) {
-			fmt.Printf("[WARNING] Dir \"%s\" not found\n", conf.Directories[i])
-			continue
-		}
+	if info.Mode().IsRegular() {
+		size = info.Size()
+	}
 
-		err = filepath.Walk(conf.Directories[i],
-			func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+	walkMutex.Lock()
 
-				if !info.IsDir() {
-					filesToCopy = append(filesToCopy, path)
-					totalFilesToCopy++
-				}
+	// Archives name their files relative to the directory
+	if conf.Archive == "" {
+		name, err := objectPath(root, path)
 
-				return nil
-			})
+		if errors.Is(err, errAlreadyQueued) || errors.Is(err, errCollisionSkipped) {
+			walkMutex.Unlock()
+
+			if errors.Is(err, errCollisionSkipped) {
+				logWarning("%s", err)
+			}
+
+			return nil
+		}
 
 		if err != nil {
-			fmt.Printf("[ERROR]: %s\n", err)
-			os.Exit(1)
+			walkMutex.Unlock()
+			return err
+		}
+
+		// Absolute object paths are derived again from the file
+		if name != absoluteObjectPath(path) {
+			objectPathsMutex.Lock()
+			objectPaths[path] = name
+			objectPathsMutex.Unlock()
 		}
 	}
+
+	totalFilesToCopy++
+	totalBytesToCopy += size
+
+	// Often a source file that was truncated
+	if size == 0 && info.Mode().IsRegular() {
+		totalFilesEmpty++
+		logEvent(levelWarning, logFields{File: path}, fmt.Sprintf("File \"%s\" is empty", path))
+	}
+
+	if fileQueue == nil {
+		filesToCopy = append(filesToCopy, path)
+		walkMutex.Unlock()
+
+		return nil
+	}
+
+	walkMutex.Unlock()
+
+	walkProgress.discover(size)
+
+	select {
+	case fileQueue <- path:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func copyFiles() {
-	var processFilesForGoRoutine int = 20
+// walkPath adds path, found under the configured directory root, and
+// everything below it to filesToCopy. ancestors holds the directories
+// walked to get here, so following a symlink back into one of them is
+// detected as a loop, and ignores the rules of the ignore files above it.
+// The walk stops with the error of ctx once it's done
+func walkPath(ctx context.Context, root, path string, info os.FileInfo, ancestors []os.FileInfo, ignores []ignoreRule) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	var wg sync.WaitGroup
-	var mutex sync.Mutex
-	var start, end int
+	rel, err := filepath.Rel(root, path)
+
+	if err != nil {
+		return err
+	}
+
+	rel = filepath.ToSlash(rel)
+	include, exclude := patternsFor(root)
+
+	// Exclude wins over include and prunes whole directories
+	if rel != "." && matchAny(exclude, rel) {
+		logDebug("Excluded \"%s\"", path)
+		return nil
+	}
+
+	if rel != "." && ignored(ignores, rel, info.IsDir()) {
+		logDebug("Ignored \"%s\" by %s", path, ignoreFileName)
+		return nil
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch conf.Symlinks {
+		case symlinksRecord:
+			if (len(include) == 0 || matchAny(include, rel)) && (onlyMatch == "" || matchPattern(onlyMatch, rel)) {
+				return addFileToCopy(ctx, root, path, info)
+			}
+
+			return nil
+		case symlinksFollow:
+			info, err = os.Stat(path)
+
+			if err != nil {
+				logWarning("Broken symlink \"%s\": %s", path, err)
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+
+	if !info.IsDir() {
+		if len(include) > 0 && !matchAny(include, rel) {
+			return nil
+		}
+
+		if onlyMatch != "" && !matchPattern(onlyMatch, rel) {
+			return nil
+		}
+
+		// Reading a named pipe or a device can block or never end
+		if !info.Mode().IsRegular() {
+			skipSpecial(path, info)
+			return nil
+		}
+
+		reason := filteredBy(info)
+
+		if reason == "" && !passesContent(path) {
+			reason = "content"
+		}
+
+		if reason != "" {
+			filteredOut(path, info.Size(), reason)
+			return nil
+		}
 
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx, option.WithCredentialsFile(conf.GoogleCloud.PathJSONKey))
+		return addFileToCopy(ctx, root, path, info)
+	}
+
+	for _, ancestor := range ancestors {
+		if os.SameFile(ancestor, info) {
+			logWarning("Symlink loop at \"%s\", not followed", path)
+			return nil
+		}
+	}
+
+	children, err := ioutil.ReadDir(path)
 
 	if err != nil {
-		fmt.Printf("[ERROR] %s", err)
-		os.Exit(1)
+		return err
 	}
 
-	defer client.Close()
+	ancestors = append(ancestors[:len(ancestors):len(ancestors)], info)
 
-	currentTime := time.Now()
+	rules, err := readIgnoreFile(path, rel)
+
+	if err != nil {
+		return err
+	}
+
+	ignores = append(ignores[:len(ignores):len(ignores)], rules...)
+
+	for _, child := range children {
+		if err := walkPath(ctx, root, filepath.Join(path, child.Name()), child, ancestors, ignores); err != nil {
+			return err
+		}
+	}
 
-	pathBase := fmt.Sprintf("%d-%02d-%02d_%02d:%02d:%02d", currentTime.Year(),
-		currentTime.Month(), currentTime.Day(), currentTime.Hour(), currentTime.Minute(),
-		currentTime.Second())
+	return nil
+}
 
-	goRoutines := int(math.Round(float64(totalFilesToCopy) / float64(processFilesForGoRoutine)))
+// expandBraces expands the first {a,b} group of s and, recursively, the
+// groups that follow it, "/var/log/app-{a,b}" gives "/var/log/app-a" and
+// "/var/log/app-b"
+func expandBraces(s string) []string {
+	open := strings.Index(s, "{")
 
-	if goRoutines == 0 {
-		goRoutines = 1
+	if open < 0 {
+		return []string{s}
 	}
 
-	wg.Add(goRoutines)
+	// The closing brace of the group, skipping nested groups
+	depth, end := 0, -1
 
-	for i := 0; i < goRoutines; i++ {
-		if goRoutines == 1 {
-			// Only one go routine with the complete slice
-			start = 0
-			end = len(filesToCopy) - 1
-		} else {
-			if i == 0 {
-				// We are at the beginning
-				start = 0
-				end = processFilesForGoRoutine - 1
-			} else if i == goRoutines-1 {
-				// We are at the end
-				start = end + 1
-				end = len(filesToCopy) - 1
-			} else {
-				start = end + 1
-				end = (start + processFilesForGoRoutine) - 1
+	for i := open; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				end = i
 			}
 		}
+	}
 
-		go func(start, end int) {
-			for n := start; n <= end; n++ {
-				path := filesToCopy[n]
+	if end < 0 {
+		return []string{s}
+	}
 
-				// Double check
-				_, err := os.Stat(path)
+	var alternatives []string
+	depth, start := 0, open+1
 
-				if os.IsNotExist(err) {
-					fmt.Printf("[WARNING] File \"%s\" not found\n", path)
-					continue
-				}
+	for i := open + 1; i < end; i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, s[start:i])
+				start = i + 1
+			}
+		}
+	}
 
-				f, err := os.Open(path)
+	alternatives = append(alternatives, s[start:end])
 
-				if err != nil {
-					fmt.Errorf("os.Open: %v", err)
-					continue
-				}
+	var expanded []string
 
-				ctx, cancel := context.WithTimeout(ctx, time.Second*50)
+	for _, alternative := range alternatives {
+		for _, rest := range expandBraces(alternative + s[end+1:]) {
+			expanded = append(expanded, s[:open]+rest)
+		}
+	}
 
-				// Upload the file to the bucket
-				wc := client.Bucket(conf.GoogleCloud.NameBucket).Object(pathBase + path).NewWriter(ctx)
+	return expanded
+}
 
-				if _, err = io.Copy(wc, f); err != nil {
-					fmt.Errorf("io.Copy: %v", err)
+// expandDirectories expands the braces and glob patterns of the configured
+// directories, without duplicates. Every match gets the settings of its
+// entry. Entries without patterns are kept as they are, so a missing
+// directory is still reported by the walk
+func expandDirectories(entries []Directory) []Directory {
+	var dirs []Directory
 
-					mutex.Lock()
-					totalFilesError++
-					mutex.Unlock()
+	seen := map[string]bool{}
+
+	for _, entry := range entries {
+		var matches []string
+
+		for _, expanded := range expandBraces(entry.Path) {
+			if !strings.ContainsAny(expanded, "*?[") {
+				matches = append(matches, expanded)
+				continue
+			}
+
+			globbed, err := filepath.Glob(expanded)
+
+			if err != nil {
+				logWarning("Dir pattern \"%s\": %s", entry.Path, err)
+			}
+
+			matches = append(matches, globbed...)
+		}
+
+		if len(matches) == 0 {
+			logWarning("Dir pattern \"%s\" matches nothing", entry.Path)
+		}
+
+		for _, dir := range matches {
+			if clean := filepath.Clean(dir); !seen[clean] {
+				seen[clean] = true
+
+				d := entry
+				d.Path = dir
+				dirs = append(dirs, d)
+			}
+		}
+	}
+
+	return dirs
+}
+
+// walkEntry adds the files of the configured entry dir with info. Regular
+// files are backed up on their own, whatever the patterns and filters,
+// unless fileEntries is skip. Anything else that isn't a directory is
+// skipped
+func walkEntry(ctx context.Context, dir string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		return walkPath(ctx, dir, dir, info, nil, nil)
+	case !info.Mode().IsRegular():
+		logWarning("Dir \"%s\" is neither a file nor a directory, skipped", dir)
+	case conf.FileEntries == fileEntriesSkip:
+		logWarning("Dir \"%s\" is a file, skipped", dir)
+	default:
+		return addFileToCopy(ctx, filepath.Dir(dir), dir, info)
+	}
+
+	return nil
+}
+
+// getFilesToCopy walks the configured directories, up to walkers of them
+// at once, so the order of the files found is unspecified. It returns the
+// first error of any directory, or the error of ctx when it's done first
+func getFilesToCopy(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
 
-					cancel()
-					f.Close()
+	dirs := make(chan string)
 
+	wg.Add(walkers)
+
+	for i := 0; i < walkers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for dir := range dirs {
+				info, err := os.Stat(dir)
+
+				if os.IsNotExist(err) {
+					logWarning("Dir \"%s\" not found", dir)
 					continue
 				}
 
-				if err := wc.Close(); err != nil {
-					fmt.Errorf("Writer.Close: %v", err)
+				if err == nil {
+					err = walkEntry(ctx, dir, info)
+				}
 
+				if err != nil {
 					mutex.Lock()
-					totalFilesError++
-					mutex.Unlock()
 
-					cancel()
-					f.Close()
+					if firstErr == nil {
+						firstErr = err
+					}
 
-					continue
+					mutex.Unlock()
 				}
+			}
+		}()
+	}
 
-				fmt.Printf("[OK] File \"%s%s\" copied successfully\n", pathBase, path)
+	walkedDirs = expandDirectories(conf.Directories)
 
-				mutex.Lock()
-				totalFilesOK++
-				mutex.Unlock()
+feed:
+	for _, d := range walkedDirs {
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
 
-				cancel()
-				f.Close()
-			}
+		if failed {
+			break
+		}
 
-			wg.Done()
-		}(start, end)
+		select {
+		case dirs <- d.Path:
+		case <-ctx.Done():
+			break feed
+		}
 	}
 
+	close(dirs)
 	wg.Wait()
 
-	elapsed := time.Since(currentTime)
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
 
-	fmt.Printf("\n\nTotal files to copy: %d \n", totalFilesToCopy)
-	fmt.Printf("Total files copied: %d \n", totalFilesOK)
-	fmt.Printf("Total files with errors: %d \n", totalFilesError)
-	fmt.Printf("Copy files took: %v \n", elapsed)
+	return firstErr
 }
 
-func main() {
+// touchFile sets the modification time of path to t, creating it when it
+// doesn't exist
+func touchFile(path string, t time.Time) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 
-	if len(os.Args) == 1 {
-		usage()
+	if err != nil {
+		return err
 	}
 
-	flag.StringVar(&fileConf, "config", "conf.yaml", "YAML file with the configuration")
+	if err := f.Close(); err != nil {
+		return err
+	}
 
-	flag.Parse()
+	return os.Chtimes(path, t, t)
+}
+
+// preflightAll checks every destination before anything is uploaded and
+// exits when one of them can't take the backup or the lifecycle rules
+func preflightAll(ctx context.Context, dests []*bucketClient) {
+	probe := withBasePrefix(fmt.Sprintf(".preflight-%d", time.Now().UnixNano()))
+
+	for _, dest := range dests {
+		if err := dest.preflight(ctx, probe); err != nil {
+			logError("Bucket \"%s\" can't take the backup: %s", dest.NameBucket, err)
+			exit(1)
+		}
+
+		if err := dest.applyLifecycle(ctx); err != nil {
+			logError("Setting the lifecycle rules of bucket \"%s\": %s", dest.NameBucket, err)
+			exit(1)
+		}
+	}
+}
+
+// isFatal reports whether err dooms every other file too, such as a missing
+// bucket or credentials that don't work, so the run is better aborted
+func isFatal(err error) bool {
+	var apiErr *googleapi.Error
+	var tokenErr *oauth2.RetrieveError
+
+	if errors.Is(err, storage.ErrBucketNotExist) || errors.As(err, &tokenErr) {
+		return true
+	}
+
+	// Bad credentials, signatures or a missing bucket fail every file
+	var s3Err *s3Error
+
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode == http.StatusForbidden || s3Err.Code == "NoSuchBucket"
+	}
+
+	// Objects are created on write, so a 404 is the bucket that is missing
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusNotFound)
+}
+
+// isRetryable reports whether err is a transient failure worth another attempt
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+
+	var s3Err *s3Error
+
+	if errors.As(err, &s3Err) {
+		return s3Err.StatusCode == 429 || s3Err.StatusCode >= 500
+	}
+
+	var netErr net.Error
+
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, errChecksumMismatch)
+}
+
+// backoff returns the wait before the given retry: exponential with full
+// jitter, up to maxBackoff
+func backoff(attempt int) time.Duration {
+	max := maxBackoff
+
+	// Past 2^5 seconds it's maxBackoff anyway, and a bigger shift overflows
+	if attempt >= 0 && attempt < 5 {
+		max = min(time.Second<<uint(attempt), maxBackoff)
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// sleepJitter waits a random time up to max before a backup starts, so
+// hosts scheduled at the same time don't all hit GCS at once. It returns
+// early with the error of ctx when it's cancelled
+func sleepJitter(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+
+	wait := time.Duration(rand.Int63n(int64(max)))
+	logInfo("Waiting %s before starting", wait.Round(time.Second))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unixMode returns the permission, setuid, setgid and sticky bits of mode
+// in their usual octal Unix form
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+
+	return bits
+}
+
+// fileMode is the reverse of unixMode
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// fileMetadata returns the custom metadata stored with the object of a file
+func fileMetadata(info os.FileInfo) map[string]string {
+	return map[string]string{
+		"x-size":  strconv.FormatInt(info.Size(), 10),
+		"x-mode":  fmt.Sprintf("%04o", unixMode(info.Mode())),
+		"x-mtime": info.ModTime().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// objectMetadata returns the metadata of the object of the file path with
+// info: the configured metadata, then the file attributes and the built-in
+// x-source-path, x-source-host and x-uploaded, which the configuration
+// can't override
+func objectMetadata(path string, info os.FileInfo) map[string]string {
+	metadata := map[string]string{}
+
+	for k, v := range customMetadata {
+		metadata[k] = v
+	}
+
+	for k, v := range fileMetadata(info) {
+		metadata[k] = v
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		metadata["x-source-path"] = abs
+	}
+
+	metadata["x-source-host"] = sourceHost
+
+	metadata["x-uploaded"] = time.Now().UTC().Format(time.RFC3339)
+
+	return metadata
+}
+
+// isUnchanged reports whether the object already holds the current content
+// of the file, going by the size and mtime recorded in its metadata
+func isUnchanged(attrs *storage.ObjectAttrs, info os.FileInfo) bool {
+	current := fileMetadata(info)
+
+	return attrs.Metadata["x-size"] == current["x-size"] && attrs.Metadata["x-mtime"] == current["x-mtime"]
+}
+
+// objectUnchanged fetches the attributes of obj to check it against the file
+// info. A missing object is reported as changed
+func objectUnchanged(ctx context.Context, obj *storage.ObjectHandle, info os.FileInfo) (bool, error) {
+	attrs, err := obj.Attrs(ctx)
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("Object.Attrs: %w", err)
+	}
+
+	return isUnchanged(attrs, info), nil
+}
+
+// objectOptions are the settings of an object written by writeObject
+type objectOptions struct {
+	Metadata     map[string]string
+	ContentType  string
+	StorageClass string
+	KMSKeyName   string
+	ChunkSize    int
+	// Predefined ACL of the object, "" for the bucket default
+	PredefinedACL string
+	// Stages the content goes through, such as compression
+	Transforms pipeline
+
+	// Set for streams without a known length, which uploadTimeout can't
+	// be sized for
+	NoTimeout bool
+
+	// Gets the bytes read from r, before compression, when set
+	Hash hash.Hash
+
+	// CRC32C of the bytes to store when it's known before the upload, so
+	// GCS checks it and rejects a mismatch, with SendCRC32C
+	CRC32C     uint32
+	SendCRC32C bool
+}
+
+// startUpload waits for a slot of maxInflight, then applies uploadTimeout
+// to ctx unless opts can't take it. The returned function ends both
+func startUpload(ctx context.Context, opts objectOptions) (context.Context, func(), error) {
+	release := func() {}
+
+	// Waiting for a slot doesn't count against the upload timeout
+	if inflight != nil {
+		select {
+		case inflight <- struct{}{}:
+			release = func() { <-inflight }
+		case <-ctx.Done():
+			return ctx, release, ctx.Err()
+		}
+	}
+
+	if uploadTimeout > 0 && !opts.NoTimeout {
+		ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+		slot := release
+
+		return ctx, func() { cancel(); slot() }, nil
+	}
+
+	return ctx, release, nil
+}
+
+// writeObject streams r into obj, checks the CRC32C reported by GCS against
+// the one of the bytes sent and returns it. The object is already written by
+// then, so it's deleted when they don't match
+func writeObject(ctx context.Context, obj *storage.ObjectHandle, r io.Reader, opts objectOptions) (uint32, error) {
+	ctx, done, err := startUpload(ctx, opts)
+	defer done()
+
+	if err != nil {
+		return 0, err
+	}
+
+	wc := obj.NewWriter(ctx)
+	wc.Metadata = opts.Metadata
+	wc.ContentType = opts.ContentType
+	wc.StorageClass = opts.StorageClass
+	wc.KMSKeyName = opts.KMSKeyName
+	wc.PredefinedACL = opts.PredefinedACL
+	wc.ChunkSize = opts.ChunkSize
+	wc.CRC32C, wc.SendCRC32C = opts.CRC32C, opts.SendCRC32C
+
+	// The checksum is compared below instead, once the writer is done
+	// with the object and it can be deleted when it doesn't match
+	wc.DisableAutoChecksum = true
+	crc := crc32.New(crc32cTable)
+
+	var w io.Writer = io.MultiWriter(wc, crc)
+	var tw io.WriteCloser
+
+	// Transform on the fly so files are never buffered whole in memory
+	if len(opts.Transforms) > 0 {
+		wc.ContentEncoding = opts.Transforms.encoding()
+		wc.Metadata = opts.Transforms.metadata(opts.Metadata)
+
+		if tw, err = opts.Transforms.writer(w); err != nil {
+			return 0, err
+		}
+
+		w = tw
+	}
+
+	if opts.Hash != nil {
+		r = io.TeeReader(r, opts.Hash)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return 0, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	if tw != nil {
+		if err := tw.Close(); err != nil {
+			return 0, fmt.Errorf("closing the transforms: %w", err)
+		}
+	}
+
+	if err := wc.Close(); err != nil {
+		return 0, fmt.Errorf("Writer.Close: %w", err)
+	}
+
+	if attrs := wc.Attrs(); attrs.CRC32C != crc.Sum32() {
+		discardObject(ctx, obj, attrs.Generation)
+		return 0, fmt.Errorf("%w: local crc32c %08x, remote %08x", errChecksumMismatch, crc.Sum32(), attrs.CRC32C)
+	}
+
+	return crc.Sum32(), nil
+}
+
+// discardObject deletes the generation of obj written with the wrong
+// checksum, so that neither a restore nor a later backup takes it for a
+// good copy of its file
+func discardObject(ctx context.Context, obj *storage.ObjectHandle, generation int64) {
+	err := obj.If(storage.Conditions{GenerationMatch: generation}).Delete(context.WithoutCancel(ctx))
+
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		logWarning("Deleting the corrupt object \"%s\": %s", obj.ObjectName(), err)
+	}
+}
+
+// holdObject sets the configured retention and temporary hold on the object
+// of entry once it's written, failing the entry when that doesn't work
+func holdObject(ctx context.Context, dest *bucketClient, entry *manifestEntry) {
+	if (holdFor == 0 && !conf.TemporaryHold) || (entry.Status != statusCopied && entry.Status != statusChanged) {
+		return
+	}
+
+	var update storage.ObjectAttrsToUpdate
+
+	if conf.TemporaryHold {
+		update.TemporaryHold = true
+	}
+
+	if holdFor > 0 {
+		update.Retention = &storage.ObjectRetention{Mode: conf.RetentionMode, RetainUntil: time.Now().Add(holdFor)}
+	}
+
+	if _, err := dest.object(entry.Object).Update(ctx, update); err != nil {
+		entry.fail(fmt.Errorf("holding the object: Object.Update: %w", err))
+	}
+}
+
+// buildObjectName joins the backup prefix and the object path of a local
+// file, its absolute path unless pathMode says otherwise
+func buildObjectName(pathBase, filePath string) string {
+	objectPathsMutex.Lock()
+	name, ok := objectPaths[filePath]
+	objectPathsMutex.Unlock()
+
+	if !ok {
+		name = absoluteObjectPath(filePath)
+	}
+
+	return pathBase + "/" + name
+}
+
+// absoluteObjectPath returns the object path of a file in the absolute
+// pathMode, its path without the leading slash or drive letter
+func absoluteObjectPath(filePath string) string {
+	name := strings.ReplaceAll(filePath, "\\", "/")
+
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+
+	return strings.TrimLeft(name, "/")
+}
+
+// objectPath returns the object path of the file path found under root
+// according to pathMode: absolute, relative to the parent of root or just
+// the file name. Paths already taken by another file are an error, skip the
+// file or get a numbered suffix according to collisions. The caller holds
+// walkMutex
+func objectPath(root, path string) (string, error) {
+	// Directories that overlap find the same files twice, under another
+	// name in relative mode
+	if _, ok := objectPaths[path]; ok {
+		return "", errAlreadyQueued
+	}
+
+	var name string
+
+	switch conf.PathMode {
+	case pathModeAbsolute:
+		name = absoluteObjectPath(path)
+	case pathModeFlatten:
+		name = filepath.Base(path)
+	default:
+		rel, err := filepath.Rel(filepath.Dir(filepath.Clean(root)), path)
+
+		if err != nil {
+			return "", err
+		}
+
+		name = filepath.ToSlash(rel)
+	}
+
+	other, taken := takenPaths[name]
+
+	// Directories that overlap find the same files twice
+	if taken && other == path {
+		return "", errAlreadyQueued
+	}
+
+	if taken && conf.Collisions == collisionSkip {
+		return "", fmt.Errorf("File \"%s\" %w, \"%s\" is already stored as \"%s\"", path, errCollisionSkipped, other, name)
+	}
+
+	if taken && conf.Collisions != collisionSuffix {
+		return "", fmt.Errorf("Files \"%s\" and \"%s\" would both be stored as \"%s\"", other, path, name)
+	}
+
+	if taken {
+		ext := filepath.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+
+		for i := 1; taken; i++ {
+			name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+			_, taken = takenPaths[name]
+		}
+	}
+
+	takenPaths[name] = path
+
+	return name, nil
+}
+
+// chunkSize returns the chunk size of the resumable upload of a file of
+// size bytes. Files that fit in a single chunk are sent in one request
+// instead, so they don't each hold a chunk sized buffer
+func chunkSize(size int64) int {
+	chunk := conf.ChunkSizeMB << 20
+
+	if size < int64(chunk) {
+		return 0
+	}
+
+	return chunk
+}
+
+// detectContentType returns the content type of the file path, opened as
+// f, from the configured overrides, its extension or, failing both, its
+// first 512 bytes. f is left at offset 0
+func detectContentType(path string, f io.ReadSeeker) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	if contentType, ok := conf.ContentTypes[ext]; ok {
+		return contentType, nil
+	}
+
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType, nil
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("Read: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("Seek: %w", err)
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// fileChanged describes how the file path differs from info after n bytes
+// of it were read, or returns "" when it didn't change
+func fileChanged(path string, info os.FileInfo, n int64) string {
+	if n != info.Size() {
+		return fmt.Sprintf("%d bytes read, %d expected", n, info.Size())
+	}
+
+	current, err := os.Stat(path)
+
+	if err == nil && (current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime())) {
+		return "modified while reading it"
+	}
+
+	return ""
+}
+
+// uploadFile copies the local file path to the object name of dest,
+// retrying transient failures up to conf.MaxRetries times, and returns the
+// CRC32C of the object and the SHA-256 of the file in hex. A file that
+// changed while it was read is uploaded anyway and reported with
+// errFileChanged, after one more try when retryChanged is set. With stage,
+// a copy of the file is uploaded instead and the file can't change anymore
+func uploadFile(ctx context.Context, dest *bucketClient, path, object string) (uint32, string, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return 0, "", fmt.Errorf("os.Open: %w", err)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return 0, "", fmt.Errorf("File.Stat: %w", err)
+	}
+
+	// SHA-256 of the staged copy, which the upload must match, and its
+	// CRC32C, which GCS checks
+	var staged string
+	var stagedCRC uint32
+
+	if conf.Stage {
+		var tmp *os.File
+
+		if tmp, info, staged, stagedCRC, err = stageFile(f, path, info); err != nil {
+			return 0, "", err
+		}
+
+		// Removed whatever happens to the upload
+		defer removeStaged(tmp)
+
+		f = tmp
+	}
+
+	contentType, err := detectContentType(path, f)
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	var r io.Reader = f
+
+	if uploadLimiter != nil {
+		r = &rateLimitedReader{ctx: ctx, r: f, limiter: uploadLimiter}
+	}
+
+	// Counts what was actually sent, to spot files written meanwhile
+	counter := &countingReader{r: r}
+	retriedChange := false
+
+	for attempt := 0; ; attempt++ {
+		counter.n = 0
+
+		// Upload the file to the bucket
+		opts := dest.objectOptions()
+		opts.Metadata = objectMetadata(path, info)
+		opts.Transforms = pipelineFor(path)
+
+		if class := storageClassFor(path); class != "" {
+			opts.StorageClass = class
+		}
+		opts.ChunkSize = chunkSize(info.Size())
+		opts.ContentType = contentType
+		opts.Hash = sha256.New()
+
+		// Without transforms, the staged copy is what GCS gets
+		if staged != "" && len(opts.Transforms) == 0 {
+			opts.CRC32C, opts.SendCRC32C = stagedCRC, true
+		}
+
+		logEvent(levelDebug, logFields{File: path, Bucket: dest.NameBucket, Object: object},
+			fmt.Sprintf("Uploading \"%s\" to \"%s\" (attempt %d, content type %s)", path, object, attempt+1, contentType))
+
+		var crc uint32
+		var sum string
+
+		// Parts are retried on their own, a failed compose starts over
+		if useComposite(info.Size(), opts.Transforms) {
+			crc, sum, counter.n, err = compositeUpload(ctx, dest, f, info.Size(), object, opts)
+		} else {
+			crc, err = dest.backend.Upload(ctx, object, counter, opts)
+			sum = hex.EncodeToString(opts.Hash.Sum(nil))
+		}
+
+		if err == nil && staged != "" && sum != staged {
+			err = fmt.Errorf("%w: staged copy sha256 %s, uploaded %s", errChecksumMismatch, staged, sum)
+		}
+
+		if err == nil {
+			changed := ""
+
+			if staged == "" {
+				changed = fileChanged(path, info, counter.n)
+			}
+
+			if changed == "" {
+				return crc, sum, nil
+			}
+
+			if !conf.RetryChanged || retriedChange {
+				return crc, sum, fmt.Errorf("%w: %s", errFileChanged, changed)
+			}
+
+			logEvent(levelWarning, logFields{File: path, Object: object},
+				fmt.Sprintf("File \"%s\" changed during the upload (%s), retrying", path, changed))
+
+			retriedChange = true
+
+			if info, err = os.Stat(path); err != nil {
+				return 0, "", fmt.Errorf("os.Stat: %w", err)
+			}
+
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return 0, "", fmt.Errorf("Seek: %w", err)
+			}
+
+			attempt--
+			continue
+		}
+
+		if attempt >= conf.MaxRetries || !isRetryable(err) {
+			return 0, "", err
+		}
+
+		logEvent(levelWarning, logFields{File: path, Object: object, Error: err.Error()},
+			fmt.Sprintf("File \"%s\" failed, retrying (%d/%d): %v", path, attempt+1, conf.MaxRetries, err))
+
+		select {
+		case <-ctx.Done():
+			return 0, "", ctx.Err()
+		case <-time.After(backoff(attempt)):
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, "", fmt.Errorf("Seek: %w", err)
+		}
+	}
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// resolveSourceHost returns the identifier of the host the backups come
+// from: the environment variable, then sourceHost and then the hostname
+func resolveSourceHost() (string, error) {
+	host := strings.TrimSpace(os.Getenv(sourceHostEnv))
+
+	if host == "" {
+		host = strings.TrimSpace(conf.SourceHost)
+	}
+
+	if host == "" {
+		hostname, err := os.Hostname()
+
+		if err != nil {
+			return "", fmt.Errorf("os.Hostname: %w", err)
+		}
+
+		host = hostname
+	}
+
+	if strings.Contains(host, "/") {
+		return "", fmt.Errorf("source host \"%s\" can't contain /", host)
+	}
+
+	return host, nil
+}
+
+// expandPlaceholders replaces the {hostname}, {date}, {time} and {env}
+// placeholders of tmpl for a backup started at t. {hostname} is the
+// source host. {date} and {time} are in the time zone of the timestamps,
+// with fixed formats since timestampFormat can't be split in two
+func expandPlaceholders(tmpl string, t time.Time) (string, error) {
+	t = t.In(prefixLocation)
+	values := map[string]string{
+		"{hostname}": sourceHost,
+		"{date}":     t.Format("2006-01-02"),
+		"{time}":     t.Format("15-04-05"),
+		"{env}":      os.Getenv(conf.PrefixEnvVar),
+	}
+
+	var unknown []string
+
+	expanded := placeholderRegexp.ReplaceAllStringFunc(tmpl, func(p string) string {
+		v, ok := values[p]
+
+		if !ok {
+			unknown = append(unknown, p)
+		}
+
+		return v
+	})
+
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder %s in \"%s\"", strings.Join(unknown, ", "), tmpl)
+	}
+
+	return expanded, nil
+}
+
+// renderPrefix expands the placeholders of the prefix template tmpl for a
+// backup started at t
+func renderPrefix(tmpl string, t time.Time) (string, error) {
+	prefix, err := expandPlaceholders(tmpl, t)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Trim(path.Clean("/"+prefix), "/"), nil
+}
+
+// backupPrefix returns the prefix of every object of a backup started at t
+func backupPrefix(t time.Time) string {
+	prefix := t.In(prefixLocation).Format(conf.TimestampFormat)
+
+	if conf.Incremental {
+		prefix = incrementalPrefix
+	} else if conf.PrefixTemplate != "" {
+		// Already validated by parseFileConf
+		prefix, _ = renderPrefix(conf.PrefixTemplate, t)
+	}
+
+	return withBasePrefix(prefix)
+}
+
+// cleanPrefix drops the empty segments of the object prefix s, so it has
+// neither leading, trailing nor doubled slashes
+func cleanPrefix(s string) string {
+	var parts []string
+
+	for _, part := range strings.Split(s, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// withBasePrefix puts prefix under the configured basePrefix
+func withBasePrefix(prefix string) string {
+	if conf.BasePrefix == "" {
+		return prefix
+	}
+
+	return conf.BasePrefix + "/" + prefix
+}
+
+// backupFile uploads the file path under pathBase to dest, unless it's
+// unchanged since the last incremental backup, and returns its manifest entry
+func backupFile(ctx context.Context, dest *bucketClient, pathBase, path string) manifestEntry {
+	entry := manifestEntry{File: path, Object: buildObjectName(pathBase, path) + pipelineFor(path).suffix()}
+
+	if conf.Symlinks == symlinksRecord {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return recordSymlink(ctx, dest, pathBase, path, info)
+		}
+	}
+
+	// Double check
+	info, err := os.Stat(path)
+
+	if os.IsNotExist(err) {
+		entry.Status = statusMissing
+		return entry
+	}
+
+	if err != nil {
+		entry.Status, entry.Error = statusError, fmt.Sprintf("os.Stat: %v", err)
+		return entry
+	}
+
+	// Replaced by a named pipe or a device since the walk
+	if !info.Mode().IsRegular() {
+		entry.Status, entry.Error = statusSkipped, fmt.Sprintf("%s, not a regular file", specialKind(info.Mode()))
+		return entry
+	}
+
+	entry.Size, entry.Mtime = info.Size(), info.ModTime().UTC().Format(time.RFC3339Nano)
+
+	if info.Size() == 0 && conf.SkipEmptyFiles {
+		entry.Status = statusSkipped
+		return entry
+	}
+
+	// The object of the previous backup still holds the file
+	if prev, ok := dest.previous[path]; ok && sameAsPrevious(prev, info) {
+		entry.Status, entry.Object = statusUnchanged, prev.Object
+		entry.CRC32C, entry.SHA256 = prev.CRC32C, prev.SHA256
+
+		return entry
+	}
+
+	if conf.Incremental {
+		unchanged, err := objectUnchanged(ctx, dest.object(entry.Object), info)
+
+		if err != nil {
+			entry.fail(err)
+			return entry
+		}
+
+		if unchanged {
+			entry.Status = statusUnchanged
+			return entry
+		}
+	}
+
+	// Left by the interrupted run, the object is kept when it still holds
+	// the file. GCS never leaves an object half written, a stopped upload
+	// leaves none, so what this catches are the objects of files that
+	// changed since, or that were written while they changed
+	if obj, ok := dest.partial[entry.Object]; ok {
+		crc, sum, err := fileChecksums(path)
+
+		if err != nil {
+			entry.fail(err)
+			return entry
+		}
+
+		if objectComplete(obj, info, pipelineFor(path), crc) {
+			entry.Status = statusUnchanged
+			entry.CRC32C, entry.SHA256 = fmt.Sprintf("%08x", obj.CRC32C), sum
+
+			return entry
+		}
+
+		logWarning("Object \"%s\" doesn't hold the current \"%s\", uploading it again", entry.Object, path)
+	}
+
+	// The object of the latest backup is copied when the file didn't change
+	if dest.latest != "" {
+		copied, err := copyFromLatest(ctx, dest, pathBase, path, info, &entry)
+
+		if err != nil {
+			entry.fail(err)
+		}
+
+		if err != nil || copied {
+			holdObject(ctx, dest, &entry)
+			return entry
+		}
+	}
+
+	// Files with the same content as one already uploaded in this backup
+	// are copied from its object
+	if conf.Dedup {
+		hash, err := fileHash(path)
+
+		if err != nil {
+			entry.fail(err)
+			return entry
+		}
+
+		entry.SHA256 = hash
+		claim, first := dest.dedup.claim(hash)
+
+		if !first {
+			copied, err := copyDuplicate(ctx, dest, claim, path, info, &entry)
+
+			if err != nil {
+				entry.fail(err)
+			}
+
+			if err != nil || copied {
+				holdObject(ctx, dest, &entry)
+				return entry
+			}
+		} else {
+			defer func() { claim.finish(entry.Object, entry.Status == statusCopied) }()
+		}
+	}
+
+	crc, sum, err := uploadFile(ctx, dest, path, entry.Object)
+
+	if errors.Is(err, errFileChanged) {
+		entry.Status, entry.Error = statusChanged, err.Error()
+		entry.CRC32C, entry.SHA256 = fmt.Sprintf("%08x", crc), sum
+		holdObject(ctx, dest, &entry)
+
+		return entry
+	}
+
+	if err != nil {
+		entry.fail(err)
+		return entry
+	}
+
+	entry.Status, entry.CRC32C, entry.SHA256 = statusCopied, fmt.Sprintf("%08x", crc), sum
+	holdObject(ctx, dest, &entry)
+
+	return entry
+}
+
+// safeBackupFile is backupFile for the workers: a panic while backing up
+// path fails only that file, and the other files go on
+func safeBackupFile(ctx context.Context, dest *bucketClient, pathBase, path string) (entry manifestEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			logEvent(levelError, logFields{File: path, Bucket: dest.NameBucket},
+				fmt.Sprintf("Panic backing up \"%s\": %v\n%s", path, r, debug.Stack()))
+
+			entry = manifestEntry{File: path}
+			entry.fail(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	return backupFile(ctx, dest, pathBase, path)
+}
+
+// recordSymlink uploads an empty object holding the target of the symlink
+// path in its x-symlink metadata
+func recordSymlink(ctx context.Context, dest *bucketClient, pathBase, path string, info os.FileInfo) manifestEntry {
+	entry := manifestEntry{File: path, Object: buildObjectName(pathBase, path)}
+
+	target, err := os.Readlink(path)
+
+	if err != nil {
+		entry.Status, entry.Error = statusError, fmt.Sprintf("os.Readlink: %v", err)
+		return entry
+	}
+
+	opts := dest.objectOptions()
+	opts.Metadata = objectMetadata(path, info)
+	opts.Metadata["x-symlink"] = target
+
+	crc, err := dest.backend.Upload(ctx, entry.Object, strings.NewReader(""), opts)
+
+	if err != nil {
+		entry.fail(err)
+		return entry
+	}
+
+	entry.Status, entry.CRC32C = statusCopied, fmt.Sprintf("%08x", crc)
+
+	return entry
+}
+
+// logEntryResult prints the outcome of backupFile for the bucket, which is
+// only named in text format when there are several destinations
+func logEntryResult(entry manifestEntry, bucket string) {
+	fields := logFields{File: entry.File, Bucket: bucket, Object: entry.Object, Error: entry.Error}
+	where := ""
+
+	if len(conf.GoogleCloud) > 1 {
+		where = fmt.Sprintf(" (bucket \"%s\")", bucket)
+	}
+
+	switch entry.Status {
+	case statusMissing:
+		logEvent(levelWarning, fields, fmt.Sprintf("File \"%s\" not found", entry.File))
+	case statusUnchanged:
+		logEvent(levelInfo, fields, fmt.Sprintf("File \"%s\" unchanged, skipped%s", entry.File, where))
+	case statusSkipped:
+		if entry.Error != "" {
+			logEvent(levelWarning, fields, fmt.Sprintf("File \"%s\" skipped%s: %s", entry.File, where, entry.Error))
+			break
+		}
+
+		logEvent(levelInfo, fields, fmt.Sprintf("File \"%s\" empty, skipped%s", entry.File, where))
+	case statusChanged:
+		logEvent(levelWarning, fields, fmt.Sprintf("File \"%s\" copied to \"%s\"%s but %s", entry.File, entry.Object, where, entry.Error))
+	case statusError:
+		logEvent(levelError, fields, fmt.Sprintf("File \"%s\"%s: %s", entry.File, where, entry.Error))
+	default:
+		logEvent(levelOK, fields, fmt.Sprintf("File \"%s\" copied successfully%s", entry.Object, where))
+	}
+}
+
+// copyFiles walks the directories and uploads the files found to every
+// destination as they are found, and returns the number of files that
+// failed in any of them. Cancelling ctx stops the walk and the workers and
+// aborts the uploads in progress
+func copyFiles(ctx context.Context) int {
+	var workers int = conf.Concurrency
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	var dests []*bucketClient
+
+	for _, d := range conf.GoogleCloud {
+		dest := newClient(ctx, d)
+		defer dest.Close()
+
+		dests = append(dests, dest)
+	}
+
+	preflightAll(ctx, dests)
+
+	// Cancelled on a fatal error, too many errors or any error with
+	// failFast, to stop the walk and the workers
+	runCtx, abort := context.WithCancel(ctx)
+	defer abort()
+
+	var abortErr string
+	var abortOnce sync.Once
+
+	stopRun := func(reason string) {
+		abortOnce.Do(func() {
+			abortErr, aborted = reason, true
+			abort()
+		})
+	}
+
+	// A percentage of maxFileErrors is only known once the walk has found
+	// every file
+	walkDone := make(chan struct{})
+
+	checkErrors := func() {
+		if conf.MaxFileErrors == "" {
+			return
+		}
+
+		if maxFileErrorsPercent {
+			select {
+			case <-walkDone:
+			default:
+				return
+			}
+		}
+
+		walkMutex.Lock()
+		total := totalFilesToCopy
+		walkMutex.Unlock()
+
+		if failed := totalFilesError.get(); failed > fileErrorLimit(total) {
+			stopRun(fmt.Sprintf("too many errors, %d files failed, over the maxFileErrors of %s", failed, conf.MaxFileErrors))
+		}
+	}
+
+	currentTime := time.Now()
+	pathBase := backupPrefix(currentTime)
+
+	// A resumed backup writes to its original prefix and skips the files
+	// its checkpoint has as done
+	if resumePrefix != "" {
+		pathBase = resumePrefix
+	}
+
+	// The cutoff comes from the first destination, like every read from GCS
+	if err := applyCutoff(ctx, dests[0], pathBase); err != nil {
+		logError("%s", err)
+		exit(1)
+	}
+
+	if conf.OnlyChanged {
+		for _, dest := range dests {
+			var err error
+
+			if dest.previous, err = previousManifest(ctx, dest, pathBase); err != nil {
+				logWarning("Previous manifest of bucket \"%s\": %s, copying every file", dest.NameBucket, err)
+			} else if dest.previous == nil {
+				logWarning("No previous manifest in bucket \"%s\", copying every file", dest.NameBucket)
+			}
+		}
+	}
+
+	if conf.CompareWithLatest {
+		for _, dest := range dests {
+			backups, err := listBackups(ctx, dest.backend)
+
+			if err != nil {
+				logWarning("Listing backups of bucket \"%s\": %s, uploading every file", dest.NameBucket, err)
+				continue
+			}
+
+			if latest, _, ok := latestBackup(backups, pathBase); ok {
+				dest.latest = latest
+				logInfo("Copying the unchanged files of \"%s\" within bucket \"%s\"", latest, dest.NameBucket)
+
+				// Its checksums are those of the objects copied
+				if dest.latestEntries, err = readManifestObject(ctx, dest, latest+"/"+manifestName); err != nil {
+					logWarning("Manifest of \"%s\" in bucket \"%s\": %s, reading the files copied for their checksums", latest, dest.NameBucket, err)
+				}
+			} else {
+				logInfo("No previous backup in bucket \"%s\", uploading every file", dest.NameBucket)
+			}
+		}
+	}
+
+	// The checkpoint misses the files done since its last save, and the
+	// objects stopped halfway
+	if resumeOnPartial {
+		for _, dest := range dests {
+			var err error
+
+			if dest.partial, err = listObjects(ctx, dest, pathBase); err != nil {
+				logWarning("Listing the objects of \"%s\" in bucket \"%s\": %s, uploading every file", pathBase, dest.NameBucket, err)
+			} else {
+				logInfo("Found %d objects of \"%s\" in bucket \"%s\"", len(dest.partial), pathBase, dest.NameBucket)
+			}
+		}
+	}
+
+	state, err := loadCheckpoint(pathBase)
+
+	if err != nil {
+		logWarning("%s, starting over", err)
+	}
+
+	if resumePrefix != "" && len(state.Done) == 0 {
+		logWarning("No checkpoint of \"%s\" to resume, copying every file", pathBase)
+	}
+
+	stateCtx, stopState := context.WithCancel(ctx)
+	stateDone := make(chan struct{})
+
+	go func() {
+		state.keepSaving(stateCtx)
+		close(stateDone)
+	}()
+
+	events.OnStart(pathBase)
+
+	progress := newProgress()
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	progressDone := make(chan struct{})
+
+	go func() {
+		if showProgress {
+			progress.report(progressCtx, isTerminal(os.Stdout) && logFormat == "text", progressInterval)
+		}
+
+		close(progressDone)
+	}()
+
+	setActiveProgress(progress)
+
+	// Every worker pulls paths from the same channel, so each file is
+	// processed exactly once no matter how many files there are. The walk
+	// fills it while the workers drain it, and blocks once queueSize files
+	// are waiting, so the memory it takes doesn't grow with the tree
+	paths := make(chan string, conf.QueueSize)
+
+	fileQueue = paths
+	walkProgress = progress
+
+	// Backs up path to every destination
+	backupPath := func(path string) {
+		if done, ok := state.done(path, len(dests)); ok {
+			mutex.Lock()
+
+			for i, dest := range dests {
+				dest.entries = append(dest.entries, done[i])
+			}
+
+			mutex.Unlock()
+
+			totalFilesSkipped.inc()
+
+			progress.add(done[0].Size)
+			return
+		}
+
+		var size int64
+		var entries []manifestEntry
+
+		// The file takes the worst status among all destinations
+		status := statusUnchanged
+
+		for _, dest := range dests {
+			entry := safeBackupFile(runCtx, dest, pathBase, path)
+			fileEvent(dest.NameBucket, entry)
+			entries = append(entries, entry)
+
+			mutex.Lock()
+
+			dest.entries = append(dest.entries, entry)
+
+			switch entry.Status {
+			case statusCopied, statusChanged:
+				dest.filesOK++
+				dest.failuresInRow = 0
+			case statusUnchanged, statusSkipped:
+				dest.failuresInRow = 0
+			case statusError:
+				dest.filesError++
+				dest.failuresInRow++
+			}
+
+			reason := ""
+
+			if entry.Status == statusError && (conf.FailFast || isFatal(entry.err)) {
+				reason = entry.Error
+			} else if conf.MaxConsecutiveFailures > 0 && dest.failuresInRow >= conf.MaxConsecutiveFailures {
+				reason = fmt.Sprintf("destination appears unavailable, %d files failed in a row, the last with: %s", dest.failuresInRow, entry.Error)
+			}
+
+			mutex.Unlock()
+
+			if reason != "" {
+				stopRun(fmt.Sprintf("bucket \"%s\": %s", dest.NameBucket, reason))
+			}
+
+			size = entry.Size
+
+			if statusRank[entry.Status] > statusRank[status] {
+				status = entry.Status
+			}
+		}
+
+		progress.add(size)
+
+		if status == statusCopied || status == statusUnchanged {
+			state.markDone(path, entries)
+		}
+
+		switch status {
+		case statusCopied:
+			totalFilesOK.inc()
+			totalBytesOK.add(size)
+		case statusChanged:
+			totalFilesChanged.inc()
+			totalBytesOK.add(size)
+		case statusUnchanged, statusSkipped:
+			totalFilesSkipped.inc()
+		case statusError:
+			totalFilesError.inc()
+			totalBytesError.add(size)
+			checkErrors()
+		}
+	}
+
+	// With autoConcurrency, workers is only the most that can be busy
+	var tune *tuner
+
+	concurrencyUsed = workers
+
+	if conf.AutoConcurrency {
+		tune = newTuner(workers)
+
+		tuneCtx, stopTune := context.WithCancel(runCtx)
+		defer stopTune()
+
+		go tune.run(tuneCtx)
+	}
+
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for path := range paths {
+				// The files left are reported as not copied by the manifest
+				if runCtx.Err() != nil {
+					break
+				}
+
+				tune.acquire()
+				backupPath(path)
+				tune.release()
+			}
+		}()
+	}
+
+	err = getFilesToCopy(runCtx)
+	close(paths)
+	close(walkDone)
+
+	// Files that failed before the walk ended count towards a percentage
+	// only now
+	checkErrors()
+
+	// A walk stopped by the interrupt or an abort is reported along with
+	// the backup
+	if err != nil && runCtx.Err() == nil {
+		logError("Walking directories: %s", err)
+		totalFilesError.inc()
+	}
+
+	checkErrors()
+
+	wg.Wait()
+
+	if tune != nil {
+		concurrencyUsed = tune.concurrency()
+	}
+
+	stopProgress()
+	<-progressDone
+
+	stopState()
+	<-stateDone
+
+	// The checkpoint is only needed while the backup is incomplete
+	if totalFilesError.get() == 0 && ctx.Err() == nil {
+		if sinceFile != "" {
+			if err := touchFile(sinceFile, currentTime); err != nil {
+				logWarning("Touching -since-file: %s", err)
+			}
+		}
+
+		err = state.remove()
+	} else if err = state.save(); err == nil {
+		logInfo("Resume the backup with -resume %s", pathBase)
+	}
+
+	if err != nil {
+		logWarning("Checkpoint \"%s\": %s", state.path, err)
+	}
+
+	// The manifest is written even when the backup was interrupted
+	writeManifests(ctx, dests, pathBase, currentTime, totalFilesError.get() == 0 && ctx.Err() == nil)
+
+	elapsed := time.Since(currentTime)
+
+	truncated := errors.Is(ctx.Err(), context.DeadlineExceeded)
+
+	if abortErr != "" {
+		logError("Backup aborted by %s", abortErr)
+	}
+
+	if truncated {
+		logWarning("Backup truncated by the deadline of %s", maxDuration)
+	} else if ctx.Err() != nil {
+		logWarning("Backup interrupted: %s", ctx.Err())
+	}
+
+	logSummary("Backup finished", []summaryField{
+		{"Truncated by the deadline", "truncated", truncated},
+		{"Total files to copy", "filesToCopy", totalFilesToCopy},
+		{"Total files copied", "filesCopied", totalFilesOK.get()},
+		{"Total files with errors", "filesError", totalFilesError.get()},
+		{"Total files unchanged or skipped", "filesSkipped", totalFilesSkipped.get()},
+		{"Total empty files", "filesEmpty", totalFilesEmpty},
+		{"Total special files skipped", "filesSpecial", totalFilesSpecial},
+		{"Total files changed during backup", "filesChanged", totalFilesChanged.get()},
+		{"Total files filtered out by size", "filesFilteredSize", totalFilesFilterSize},
+		{"Total files filtered out by age", "filesFilteredAge", totalFilesFilterAge},
+		{"Total files filtered out by extension", "filesFilteredExtension", totalFilesFilterExt},
+		{"Total files filtered out by content", "filesFilteredContent", totalFilesFilterContent},
+		{"Total bytes copied", "bytesCopied", byteCount(totalBytesOK.get())},
+		{"Total bytes with errors", "bytesError", byteCount(totalBytesError.get())},
+		{"Average throughput per second", "bytesPerSecond", throughput(totalBytesOK.get(), elapsed)},
+		{"Concurrency", "concurrency", concurrencyUsed},
+		{"Copy files took", "elapsed", elapsed.String()},
+	}, destinationSummaries(dests))
+
+	report := runReport{
+		Prefix:         pathBase,
+		Started:        currentTime.Format(time.RFC3339),
+		Duration:       elapsed.Round(time.Second).String(),
+		FilesToCopy:    totalFilesToCopy,
+		FilesCopied:    int(totalFilesOK.get()),
+		FilesError:     int(totalFilesError.get()),
+		FilesUnchanged: int(totalFilesSkipped.get()),
+		BytesCopied:    totalBytesOK.get(),
+		Failed:         totalFilesError.get() > 0 || ctx.Err() != nil,
+	}
+
+	finishRun(ctx, dests, currentTime, elapsed, report, abortErr)
+
+	return int(totalFilesError.get())
+}
+
+// writeManifests writes the manifest and the checksums of the entries of
+// every destination. complete tells whether the backup finished cleanly
+func writeManifests(ctx context.Context, dests []*bucketClient, pathBase string, currentTime time.Time, complete bool) {
+	for _, dest := range dests {
+		if err := writeManifest(context.WithoutCancel(ctx), dest, pathBase, currentTime, complete, dest.entries); err != nil {
+			logError("Writing manifest to \"%s\": %s", dest.NameBucket, err)
+		}
+
+		if err := writeChecksums(context.WithoutCancel(ctx), dest, pathBase, dest.entries); err != nil {
+			logError("Writing checksums to \"%s\": %s", dest.NameBucket, err)
+		}
+	}
+}
+
+// finishRun ends every kind of backup once its summary is logged: it writes
+// the run summary and the run log of every destination, then reports the
+// run to the event hooks, the webhook and the metrics
+func finishRun(ctx context.Context, dests []*bucketClient, currentTime time.Time, elapsed time.Duration, report runReport, abortErr string) {
+	writeSummary(context.WithoutCancel(ctx), dests, newRunSummary(ctx, report.Prefix, currentTime, dests, abortErr))
+
+	// After the summary so the log holds it too
+	for _, dest := range dests {
+		if err := writeRunLog(context.WithoutCancel(ctx), dest, report.Prefix); err != nil {
+			logError("Writing run log to \"%s\": %s", dest.NameBucket, err)
+		}
+	}
+
+	events.OnComplete(report)
+	notify(context.WithoutCancel(ctx), report)
+	pushMetrics(context.WithoutCancel(ctx), report, elapsed)
+}
+
+// applyCutoff moves modifiedAfter, before which the walk leaves the files
+// out, to the time of -since-file and, with newerThanBackup, to the start of
+// the latest complete backup of dest other than pathBase, whichever is the
+// latest. The backup, -dry-run and -plan walk with the same cutoff
+func applyCutoff(ctx context.Context, dest *bucketClient, pathBase string) error {
+	if sinceFile != "" {
+		if info, err := os.Stat(sinceFile); os.IsNotExist(err) {
+			logInfo("No file \"%s\" yet, copying every file", sinceFile)
+		} else if err != nil {
+			return fmt.Errorf("Reading -since-file: %w", err)
+		} else if info.ModTime().After(modifiedAfter) {
+			modifiedAfter = info.ModTime()
+		}
+	}
+
+	if !conf.NewerThanBackup {
+		return nil
+	}
+
+	backups, err := listBackups(ctx, dest.backend)
+
+	if err != nil {
+		return fmt.Errorf("Listing backups: %w", err)
+	}
+
+	_, since, ok, err := latestCompleteBackup(ctx, dest, backups, pathBase)
+
+	if err != nil {
+		return fmt.Errorf("Reading the manifests of the backups: %w", err)
+	}
+
+	if !ok {
+		logInfo("No previous backup completed, copying every file")
+		return nil
+	}
+
+	logInfo("Copying the files modified since the backup of %s", since.Format(time.RFC3339))
+
+	if since.After(modifiedAfter) {
+		modifiedAfter = since
+	}
+
+	return nil
+}
+
+// throughput returns the bytes per second of n bytes copied in elapsed
+func throughput(n int64, elapsed time.Duration) byteCount {
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return byteCount(float64(n) / elapsed.Seconds())
+}
+
+// destinationSummaries returns the counters of each destination, which are
+// only worth printing when there are several of them
+func destinationSummaries(dests []*bucketClient) []destinationSummary {
+	if len(dests) < 2 {
+		return nil
+	}
+
+	var summaries []destinationSummary
+
+	for _, dest := range dests {
+		summaries = append(summaries, destinationSummary{
+			Bucket:      dest.NameBucket,
+			FilesCopied: dest.filesOK,
+			FilesError:  dest.filesError,
+		})
+	}
+
+	return summaries
+}
+
+// fileErrorLimit returns the number of failed files maxFileErrors allows
+// out of total files to copy
+func fileErrorLimit(total int) int64 {
+	if maxFileErrorsPercent {
+		return int64(maxFileErrors * float64(total) / 100)
+	}
+
+	return int64(maxFileErrors)
+}
+
+// exitCode maps the outcome of the copy to the process exit status: 0 for a
+// clean run, 2 when some files could not be copied, 3 when the deadline
+// stopped it, 4 when it was aborted and 130 when the backup was
+// interrupted. Fatal setup errors exit with 1 before getting here
+func exitCode(ctx context.Context, filesError int) int {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return 3
+	}
+
+	if ctx.Err() != nil {
+		return 130
+	}
+
+	if aborted {
+		return 4
+	}
+
+	if filesError > 0 {
+		return 2
+	}
+
+	return 0
+}
+
+// printPlan lists the objects a backup would create without contacting GCS
+func printPlan() {
+	pathBase := backupPrefix(time.Now())
+
+	for _, path := range filesToCopy {
+		object := buildObjectName(pathBase, path) + pipelineFor(path).suffix()
+
+		logEvent(levelInfo, logFields{File: path, Object: object},
+			fmt.Sprintf("File \"%s\" would be copied to \"%s\"", path, object))
+	}
+
+	logSummary("Dry run finished", []summaryField{
+		{"Total files to copy", "filesToCopy", totalFilesToCopy},
+		{"Total bytes to copy", "bytesToCopy", byteCount(totalBytesToCopy)},
+		{"Total empty files", "filesEmpty", totalFilesEmpty},
+		{"Total special files skipped", "filesSpecial", totalFilesSpecial},
+		{"Total files filtered out by size", "filesFilteredSize", totalFilesFilterSize},
+		{"Total files filtered out by age", "filesFilteredAge", totalFilesFilterAge},
+		{"Total files filtered out by extension", "filesFilteredExtension", totalFilesFilterExt},
+		{"Total files filtered out by content", "filesFilteredContent", totalFilesFilterContent},
+	}, nil)
+}
+
+func main() {
+
+	if len(os.Args) == 1 {
+		usage()
+	}
+
+	flag.StringVar(&fileConf, "config", "conf.yaml", "YAML file with the configuration, - for stdin or an http(s) URL")
+	flag.StringVar(&configDir, "config-dir", "", "Run a backup for every *.yaml file of this directory, one after the other")
+	flag.BoolVar(&failFast, "fail-fast", false, "Abort the backup on the first file that fails and, with -config-dir, skip the configurations left (overrides the configuration)")
+	flag.IntVar(&concurrency, "concurrency", 0, "Number of upload workers (overrides the configuration)")
+	flag.BoolVar(&autoConcurrency, "auto-concurrency", false, "Tune the number of busy workers, up to -concurrency, by the throughput (overrides the configuration)")
+	flag.Var(&onlyDirs, "only-dir", "Back up only this configured directory, can be repeated")
+	flag.StringVar(&onlyMatch, "match", "", "Back up only the files matching this pattern too, like include")
+	flag.StringVar(&includeFrom, "include-from", "", "File with more include patterns, one per line (overrides the configuration)")
+	flag.StringVar(&excludeFrom, "exclude-from", "", "File with more exclude patterns, one per line (overrides the configuration)")
+	flag.IntVar(&queueSize, "queue-size", defaultQueueSize, "Files the walk can get ahead of the upload workers (overrides the configuration)")
+	flag.StringVar(&maxFileErrorsFlag, "max-file-errors", "", "Abort the backup when more files than this, or this percentage of them, fail, e.g. 50 or 5% (overrides the configuration)")
+	flag.IntVar(&maxRetries, "max-retries", 3, "Retries for transient upload failures (overrides the configuration)")
+	flag.DurationVar(&uploadTimeout, "upload-timeout", 50*time.Second, "Timeout for each file upload, 0 disables it (overrides the configuration)")
+	flag.DurationVar(&maxDuration, "deadline", 0, "Stop the backup cleanly after this long, 0 means no deadline (overrides the configuration)")
+	flag.DurationVar(&startupJitter, "startup-jitter", 0, "Wait a random time up to this long before a backup, 0 disables it (overrides the configuration)")
+	flag.Var(&compress, "compress", "Compress files before uploading, with gzip or -compress=zstd (overrides the configuration)")
+	flag.BoolVar(&incremental, "incremental", false, "Upload only new or changed files to a stable prefix (overrides the configuration)")
+	flag.BoolVar(&onlyChanged, "only-changed", false, "Skip the files whose size and modification time match the previous manifest (overrides the configuration)")
+	flag.BoolVar(&compareWithLatest, "compare-with-latest", false, "Copy the objects of the files unchanged since the latest backup within GCS instead of uploading them (overrides the configuration)")
+	flag.BoolVar(&newerThanBackup, "newer-than-backup", false, "Skip the files modified before the start of the latest backup in the bucket (overrides the configuration)")
+	flag.StringVar(&sinceFile, "since-file", "", "Copy only the files modified after this file, which is touched when the backup succeeds")
+	flag.StringVar(&summaryOut, "summary-out", "", "Write the result of the backup as JSON to this file")
+	flag.StringVar(&previousManifestPath, "previous-manifest", "", "Local manifest compared by -only-changed instead of the newest one in the bucket")
+	flag.StringVar(&rateLimit, "rate-limit", "", "Maximum upload rate in bytes per second such as 10MB, 0 means unlimited (overrides the configuration)")
+	flag.BoolVar(&showProgress, "progress", isTerminal(os.Stdout), "Report the progress of the backup (default on for terminals)")
+	flag.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "How often the progress is reported when not on a terminal")
+	flag.BoolVar(&planOnly, "plan", false, "Print what a backup would do with every file as JSON, without uploading anything")
+	flag.BoolVar(&dryRun, "dry-run", false, "List the files that would be copied, or the backups that would be pruned, without changing anything")
+	flag.StringVar(&mode, "mode", "backup", "What to do: backup, restore, prune or verify")
+	flag.StringVar(&restorePrefix, "prefix", "", "Backup to restore, verify or list, e.g. 2024-01-02_15-04-05")
+	flag.StringVar(&resumePrefix, "resume", "", "Resume the interrupted backup with this prefix, skipping the files it already copied")
+	flag.BoolVar(&resumeOnPartial, "resume-on-partial", false, "With -resume, keep the objects already under the prefix that still hold their file and upload the others again")
+	flag.StringVar(&restoreDest, "dest", "", "Directory where the backup is restored")
+	flag.BoolVar(&fromStdin, "stdin", false, "Back up stdin as a single object named by -object-name")
+	flag.StringVar(&objectName, "object-name", "", "Name of the object of -stdin under the backup prefix, e.g. db/dump.sql")
+	flag.StringVar(&stdinContentType, "content-type", "application/octet-stream", "Content type of the object of -stdin")
+	flag.BoolVar(&force, "force", false, "Overwrite existing files when restoring")
+	flag.BoolVar(&listOnly, "list", false, "List the backups in the bucket, or the objects of the backup given by -prefix, and exit")
+	flag.BoolVar(&validateOnly, "validate", false, "Validate the configuration and exit")
+	flag.BoolVar(&quiet, "quiet", false, "Only print warnings, errors and the summary")
+	flag.BoolVar(&verbose, "verbose", false, "Also print debug details such as object names and upload attempts")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the output: text or json")
+	flag.BoolVar(&showVersion, "version", false, "Print the version and exit")
+
+	flag.Parse()
+
+	if showVersion {
+		fmt.Println(versionString())
+		exit(0)
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		logError("Unknown log format \"%s\", use text or json", logFormat)
+		exit(1)
+	}
+
+	if quiet && verbose {
+		logError("-quiet and -verbose can't be used together")
+		exit(1)
+	}
+
+	if quiet {
+		logThreshold = levelWarning
+	}
+
+	if verbose {
+		logThreshold = levelDebug
+	}
+
+	// Before anything that takes long, the signal kills the process otherwise
+	handleProgressSignals()
+
+	if mode != "backup" && mode != "restore" && mode != "prune" && mode != "verify" {
+		logError("Unknown mode \"%s\", use backup, restore, prune or verify", mode)
+		exit(1)
+	}
+
+	if configDir != "" {
+		if isFlagSet("config") {
+			logError("-config and -config-dir can't be used together")
+			exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runConfigDir(ctx, configDir)
+		stop()
+
+		exit(code)
+	}
+
+	if fromStdin && fileConf == confStdin {
+		logError("-config - and -stdin can't be used together, both read stdin")
+		exit(1)
+	}
+
+	if validateOnly {
+		exit(reportValidation())
+	}
+
+	if err := parseFileConf(); err != nil {
+		logConfError(err)
+		exit(1)
+	}
+
+	if conf.RunLog {
+		runLog = new(bytes.Buffer)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, maxDuration)
+		defer cancel()
+	}
+
+	// They read the objects back with the storage client
+	if (listOnly || mode == "restore" || mode == "verify") && conf.GoogleCloud[0].isS3() {
+		logError("-list, -mode restore and -mode verify need a GCS bucket as the first destination")
+		exit(1)
+	}
+
+	if listOnly {
+		code := exitCode(ctx, listBackupsTable(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if mode == "restore" {
+		if restorePrefix == "" || restoreDest == "" {
+			logError("Restore needs -prefix and -dest")
+			exit(1)
+		}
+
+		code := exitCode(ctx, restoreFiles(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if mode == "verify" {
+		if restorePrefix == "" {
+			logError("Verify needs -prefix")
+			exit(1)
+		}
+
+		code := exitCode(ctx, verifyBackup(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if mode == "prune" {
+		if conf.RetentionDays == 0 {
+			logError("Prune needs retentionDays in the configuration")
+			exit(1)
+		}
+
+		code := exitCode(ctx, pruneBackups(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if fromStdin && objectName == "" {
+		logError("-stdin needs -object-name")
+		exit(1)
+	}
+
+	if resumeOnPartial && resumePrefix == "" {
+		logError("-resume-on-partial needs -resume")
+		exit(1)
+	}
+
+	if resumeOnPartial && conf.Archive != "" {
+		logError("-resume-on-partial compares files, it can't be used with archive")
+		exit(1)
+	}
+
+	if !dryRun && !planOnly {
+		if err := sleepJitter(ctx, startupJitter); err != nil {
+			logWarning("Backup interrupted before starting: %s", err)
+			exit(exitCode(ctx, 0))
+		}
+	}
+
+	if fromStdin {
+		code := exitCode(ctx, uploadStdin(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if planOnly {
+		if conf.Archive != "" {
+			logError("-plan lists files, it can't be used with archive")
+			exit(1)
+		}
+
+		if err := printPlanJSON(ctx); err != nil {
+			logError("%s", err)
+			exit(1)
+		}
+
+		exit(0)
+	}
+
+	if conf.Archive != "" && !dryRun {
+		code := exitCode(ctx, archiveDirectories(ctx))
+		stop()
+
+		exit(code)
+	}
+
+	if dryRun {
+		// newerThanBackup makes the only read from GCS
+		var dest *bucketClient
+
+		if conf.NewerThanBackup {
+			dest = newClient(ctx, conf.GoogleCloud[0])
+		}
+
+		if err := applyCutoff(ctx, dest, backupPrefix(time.Now())); err != nil {
+			logError("%s", err)
+			exit(1)
+		}
+
+		if err := getFilesToCopy(ctx); err != nil {
+			logError("%s", err)
+			exit(1)
+		}
+
+		printPlan()
+		exit(0)
+	}
 
-	checkFileConf()
-	parseFileConf()
-	getFilesToCopy()
-	copyFiles()
+	code := exitCode(ctx, copyFiles(ctx))
+	stop()
 
-	os.Exit(0)
+	exit(code)
 }
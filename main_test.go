@@ -0,0 +1,2566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// testBucket is the bucket the backups of the tests go to
+const testBucket = "test-bucket"
+
+// resetState puts back the state a run starts with, which every test of a
+// backup needs since it lives in package variables
+func resetState(t *testing.T) {
+	t.Helper()
+
+	conf = Configuration{}
+	fileConf = ""
+	failFast = false
+	concurrency = 0
+	autoConcurrency = false
+	queueSize = defaultQueueSize
+	includeFrom, excludeFrom = "", ""
+	onlyDirs = nil
+	onlyMatch = ""
+	maxRetries = 3
+	maxFileErrorsFlag = ""
+	dryRun, planOnly = false, false
+	fromStdin, objectName = false, ""
+	mode = "backup"
+	restorePrefix, resumePrefix, restoreDest = "", "", ""
+	force = false
+	compress = ""
+	incremental, onlyChanged, compareWithLatest = false, false, false
+	resumeOnPartial, newerThanBackup = false, false
+	sinceFile, summaryOut, previousManifestPath = "", "", ""
+	rateLimit = ""
+	uploadLimiter = nil
+	showProgress = false
+	uploadTimeout = 50 * time.Second
+	maxDuration, startupJitter = 0, 0
+	aborted = false
+	maxFileErrors, maxFileErrorsPercent = 0, false
+	holdFor = 0
+	inflight = nil
+	totalFilesToCopy, totalBytesToCopy = 0, 0
+	filesToCopy = nil
+	fileQueue = nil
+	walkProgress = nil
+	objectPaths = map[string]string{}
+	takenPaths = map[string]string{}
+	minSize, maxSize = 0, 0
+	modifiedAfter = time.Time{}
+	customMetadata = nil
+	concurrencyUsed = 0
+	sourceHost = ""
+	totalFilesOK, totalFilesError = counter{}, counter{}
+	totalFilesSkipped, totalFilesChanged = counter{}, counter{}
+	totalFilesFilterSize, totalFilesFilterAge, totalFilesFilterExt = 0, 0, 0
+	totalFilesFilterContent, totalFilesEmpty, totalFilesSpecial = 0, 0, 0
+	totalBytesOK, totalBytesError = counter{}, counter{}
+	compositeThreshold, compositeParts = 0, 0
+	clientKey = nil
+	contentFilters = nil
+	walkedDirs = nil
+	planFiltered = nil
+	secrets = nil
+	prefixLocation = time.Local
+	events = logHandler{}
+	setActiveProgress(nil)
+
+	// Only the errors, the tests check the results instead
+	logFormat = "text"
+	logThreshold = levelError
+	runLog = nil
+
+	t.Cleanup(func() {
+		scratchMutex.Lock()
+		os.RemoveAll(scratchDir)
+		scratchDir = ""
+		scratchMutex.Unlock()
+	})
+}
+
+// loadTestConf resets the state and loads the configuration yaml, which
+// must be valid
+func loadTestConf(t *testing.T, yaml string) {
+	t.Helper()
+
+	if err := parseTestConf(t, yaml); err != nil {
+		t.Fatalf("parseFileConf: %v", err)
+	}
+}
+
+// backupConf returns a configuration that backs up dir to testBucket,
+// followed by the settings of extra
+func backupConf(dir string, extra ...string) string {
+	return fmt.Sprintf("directories:\n  - %q\ngoogleCloud:\n  nameBucket: %s\n%s", dir, testBucket, strings.Join(extra, "\n"))
+}
+
+// writeFiles creates n files in dir with their name as content and returns
+// their paths
+func writeFiles(t *testing.T, dir string, n int) []string {
+	t.Helper()
+
+	var paths []string
+
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file-%04d.txt", i))
+
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// backedUp returns the object paths of the files in the backups of bucket,
+// without the prefix of the backup nor the objects written after the copy
+func backedUp(f *fakeGCS, bucket string) []string {
+	var paths []string
+
+	for _, name := range f.names(bucket, "") {
+		i := strings.Index(name, "/")
+
+		if i < 0 {
+			continue
+		}
+
+		switch name[i+1:] {
+		case manifestName, checksumsName, summaryName, runLogName:
+			continue
+		}
+
+		paths = append(paths, name[i+1:])
+	}
+
+	return paths
+}
+
+// objectPathsOf returns the object paths of files in the absolute pathMode
+func objectPathsOf(files []string) []string {
+	var paths []string
+
+	for _, file := range files {
+		paths = append(paths, absoluteObjectPath(file))
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCopyFilesCopiesEveryFileOnce(t *testing.T) {
+	for _, n := range []int{0, 1, 19, 20, 21, 39, 40, 41, 1000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, n)
+
+			loadTestConf(t, backupConf(dir, "concurrency: 8", "queueSize: 16"))
+
+			if errs := copyFiles(context.Background()); errs != 0 {
+				t.Fatalf("copyFiles = %d errors, want 0", errs)
+			}
+
+			if got := backedUp(f, testBucket); !equalStrings(got, objectPathsOf(files)) {
+				t.Errorf("got %d objects, want the %d files", len(got), n)
+			}
+
+			for _, file := range files {
+				if uploads := f.count("UPLOAD", backupPrefixOf(f, testBucket)+"/"+absoluteObjectPath(file)); uploads != 1 {
+					t.Errorf("file %s uploaded %d times, want 1", file, uploads)
+				}
+			}
+
+			if int(totalFilesOK.get()) != n || totalFilesToCopy != n {
+				t.Errorf("counted %d files copied of %d, want %d", totalFilesOK.get(), totalFilesToCopy, n)
+			}
+		})
+	}
+}
+
+// backupPrefixOf returns the prefix of the only backup in bucket
+func backupPrefixOf(f *fakeGCS, bucket string) string {
+	for _, name := range f.names(bucket, "") {
+		if strings.HasSuffix(name, "/"+manifestName) {
+			return strings.TrimSuffix(name, "/"+manifestName)
+		}
+	}
+
+	return ""
+}
+
+func TestCopyFilesCountsUnreadableFiles(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads files without permissions")
+	}
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	if err := os.Chmod(files[1], 0000); err != nil {
+		t.Fatal(err)
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Errorf("copyFiles = %d errors, want 1", errs)
+	}
+
+	if got := totalFilesError.get(); got != 1 {
+		t.Errorf("totalFilesError = %d, want 1", got)
+	}
+
+	want := objectPathsOf([]string{files[0], files[2]})
+
+	if got := backedUp(f, testBucket); !equalStrings(got, want) {
+		t.Errorf("objects = %v, want %v", got, want)
+	}
+}
+
+// flakyBackend is a Backend whose uploads fail with err the first failures
+// times, and keeps what the last one read
+type flakyBackend struct {
+	failures int
+	err      error
+	attempts int
+	data     []byte
+}
+
+func (b *flakyBackend) Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error) {
+	b.attempts++
+
+	if opts.Hash != nil {
+		r = io.TeeReader(r, opts.Hash)
+	}
+
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return 0, err
+	}
+
+	b.data = data
+
+	if b.attempts <= b.failures {
+		return 0, b.err
+	}
+
+	return 0, nil
+}
+
+func (b *flakyBackend) List(ctx context.Context, prefix, delimiter string, fn func(obj objectInfo) error) error {
+	return nil
+}
+
+func (b *flakyBackend) Delete(ctx context.Context, name string) error {
+	return nil
+}
+
+func (b *flakyBackend) Exists(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func TestUploadFileRetries(t *testing.T) {
+	unavailable := &googleapi.Error{Code: 503}
+	forbidden := &googleapi.Error{Code: 403}
+
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"no failures", 0, nil, 1, nil},
+		{"transient failures", 2, unavailable, 3, nil},
+		{"too many failures", 5, unavailable, 3, unavailable},
+		{"rate limited", 1, &googleapi.Error{Code: 429}, 2, nil},
+		{"connection cut", 1, io.ErrUnexpectedEOF, 2, nil},
+		{"forbidden", 2, forbidden, 1, forbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 1)
+
+			loadTestConf(t, backupConf(dir, "maxRetries: 2"))
+
+			backend := &flakyBackend{failures: test.failures, err: test.err}
+			dest := &bucketClient{backend: backend}
+
+			_, _, err := uploadFile(context.Background(), dest, files[0], "object")
+
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("err = %v, want %v", err, test.wantErr)
+			}
+
+			if backend.attempts != test.wantAttempts {
+				t.Errorf("%d attempts, want %d", backend.attempts, test.wantAttempts)
+			}
+
+			// Every attempt starts over from the first byte
+			if !bytes.Equal(backend.data, []byte(files[0])) {
+				t.Errorf("last attempt sent %q, want %q", backend.data, files[0])
+			}
+		})
+	}
+}
+
+func TestBuildObjectName(t *testing.T) {
+	resetState(t)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/hosts", "base/etc/hosts"},
+		{"/home/user/my file (1).txt", "base/home/user/my file (1).txt"},
+		{"/tmp/ünïcode/#hash?&.log", "base/tmp/ünïcode/#hash?&.log"},
+		{`C:\Users\me\file.txt`, "base/Users/me/file.txt"},
+		{`\\server\share\file.txt`, "base/server/share/file.txt"},
+		{"relative/file", "base/relative/file"},
+	}
+
+	for _, test := range tests {
+		if got := buildObjectName("base", test.path); got != test.want {
+			t.Errorf("buildObjectName(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestBackupPrefixHasNoColons(t *testing.T) {
+	resetState(t)
+	conf.TimestampFormat = pathBaseLayout
+
+	got := backupPrefix(time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local))
+
+	if got != "2024-01-02_15-04-05" {
+		t.Errorf("backupPrefix = %q, want 2024-01-02_15-04-05", got)
+	}
+}
+
+func TestDryRunDoesNotContactGCS(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 5)
+
+	loadTestConf(t, backupConf(dir))
+
+	if err := getFilesToCopy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	printPlan()
+	sort.Strings(filesToCopy)
+
+	if !equalStrings(filesToCopy, files) {
+		t.Errorf("files to copy = %v, want %v", filesToCopy, files)
+	}
+
+	if f.served != 0 {
+		t.Errorf("%d requests to GCS, want none", f.served)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		aborted    bool
+		filesError int
+		want       int
+	}{
+		{"clean", context.Background(), false, 0, 0},
+		{"files failed", context.Background(), false, 3, 2},
+		{"aborted", context.Background(), true, 1, 4},
+		{"deadline", expired, false, 1, 3},
+		{"interrupted", cancelled, false, 0, 130},
+	}
+
+	for _, test := range tests {
+		resetState(t)
+		aborted = test.aborted
+
+		if got := exitCode(test.ctx, test.filesError); got != test.want {
+			t.Errorf("%s: exitCode = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPartialFailureExitCode(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 4)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[2])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir, "maxConsecutiveFailures: 0"))
+
+	errs := copyFiles(context.Background())
+
+	if errs != 1 {
+		t.Errorf("copyFiles = %d errors, want 1", errs)
+	}
+
+	if code := exitCode(context.Background(), errs); code != 2 {
+		t.Errorf("exitCode = %d, want 2", code)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "dir/sub/a.tmp", true},
+		{"*.tmp", "a.tmp.txt", false},
+		{"node_modules", "web/node_modules", true},
+		{"logs/*.log", "logs/app.log", true},
+		{"logs/*.log", "old/logs/app.log", false},
+		{"**/logs/*.log", "old/logs/app.log", true},
+		{"**/logs/*.log", "logs/app.log", true},
+		{"src/**", "src/a/b/c.go", true},
+		{"src/**/*.go", "src/c.go", true},
+		{"src/**/*.go", "lib/src/c.go", false},
+	}
+
+	for _, test := range tests {
+		if got := matchPattern(test.pattern, test.rel); got != test.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", test.pattern, test.rel, got, test.want)
+		}
+	}
+}
+
+// makeTree creates the files of paths, relative to dir, with their path as
+// content
+func makeTree(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+
+	for _, p := range paths {
+		file := filepath.Join(dir, filepath.FromSlash(p))
+
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(file, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// walkedFiles loads the configuration yaml, walks its directories and
+// returns the files to copy relative to dir, sorted
+func walkedFiles(t *testing.T, dir, yaml string) []string {
+	t.Helper()
+
+	loadTestConf(t, yaml)
+
+	if err := getFilesToCopy(context.Background()); err != nil {
+		t.Fatalf("getFilesToCopy: %v", err)
+	}
+
+	var rels []string
+
+	for _, file := range filesToCopy {
+		rel, err := filepath.Rel(dir, file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+
+	sort.Strings(rels)
+
+	return rels
+}
+
+func TestIncludeExclude(t *testing.T) {
+	dir := t.TempDir()
+
+	makeTree(t, dir, "a.txt", "b.tmp", "src/main.go", "src/lib/util.go", "src/lib/util.tmp",
+		"web/node_modules/pkg/index.js", "web/app.js", ".git/config")
+
+	tests := []struct {
+		name  string
+		extra []string
+		want  []string
+	}{
+		{"everything", nil, []string{".git/config", "a.txt", "b.tmp", "src/lib/util.go", "src/lib/util.tmp", "src/main.go", "web/app.js", "web/node_modules/pkg/index.js"}},
+		{"extension", []string{"exclude: ['*.tmp']"}, []string{".git/config", "a.txt", "src/lib/util.go", "src/main.go", "web/app.js", "web/node_modules/pkg/index.js"}},
+		{"pruned directories", []string{"exclude: [node_modules, .git]"}, []string{"a.txt", "b.tmp", "src/lib/util.go", "src/lib/util.tmp", "src/main.go", "web/app.js"}},
+		{"nested include", []string{"include: ['src/**/*.go']"}, []string{"src/lib/util.go", "src/main.go"}},
+		{"exclude wins", []string{"include: ['src/**']", "exclude: [lib]"}, []string{"src/main.go"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := walkedFiles(t, dir, backupConf(dir, test.extra...))
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("files = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChecksumMismatchFailsTheFile(t *testing.T) {
+	// A staged copy has its CRC32C known before the upload, which GCS
+	// checks. Otherwise the object is checked, and deleted, once written
+	for _, stage := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		files := writeFiles(t, dir, 3)
+
+		f.corrupt = func(name string) bool {
+			return strings.HasSuffix(name, absoluteObjectPath(files[1]))
+		}
+
+		loadTestConf(t, backupConf(dir, "maxRetries: 1", fmt.Sprintf("stage: %v", stage)))
+
+		if errs := copyFiles(context.Background()); errs != 1 {
+			t.Errorf("stage %v: copyFiles = %d errors, want 1", stage, errs)
+		}
+
+		if got := totalFilesOK.get(); got != 2 {
+			t.Errorf("stage %v: totalFilesOK = %d, want 2", stage, got)
+		}
+
+		name := backupPrefixOf(f, testBucket) + "/" + absoluteObjectPath(files[1])
+
+		if f.object(testBucket, name) != nil {
+			t.Errorf("stage %v: corrupt object %s left in the bucket", stage, name)
+		}
+	}
+}
+
+// mainEnv makes the test binary run main with the arguments after "--",
+// see runMain
+const mainEnv = "GCS_BACKUP_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) != "" {
+		for i, arg := range os.Args {
+			if arg == "--" {
+				os.Args = append([]string{"gcs-backup"}, os.Args[i+1:]...)
+				break
+			}
+		}
+
+		main()
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain runs the program with args in another process, with the
+// environment of the test, and returns its output and exit status
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+
+	out, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+
+	if err != nil {
+		t.Fatalf("running main: %v", err)
+	}
+
+	return string(out), 0
+}
+
+// runMainStreams is runMain with stdout and stderr apart
+func runMainStreams(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+
+	if errors.As(err, &exitErr) {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	}
+
+	if err != nil {
+		t.Fatalf("running main: %v", err)
+	}
+
+	return stdout.String(), stderr.String(), 0
+}
+
+func TestVersionFlag(t *testing.T) {
+	// The configuration would fail
+	out, code := runMain(t, "-version", "-config", filepath.Join(t.TempDir(), "missing.yaml"))
+
+	if code != 0 {
+		t.Errorf("exit status %d, want 0: %s", code, out)
+	}
+
+	if !strings.Contains(out, version) || !strings.Contains(out, "commit "+commit) {
+		t.Errorf("output %q, want the version and the commit", out)
+	}
+}
+
+func TestStartUploadTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		opts         objectOptions
+		wantDeadline bool
+	}{
+		{"timeout", time.Minute, objectOptions{}, true},
+		{"zero means unlimited", 0, objectOptions{}, false},
+		{"stream of unknown length", time.Minute, objectOptions{NoTimeout: true}, false},
+	}
+
+	for _, test := range tests {
+		resetState(t)
+		uploadTimeout = test.timeout
+
+		ctx, done, err := startUpload(context.Background(), test.opts)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := ctx.Deadline(); ok != test.wantDeadline {
+			t.Errorf("%s: deadline %v, want %v", test.name, ok, test.wantDeadline)
+		}
+
+		done()
+	}
+}
+
+func TestCancelStopsTheWorkers(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 200)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var uploads int32
+
+	f.onUpload = func(name string) {
+		if atomic.AddInt32(&uploads, 1) == 5 {
+			cancel()
+		}
+	}
+
+	loadTestConf(t, backupConf(dir, "concurrency: 2"))
+
+	started := time.Now()
+	errs := copyFiles(ctx)
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("copyFiles took %v after the cancel", elapsed)
+	}
+
+	if copied := totalFilesOK.get(); copied >= 20 {
+		t.Errorf("%d files copied after the cancel, want the workers to stop", copied)
+	}
+
+	if code := exitCode(ctx, errs); code != 130 {
+		t.Errorf("exitCode = %d, want 130", code)
+	}
+
+	// The manifest is still written
+	if backupPrefixOf(f, testBucket) == "" {
+		t.Error("no manifest written")
+	}
+}
+
+func TestIsUnchanged(t *testing.T) {
+	files := writeFiles(t, t.TempDir(), 1)
+	info, err := os.Stat(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same := fileMetadata(info)
+	mtime := info.ModTime().Add(time.Second).UTC().Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		want     bool
+	}{
+		{"same size and mtime", same, true},
+		{"other size", map[string]string{"x-size": "1", "x-mtime": same["x-mtime"]}, false},
+		{"other mtime", map[string]string{"x-size": same["x-size"], "x-mtime": mtime}, false},
+		{"no metadata", nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isUnchanged(&storage.ObjectAttrs{Metadata: test.metadata}, info); got != test.want {
+			t.Errorf("%s: isUnchanged = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIncrementalSkipsUnchangedFiles(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	backUp(t, f, dir, "incremental: true")
+
+	if got := totalFilesOK.get(); got != 3 {
+		t.Fatalf("first run copied %d files, want 3", got)
+	}
+
+	backUp(t, f, dir, "incremental: true")
+
+	if copied, skipped := totalFilesOK.get(), totalFilesSkipped.get(); copied != 0 || skipped != 3 {
+		t.Errorf("unchanged run copied %d and skipped %d files, want 0 and 3", copied, skipped)
+	}
+
+	later := time.Now().Add(time.Minute)
+
+	if err := os.Chtimes(files[1], later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	backUp(t, f, dir, "incremental: true")
+
+	if copied, skipped := totalFilesOK.get(), totalFilesSkipped.get(); copied != 1 || skipped != 2 {
+		t.Errorf("run after a change copied %d and skipped %d files, want 1 and 2", copied, skipped)
+	}
+
+	name := incrementalPrefix + "/" + absoluteObjectPath(files[1])
+
+	if uploads := f.count("UPLOAD", name); uploads != 2 {
+		t.Errorf("changed file uploaded %d times, want 2", uploads)
+	}
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	dir := t.TempDir()
+
+	makeTree(t, dir, "file.txt", "real/inner.txt")
+
+	for link, target := range map[string]string{"link.txt": "file.txt", "linkdir": "real", "real/loop": ".."} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		symlinks string
+		want     []string
+	}{
+		{"skip", []string{"file.txt", "real/inner.txt"}},
+		{"follow", []string{"file.txt", "link.txt", "linkdir/inner.txt", "real/inner.txt"}},
+		{"record", []string{"file.txt", "link.txt", "linkdir", "real/inner.txt", "real/loop"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.symlinks, func(t *testing.T) {
+			got := walkedFiles(t, dir, backupConf(dir, "symlinks: "+test.symlinks))
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("files = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordedSymlink(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+
+	makeTree(t, dir, "file.txt")
+
+	if err := os.Symlink("file.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := backUp(t, f, dir, "symlinks: record")
+	obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(filepath.Join(dir, "link.txt")))
+
+	if obj == nil {
+		t.Fatal("no object of the symlink")
+	}
+
+	if obj.Metadata["x-symlink"] != "file.txt" || len(obj.Data) != 0 {
+		t.Errorf("object of the symlink holds %q with metadata %v", obj.Data, obj.Metadata)
+	}
+}
+
+func TestSizeAndAgeFilters(t *testing.T) {
+	dir := t.TempDir()
+	since := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	files := []struct {
+		name  string
+		size  int
+		mtime time.Time
+	}{
+		{"small", 9, since},
+		{"min", 10, since},
+		{"max", 100, since},
+		{"large", 101, since},
+		{"old", 50, since.Add(-time.Second)},
+		{"old-and-large", 500, since.Add(-time.Hour)},
+		{"new", 50, since.Add(time.Hour)},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+
+		if err := ioutil.WriteFile(path, make([]byte, file.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(path, file.mtime, file.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := walkedFiles(t, dir, backupConf(dir, "minSize: 10", "maxSize: 100B", "modifiedSince: "+since.Format(time.RFC3339)))
+
+	if want := []string{"max", "min", "new"}; !equalStrings(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+
+	// Each file counts once, for the first filter that drops it
+	if totalFilesFilterSize != 3 || totalFilesFilterAge != 1 {
+		t.Errorf("filtered %d by size and %d by age, want 3 and 1", totalFilesFilterSize, totalFilesFilterAge)
+	}
+
+	loadTestConf(t, backupConf(dir, "modifiedWithin: 1h"))
+
+	if cutoff := time.Now().Add(-time.Hour); modifiedAfter.Sub(cutoff) > time.Second || cutoff.Sub(modifiedAfter) > time.Second {
+		t.Errorf("modifiedWithin 1h cuts at %v, want about %v", modifiedAfter, cutoff)
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "minSize: 1MB", "maxSize: 1KB")), "maxSize 1KB is smaller than minSize 1MB")
+	wantConfError(t, parseTestConf(t, backupConf(dir, "modifiedSince: yesterday")), "modifiedSince")
+
+	for _, within := range []string{"-1h", "0", "-2d", "0d"} {
+		wantConfError(t, parseTestConf(t, backupConf(dir, "modifiedWithin: "+within)), "modifiedWithin must be positive")
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(dir, "modifiedWithin: NaNd")), "modifiedWithin: invalid duration")
+}
+
+func TestRenderPrefix(t *testing.T) {
+	resetState(t)
+	t.Setenv("DEPLOY_ENV", "prod")
+
+	sourceHost = "web01"
+	prefixLocation = time.UTC
+	conf.PrefixEnvVar = "DEPLOY_ENV"
+
+	started := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"{env}/{hostname}/{date}", "prod/web01/2024-01-02"},
+		{"{date}_{time}", "2024-01-02_15-04-05"},
+		{"/backups//{hostname}/", "backups/web01"},
+		{"fixed", "fixed"},
+	}
+
+	for _, test := range tests {
+		if got, err := renderPrefix(test.tmpl, started); err != nil || got != test.want {
+			t.Errorf("renderPrefix(%q) = %q, %v, want %q", test.tmpl, got, err, test.want)
+		}
+	}
+
+	if _, err := renderPrefix("{hostname}/{user}", started); err == nil || !strings.Contains(err.Error(), "unknown placeholder {user}") {
+		t.Errorf("renderPrefix with {user} gave %v, want an unknown placeholder", err)
+	}
+
+	conf.PrefixTemplate = "{env}/{hostname}"
+
+	if got := backupPrefix(started); got != "prod/web01" {
+		t.Errorf("backupPrefix = %q, want prod/web01", got)
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(t.TempDir(), "prefixTemplate: '{user}/{date}'")), "unknown placeholder {user}")
+}
+
+func TestChunkSize(t *testing.T) {
+	resetState(t)
+
+	tests := []struct {
+		chunkSizeMB int
+		size        int64
+		want        int
+	}{
+		{16, 1 << 20, 0},
+		{16, 16<<20 - 1, 0},
+		{16, 16 << 20, 16 << 20},
+		{1, 100 << 20, 1 << 20},
+		{0, 100 << 20, 0},
+	}
+
+	for _, test := range tests {
+		conf.ChunkSizeMB = test.chunkSizeMB
+
+		if got := chunkSize(test.size); got != test.want {
+			t.Errorf("chunkSize(%d) with chunkSizeMB %d = %d, want %d", test.size, test.chunkSizeMB, got, test.want)
+		}
+	}
+
+	wantConfError(t, parseTestConf(t, backupConf(t.TempDir(), "chunkSizeMB: -1")), "chunkSizeMB must not be negative")
+}
+
+func TestResumableUploads(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+
+	makeTree(t, dir, "small.txt")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "large.bin"), large, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := backUp(t, f, dir, "chunkSizeMB: 1", "pathMode: relative")
+	base := prefix + "/" + filepath.Base(dir)
+
+	if n := f.count("RESUMABLE", base+"/large.bin"); n != 1 {
+		t.Errorf("large file sent in %d resumable uploads, want 1", n)
+	}
+
+	if n := f.count("RESUMABLE", base+"/small.txt"); n != 0 {
+		t.Errorf("small file sent in %d resumable uploads, want 0", n)
+	}
+
+	if obj := f.object(testBucket, base+"/large.bin"); obj == nil || !bytes.Equal(obj.Data, large) {
+		t.Error("object of the large file differs from it")
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	resetState(t)
+	conf.ContentTypes = map[string]string{".log": "text/plain; charset=utf-8"}
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	tests := []struct {
+		path string
+		data []byte
+		want string
+	}{
+		{"data.json", []byte(`{"a": 1}`), "application/json"},
+		{"image.png", png, "image/png"},
+		{"IMAGE.PNG", png, "image/png"},
+		{"image.unknownext", png, "image/png"},
+		{"notes.unknownext", []byte("plain words"), "text/plain; charset=utf-8"},
+		{"blob.unknownext", []byte{0, 1, 2, 3}, "application/octet-stream"},
+		{"app.log", []byte{0, 1, 2, 3}, "text/plain; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		r := bytes.NewReader(test.data)
+
+		got, err := detectContentType(test.path, r)
+
+		if err != nil || got != test.want {
+			t.Errorf("detectContentType(%s) = %q, %v, want %q", test.path, got, err, test.want)
+		}
+
+		// The upload reads the file from the start
+		if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+			t.Errorf("detectContentType(%s) left the file at %d", test.path, pos)
+		}
+	}
+	// The extensions of the configuration are matched in any case, with
+	// or without the dot
+	loadTestConf(t, backupConf(t.TempDir(), "contentTypes: {LOG: text/x-log, .Dump: application/sql}"))
+
+	if conf.ContentTypes[".log"] != "text/x-log" || conf.ContentTypes[".dump"] != "application/sql" {
+		t.Errorf("contentTypes = %v", conf.ContentTypes)
+	}
+}
+
+func TestGetFilesToCopyReturnsErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, 3)
+
+	loadTestConf(t, backupConf(dir))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := getFilesToCopy(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("getFilesToCopy of a cancelled run = %v, want %v", err, context.Canceled)
+	}
+}
+
+// objectNames walks the configuration yaml and returns the object paths of
+// the files to copy, without the prefix, sorted
+func objectNames(t *testing.T, yaml string) []string {
+	t.Helper()
+
+	loadTestConf(t, yaml)
+
+	if err := getFilesToCopy(context.Background()); err != nil {
+		t.Fatalf("getFilesToCopy: %v", err)
+	}
+
+	var names []string
+
+	for _, file := range filesToCopy {
+		names = append(names, strings.TrimPrefix(buildObjectName("p", file), "p/"))
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestPathModes(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "docs/a.txt", "docs/sub/b.txt")
+
+	root := filepath.Join(dir, "docs")
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{pathModeAbsolute, []string{absoluteObjectPath(filepath.Join(root, "a.txt")), absoluteObjectPath(filepath.Join(root, "sub", "b.txt"))}},
+		{pathModeRelative, []string{"docs/a.txt", "docs/sub/b.txt"}},
+		{pathModeFlatten, []string{"a.txt", "b.txt"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			got := objectNames(t, backupConf(root, "pathMode: "+test.mode))
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("object paths = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFlattenCollisions(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "a.txt", "sub/a.txt", "sub/b.txt")
+
+	t.Run(collisionError, func(t *testing.T) {
+		loadTestConf(t, backupConf(dir, "pathMode: flatten"))
+
+		err := getFilesToCopy(context.Background())
+
+		if err == nil || !strings.Contains(err.Error(), "would both be stored as \"a.txt\"") {
+			t.Errorf("getFilesToCopy = %v, want a collision error", err)
+		}
+	})
+
+	t.Run(collisionSkip, func(t *testing.T) {
+		got := objectNames(t, backupConf(dir, "pathMode: flatten", "collisions: skip"))
+
+		if want := []string{"a.txt", "b.txt"}; !equalStrings(got, want) {
+			t.Errorf("object paths = %v, want %v", got, want)
+		}
+
+		if len(filesToCopy) != 2 {
+			t.Errorf("%d files to copy, want 2", len(filesToCopy))
+		}
+	})
+
+	t.Run(collisionSuffix, func(t *testing.T) {
+		got := objectNames(t, backupConf(dir, "pathMode: flatten", "collisions: suffix"))
+
+		if want := []string{"a-1.txt", "a.txt", "b.txt"}; !equalStrings(got, want) {
+			t.Errorf("object paths = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestUploadsStartDuringTheWalk(t *testing.T) {
+	const n, workers, queue = 50, 1, 1
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, n)
+
+	loadTestConf(t, backupConf(dir, fmt.Sprintf("concurrency: %d", workers), fmt.Sprintf("queueSize: %d", queue)))
+
+	// The files found by the walk when the first object arrives
+	found := int32(-1)
+
+	f.onUpload = func(name string) {
+		walkMutex.Lock()
+		total := totalFilesToCopy
+		walkMutex.Unlock()
+
+		atomic.CompareAndSwapInt32(&found, -1, int32(total))
+	}
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	// The walk waits for the queue, so it can't be more than the queue,
+	// each worker and the file it's sending ahead
+	if got := atomic.LoadInt32(&found); got < 1 || got > workers+queue+1 {
+		t.Errorf("first upload after %d files found, want at most %d of %d", got, workers+queue+1, n)
+	}
+
+	if totalFilesToCopy != n || int(totalFilesOK.get()) != n {
+		t.Errorf("counted %d files copied of %d, want %d", totalFilesOK.get(), totalFilesToCopy, n)
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := map[string][]string{
+		"/var/log":            {"/var/log"},
+		"/var/log/app-{a,b}":  {"/var/log/app-a", "/var/log/app-b"},
+		"/{srv,opt}/{x,y}":    {"/srv/x", "/srv/y", "/opt/x", "/opt/y"},
+		"/data/{a,b{1,2}}/in": {"/data/a/in", "/data/b1/in", "/data/b2/in"},
+		"/data/{a,}":          {"/data/a", "/data/"},
+		"/data/{unclosed":     {"/data/{unclosed"},
+	}
+
+	for s, want := range tests {
+		if got := expandBraces(s); !equalStrings(got, want) {
+			t.Errorf("expandBraces(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestExpandDirectories(t *testing.T) {
+	resetState(t)
+
+	dir := t.TempDir()
+	makeTree(t, dir, "srv/a/data/1", "srv/b/data/2", "srv/c/other/3", "log/app-a/4", "log/app-b/5", "log/app-d/6")
+
+	path := func(p string) string {
+		return filepath.Join(dir, filepath.FromSlash(p))
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"literal", []string{path("srv")}, []string{path("srv")}},
+		{"glob", []string{path("srv/*/data")}, []string{path("srv/a/data"), path("srv/b/data")}},
+		{"braces", []string{path("log/app-{a,b,c}")}, []string{path("log/app-a"), path("log/app-b"), path("log/app-c")}},
+		{"duplicates", []string{path("log/app-{a,b}"), path("log/app-*"), path("log/app-a/")}, []string{path("log/app-a"), path("log/app-b"), path("log/app-d")}},
+		{"no match", []string{path("srv/*/missing"), path("srv/a")}, []string{path("srv/a")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var entries []Directory
+
+			for _, pattern := range test.patterns {
+				entries = append(entries, Directory{Path: pattern, StorageClass: "NEARLINE"})
+			}
+
+			var got []string
+
+			for _, d := range expandDirectories(entries) {
+				if d.StorageClass != "NEARLINE" {
+					t.Errorf("%s lost the settings of its entry", d.Path)
+				}
+
+				got = append(got, d.Path)
+			}
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("directories = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("warning", func(t *testing.T) {
+		resetState(t)
+
+		logThreshold = levelWarning
+		runLog = new(bytes.Buffer)
+
+		pattern := path("srv/*/missing")
+
+		if dirs := expandDirectories([]Directory{{Path: pattern}}); len(dirs) != 0 {
+			t.Errorf("directories = %v, want none", dirs)
+		}
+
+		if want := fmt.Sprintf("Dir pattern \"%s\" matches nothing", pattern); !strings.Contains(runLog.String(), want) {
+			t.Errorf("log = %q, want %q", runLog.String(), want)
+		}
+	})
+}
+
+func TestMaxInflight(t *testing.T) {
+	// Without maxInflight, the workers upload at the same time
+	for _, limit := range []int{0, 2} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			writeFiles(t, dir, 40)
+
+			loadTestConf(t, backupConf(dir, "concurrency: 8", fmt.Sprintf("maxInflight: %d", limit)))
+
+			var current, most int32
+
+			f.onUpload = func(name string) {
+				n := atomic.AddInt32(&current, 1)
+				defer atomic.AddInt32(&current, -1)
+
+				for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+				}
+
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			if errs := copyFiles(context.Background()); errs != 0 {
+				t.Fatalf("copyFiles = %d errors, want 0", errs)
+			}
+
+			got := atomic.LoadInt32(&most)
+
+			if limit > 0 && got > int32(limit) {
+				t.Errorf("%d uploads at the same time, over the maxInflight of %d", got, limit)
+			}
+
+			if limit == 0 && got <= 2 {
+				t.Errorf("%d uploads at the same time without maxInflight, want the workers uploading together", got)
+			}
+
+			if len(inflight) != 0 {
+				t.Errorf("%d slots still taken after the run", len(inflight))
+			}
+		})
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, "main.go", "README.MD", "conf.Yaml", "bin/app.exe", "notes", "src/util.GO", "archive.tar.gz")
+
+	tests := []struct {
+		name       string
+		extra      []string
+		want       []string
+		wantFilter int
+	}{
+		{"empty list", nil, []string{"README.MD", "archive.tar.gz", "bin/app.exe", "conf.Yaml", "main.go", "notes", "src/util.GO"}, 0},
+		{"any case", []string{"extensions: [GO, .yaml, md]"}, []string{"README.MD", "conf.Yaml", "main.go", "src/util.GO"}, 3},
+		{"last extension", []string{"extensions: [gz]"}, []string{"archive.tar.gz"}, 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := walkedFiles(t, dir, backupConf(dir, test.extra...))
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("files = %v, want %v", got, test.want)
+			}
+
+			if totalFilesFilterExt != test.wantFilter {
+				t.Errorf("totalFilesFilterExt = %d, want %d", totalFilesFilterExt, test.wantFilter)
+			}
+		})
+	}
+}
+
+func TestDeadlineTruncatesTheBackup(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 100)
+
+	// Too slow for the 100 files to make it in time
+	f.onUpload = func(name string) {
+		if !strings.HasSuffix(name, "/"+manifestName) && !strings.HasSuffix(name, "/"+checksumsName) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if err := parseTestConf(t, backupConf(dir, "concurrency: 2", "maxDuration: 1h")); err != nil {
+		t.Fatal(err)
+	}
+
+	if maxDuration != time.Hour {
+		t.Errorf("maxDuration = %v, want 1h", maxDuration)
+	}
+
+	// The flag wins over the configuration
+	started := time.Now()
+	out, code := runMain(t, "-config", fileConf, "-deadline", "300ms")
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("backup took %v with a deadline of 300ms", elapsed)
+	}
+
+	if code != 3 {
+		t.Errorf("exit status %d, want 3: %s", code, out)
+	}
+
+	for _, want := range []string{"Backup truncated by the deadline of 300ms", "Truncated by the deadline: true"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output without %q:\n%s", want, out)
+		}
+	}
+
+	if n := len(backedUp(f, testBucket)); n == 0 || n >= 100 {
+		t.Errorf("%d files copied before the deadline, want some but not all", n)
+	}
+
+	// What was done is still recorded
+	if backupPrefixOf(f, testBucket) == "" {
+		t.Error("no manifest written")
+	}
+}
+
+func TestObjectMetadata(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 1)
+
+	before := time.Now().UTC().Truncate(time.Second)
+
+	loadTestConf(t, backupConf(dir, "sourceHost: web-1", "metadata: {team: payments, env: prod, host: '{hostname}', x-source-path: /elsewhere}"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	obj := f.object(testBucket, backupPrefixOf(f, testBucket)+"/"+absoluteObjectPath(files[0]))
+
+	if obj == nil {
+		t.Fatal("no object of the file")
+	}
+
+	// The built-ins can't be overridden
+	want := map[string]string{
+		"team":          "payments",
+		"env":           "prod",
+		"host":          "web-1",
+		"x-source-path": files[0],
+		"x-source-host": "web-1",
+		"x-size":        fmt.Sprint(len(files[0])),
+	}
+
+	for k, v := range want {
+		if obj.Metadata[k] != v {
+			t.Errorf("metadata %s = %q, want %q", k, obj.Metadata[k], v)
+		}
+	}
+
+	uploaded, err := time.Parse(time.RFC3339, obj.Metadata["x-uploaded"])
+
+	if err != nil || uploaded.Before(before) || uploaded.After(time.Now()) {
+		t.Errorf("x-uploaded = %q, want the time of the upload", obj.Metadata["x-uploaded"])
+	}
+
+	err = parseTestConf(t, backupConf(dir, "metadata: {owner: '{user}'}"))
+	wantConfError(t, err, "unknown placeholder {user}")
+}
+
+func TestWalkOfSeveralDirectories(t *testing.T) {
+	root := t.TempDir()
+
+	var want []string
+	var dirs []string
+
+	for d := 0; d < 6; d++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir-%d", d))
+
+		if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, file := range writeFiles(t, filepath.Join(dir, "sub"), 50) {
+			rel, _ := filepath.Rel(root, file)
+			want = append(want, filepath.ToSlash(rel))
+		}
+
+		dirs = append(dirs, fmt.Sprintf("  - %q\n", dir))
+	}
+
+	// Overlapping directories find the same files twice
+	dirs = append(dirs, fmt.Sprintf("  - %q\n", filepath.Join(root, "dir-0", "sub")))
+
+	sort.Strings(want)
+
+	yaml := "directories:\n" + strings.Join(dirs, "") + "googleCloud:\n  nameBucket: " + testBucket + "\n"
+	got := walkedFiles(t, root, yaml)
+
+	if !equalStrings(got, want) {
+		t.Errorf("found %d files, want the %d of every directory once", len(got), len(want))
+	}
+
+	if totalFilesToCopy != len(want) {
+		t.Errorf("totalFilesToCopy = %d, want %d", totalFilesToCopy, len(want))
+	}
+}
+
+func TestDirectoryEntries(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root, "dir/a.txt", "dir/sub/b.txt", "single.txt")
+
+	dir, file, missing := filepath.Join(root, "dir"), filepath.Join(root, "single.txt"), filepath.Join(root, "missing")
+
+	// A character device is neither a file nor a directory
+	entries := []string{dir, file, missing, os.DevNull}
+
+	tests := []struct {
+		fileEntries string
+		want        []string
+		warnings    []string
+	}{
+		{fileEntriesBackup, []string{"dir/a.txt", "dir/sub/b.txt", "single.txt"},
+			[]string{"Dir \"" + missing + "\" not found", "Dir \"" + os.DevNull + "\" is neither a file nor a directory, skipped"}},
+		{fileEntriesSkip, []string{"dir/a.txt", "dir/sub/b.txt"},
+			[]string{"Dir \"" + missing + "\" not found", "Dir \"" + file + "\" is a file, skipped"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fileEntries, func(t *testing.T) {
+			var list []string
+
+			for _, entry := range entries {
+				list = append(list, fmt.Sprintf("  - %q\n", entry))
+			}
+
+			yaml := "directories:\n" + strings.Join(list, "") + "googleCloud:\n  nameBucket: " + testBucket + "\nfileEntries: " + test.fileEntries + "\n"
+
+			loadTestConf(t, yaml)
+
+			logThreshold = levelWarning
+			runLog = new(bytes.Buffer)
+
+			if err := getFilesToCopy(context.Background()); err != nil {
+				t.Fatalf("getFilesToCopy: %v", err)
+			}
+
+			var got []string
+
+			for _, path := range filesToCopy {
+				rel, _ := filepath.Rel(root, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+
+			sort.Strings(got)
+
+			if !equalStrings(got, test.want) {
+				t.Errorf("files = %v, want %v", got, test.want)
+			}
+
+			for _, warning := range test.warnings {
+				if !strings.Contains(runLog.String(), "[WARNING] "+warning) {
+					t.Errorf("log without %q:\n%s", warning, runLog)
+				}
+			}
+
+			// A file entry is named like the files of its directory in
+			// relative mode
+			if test.fileEntries == fileEntriesBackup {
+				conf.PathMode = pathModeRelative
+				takenPaths = map[string]string{}
+
+				want := filepath.Base(root) + "/single.txt"
+
+				if name, err := objectPath(filepath.Dir(file), file); err != nil || name != want {
+					t.Errorf("object path of the file = %q, %v, want %q", name, err, want)
+				}
+			}
+		})
+	}
+}
+
+// changingBackend is a Backend that calls change with the number of the
+// attempt before reading each upload, and keeps what the last one read
+type changingBackend struct {
+	flakyBackend
+	change func(attempt int)
+}
+
+func (b *changingBackend) Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error) {
+	b.change(b.attempts + 1)
+
+	return b.flakyBackend.Upload(ctx, name, r, opts)
+}
+
+func TestFileChangedDuringUpload(t *testing.T) {
+	tests := []struct {
+		name         string
+		retry        bool
+		change       func(path string, attempt int) error
+		wantErr      string
+		wantAttempts int
+	}{
+		{"grew", false, func(path string, attempt int) error {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			_, err = f.WriteString(" and more")
+
+			return err
+		}, "bytes read", 1},
+		{"shrank", false, func(path string, attempt int) error {
+			return os.Truncate(path, 3)
+		}, "3 bytes read", 1},
+		{"modified", false, func(path string, attempt int) error {
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(path, later, later)
+		}, "modified while reading it", 1},
+		{"retried", true, func(path string, attempt int) error {
+			if attempt > 1 {
+				return nil
+			}
+
+			return os.Truncate(path, 3)
+		}, "", 2},
+		{"retried once", true, func(path string, attempt int) error {
+			return os.Truncate(path, int64(10-attempt))
+		}, "bytes read", 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "growing.log")
+
+			if err := ioutil.WriteFile(path, []byte("some log lines"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			extra := []string{}
+
+			if test.retry {
+				extra = append(extra, "retryChanged: true")
+			}
+
+			loadTestConf(t, backupConf(dir, extra...))
+
+			backend := &changingBackend{change: func(attempt int) {
+				if err := test.change(path, attempt); err != nil {
+					t.Error(err)
+				}
+			}}
+
+			_, _, err := uploadFile(context.Background(), &bucketClient{backend: backend}, path, "object")
+
+			if test.wantErr == "" && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+
+			if test.wantErr != "" && (!errors.Is(err, errFileChanged) || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("err = %v, want %v with %q", err, errFileChanged, test.wantErr)
+			}
+
+			if backend.attempts != test.wantAttempts {
+				t.Errorf("%d attempts, want %d", backend.attempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestFilesChangedAreCounted(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	f.onUpload = func(name string) {
+		if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(files[1], later, later)
+		}
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Errorf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if changed, copied := totalFilesChanged.get(), totalFilesOK.get(); changed != 1 || copied != 2 {
+		t.Errorf("%d files changed and %d copied, want 1 and 2", changed, copied)
+	}
+
+	for _, entry := range readManifest(t, f, testBucket, backupPrefixOf(f, testBucket)).Files {
+		want := statusCopied
+
+		if entry.File == files[1] {
+			want = statusChanged
+		}
+
+		if entry.Status != want {
+			t.Errorf("%s is %s, want %s", entry.File, entry.Status, want)
+		}
+	}
+}
+
+func TestSleepJitter(t *testing.T) {
+	loadTestConf(t, backupConf(t.TempDir(), "startupJitter: 10m"))
+
+	if startupJitter != 10*time.Minute {
+		t.Errorf("startupJitter = %v, want 10m", startupJitter)
+	}
+
+	// Zero disables it, whatever the context
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := sleepJitter(cancelled, 0); err != nil {
+		t.Errorf("sleepJitter of 0 = %v, want nil", err)
+	}
+
+	const max = 50 * time.Millisecond
+
+	for i := 0; i < 5; i++ {
+		started := time.Now()
+
+		if err := sleepJitter(context.Background(), max); err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(started); elapsed > max+time.Second {
+			t.Errorf("slept %v, want at most %v", elapsed, max)
+		}
+	}
+
+	// Cancelled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	started := time.Now()
+
+	if err := sleepJitter(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepJitter = %v, want %v", err, context.Canceled)
+	}
+
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("returned %v after the cancel", elapsed)
+	}
+}
+
+func TestIsFatal(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bucket missing", fmt.Errorf("Writer.Close: %w", storage.ErrBucketNotExist), true},
+		{"token refused", &oauth2.RetrieveError{}, true},
+		{"unauthorized", &googleapi.Error{Code: 401}, true},
+		{"not found", fmt.Errorf("Writer.Close: %w", &googleapi.Error{Code: 404}), true},
+		{"S3 forbidden", &s3Error{StatusCode: 403, Code: "SignatureDoesNotMatch"}, true},
+		{"S3 bucket missing", &s3Error{StatusCode: 404, Code: "NoSuchBucket"}, true},
+		{"forbidden file", &googleapi.Error{Code: 403}, false},
+		{"unavailable", &googleapi.Error{Code: 503}, false},
+		{"S3 unavailable", &s3Error{StatusCode: 503}, false},
+		{"file error", os.ErrPermission, false},
+		{"connection cut", io.ErrUnexpectedEOF, false},
+	}
+
+	for _, test := range tests {
+		if got := isFatal(test.err); got != test.want {
+			t.Errorf("%s: isFatal(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestFatalErrorsAbort(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		extra       []string
+		wantAborted bool
+	}{
+		{"file error", http.StatusForbidden, nil, false},
+		{"file error with failFast", http.StatusForbidden, []string{"failFast: true"}, true},
+		{"bucket missing", http.StatusNotFound, nil, true},
+		{"credentials refused", http.StatusUnauthorized, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 50)
+
+			f.failUpload = func(bucket, name string) int {
+				if strings.HasSuffix(name, absoluteObjectPath(files[0])) {
+					return test.status
+				}
+
+				return 0
+			}
+
+			loadTestConf(t, backupConf(dir, append([]string{"concurrency: 1", "maxConsecutiveFailures: 0"}, test.extra...)...))
+
+			errs := copyFiles(context.Background())
+
+			if aborted != test.wantAborted {
+				t.Errorf("aborted = %v, want %v", aborted, test.wantAborted)
+			}
+
+			// The first file stops the run before the others are copied
+			copied := int(totalFilesOK.get())
+
+			if test.wantAborted && copied >= 10 {
+				t.Errorf("%d files copied after the first one failed", copied)
+			}
+
+			if !test.wantAborted && copied != len(files)-1 {
+				t.Errorf("%d files copied, want %d", copied, len(files)-1)
+			}
+
+			want := 2
+
+			if test.wantAborted {
+				want = 4
+			}
+
+			if code := exitCode(context.Background(), errs); code != want {
+				t.Errorf("exitCode = %d, want %d", code, want)
+			}
+		})
+	}
+}
+
+func TestHoldObject(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if n := f.count(http.MethodPatch, backupPrefixOf(f, testBucket)+"/"+absoluteObjectPath(files[0])); n != 0 {
+		t.Errorf("%d updates without a hold, want 0", n)
+	}
+
+	f = newFakeGCS(t, testBucket)
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+			return http.StatusForbidden
+		}
+
+		return 0
+	}
+
+	before := time.Now().Truncate(time.Second)
+
+	loadTestConf(t, backupConf(dir, "temporaryHold: true", "holdUntil: 24h", "retentionMode: Locked", "maxRetries: 0"))
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	held := prefix + "/" + absoluteObjectPath(files[0])
+	obj := f.object(testBucket, held)
+
+	if obj == nil {
+		t.Fatal("no object of the file")
+	}
+
+	if n := f.count(http.MethodPatch, held); n != 1 {
+		t.Errorf("%d updates of the object, want 1", n)
+	}
+
+	if !obj.TemporaryHold {
+		t.Error("the object has no temporary hold")
+	}
+
+	if obj.RetentionMode != retentionLocked {
+		t.Errorf("retention mode = %q, want %q", obj.RetentionMode, retentionLocked)
+	}
+
+	if obj.RetainUntil.Before(before.Add(24*time.Hour)) || obj.RetainUntil.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("retained until %v, want 24h after the upload", obj.RetainUntil)
+	}
+
+	// A file that failed isn't held
+	if n := f.count(http.MethodPatch, prefix+"/"+absoluteObjectPath(files[1])); n != 0 {
+		t.Errorf("%d updates of the failed file, want 0", n)
+	}
+
+	err := parseTestConf(t, backupConf(dir, "holdUntil: 1d", "retentionMode: Forever"))
+	wantConfError(t, err, "unknown retentionMode \"Forever\"")
+}
+
+func TestConsecutiveFailuresAbort(t *testing.T) {
+	tests := []struct {
+		name        string
+		fails       func(i int) bool
+		wantAborted bool
+	}{
+		{"all fail", func(i int) bool { return true }, true},
+		// Any success resets the count
+		{"every other fails", func(i int) bool { return i%2 == 0 }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 40)
+
+			f.failUpload = func(bucket, name string) int {
+				for i, file := range files {
+					if strings.HasSuffix(name, absoluteObjectPath(file)) && test.fails(i) {
+						return http.StatusForbidden
+					}
+				}
+
+				return 0
+			}
+
+			loadTestConf(t, backupConf(dir, "concurrency: 1", "maxConsecutiveFailures: 5"))
+			runLog = new(bytes.Buffer)
+
+			errs := copyFiles(context.Background())
+
+			if aborted != test.wantAborted {
+				t.Fatalf("aborted = %v, want %v", aborted, test.wantAborted)
+			}
+
+			if !test.wantAborted {
+				if errs != len(files)/2 {
+					t.Errorf("copyFiles = %d errors, want %d", errs, len(files)/2)
+				}
+
+				return
+			}
+
+			if !strings.Contains(runLog.String(), "destination appears unavailable, 5 files failed in a row") {
+				t.Errorf("log = %q, want the destination unavailable", runLog.String())
+			}
+
+			// The run stops at the threshold instead of trying every file
+			if failed := int(totalFilesError.get()); failed < 5 || failed >= 10 {
+				t.Errorf("%d files failed, want the run to stop after 5", failed)
+			}
+
+			if code := exitCode(context.Background(), errs); code != 4 {
+				t.Errorf("exitCode = %d, want 4", code)
+			}
+		})
+	}
+}
+
+func TestFileErrorLimit(t *testing.T) {
+	tests := []struct {
+		setting string
+		total   int
+		want    int64
+	}{
+		{"0", 100, 0},
+		{"3", 100, 3},
+		{"3", 1, 3},
+		{"10%", 100, 10},
+		{"10%", 25, 2},
+		{"2.5%", 200, 5},
+		{"100%", 7, 7},
+	}
+
+	dir := t.TempDir()
+
+	for _, test := range tests {
+		loadTestConf(t, backupConf(dir, "maxFileErrors: '"+test.setting+"'"))
+
+		if got := fileErrorLimit(test.total); got != test.want {
+			t.Errorf("maxFileErrors %s of %d files allows %d, want %d", test.setting, test.total, got, test.want)
+		}
+	}
+
+	for _, setting := range []string{"-1", "1.5", "120%", "many", "%"} {
+		wantConfError(t, parseTestConf(t, backupConf(dir, "maxFileErrors: '"+setting+"'")), "maxFileErrors \""+setting+"\" is not a count")
+	}
+}
+
+func TestMaxFileErrorsAbort(t *testing.T) {
+	tests := []struct {
+		setting     string
+		wantAborted bool
+	}{
+		{"3", true},
+		{"5", false},
+		{"20%", true},
+		{"25%", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.setting, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 20)
+
+			// 5 of the 20 files fail
+			f.failUpload = func(bucket, name string) int {
+				for _, file := range files[:5] {
+					if strings.HasSuffix(name, absoluteObjectPath(file)) {
+						return http.StatusForbidden
+					}
+				}
+
+				return 0
+			}
+
+			loadTestConf(t, backupConf(dir, "concurrency: 1", "maxFileErrors: '"+test.setting+"'"))
+			runLog = new(bytes.Buffer)
+
+			errs := copyFiles(context.Background())
+
+			if aborted != test.wantAborted {
+				t.Fatalf("aborted = %v, want %v", aborted, test.wantAborted)
+			}
+
+			want := 2
+
+			if test.wantAborted {
+				want = 4
+
+				if msg := "over the maxFileErrors of " + test.setting; !strings.Contains(runLog.String(), msg) {
+					t.Errorf("log without %q:\n%s", msg, runLog)
+				}
+			} else if errs != 5 {
+				t.Errorf("copyFiles = %d errors, want 5", errs)
+			}
+
+			if code := exitCode(context.Background(), errs); code != want {
+				t.Errorf("exitCode = %d, want %d", code, want)
+			}
+		})
+	}
+}
+
+func TestBasePrefix(t *testing.T) {
+	started := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	dir := t.TempDir()
+
+	tests := []struct {
+		base string
+		want string
+	}{
+		{"", "20240102150405"},
+		{"apps/web/backups", "apps/web/backups/20240102150405"},
+		{"apps/web/backups/", "apps/web/backups/20240102150405"},
+		{"/apps/web/backups", "apps/web/backups/20240102150405"},
+		{"//apps//web/backups//", "apps/web/backups/20240102150405"},
+		{"/", "20240102150405"},
+	}
+
+	for _, test := range tests {
+		loadTestConf(t, backupConf(dir, "basePrefix: '"+test.base+"'", "timestampFormat: '20060102150405'"))
+		prefixLocation = time.UTC
+
+		if got := backupPrefix(started); got != test.want {
+			t.Errorf("basePrefix %q gives the prefix %q, want %q", test.base, got, test.want)
+		}
+	}
+
+	f := newFakeGCS(t, testBucket)
+	files := writeFiles(t, dir, 2)
+
+	loadTestConf(t, backupConf(dir, "basePrefix: 'apps/web/'"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	names := f.names(testBucket, "apps/web/")
+
+	for _, name := range names {
+		if strings.Contains(name, "//") {
+			t.Errorf("object %q has a doubled slash", name)
+		}
+	}
+
+	for _, file := range files {
+		found := false
+
+		for _, name := range names {
+			found = found || strings.HasSuffix(name, "/"+absoluteObjectPath(file))
+		}
+
+		if !found {
+			t.Errorf("no object of %s under apps/web/ in %v", file, names)
+		}
+	}
+}
+
+func TestSinceFile(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mark := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := writeFiles(t, dir, 4)
+
+	// The first two are older than the reference file
+	for i, file := range files {
+		mtime := old
+
+		if i >= 2 {
+			mtime = mark.Add(time.Hour)
+		}
+
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("newer files", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		ref := filepath.Join(t.TempDir(), "last-backup")
+
+		if err := touchFile(ref, mark); err != nil {
+			t.Fatal(err)
+		}
+
+		loadTestConf(t, backupConf(dir))
+		sinceFile = ref
+		started := time.Now().Truncate(time.Second)
+
+		if errs := copyFiles(context.Background()); errs != 0 {
+			t.Fatalf("copyFiles = %d errors, want 0", errs)
+		}
+
+		if got := backedUp(f, testBucket); len(got) != 2 {
+			t.Errorf("backed up %v, want the 2 newer files", got)
+		}
+
+		// Touched with the start of the run, so the files changed
+		// during it are copied by the next one
+		info, err := os.Stat(ref)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.ModTime().Before(started) || info.ModTime().After(time.Now()) {
+			t.Errorf("reference file modified at %v, want the start of the run", info.ModTime())
+		}
+	})
+
+	t.Run("missing reference", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		ref := filepath.Join(t.TempDir(), "last-backup")
+
+		loadTestConf(t, backupConf(dir))
+		sinceFile = ref
+
+		if errs := copyFiles(context.Background()); errs != 0 {
+			t.Fatalf("copyFiles = %d errors, want 0", errs)
+		}
+
+		if got := backedUp(f, testBucket); len(got) != len(files) {
+			t.Errorf("backed up %v, want every file", got)
+		}
+
+		if _, err := os.Stat(ref); err != nil {
+			t.Errorf("reference file not created: %v", err)
+		}
+	})
+
+	t.Run("failed run", func(t *testing.T) {
+		f := newFakeGCS(t, testBucket)
+		f.failUpload = func(bucket, name string) int {
+			if strings.HasSuffix(name, absoluteObjectPath(files[3])) {
+				return http.StatusForbidden
+			}
+
+			return 0
+		}
+
+		ref := filepath.Join(t.TempDir(), "last-backup")
+
+		if err := touchFile(ref, mark); err != nil {
+			t.Fatal(err)
+		}
+
+		loadTestConf(t, backupConf(dir))
+		sinceFile = ref
+
+		if errs := copyFiles(context.Background()); errs != 1 {
+			t.Fatalf("copyFiles = %d errors, want 1", errs)
+		}
+
+		// The failed file is tried again by the next run
+		info, err := os.Stat(ref)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(mark) {
+			t.Errorf("reference file touched by a failed run at %v", info.ModTime())
+		}
+	})
+}
+
+func TestCancelStopsTheWalk(t *testing.T) {
+	const dirs, perDir, stopAt = 20, 50, 30
+
+	dir := t.TempDir()
+
+	for i := 0; i < dirs; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir-%02d", i))
+
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFiles(t, sub, perDir)
+	}
+
+	loadTestConf(t, backupConf(dir))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The files are taken one at a time and the walk cancelled once
+	// stopAt are found
+	queue := make(chan string)
+	fileQueue = queue
+	walkProgress = &progress{}
+
+	found := 0
+	taken := make(chan struct{})
+
+	go func() {
+		defer close(taken)
+
+		for range queue {
+			if found++; found == stopAt {
+				cancel()
+			}
+		}
+	}()
+
+	started := time.Now()
+	err := getFilesToCopy(ctx)
+	close(queue)
+	<-taken
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("getFilesToCopy = %v, want context.Canceled", err)
+	}
+
+	if found >= dirs*perDir {
+		t.Errorf("walk found all the %d files after the cancel", found)
+	}
+
+	walkMutex.Lock()
+	total := totalFilesToCopy
+	walkMutex.Unlock()
+
+	// Each walker may have one file in hand when the cancel comes
+	if total > stopAt+walkers {
+		t.Errorf("walk found %d files, want it to stop after %d", total, stopAt)
+	}
+
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("walk took %v after the cancel", elapsed)
+	}
+}
+
+func TestCollisionStrategies(t *testing.T) {
+	base := t.TempDir()
+	var roots []string
+
+	// Three directories named data hold the same x.txt
+	for i := 1; i <= 3; i++ {
+		root := filepath.Join(base, fmt.Sprintf("host-%d", i), "data")
+		makeTree(t, root, "x.txt", fmt.Sprintf("only-%d.txt", i))
+		roots = append(roots, root)
+	}
+
+	yaml := func(extra ...string) string {
+		s := "directories:\n"
+
+		for _, root := range roots {
+			s += fmt.Sprintf("  - %q\n", root)
+		}
+
+		return s + fmt.Sprintf("googleCloud:\n  nameBucket: %s\npathMode: relative\n%s", testBucket, strings.Join(extra, "\n"))
+	}
+
+	t.Run(collisionError, func(t *testing.T) {
+		loadTestConf(t, yaml())
+
+		err := getFilesToCopy(context.Background())
+
+		if err == nil || !strings.Contains(err.Error(), "would both be stored as \"data/x.txt\"") {
+			t.Errorf("getFilesToCopy = %v, want a collision error", err)
+		}
+	})
+
+	t.Run(collisionSkip, func(t *testing.T) {
+		loadTestConf(t, yaml("collisions: skip"))
+		runLog = new(bytes.Buffer)
+		logThreshold = levelWarning
+
+		if err := getFilesToCopy(context.Background()); err != nil {
+			t.Fatalf("getFilesToCopy: %v", err)
+		}
+
+		var got []string
+
+		for _, file := range filesToCopy {
+			got = append(got, objectPaths[file])
+		}
+
+		sort.Strings(got)
+
+		if want := []string{"data/only-1.txt", "data/only-2.txt", "data/only-3.txt", "data/x.txt"}; !equalStrings(got, want) {
+			t.Errorf("object paths = %v, want %v", got, want)
+		}
+
+		if n := strings.Count(runLog.String(), "is already stored as \"data/x.txt\""); n != 2 {
+			t.Errorf("%d warnings of skipped files, want 2:\n%s", n, runLog)
+		}
+	})
+
+	// Numbered in turn, whichever directory comes first
+	t.Run(collisionSuffix, func(t *testing.T) {
+		got := objectNames(t, yaml("collisions: suffix"))
+		want := []string{"data/only-1.txt", "data/only-2.txt", "data/only-3.txt", "data/x-1.txt", "data/x-2.txt", "data/x.txt"}
+
+		if !equalStrings(got, want) {
+			t.Errorf("object paths = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("former name", func(t *testing.T) {
+		loadTestConf(t, yaml("flattenCollisions: skip"))
+
+		if conf.Collisions != collisionSkip {
+			t.Errorf("collisions = %q with flattenCollisions skip", conf.Collisions)
+		}
+	})
+
+	wantConfError(t, parseTestConf(t, yaml("collisions: rename")), "unknown collisions \"rename\"")
+}
+
+func TestWalkBlocksOnAFullQueue(t *testing.T) {
+	const n, queueSize = 200, 5
+
+	dir := t.TempDir()
+	writeFiles(t, dir, n)
+
+	loadTestConf(t, backupConf(dir))
+
+	if conf.QueueSize != defaultQueueSize {
+		t.Errorf("queueSize = %d by default, want %d", conf.QueueSize, defaultQueueSize)
+	}
+
+	queue := make(chan string, queueSize)
+	fileQueue = queue
+	walkProgress = &progress{}
+
+	walked := make(chan error, 1)
+
+	go func() {
+		walked <- getFilesToCopy(context.Background())
+	}()
+
+	// Nothing takes the files for a while
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case err := <-walked:
+		t.Fatalf("walk ended with %v while the queue was full", err)
+	default:
+	}
+
+	walkMutex.Lock()
+	found, kept := totalFilesToCopy, len(filesToCopy)
+	walkMutex.Unlock()
+
+	// The queue and a file in the hands of each walker
+	if found > queueSize+walkers {
+		t.Errorf("walk found %d files with nobody taking them, want at most %d", found, queueSize+walkers)
+	}
+
+	if kept != 0 {
+		t.Errorf("%d files kept in filesToCopy, want them all sent to the queue", kept)
+	}
+
+	// A slow consumer gets every file in the end
+	taken := 0
+
+	for taken < n {
+		<-queue
+		taken++
+	}
+
+	if err := <-walked; err != nil {
+		t.Fatalf("getFilesToCopy: %v", err)
+	}
+
+	if totalFilesToCopy != n {
+		t.Errorf("walk found %d files, want %d", totalFilesToCopy, n)
+	}
+}
+
+// panickingBackend panics on the upload of the object named panicOn
+type panickingBackend struct {
+	flakyBackend
+	panicOn string
+}
+
+func (b *panickingBackend) Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error) {
+	if name == b.panicOn {
+		var m map[string]int
+		m[name]++
+	}
+
+	return b.flakyBackend.Upload(ctx, name, r, opts)
+}
+
+func TestPanicFailsOnlyItsFile(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	loadTestConf(t, backupConf(dir, "maxRetries: 0"))
+	runLog = new(bytes.Buffer)
+
+	dest := &bucketClient{backend: &panickingBackend{panicOn: buildObjectName("p", files[0])}}
+
+	entry := safeBackupFile(context.Background(), dest, "p", files[0])
+
+	if entry.Status != statusError || !strings.HasPrefix(entry.Error, "panic: assignment to entry in nil map") {
+		t.Errorf("entry of the panicking file = %+v, want a failure with the panic", entry)
+	}
+
+	if !strings.Contains(runLog.String(), "Panic backing up \""+files[0]+"\"") {
+		t.Errorf("log without the panic of the file:\n%s", runLog)
+	}
+
+	if entry := safeBackupFile(context.Background(), dest, "p", files[1]); entry.Status != statusCopied {
+		t.Errorf("entry of the other file = %+v, want it copied", entry)
+	}
+}
+
+func TestPanicsDontStopTheRun(t *testing.T) {
+	newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 3)
+
+	loadTestConf(t, backupConf(dir, "transforms: [encrypt]", "clientKey: "+base64.StdEncoding.EncodeToString(make([]byte, 32))))
+	runLog = new(bytes.Buffer)
+	logThreshold = levelInfo
+
+	// Without its key the encrypt stage panics in every worker
+	clientKey = nil
+
+	errs := copyFiles(context.Background())
+
+	if errs != len(files) || int(totalFilesError.get()) != len(files) {
+		t.Fatalf("copyFiles = %d errors and %d files failed, want %d", errs, totalFilesError.get(), len(files))
+	}
+
+	if n := strings.Count(runLog.String(), "Panic backing up"); n != len(files) {
+		t.Errorf("%d panics logged, want %d", n, len(files))
+	}
+
+	// The run still ends with its summary
+	if want := fmt.Sprintf("Total files with errors: %d", len(files)); !strings.Contains(runLog.String(), want) {
+		t.Errorf("log without %q:\n%s", want, runLog)
+	}
+}
+
+func TestResolveSourceHost(t *testing.T) {
+	hostname, err := os.Hostname()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env, conf string
+		want      string
+	}{
+		{"", "", hostname},
+		{"", " web-1 ", "web-1"},
+		{"web-2", "web-1", "web-2"},
+		{"  ", "web-1", "web-1"},
+	}
+
+	for _, test := range tests {
+		resetState(t)
+		t.Setenv(sourceHostEnv, test.env)
+		conf.SourceHost = test.conf
+
+		if got, err := resolveSourceHost(); err != nil || got != test.want {
+			t.Errorf("resolveSourceHost with %q and %q = %q, %v, want %q", test.env, test.conf, got, err, test.want)
+		}
+	}
+
+	t.Setenv(sourceHostEnv, "")
+	wantConfError(t, parseTestConf(t, backupConf(t.TempDir(), "sourceHost: racks/web-1")), "source host \"racks/web-1\" can't contain /")
+}
+
+func TestSourceHostInMetadataAndPrefix(t *testing.T) {
+	t.Setenv(sourceHostEnv, "")
+
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 1)
+
+	loadTestConf(t, backupConf(dir, "sourceHost: web-7", "prefixTemplate: 'backups/{hostname}/{date}'"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	names := f.names(testBucket, "backups/web-7/")
+
+	if len(names) == 0 {
+		t.Fatalf("no object under backups/web-7/, got %v", f.names(testBucket, ""))
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(files[0]))
+
+	if obj == nil {
+		t.Fatalf("no object of the file under %s", prefix)
+	}
+
+	if obj.Metadata["x-source-host"] != "web-7" {
+		t.Errorf("x-source-host = %q, want web-7", obj.Metadata["x-source-host"])
+	}
+
+	// The environment beats the configuration
+	t.Setenv(sourceHostEnv, "web-8")
+	loadTestConf(t, backupConf(dir, "sourceHost: web-7", "prefixTemplate: '{hostname}'"))
+
+	if got := backupPrefix(time.Now()); got != "web-8" {
+		t.Errorf("backupPrefix = %q, want web-8", got)
+	}
+}
+
+func TestOverlappingDirectoriesInRelativeMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	makeTree(t, dir, "main.go", "sub/notes.txt")
+
+	yaml := fmt.Sprintf("directories:\n  - %q\n  - %q\ngoogleCloud:\n  nameBucket: %s\npathMode: relative\n", dir, filepath.Join(dir, "sub"), testBucket)
+
+	loadTestConf(t, yaml)
+
+	if err := getFilesToCopy(context.Background()); err != nil {
+		t.Fatalf("getFilesToCopy: %v", err)
+	}
+
+	// Found by both directories, queued once under either name
+	if len(filesToCopy) != 2 || totalFilesToCopy != 2 {
+		t.Errorf("files to copy = %v, want each file once", filesToCopy)
+	}
+
+	if name := objectPaths[filepath.Join(dir, "sub", "notes.txt")]; name != "app/sub/notes.txt" && name != "sub/notes.txt" {
+		t.Errorf("object path of notes.txt = %q", name)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, attempt := range []int{0, 1, 4, 5, 10, 33, 34, 63, 64, 1000} {
+		for i := 0; i < 20; i++ {
+			if wait := backoff(attempt); wait < 0 || wait > maxBackoff {
+				t.Fatalf("backoff(%d) = %v, want between 0 and %v", attempt, wait, maxBackoff)
+			}
+		}
+	}
+
+	resetState(t)
+	conf = Configuration{Directories: []Directory{{Path: t.TempDir()}}, Concurrency: 1, QueueSize: 1, MaxRetries: 40}
+
+	for _, err := range validateConf() {
+		if strings.Contains(err.Error(), "maxRetries") {
+			t.Errorf("maxRetries 40: %v", err)
+		}
+	}
+
+	conf.MaxRetries = maxRetryLimit + 1
+	found := false
+
+	for _, err := range validateConf() {
+		found = found || strings.Contains(err.Error(), "maxRetries must be at most")
+	}
+
+	if !found {
+		t.Errorf("maxRetries %d accepted", conf.MaxRetries)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Name of the manifest object under the backup prefix
+const manifestName = "manifest.json"
+
+// Name of the sha256sum compatible list of the files under the backup prefix
+const checksumsName = "checksums.txt"
+
+// Status of a file in the manifest
+const (
+	statusCopied    = "copied"
+	statusChanged   = "changed"
+	statusUnchanged = "unchanged"
+	statusSkipped   = "skipped"
+	statusMissing   = "missing"
+	statusError     = "error"
+)
+
+// Severity of each status, used to combine the results of several destinations
+var statusRank = map[string]int{
+	statusUnchanged: 0,
+	statusSkipped:   0,
+	statusCopied:    1,
+	statusChanged:   2,
+	statusMissing:   3,
+	statusError:     4,
+}
+
+// manifestEntry describes one file of a backup. CRC32C is the checksum of
+// the object, i.e. of the compressed bytes when compression is enabled
+type manifestEntry struct {
+	File   string `json:"file"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+	Mtime  string `json:"mtime,omitempty"`
+	CRC32C string `json:"crc32c,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Set with dedup, DuplicateOf is the object of the same backup this
+	// one was copied from
+	SHA256      string `json:"sha256,omitempty"`
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+
+	// The error behind Error, to tell the fatal ones apart
+	err error
+}
+
+// fail marks the entry as failed with err
+func (e *manifestEntry) fail(err error) {
+	e.Status, e.Error, e.err = statusError, err.Error(), err
+}
+
+// manifest lists everything captured by a backup. Complete is set when the
+// backup finished without being interrupted or aborted and no file failed
+type manifest struct {
+	Prefix   string          `json:"prefix"`
+	Started  time.Time       `json:"started"`
+	Complete bool            `json:"complete"`
+	Files    []manifestEntry `json:"files"`
+}
+
+// writeManifest uploads the manifest of the backup pathBase to
+// <pathBase>/manifest.json
+func writeManifest(ctx context.Context, dest *bucketClient, pathBase string, started time.Time, complete bool, entries []manifestEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+
+	data, err := json.MarshalIndent(manifest{Prefix: pathBase, Started: started, Complete: complete, Files: entries}, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	opts := dest.objectOptions()
+	opts.ContentType = "application/json"
+
+	_, err = dest.backend.Upload(ctx, pathBase+"/"+manifestName, bytes.NewReader(data), opts)
+
+	return err
+}
+
+// writeChecksums uploads <pathBase>/checksums.txt with the SHA-256 of every
+// file copied, in the format of sha256sum with the object names relative to
+// the prefix, so a downloaded backup can be checked with sha256sum -c. The
+// unchanged files count when their object is under the prefix, such as
+// those kept by -resume-on-partial
+func writeChecksums(ctx context.Context, dest *bucketClient, pathBase string, entries []manifestEntry) error {
+	var lines []string
+
+	for _, entry := range entries {
+		if entry.SHA256 == "" || !strings.HasPrefix(entry.Object, pathBase+"/") {
+			continue
+		}
+
+		if entry.Status == statusCopied || entry.Status == statusUnchanged {
+			lines = append(lines, fmt.Sprintf("%s  %s\n", entry.SHA256, strings.TrimPrefix(entry.Object, pathBase+"/")))
+		}
+	}
+
+	sort.Strings(lines)
+
+	opts := dest.objectOptions()
+	opts.ContentType = "text/plain"
+
+	_, err := dest.backend.Upload(ctx, pathBase+"/"+checksumsName, strings.NewReader(strings.Join(lines, "")), opts)
+
+	return err
+}
+
+// decodeManifest returns the manifest data
+func decodeManifest(data []byte) (manifest, error) {
+	var m manifest
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	return m, nil
+}
+
+// parseManifest returns the entries of the manifest data by file
+func parseManifest(data []byte) (map[string]manifestEntry, error) {
+	m, err := decodeManifest(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]manifestEntry, len(m.Files))
+
+	for _, entry := range m.Files {
+		entries[entry.File] = entry
+	}
+
+	return entries, nil
+}
+
+// latestManifest returns the name of the newest manifest of the backups
+// next to pathBase, i.e. under the same parent prefix, or "" when there
+// is none
+func latestManifest(ctx context.Context, dest *bucketClient, pathBase string) (string, error) {
+	parent := ""
+
+	if dir := path.Dir(pathBase); dir != "." {
+		parent = dir + "/"
+	}
+
+	var name string
+	var created time.Time
+
+	it := dest.bucket.Objects(ctx, &storage.Query{Prefix: parent, MatchGlob: parent + "*/" + manifestName})
+
+	for {
+		attrs, err := it.Next()
+
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("listing manifests: %w", err)
+		}
+
+		if attrs.Created.After(created) {
+			name, created = attrs.Name, attrs.Created
+		}
+	}
+
+	return name, nil
+}
+
+// previousManifest returns the entries of the manifest -only-changed
+// compares with: the file given by -previous-manifest, or else the newest
+// manifest in the bucket of dest. It returns nil when there is none
+func previousManifest(ctx context.Context, dest *bucketClient, pathBase string) (map[string]manifestEntry, error) {
+	if previousManifestPath != "" {
+		data, err := ioutil.ReadFile(previousManifestPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return parseManifest(data)
+	}
+
+	name, err := latestManifest(ctx, dest, pathBase)
+
+	if err != nil || name == "" {
+		return nil, err
+	}
+
+	logInfo("Comparing with the manifest \"%s\" of bucket \"%s\"", name, dest.NameBucket)
+
+	return readManifestObject(ctx, dest, name)
+}
+
+// readManifestObject returns the entries of the manifest object name of
+// dest by file
+func readManifestObject(ctx context.Context, dest *bucketClient, name string) (map[string]manifestEntry, error) {
+	data, err := downloadManifest(ctx, dest, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifest(data)
+}
+
+// downloadManifest returns the content of the manifest object name of dest
+func downloadManifest(ctx context.Context, dest *bucketClient, name string) ([]byte, error) {
+	rc, err := dest.object(name).NewReader(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Object.NewReader: %w", err)
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+
+	if err != nil {
+		return nil, fmt.Errorf("reading \"%s\": %w", name, err)
+	}
+
+	return data, nil
+}
+
+// sameAsPrevious reports whether the file info still has the size and
+// modification time of its entry in the previous manifest. Only entries
+// whose object is complete count, so failed and changed files are copied
+// again
+func sameAsPrevious(prev manifestEntry, info os.FileInfo) bool {
+	if prev.Status != statusCopied && prev.Status != statusUnchanged {
+		return false
+	}
+
+	mtime, err := time.Parse(time.RFC3339Nano, prev.Mtime)
+
+	return err == nil && prev.Size == info.Size() && mtime.Equal(info.ModTime())
+}
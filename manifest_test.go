@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readManifest decodes the manifest of the backup prefix of bucket
+func readManifest(t *testing.T, f *fakeGCS, bucket, prefix string) manifest {
+	t.Helper()
+
+	obj := f.object(bucket, prefix+"/"+manifestName)
+
+	if obj == nil {
+		t.Fatalf("no manifest under %s", prefix)
+	}
+
+	var m manifest
+
+	if err := json.Unmarshal(obj.Data, &m); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v", err)
+	}
+
+	return m
+}
+
+func TestManifestOfPartialFailure(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 5)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[3])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+	copyFiles(context.Background())
+
+	prefix := backupPrefixOf(f, testBucket)
+	m := readManifest(t, f, testBucket, prefix)
+
+	if m.Prefix != prefix || m.Started.IsZero() {
+		t.Errorf("manifest of prefix %q started %v, want %q", m.Prefix, m.Started, prefix)
+	}
+
+	if len(m.Files) != len(files) {
+		t.Fatalf("manifest has %d entries, want %d", len(m.Files), len(files))
+	}
+
+	for i, entry := range m.Files {
+		want := statusCopied
+
+		if i == 3 {
+			want = statusError
+		}
+
+		if entry.File != files[i] || entry.Status != want {
+			t.Errorf("entry %d is %s %s, want %s %s", i, entry.File, entry.Status, files[i], want)
+		}
+
+		if entry.Object != prefix+"/"+absoluteObjectPath(files[i]) || entry.Size != int64(len(files[i])) {
+			t.Errorf("entry %d has object %s of %d bytes", i, entry.Object, entry.Size)
+		}
+
+		if want == statusCopied && entry.CRC32C == "" {
+			t.Errorf("entry %d has no checksum", i)
+		}
+
+		if want == statusError && entry.Error == "" {
+			t.Errorf("entry %d has no error", i)
+		}
+	}
+}
+
+func TestChecksumsFile(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 4)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[2])) {
+			return 403
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir))
+	copyFiles(context.Background())
+
+	prefix := backupPrefixOf(f, testBucket)
+	obj := f.object(testBucket, prefix+"/"+checksumsName)
+
+	if obj == nil {
+		t.Fatalf("no %s under %s", checksumsName, prefix)
+	}
+
+	// What sha256sum prints for the files copied, run from the prefix
+	var want []string
+
+	for i, file := range files {
+		if i == 2 {
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(file))
+		want = append(want, hex.EncodeToString(sum[:])+"  "+absoluteObjectPath(file)+"\n")
+	}
+
+	sort.Strings(want)
+
+	if got := string(obj.Data); got != strings.Join(want, "") {
+		t.Errorf("%s =\n%s\nwant\n%s", checksumsName, got, strings.Join(want, ""))
+	}
+}
+
+func TestSameAsPrevious(t *testing.T) {
+	files := writeFiles(t, t.TempDir(), 1)
+	info, err := os.Stat(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := info.ModTime().UTC().Format(time.RFC3339Nano)
+	older := info.ModTime().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name string
+		prev manifestEntry
+		want bool
+	}{
+		{"copied", manifestEntry{Status: statusCopied, Size: info.Size(), Mtime: mtime}, true},
+		{"unchanged", manifestEntry{Status: statusUnchanged, Size: info.Size(), Mtime: mtime}, true},
+		{"failed", manifestEntry{Status: statusError, Size: info.Size(), Mtime: mtime}, false},
+		{"changed during the upload", manifestEntry{Status: statusChanged, Size: info.Size(), Mtime: mtime}, false},
+		{"other size", manifestEntry{Status: statusCopied, Size: info.Size() + 1, Mtime: mtime}, false},
+		{"other mtime", manifestEntry{Status: statusCopied, Size: info.Size(), Mtime: older}, false},
+		{"no mtime", manifestEntry{Status: statusCopied, Size: info.Size()}, false},
+	}
+
+	for _, test := range tests {
+		if got := sameAsPrevious(test.prev, info); got != test.want {
+			t.Errorf("%s: sameAsPrevious = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// previousEntries returns a manifest of a backup at prefix with files as
+// they are now, but for changed which is recorded with an older mtime
+func previousEntries(t *testing.T, prefix string, files []string, changed string) []byte {
+	t.Helper()
+
+	m := manifest{Prefix: prefix, Started: time.Now().Add(-time.Hour)}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := info.ModTime()
+
+		if file == changed {
+			mtime = mtime.Add(-time.Hour)
+		}
+
+		m.Files = append(m.Files, manifestEntry{File: file, Object: prefix + "/" + absoluteObjectPath(file), Size: info.Size(),
+			Mtime: mtime.UTC().Format(time.RFC3339Nano), CRC32C: "0badc0de", Status: statusCopied})
+	}
+
+	data, err := json.Marshal(m)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestOnlyChanged(t *testing.T) {
+	const previous = "2024-01-01_00-00-00"
+
+	for _, local := range []bool{false, true} {
+		name := "bucket"
+
+		if local {
+			name = "local"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 4)
+
+			// The last file is new
+			data := previousEntries(t, previous, files[:3], files[1])
+
+			loadTestConf(t, backupConf(dir, "onlyChanged: true"))
+
+			if local {
+				previousManifestPath = filepath.Join(t.TempDir(), manifestName)
+
+				if err := ioutil.WriteFile(previousManifestPath, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				f.put(testBucket, fakeObject{Name: previous + "/" + manifestName, Data: data, Created: time.Now().Add(-time.Hour)})
+			}
+
+			if errs := copyFiles(context.Background()); errs != 0 {
+				t.Fatalf("copyFiles = %d errors, want 0", errs)
+			}
+
+			prefix := ""
+
+			for _, name := range f.names(testBucket, "") {
+				if strings.HasSuffix(name, "/"+manifestName) && !strings.HasPrefix(name, previous) {
+					prefix = strings.TrimSuffix(name, "/"+manifestName)
+				}
+			}
+
+			for i, file := range files {
+				want := 0
+
+				if i == 1 || i == 3 {
+					want = 1
+				}
+
+				if n := f.count("UPLOAD", prefix+"/"+absoluteObjectPath(file)); n != want {
+					t.Errorf("%s uploaded %d times, want %d", file, n, want)
+				}
+			}
+
+			// The unchanged files point to the objects of the previous backup
+			for _, entry := range readManifest(t, f, testBucket, prefix).Files {
+				unchanged := entry.File == files[0] || entry.File == files[2]
+
+				if unchanged && (entry.Status != statusUnchanged || entry.Object != previous+"/"+absoluteObjectPath(entry.File) || entry.CRC32C != "0badc0de") {
+					t.Errorf("entry of the unchanged %s = %+v", entry.File, entry)
+				}
+
+				if !unchanged && entry.Status != statusCopied {
+					t.Errorf("%s is %s, want %s", entry.File, entry.Status, statusCopied)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	dir := t.TempDir()
+	full := writeFiles(t, dir, 3)
+	var empty []string
+
+	for _, name := range []string{"empty-1.txt", "empty-2.txt"} {
+		path := filepath.Join(dir, name)
+
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		empty = append(empty, path)
+	}
+
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipEmptyFiles %v", skip), func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+
+			loadTestConf(t, backupConf(dir, fmt.Sprintf("skipEmptyFiles: %v", skip)))
+			runLog = new(bytes.Buffer)
+			logThreshold = levelWarning
+
+			if errs := copyFiles(context.Background()); errs != 0 {
+				t.Fatalf("copyFiles = %d errors, want 0", errs)
+			}
+
+			// Warned about either way
+			if totalFilesEmpty != len(empty) {
+				t.Errorf("%d empty files counted, want %d", totalFilesEmpty, len(empty))
+			}
+
+			for _, path := range empty {
+				if !strings.Contains(runLog.String(), "File \""+path+"\" is empty") {
+					t.Errorf("no warning of %s:\n%s", path, runLog)
+				}
+			}
+
+			prefix := backupPrefixOf(f, testBucket)
+			status := map[string]string{}
+
+			for _, entry := range readManifest(t, f, testBucket, prefix).Files {
+				status[entry.File] = entry.Status
+			}
+
+			for _, path := range full {
+				if status[path] != statusCopied {
+					t.Errorf("%s is %q in the manifest, want %s", path, status[path], statusCopied)
+				}
+			}
+
+			for _, path := range empty {
+				obj := f.object(testBucket, prefix+"/"+absoluteObjectPath(path))
+
+				if skip && (obj != nil || status[path] != statusSkipped) {
+					t.Errorf("empty %s uploaded or %q in the manifest, want it skipped", path, status[path])
+				}
+
+				if !skip && (obj == nil || status[path] != statusCopied) {
+					t.Errorf("empty %s not uploaded or %q in the manifest, want it copied", path, status[path])
+				}
+			}
+
+			if want := int64(len(full)); skip && totalFilesOK.get() != want {
+				t.Errorf("%d files copied, want %d", totalFilesOK.get(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// MetricsConfig is the Prometheus Pushgateway the metrics of every backup
+// are pushed to
+type MetricsConfig struct {
+	PushgatewayURL string `yaml:"pushgatewayURL"`
+	// Labels of the pushed group, "gcs-backup" and the hostname by default
+	Job      string `yaml:"job"`
+	Instance string `yaml:"instance"`
+}
+
+// pushMetrics pushes the counters of a backup that took elapsed. Failing to
+// do so is only logged, since the backup itself is done by then
+func pushMetrics(ctx context.Context, report runReport, elapsed time.Duration) {
+	m := conf.Metrics
+
+	if m.PushgatewayURL == "" {
+		return
+	}
+
+	filesUploaded := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcs_backup_files_uploaded_total",
+		Help: "Files copied by the last backup.",
+	})
+	bytesUploaded := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcs_backup_bytes_uploaded_total",
+		Help: "Bytes of the files copied by the last backup.",
+	})
+	filesFailed := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcs_backup_files_failed_total",
+		Help: "Files the last backup failed to copy.",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcs_backup_duration_seconds",
+		Help: "How long the last backup took.",
+	})
+	lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcs_backup_last_success_timestamp_seconds",
+		Help: "When the last backup without errors finished.",
+	})
+
+	filesUploaded.Add(float64(report.FilesCopied))
+	bytesUploaded.Add(float64(report.BytesCopied))
+	filesFailed.Add(float64(report.FilesError))
+	duration.Set(elapsed.Seconds())
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(filesUploaded, bytesUploaded, filesFailed, duration)
+
+	// Add only replaces the metrics pushed now, so a failed backup keeps
+	// the previous success time in the Pushgateway
+	if !report.Failed {
+		lastSuccess.SetToCurrentTime()
+		registry.MustRegister(lastSuccess)
+	}
+
+	job, instance := m.Job, m.Instance
+
+	if job == "" {
+		job = "gcs-backup"
+	}
+
+	if instance == "" {
+		instance = sourceHost
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	err := push.New(m.PushgatewayURL, job).Grouping("instance", instance).Gatherer(registry).AddContext(ctx)
+
+	if err != nil {
+		logWarning("Pushing metrics: %s", err)
+	}
+}
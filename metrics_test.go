@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// newPushgateway starts a Pushgateway that keeps the path and the metric
+// families of the last push
+func newPushgateway(t *testing.T) (string, *string, map[string]*dto.MetricFamily) {
+	t.Helper()
+
+	var path string
+	families := map[string]*dto.MetricFamily{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.Method + " " + r.URL.Path
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+
+		for {
+			family := &dto.MetricFamily{}
+
+			if err := decoder.Decode(family); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Errorf("decoding the push: %v", err)
+				break
+			}
+
+			families[family.GetName()] = family
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL, &path, families
+}
+
+// metricValue returns the value of the only metric of family
+func metricValue(family *dto.MetricFamily) float64 {
+	m := family.GetMetric()[0]
+
+	if family.GetType() == dto.MetricType_COUNTER {
+		return m.GetCounter().GetValue()
+	}
+
+	return m.GetGauge().GetValue()
+}
+
+func TestPushMetrics(t *testing.T) {
+	report := runReport{FilesCopied: 7, FilesError: 2, BytesCopied: 4096}
+
+	for _, failed := range []bool{false, true} {
+		resetState(t)
+
+		url, path, families := newPushgateway(t)
+
+		conf.Metrics = MetricsConfig{PushgatewayURL: url, Instance: "web-1"}
+		report.Failed = failed
+
+		started := time.Now()
+		pushMetrics(context.Background(), report, 90*time.Second)
+
+		if want := "POST /metrics/job/gcs-backup/instance/web-1"; *path != want {
+			t.Errorf("pushed to %q, want %q", *path, want)
+		}
+
+		want := map[string]float64{
+			"gcs_backup_files_uploaded_total": 7,
+			"gcs_backup_bytes_uploaded_total": 4096,
+			"gcs_backup_files_failed_total":   2,
+			"gcs_backup_duration_seconds":     90,
+		}
+
+		for name, value := range want {
+			if family, ok := families[name]; !ok {
+				t.Errorf("no %s pushed", name)
+			} else if got := metricValue(family); got != value {
+				t.Errorf("%s = %v, want %v", name, got, value)
+			}
+		}
+
+		// A failed backup leaves the previous success time
+		family, ok := families["gcs_backup_last_success_timestamp_seconds"]
+
+		if failed && ok {
+			t.Errorf("failed backup pushed a success time")
+		}
+
+		if !failed && (!ok || metricValue(family) < float64(started.Unix())) {
+			t.Errorf("no success time of now pushed")
+		}
+
+		types := map[string]dto.MetricType{
+			"gcs_backup_files_uploaded_total": dto.MetricType_COUNTER,
+			"gcs_backup_duration_seconds":     dto.MetricType_GAUGE,
+		}
+
+		for name, typ := range types {
+			if got := families[name].GetType(); got != typ {
+				t.Errorf("%s is a %s, want a %s", name, got, typ)
+			}
+		}
+	}
+}
+
+func TestPushMetricsFailureIsLogged(t *testing.T) {
+	resetState(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	conf.Metrics = MetricsConfig{PushgatewayURL: server.URL}
+	logThreshold = levelWarning
+	runLog = new(bytes.Buffer)
+
+	pushMetrics(context.Background(), runReport{}, time.Second)
+
+	if !strings.Contains(runLog.String(), "Pushing metrics:") {
+		t.Errorf("log = %q, want the failed push", runLog.String())
+	}
+}
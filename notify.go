@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Message sent when the notify section has no template
+const defaultNotifyTemplate = `Backup {{.Prefix}} {{if .Failed}}failed{{else}}finished{{end}}: ` +
+	`{{.FilesCopied}} files copied, {{.FilesError}} with errors, {{.FilesUnchanged}} unchanged in {{.Duration}}`
+
+// Time allowed for the webhook to answer
+const notifyTimeout = 10 * time.Second
+
+// NotifyConfig is the webhook called at the end of every backup
+type NotifyConfig struct {
+	WebhookURL string `yaml:"webhookURL"`
+	// text/template of the message, executed with a runReport
+	Template string `yaml:"template"`
+	// Skip the notification when every file was copied
+	OnlyOnError bool `yaml:"onlyOnError"`
+}
+
+// runReport summarizes a backup for the notifications
+type runReport struct {
+	Prefix         string `json:"prefix"`
+	Started        string `json:"started"`
+	Duration       string `json:"duration"`
+	FilesToCopy    int    `json:"filesToCopy"`
+	FilesCopied    int    `json:"filesCopied"`
+	FilesError     int    `json:"filesError"`
+	FilesUnchanged int    `json:"filesUnchanged"`
+	BytesCopied    int64  `json:"bytesCopied"`
+	Failed         bool   `json:"failed"`
+}
+
+// notifyPayload is the body posted to the webhook. Text is what Slack
+// shows, the report is there for other consumers
+type notifyPayload struct {
+	Text string `json:"text"`
+	runReport
+}
+
+// parseNotifyTemplate parses the configured message or the default one
+func parseNotifyTemplate(n NotifyConfig) (*template.Template, error) {
+	text := n.Template
+
+	if text == "" {
+		text = defaultNotifyTemplate
+	}
+
+	return template.New("notify").Parse(text)
+}
+
+// notify posts report to the configured webhook. Failing to do so is only
+// logged, since the backup itself is done by then
+func notify(ctx context.Context, report runReport) {
+	n := conf.Notify
+
+	if n.WebhookURL == "" || (n.OnlyOnError && !report.Failed) {
+		return
+	}
+
+	if err := postNotification(ctx, n, report); err != nil {
+		logWarning("Notifying webhook: %s", err)
+	}
+}
+
+func postNotification(ctx context.Context, n NotifyConfig, report runReport) error {
+	tmpl, err := parseNotifyTemplate(n)
+
+	if err != nil {
+		return fmt.Errorf("template.Parse: %w", err)
+	}
+
+	var text strings.Builder
+
+	if err := tmpl.Execute(&text, report); err != nil {
+		return fmt.Errorf("template.Execute: %w", err)
+	}
+
+	body, err := json.Marshal(notifyPayload{Text: text.String(), runReport: report})
+
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.WebhookURL, bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
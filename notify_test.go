@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newWebhook starts a webhook answering status, and returns its URL and
+// the bodies it got
+func newWebhook(t *testing.T, status int) (string, *[][]byte) {
+	t.Helper()
+
+	var bodies [][]byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server.URL, &bodies
+}
+
+func TestNotifyPayload(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 3)
+
+	url, bodies := newWebhook(t, http.StatusOK)
+
+	loadTestConf(t, backupConf(dir, "notify: {webhookURL: "+url+"}"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if len(*bodies) != 1 {
+		t.Fatalf("webhook called %d times, want 1", len(*bodies))
+	}
+
+	var payload map[string]interface{}
+
+	if err := json.Unmarshal((*bodies)[0], &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+
+	for key := range payload {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	want := []string{"bytesCopied", "duration", "failed", "filesCopied", "filesError", "filesToCopy", "filesUnchanged", "prefix", "started", "text"}
+
+	if !equalStrings(keys, want) {
+		t.Errorf("payload keys = %v, want %v", keys, want)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+
+	if payload["prefix"] != prefix || payload["filesCopied"] != 3.0 || payload["filesError"] != 0.0 || payload["failed"] != false {
+		t.Errorf("payload = %s", (*bodies)[0])
+	}
+
+	if text, _ := payload["text"].(string); !strings.HasPrefix(text, "Backup "+prefix+" finished: 3 files copied, 0 with errors") {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestNotifyOnlyOnError(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		writeFiles(t, dir, 2)
+
+		if fail {
+			f.failUpload = func(bucket, name string) int {
+				if strings.HasSuffix(name, "file-0000.txt") {
+					return http.StatusForbidden
+				}
+
+				return 0
+			}
+		}
+
+		url, bodies := newWebhook(t, http.StatusOK)
+
+		loadTestConf(t, backupConf(dir, "notify: {webhookURL: "+url+", onlyOnError: true, template: '{{.FilesError}} of {{.FilesToCopy}} failed'}"))
+
+		copyFiles(context.Background())
+
+		if !fail && len(*bodies) != 0 {
+			t.Errorf("webhook called for a backup without errors")
+		}
+
+		if fail && (len(*bodies) != 1 || !bytes.Contains((*bodies)[0], []byte(`"text":"1 of 2 failed"`))) {
+			t.Errorf("webhook got %q, want one message of the failure", *bodies)
+		}
+	}
+}
+
+func TestNotifyFailureIsNotFatal(t *testing.T) {
+	newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 1)
+
+	url, bodies := newWebhook(t, http.StatusInternalServerError)
+
+	loadTestConf(t, backupConf(dir, "notify: {webhookURL: "+url+"}"))
+
+	logThreshold = levelWarning
+	runLog = new(bytes.Buffer)
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Errorf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if len(*bodies) != 1 || !strings.Contains(runLog.String(), "Notifying webhook: webhook answered 500") {
+		t.Errorf("log = %q, want the failed notification", runLog.String())
+	}
+}
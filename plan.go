@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// What the plan does with a file
+const (
+	planUpload = "upload"
+	planSkip   = "skip"
+)
+
+// planEntry is a file of the -plan output. Reason tells why a skipped file
+// is left out: extension, size, age, content, special, empty, unchanged or
+// unchanged-since-previous
+type planEntry struct {
+	File   string `json:"file"`
+	Object string `json:"object,omitempty"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Files left out by the filters during the walk, only kept with -plan
+var planFiltered []planEntry
+
+// filteredOut records path, left out of the backup for reason, in the plan
+func filteredOut(path string, size int64, reason string) {
+	if !planOnly {
+		return
+	}
+
+	walkMutex.Lock()
+	planFiltered = append(planFiltered, planEntry{File: path, Size: size, Action: planSkip, Reason: reason})
+	walkMutex.Unlock()
+}
+
+// buildPlan walks the directories and returns what a backup would do with
+// every file found, sorted by file. Only incremental, onlyChanged and
+// newerThanBackup read from GCS, in the first destination
+func buildPlan(ctx context.Context) ([]planEntry, error) {
+	pathBase := backupPrefix(time.Now())
+
+	var dest *bucketClient
+	var previous map[string]manifestEntry
+
+	if conf.Incremental || conf.OnlyChanged || conf.NewerThanBackup {
+		dest = newClient(ctx, conf.GoogleCloud[0])
+		defer dest.Close()
+	}
+
+	// The files before the cutoff are left out by the walk, as age
+	if err := applyCutoff(ctx, dest, pathBase); err != nil {
+		return nil, err
+	}
+
+	if err := getFilesToCopy(ctx); err != nil {
+		return nil, err
+	}
+
+	if conf.OnlyChanged {
+		var err error
+
+		if previous, err = previousManifest(ctx, dest, pathBase); err != nil {
+			return nil, fmt.Errorf("Reading the previous manifest: %w", err)
+		}
+	}
+
+	plan := append([]planEntry(nil), planFiltered...)
+
+	for _, path := range filesToCopy {
+		entry := planEntry{File: path, Object: buildObjectName(pathBase, path) + pipelineFor(path).suffix(), Action: planUpload}
+
+		// Recorded symlinks are stored as they are, even when broken
+		if conf.Symlinks == symlinksRecord {
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				plan = append(plan, entry)
+				continue
+			}
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			return nil, fmt.Errorf("os.Stat: %w", err)
+		}
+
+		entry.Size = info.Size()
+
+		if prev, ok := previous[path]; ok && sameAsPrevious(prev, info) {
+			entry.Action, entry.Reason = planSkip, "unchanged-since-previous"
+		} else if info.Size() == 0 && conf.SkipEmptyFiles {
+			entry.Action, entry.Reason = planSkip, "empty"
+		} else if conf.Incremental {
+			unchanged, err := objectUnchanged(ctx, dest.object(entry.Object), info)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if unchanged {
+				entry.Action, entry.Reason = planSkip, "unchanged"
+			}
+		}
+
+		plan = append(plan, entry)
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].File < plan[j].File })
+
+	return plan, nil
+}
+
+// printPlanJSON writes the plan of the backup to stdout as a JSON array
+func printPlanJSON(ctx context.Context) error {
+	plan, err := buildPlan(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// An empty plan is still an array
+	if plan == nil {
+		plan = []planEntry{}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(plan)
+}
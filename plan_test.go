@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The -plan output of the tree of TestPlanJSON, with {dir} for its
+// directory
+const planFixture = `[
+  {
+    "file": "{dir}/app/app.log",
+    "size": 7,
+    "action": "skip",
+    "reason": "extension"
+  },
+  {
+    "file": "{dir}/app/empty.txt",
+    "object": "plan/app/empty.txt",
+    "size": 0,
+    "action": "skip",
+    "reason": "empty"
+  },
+  {
+    "file": "{dir}/app/main.go",
+    "object": "plan/app/main.go",
+    "size": 7,
+    "action": "upload"
+  },
+  {
+    "file": "{dir}/docs/notes.txt",
+    "object": "plan/docs/notes.txt.gz",
+    "size": 9,
+    "action": "upload"
+  }
+]
+`
+
+func TestPlanJSON(t *testing.T) {
+	base := t.TempDir()
+	dir, docs := filepath.Join(base, "app"), filepath.Join(base, "docs")
+	makeTree(t, dir, "main.go", "app.log")
+	makeTree(t, docs, "notes.txt")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Per-directory settings show in the object names
+	yaml := strings.Join([]string{
+		"directories:",
+		"  - path: " + dir,
+		"    compress: none",
+		"  - path: " + docs,
+		"    compress: gzip",
+		"googleCloud:",
+		"  nameBucket: " + testBucket,
+		"pathMode: relative",
+		"prefixTemplate: plan",
+		"extensions: [.go, .txt]",
+		"skipEmptyFiles: true",
+	}, "\n")
+
+	loadTestConf(t, yaml)
+	planOnly = true
+
+	var err error
+
+	out := captureStdout(t, func() {
+		err = printPlanJSON(context.Background())
+	})
+
+	if err != nil {
+		t.Fatalf("printPlanJSON: %v", err)
+	}
+
+	want := strings.ReplaceAll(planFixture, "{dir}", base)
+
+	if out != want {
+		t.Errorf("plan =\n%s\nwant\n%s", out, want)
+	}
+
+	var plan []planEntry
+
+	if err := json.Unmarshal([]byte(out), &plan); err != nil {
+		t.Fatalf("plan is not a JSON array: %v", err)
+	}
+}
+
+func TestEmptyPlanIsAnArray(t *testing.T) {
+	loadTestConf(t, backupConf(t.TempDir()))
+	planOnly = true
+
+	out := captureStdout(t, func() {
+		if err := printPlanJSON(context.Background()); err != nil {
+			t.Errorf("printPlanJSON: %v", err)
+		}
+	})
+
+	if got := string(bytes.TrimSpace([]byte(out))); got != "[]" {
+		t.Errorf("plan of no files = %q, want []", got)
+	}
+}
+
+func TestPlanUploadsNothing(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	if err := parseTestConf(t, backupConf(dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runMain(t, "-plan", "-config", fileConf)
+
+	if code != 0 {
+		t.Fatalf("exit status %d, want 0: %s", code, out)
+	}
+
+	for _, file := range files {
+		if !strings.Contains(out, `"file": "`+file+`"`) {
+			t.Errorf("plan without %s:\n%s", file, out)
+		}
+	}
+
+	if f.served != 0 {
+		t.Errorf("%d requests to GCS, want none", f.served)
+	}
+}
+
+func TestPlanAppliesTheCutoff(t *testing.T) {
+	for _, newer := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		files := writeFiles(t, dir, 4)
+
+		// The first two files are older than the cutoff
+		cutoff := time.Now().Add(-time.Hour).Truncate(time.Second)
+		old := cutoff.Add(-time.Hour)
+
+		for _, file := range files[:2] {
+			if err := os.Chtimes(file, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var args []string
+		extra := []string{}
+
+		if newer {
+			f.put(testBucket, fakeObject{Name: backupPrefix(cutoff) + "/" + manifestName, Data: []byte(`{"complete": true}`)})
+			extra = append(extra, "newerThanBackup: true")
+		} else {
+			since := filepath.Join(t.TempDir(), "since")
+
+			if err := ioutil.WriteFile(since, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chtimes(since, cutoff, cutoff); err != nil {
+				t.Fatal(err)
+			}
+
+			args = append(args, "-since-file", since)
+		}
+
+		if err := parseTestConf(t, backupConf(dir, extra...)); err != nil {
+			t.Fatal(err)
+		}
+
+		out, code := runMain(t, append([]string{"-plan", "-config", fileConf}, args...)...)
+
+		if code != 0 {
+			t.Fatalf("newerThanBackup %v: -plan exit status %d: %s", newer, code, out)
+		}
+
+		for i, file := range files {
+			want := `"action": "upload"`
+
+			if i < 2 {
+				want = `"action": "skip",
+    "reason": "age"`
+			}
+
+			if !strings.Contains(out, `"file": "`+file+`",`) || !strings.Contains(out[strings.Index(out, file):], want) {
+				t.Errorf("newerThanBackup %v: -plan without %s for %s:\n%s", newer, want, file, out)
+			}
+		}
+
+		out, code = runMain(t, append([]string{"-dry-run", "-config", fileConf}, args...)...)
+
+		if code != 0 {
+			t.Fatalf("newerThanBackup %v: -dry-run exit status %d: %s", newer, code, out)
+		}
+
+		for i, file := range files {
+			if copied := strings.Contains(out, `File "`+file+`" would be copied`); copied != (i >= 2) {
+				t.Errorf("newerThanBackup %v: -dry-run copies %s: %v, want %v", newer, file, copied, i >= 2)
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// progress tracks how far along a backup is
+type progress struct {
+	mutex      sync.Mutex
+	start      time.Time
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+}
+
+func newProgress() *progress {
+	return &progress{start: time.Now()}
+}
+
+// discover records a file of size bytes found by the walk, the totals grow
+// while the walk runs alongside the uploads
+func (p *progress) discover(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.totalFiles++
+	p.totalBytes += size
+}
+
+// add records a processed file of size bytes
+func (p *progress) add(size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.doneFiles++
+	p.doneBytes += size
+}
+
+// estimate returns the throughput in bytes per second and the time left to
+// process totalBytes, or -1 when there is no throughput to go by yet
+func estimate(doneBytes, totalBytes int64, elapsed time.Duration) (float64, time.Duration) {
+	if doneBytes <= 0 || elapsed <= 0 {
+		return 0, -1
+	}
+
+	throughput := float64(doneBytes) / elapsed.Seconds()
+	left := totalBytes - doneBytes
+
+	if left < 0 {
+		left = 0
+	}
+
+	return throughput, time.Duration(float64(left) / throughput * float64(time.Second))
+}
+
+// String describes the progress in a single line
+func (p *progress) String() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	percent := 100.0
+
+	if p.totalBytes > 0 {
+		percent = float64(p.doneBytes) * 100 / float64(p.totalBytes)
+	}
+
+	throughput, eta := estimate(p.doneBytes, p.totalBytes, time.Since(p.start))
+	etaText := "unknown"
+
+	if eta >= 0 {
+		etaText = eta.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("%5.1f%% %d/%d files, %s/%s, %s/s, ETA %s", percent, p.doneFiles, p.totalFiles,
+		humanBytes(p.doneBytes), humanBytes(p.totalBytes), humanBytes(int64(throughput)), etaText)
+}
+
+// report prints the progress until ctx is done: as a line redrawn in place
+// when tty is set, otherwise as a log line every interval
+func (p *progress) report(ctx context.Context, tty bool, interval time.Duration) {
+	if tty {
+		interval = 500 * time.Millisecond
+
+		logMutex.Lock()
+		clearLine = true
+		logMutex.Unlock()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if tty {
+				logMutex.Lock()
+				fmt.Fprintf(os.Stdout, "\r\033[K%s\n", p)
+				clearLine = false
+				logMutex.Unlock()
+			}
+
+			return
+		case <-ticker.C:
+			if !tty {
+				logInfo("Progress: %s", p)
+				continue
+			}
+
+			logMutex.Lock()
+			fmt.Fprintf(os.Stdout, "\r\033[K%s", p)
+			logMutex.Unlock()
+		}
+	}
+}
+
+// snapshot describes the progress with the time elapsed so far
+func (p *progress) snapshot() string {
+	return fmt.Sprintf("%s, elapsed %s", p, time.Since(p.start).Round(time.Second))
+}
+
+// Progress of the backup copying files, printed on progressSignals, nil
+// before the copy starts
+var (
+	activeProgress      *progress
+	activeProgressMutex sync.Mutex
+)
+
+// setActiveProgress makes p the progress printed on progressSignals
+func setActiveProgress(p *progress) {
+	activeProgressMutex.Lock()
+	activeProgress = p
+	activeProgressMutex.Unlock()
+}
+
+// handleProgressSignals prints the active progress to stderr on every
+// progressSignals, whether -progress is set or not. main calls it for the
+// whole run, so the signals never kill the process, and they are ignored
+// while there is no progress to print, e.g. during the startup jitter
+func handleProgressSignals() {
+	if len(progressSignals) == 0 {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, progressSignals...)
+
+	go func() {
+		for range signals {
+			activeProgressMutex.Lock()
+			p := activeProgress
+			activeProgressMutex.Unlock()
+
+			if p != nil {
+				p.dump()
+			}
+		}
+	}()
+}
+
+// dump prints the progress with the time elapsed to stderr
+func (p *progress) dump() {
+	msg := "Progress: " + p.snapshot()
+
+	if logFormat == "json" {
+		writeEntry(os.Stderr, logEntry{Time: time.Now().Format(time.RFC3339), Level: levelNames[levelInfo][1], Msg: msg})
+		return
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if clearLine {
+		fmt.Fprint(os.Stdout, "\r\033[K")
+	}
+
+	fmt.Fprintf(os.Stderr, "[%s] %s\n", levelNames[levelInfo][0], msg)
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that print the progress of a running backup
+var progressSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestProgressSignal(t *testing.T) {
+	resetState(t)
+
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := os.Stderr
+	os.Stderr = w
+
+	t.Cleanup(func() {
+		setActiveProgress(nil)
+		os.Stderr = saved
+		w.Close()
+	})
+
+	lines := make(chan string)
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+
+		close(lines)
+	}()
+
+	handleProgressSignals()
+
+	// Without a backup running the signal is ignored, and doesn't kill
+	// the process
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-lines:
+		t.Fatalf("printed %q without a backup running", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p := newProgress()
+	p.discover(10)
+	p.discover(30)
+	p.add(10)
+	setActiveProgress(p)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "Progress:") || !strings.Contains(line, "1/2 files, 10 B/40 B") {
+			t.Errorf("printed %q on SIGUSR1", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing printed on SIGUSR1")
+	}
+}
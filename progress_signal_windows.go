@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Windows has no SIGUSR1, the progress is only printed by -progress
+var progressSignals []os.Signal
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimate(t *testing.T) {
+	tests := []struct {
+		name           string
+		done, total    int64
+		elapsed        time.Duration
+		wantThroughput float64
+		wantETA        time.Duration
+	}{
+		{"halfway", 50, 100, 10 * time.Second, 5, 10 * time.Second},
+		{"done", 100, 100, 4 * time.Second, 25, 0},
+		{"more than the total", 150, 100, 3 * time.Second, 50, 0},
+		{"nothing done", 0, 100, time.Second, 0, -1},
+		{"no time elapsed", 10, 100, 0, 0, -1},
+	}
+
+	for _, test := range tests {
+		throughput, eta := estimate(test.done, test.total, test.elapsed)
+
+		if throughput != test.wantThroughput || eta != test.wantETA {
+			t.Errorf("%s: estimate = %v, %v, want %v, %v", test.name, throughput, eta, test.wantThroughput, test.wantETA)
+		}
+	}
+}
+
+func TestProgressString(t *testing.T) {
+	p := newProgress()
+
+	p.discover(300)
+	p.discover(100)
+	p.add(100)
+
+	if got := p.String(); !strings.HasPrefix(got, " 25.0% 1/2 files, 100 B/400 B") {
+		t.Errorf("progress = %q", got)
+	}
+
+	if got := newProgress().String(); !strings.Contains(got, "100.0% 0/0 files") || !strings.HasSuffix(got, "ETA unknown") {
+		t.Errorf("progress of nothing = %q", got)
+	}
+}
+
+func TestProgressDump(t *testing.T) {
+	resetState(t)
+
+	p := newProgress()
+	p.start = time.Now().Add(-90 * time.Second)
+
+	p.discover(300)
+	p.discover(100)
+	p.add(100)
+
+	out := captureOutput(t, &os.Stderr, p.dump)
+
+	for _, want := range []string{"[INFO] Progress:", "1/2 files, 100 B/400 B", "ETA", "elapsed 1m30s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dump = %q, without %q", out, want)
+		}
+	}
+
+	logFormat = "json"
+
+	var entry logEntry
+
+	if err := json.Unmarshal([]byte(captureOutput(t, &os.Stderr, p.dump)), &entry); err != nil {
+		t.Fatalf("dump in json: %v", err)
+	}
+
+	if entry.Level != levelNames[levelInfo][1] || !strings.HasPrefix(entry.Msg, "Progress: ") || !strings.Contains(entry.Msg, "elapsed 1m30s") {
+		t.Errorf("dump in json = %+v", entry)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// parsePrefixTime returns the start time of the backup with a prefix such as
+// "2024-01-02_15-04-05/", in timestampFormat and timezone. Prefixes that
+// aren't backups are reported as false
+func parsePrefixTime(prefix string) (time.Time, bool) {
+	t, err := time.ParseInLocation(conf.TimestampFormat, strings.TrimSuffix(prefix, "/"), prefixLocation)
+
+	return t, err == nil
+}
+
+// expired reports whether a backup started at t is past the retention period
+func expired(t, now time.Time, retentionDays int) bool {
+	return t.Before(now.AddDate(0, 0, -retentionDays))
+}
+
+// listBackups returns the prefixes right under basePrefix, or at the top
+// level of the bucket without it, that are backups together with their
+// start time
+func listBackups(ctx context.Context, backend Backend) (map[string]time.Time, error) {
+	backups := map[string]time.Time{}
+	base := withBasePrefix("")
+
+	err := backend.List(ctx, base, "/", func(obj objectInfo) error {
+		if !isDirName(obj.Name, "/") {
+			return nil
+		}
+
+		if t, ok := parsePrefixTime(strings.TrimPrefix(obj.Name, base)); ok {
+			backups[obj.Name] = t
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return backups, nil
+}
+
+// latestBackup returns the prefix, without the trailing slash, and the
+// start time of the newest backup of the bucket other than the prefix
+// current, false when there is none
+func latestBackup(backups map[string]time.Time, current string) (string, time.Time, bool) {
+	var name string
+	var latest time.Time
+	var found bool
+
+	for prefix, t := range backups {
+		if prefix != current+"/" && (!found || t.After(latest)) {
+			name, latest, found = strings.TrimSuffix(prefix, "/"), t, true
+		}
+	}
+
+	return name, latest, found
+}
+
+// latestCompleteBackup is latestBackup among the backups of dest whose
+// manifest records a clean finish. The backups interrupted, aborted or with
+// files that failed are passed over, since the files they missed would not
+// be copied again otherwise
+func latestCompleteBackup(ctx context.Context, dest *bucketClient, backups map[string]time.Time, current string) (string, time.Time, bool, error) {
+	left := make(map[string]time.Time, len(backups))
+
+	for prefix, t := range backups {
+		left[prefix] = t
+	}
+
+	for {
+		name, started, ok := latestBackup(left, current)
+
+		if !ok {
+			return "", time.Time{}, false, nil
+		}
+
+		data, err := downloadManifest(ctx, dest, name+"/"+manifestName)
+
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return "", time.Time{}, false, err
+		}
+
+		if err == nil {
+			m, err := decodeManifest(data)
+
+			if err != nil {
+				return "", time.Time{}, false, fmt.Errorf("manifest of \"%s\": %w", name, err)
+			}
+
+			if m.Complete {
+				return name, started, true, nil
+			}
+		}
+
+		logInfo("Backup \"%s\" didn't complete, looking at the one before", name)
+		delete(left, name+"/")
+	}
+}
+
+// deletePrefix removes every object under prefix and returns how many were
+// deleted and how many failed
+func deletePrefix(ctx context.Context, backend Backend, prefix string) (int, int) {
+	var deleted, failed int
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	names := make(chan string)
+
+	wg.Add(conf.Concurrency)
+
+	for i := 0; i < conf.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for name := range names {
+				err := backend.Delete(ctx, name)
+
+				mutex.Lock()
+
+				if err != nil {
+					logEvent(levelError, logFields{Object: name, Error: err.Error()}, fmt.Sprintf("Deleting \"%s\": %v", name, err))
+					failed++
+				} else {
+					deleted++
+				}
+
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	err := backend.List(ctx, prefix, "", func(obj objectInfo) error {
+		select {
+		case names <- obj.Name:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	if err != nil && ctx.Err() == nil {
+		logError("Listing \"%s\": %s", prefix, err)
+
+		mutex.Lock()
+		failed++
+		mutex.Unlock()
+	}
+
+	close(names)
+
+	wg.Wait()
+
+	return deleted, failed
+}
+
+// pruneBackups deletes the backups older than conf.RetentionDays from every
+// destination, or only lists them in dry-run, and returns the number of
+// failures
+func pruneBackups(ctx context.Context) int {
+	var totalPruned, totalKept, totalDeleted, totalFailed int
+
+	currentTime := time.Now()
+
+	// Never delete the backup a concurrent run may be writing right now
+	current := backupPrefix(currentTime) + "/"
+
+	for _, d := range conf.GoogleCloud {
+		dest := newClient(ctx, d)
+		defer dest.Close()
+
+		backups, err := listBackups(ctx, dest.backend)
+
+		if err != nil {
+			logError("Listing backups in \"%s\": %s", dest.NameBucket, err)
+			totalFailed++
+
+			continue
+		}
+
+		for prefix, t := range backups {
+			if ctx.Err() != nil {
+				break
+			}
+
+			if prefix == current || !expired(t, currentTime, conf.RetentionDays) {
+				totalKept++
+				continue
+			}
+
+			if dryRun {
+				logEvent(levelInfo, logFields{Bucket: dest.NameBucket, Object: prefix},
+					fmt.Sprintf("Backup \"%s\" in \"%s\" would be deleted", prefix, dest.NameBucket))
+
+				totalPruned++
+
+				continue
+			}
+
+			deleted, failed := deletePrefix(ctx, dest.backend, prefix)
+			totalDeleted += deleted
+			totalFailed += failed
+
+			if failed == 0 {
+				logEvent(levelOK, logFields{Bucket: dest.NameBucket, Object: prefix},
+					fmt.Sprintf("Backup \"%s\" in \"%s\" deleted (%d objects)", prefix, dest.NameBucket, deleted))
+
+				totalPruned++
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		logWarning("Prune interrupted: %s", ctx.Err())
+	}
+
+	logSummary("Prune finished", []summaryField{
+		{"Total backups deleted", "backupsDeleted", totalPruned},
+		{"Total backups kept", "backupsKept", totalKept},
+		{"Total objects deleted", "objectsDeleted", totalDeleted},
+		{"Total errors", "errors", totalFailed},
+		{"Prune took", "elapsed", time.Since(currentTime).String()},
+	}, nil)
+
+	return totalFailed
+}
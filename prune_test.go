@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrefixTime(t *testing.T) {
+	resetState(t)
+	conf.TimestampFormat = pathBaseLayout
+	prefixLocation = time.UTC
+
+	tests := []struct {
+		prefix string
+		want   time.Time
+		ok     bool
+	}{
+		{"2024-01-02_15-04-05/", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), true},
+		{"2024-01-02_15-04-05", time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), true},
+		{"2024-13-02_15-04-05/", time.Time{}, false},
+		{"incremental/", time.Time{}, false},
+		{"2024-01-02/", time.Time{}, false},
+		{"logs/2024-01-02_15-04-05/", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parsePrefixTime(test.prefix)
+
+		if ok != test.ok || !got.Equal(test.want) {
+			t.Errorf("parsePrefixTime(%q) = %v, %v, want %v, %v", test.prefix, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{now, false},
+		{now.AddDate(0, 0, -6), false},
+		{now.AddDate(0, 0, -7), false},
+		{now.AddDate(0, 0, -7).Add(-time.Second), true},
+		{now.AddDate(-1, 0, 0), true},
+	}
+
+	for _, test := range tests {
+		if got := expired(test.t, now, 7); got != test.want {
+			t.Errorf("expired(%v) = %v, want %v", test.t, got, test.want)
+		}
+	}
+}
+
+func TestLatestBackup(t *testing.T) {
+	backups := map[string]time.Time{
+		"a/": time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"b/": time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+		"c/": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	if name, _, ok := latestBackup(backups, "x"); !ok || name != "b" {
+		t.Errorf("latestBackup = %q, %v, want b", name, ok)
+	}
+
+	// The current backup isn't the latest one
+	if name, _, ok := latestBackup(backups, "b"); !ok || name != "c" {
+		t.Errorf("latestBackup other than b = %q, %v, want c", name, ok)
+	}
+
+	if _, _, ok := latestBackup(map[string]time.Time{"a/": {}}, "a"); ok {
+		t.Error("latestBackup found a backup other than the current one")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	now := time.Now()
+	old := now.AddDate(0, 0, -40).Format(pathBaseLayout)
+	recent := now.AddDate(0, 0, -2).Format(pathBaseLayout)
+
+	for _, name := range []string{old + "/a", old + "/b/c", recent + "/a", "other/a"} {
+		f.put(testBucket, fakeObject{Name: name, Data: []byte(name)})
+	}
+
+	loadTestConf(t, backupConf(t.TempDir(), "retentionDays: 30"))
+
+	dryRun = true
+
+	if failed := pruneBackups(context.Background()); failed != 0 {
+		t.Fatalf("pruneBackups -dry-run = %d failures", failed)
+	}
+
+	if names := f.names(testBucket, ""); len(names) != 4 {
+		t.Errorf("dry run left %v, want every object", names)
+	}
+
+	dryRun = false
+
+	if failed := pruneBackups(context.Background()); failed != 0 {
+		t.Fatalf("pruneBackups = %d failures", failed)
+	}
+
+	want := []string{recent + "/a", "other/a"}
+
+	if names := f.names(testBucket, ""); !equalStrings(names, want) {
+		t.Errorf("prune left %v, want %v", names, want)
+	}
+}
+
+func TestListBackups(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+
+	loadTestConf(t, backupConf(t.TempDir(), "basePrefix: web-1"))
+
+	for _, name := range []string{"web-1/2024-01-01_00-00-00/a", "web-1/2024-01-02_10-30-00/sub/b", "web-1/notes/c", "web-1/top-level", "2024-01-05_00-00-00/d"} {
+		f.put(testBucket, fakeObject{Name: name, Data: []byte(name)})
+	}
+
+	dest := newClient(context.Background(), conf.GoogleCloud[0])
+	defer dest.Close()
+
+	backups, err := listBackups(context.Background(), dest.backend)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the backups under the base prefix
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2", backups)
+	}
+
+	name, since, ok := latestBackup(backups, "web-1/2024-06-01_00-00-00")
+
+	if !ok || name != "web-1/2024-01-02_10-30-00" {
+		t.Errorf("latestBackup = %q, %v, want web-1/2024-01-02_10-30-00", name, ok)
+	}
+
+	if want, _ := parsePrefixTime("2024-01-02_10-30-00"); !since.Equal(want) {
+		t.Errorf("cutoff = %v, want %v", since, want)
+	}
+}
+
+func TestNewerThanBackup(t *testing.T) {
+	for _, previous := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		files := writeFiles(t, dir, 4)
+
+		loadTestConf(t, backupConf(dir, "newerThanBackup: true"))
+
+		// The first two files are older than the previous backup
+		cutoff := time.Now().Add(-time.Hour).Truncate(time.Second)
+		old := cutoff.Add(-time.Hour)
+
+		for _, file := range files[:2] {
+			if err := os.Chtimes(file, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if previous {
+			f.put(testBucket, fakeObject{Name: backupPrefix(cutoff) + "/" + manifestName, Data: []byte(`{"complete": true}`)})
+		}
+
+		if errs := copyFiles(context.Background()); errs != 0 {
+			t.Fatalf("copyFiles = %d errors, want 0", errs)
+		}
+
+		want := files
+
+		if previous {
+			want = files[2:]
+		}
+
+		prefix := ""
+
+		for _, name := range f.names(testBucket, "") {
+			if strings.HasSuffix(name, "/"+manifestName) && !strings.HasPrefix(name, backupPrefix(cutoff)+"/") {
+				prefix = strings.TrimSuffix(name, "/"+manifestName)
+			}
+		}
+
+		var got []string
+
+		for _, name := range f.names(testBucket, prefix+"/") {
+			if rel := strings.TrimPrefix(name, prefix+"/"); rel != manifestName && rel != checksumsName {
+				got = append(got, rel)
+			}
+		}
+
+		if !equalStrings(got, objectPathsOf(want)) {
+			t.Errorf("previous backup %v: copied %v, want %v", previous, got, objectPathsOf(want))
+		}
+
+		if previous && totalFilesFilterAge != 2 {
+			t.Errorf("totalFilesFilterAge = %d, want 2", totalFilesFilterAge)
+		}
+	}
+}
+
+func TestNewerThanBackupSkipsIncomplete(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 4)
+
+	loadTestConf(t, backupConf(dir, "newerThanBackup: true"))
+
+	// The last complete backup, then one interrupted and one killed before
+	// its manifest. The second file changed between the first two
+	completed := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	interrupted := completed.Add(time.Hour)
+	killed := interrupted.Add(time.Hour)
+
+	for i, mtime := range []time.Time{completed.Add(-time.Hour), completed.Add(-time.Hour), completed.Add(time.Minute)} {
+		if err := os.Chtimes(files[i], mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.put(testBucket, fakeObject{Name: backupPrefix(completed) + "/" + manifestName, Data: []byte(`{"complete": true}`)})
+	f.put(testBucket, fakeObject{Name: backupPrefix(interrupted) + "/" + manifestName, Data: []byte(`{"complete": false}`)})
+	f.put(testBucket, fakeObject{Name: backupPrefix(killed) + "/" + objectPathsOf(files[:1])[0], Data: []byte("partial")})
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	prefix := ""
+
+	for _, name := range f.names(testBucket, "") {
+		if strings.HasSuffix(name, "/"+manifestName) && !strings.HasPrefix(name, backupPrefix(completed)+"/") &&
+			!strings.HasPrefix(name, backupPrefix(interrupted)+"/") {
+			prefix = strings.TrimSuffix(name, "/"+manifestName)
+		}
+	}
+
+	want := objectPathsOf(files[2:])
+
+	var got []string
+
+	for _, name := range f.names(testBucket, prefix+"/") {
+		if rel := strings.TrimPrefix(name, prefix+"/"); rel != manifestName && rel != checksumsName {
+			got = append(got, rel)
+		}
+	}
+
+	if !equalStrings(got, want) {
+		t.Errorf("copied %v, want %v", got, want)
+	}
+
+	if m := readManifest(t, f, testBucket, prefix); !m.Complete {
+		t.Errorf("manifest of a clean backup isn't complete")
+	}
+}
+
+func TestTimezonePrefix(t *testing.T) {
+	// Late in the day in UTC, the next day in Tokyo and the day before
+	// in Los Angeles
+	started := time.Date(2024, 3, 10, 22, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		timezone string
+		format   string
+		want     string
+	}{
+		{"UTC", "", "2024-03-10_22-30-15"},
+		{"Asia/Tokyo", "", "2024-03-11_07-30-15"},
+		{"America/Los_Angeles", "", "2024-03-10_15-30-15"},
+		{"Asia/Kolkata", "20060102T150405", "20240311T040015"},
+		{"UTC", "20060102T150405Z0700", "20240310T223015Z"},
+	}
+
+	for _, test := range tests {
+		extra := []string{"timezone: " + test.timezone}
+
+		if test.format != "" {
+			extra = append(extra, "timestampFormat: "+test.format)
+		}
+
+		loadTestConf(t, backupConf(t.TempDir(), extra...))
+
+		prefix := backupPrefix(started)
+
+		if prefix != test.want {
+			t.Errorf("%s: backupPrefix = %q, want %q", test.timezone, prefix, test.want)
+		}
+
+		// Read back as the same instant, wherever it was made
+		if got, ok := parsePrefixTime(prefix + "/"); !ok || !got.Equal(started) {
+			t.Errorf("%s: parsePrefixTime(%q) = %v, %v, want %v", test.timezone, prefix, got, ok, started)
+		}
+	}
+
+	// So are the placeholders
+	loadTestConf(t, backupConf(t.TempDir(), "timezone: Asia/Tokyo", "prefixTemplate: '{date}/{time}'"))
+
+	if got, err := renderPrefix(conf.PrefixTemplate, started); err != nil || got != "2024-03-11/07-30-15" {
+		t.Errorf("renderPrefix in Tokyo = %q, %v", got, err)
+	}
+}
+
+func TestTimezoneBackups(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 1)
+
+	before := time.Now().Truncate(time.Second)
+	prefix := backUp(t, f, dir, "timezone: Asia/Tokyo", "timestampFormat: 20060102T150405")
+
+	// The backup is found again by its prefix, at the time it started
+	dest := newClient(context.Background(), conf.GoogleCloud[0])
+	defer dest.Close()
+
+	backups, err := listBackups(context.Background(), dest.backend)
+
+	if err != nil {
+		t.Fatalf("listBackups: %v", err)
+	}
+
+	started, ok := backups[prefix+"/"]
+
+	if !ok || started.Before(before) || started.After(time.Now()) {
+		t.Errorf("backups = %v, want %s started after %v", backups, prefix, before)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// Shorter values aren't masked, they would garble unrelated text
+const minSecretLen = 4
+
+// Values masked in every line printed, longest first. Guarded by logMutex
+var secrets []string
+
+// addSecret adds s to list, as it is and as it looks inside a JSON string
+func addSecret(list []string, s string) []string {
+	if len(s) < minSecretLen {
+		return list
+	}
+
+	list = append(list, s)
+
+	if encoded, err := json.Marshal(s); err == nil {
+		if e := string(encoded[1 : len(encoded)-1]); e != s {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// setSecrets collects the sensitive settings of conf and of the
+// environment: the key files and encryption keys of the destinations, the
+// credentials, the webhook and the password of the Pushgateway
+func setSecrets() {
+	var list []string
+
+	for _, d := range conf.GoogleCloud {
+		list = addSecret(list, d.PathJSONKey)
+		list = addSecret(list, d.EncryptionKey)
+	}
+
+	list = addSecret(list, conf.ClientKey)
+
+	for _, env := range []string{encryptionKeyEnv, clientKeyEnv, s3SecretKeyEnv, s3SessionTokenEnv} {
+		list = addSecret(list, os.Getenv(env))
+	}
+
+	// Bits of the key JSON are as bad as all of it
+	if creds := os.Getenv(credentialsJSONEnv); creds != "" {
+		list = addSecret(list, creds)
+
+		var key map[string]interface{}
+
+		if json.Unmarshal([]byte(creds), &key) == nil {
+			for _, field := range []string{"private_key", "private_key_id"} {
+				if v, ok := key[field].(string); ok {
+					list = addSecret(list, v)
+				}
+			}
+		}
+	}
+
+	list = addSecret(list, conf.Notify.WebhookURL)
+
+	if u, err := url.Parse(conf.Metrics.PushgatewayURL); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		list = addSecret(list, password)
+	}
+
+	// A secret that contains another one is masked whole
+	sort.Slice(list, func(i, j int) bool { return len(list[i]) > len(list[j]) })
+
+	logMutex.Lock()
+	secrets = list
+	logMutex.Unlock()
+}
+
+// redact returns s with every secret replaced by ****. The caller holds
+// logMutex
+func redact(s []byte) []byte {
+	for _, secret := range secrets {
+		s = bytes.ReplaceAll(s, []byte(secret), []byte("****"))
+	}
+
+	return s
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// restoreTarget returns the local path under dest for an object of the
+// backup prefix, or an error when the object name would escape dest
+func restoreTarget(prefix, dest string, attrs *storage.ObjectAttrs) (string, error) {
+	rel := strings.TrimPrefix(attrs.Name, prefix)
+
+	// Objects are restored as they were before their transforms, so drop
+	// the suffixes too
+	rel = strings.TrimSuffix(rel, objectSuffix(attrs.Metadata, attrs.ContentEncoding))
+
+	// Archives are extracted into the directory they were made of
+	if isArchive(attrs) {
+		rel = strings.TrimSuffix(rel, archiveSuffix(attrs.Metadata["x-archive"]))
+	}
+
+	target := filepath.Join(dest, filepath.FromSlash(rel))
+
+	// Rel and not a prefix check, so that dest can be / or .
+	inside, err := filepath.Rel(dest, target)
+
+	if err != nil || inside == "." || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("object name \"%s\" is outside the destination", attrs.Name)
+	}
+
+	return target, nil
+}
+
+// applyMetadata sets the mode and mtime recorded by fileMetadata on target.
+// Objects without that metadata are left as created
+func applyMetadata(target string, metadata map[string]string) error {
+	if s, ok := metadata["x-mode"]; ok {
+		bits, err := strconv.ParseUint(s, 8, 32)
+
+		if err != nil {
+			return fmt.Errorf("invalid x-mode \"%s\"", s)
+		}
+
+		if err := os.Chmod(target, fileMode(uint32(bits))); err != nil {
+			return fmt.Errorf("os.Chmod: %w", err)
+		}
+	}
+
+	if s, ok := metadata["x-mtime"]; ok {
+		mtime, err := time.Parse(time.RFC3339Nano, s)
+
+		if err != nil {
+			return fmt.Errorf("invalid x-mtime \"%s\"", s)
+		}
+
+		if err := os.Chtimes(target, mtime, mtime); err != nil {
+			return fmt.Errorf("os.Chtimes: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// restoreObject downloads the object into target. It returns false without
+// touching an existing target unless force is set
+func restoreObject(ctx context.Context, dest *bucketClient, attrs *storage.ObjectAttrs, target string) (bool, error) {
+	if isArchive(attrs) {
+		return extractArchive(ctx, dest, attrs, target)
+	}
+
+	if !force {
+		if _, err := os.Stat(target); err == nil {
+			return false, nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	// Symlinks recorded by the backup are recreated, not downloaded
+	if link, ok := attrs.Metadata["x-symlink"]; ok {
+		os.Remove(target)
+
+		if err := os.Symlink(link, target); err != nil {
+			return false, fmt.Errorf("os.Symlink: %w", err)
+		}
+
+		return true, nil
+	}
+
+	rc, err := dest.object(attrs.Name).NewReader(ctx)
+
+	if err != nil {
+		return false, fmt.Errorf("Object.NewReader: %w", err)
+	}
+
+	defer rc.Close()
+
+	r, err := downloadReader(rc, attrs.Metadata, attrs.ContentEncoding)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer r.Close()
+
+	f, err := os.Create(target)
+
+	if err != nil {
+		return false, fmt.Errorf("os.Create: %w", err)
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(target)
+
+		return false, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("File.Close: %w", err)
+	}
+
+	if err := applyMetadata(target, attrs.Metadata); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// restoreFiles downloads every object of the backup restorePrefix into
+// restoreDest and returns the number of objects that failed
+func restoreFiles(ctx context.Context) int {
+	var totalRestored, totalSkipped, totalFailed int
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	// Backups are restored from the first destination
+	dest := newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	currentTime := time.Now()
+
+	if err := os.MkdirAll(restoreDest, 0755); err != nil {
+		logError("Creating destination \"%s\": %s", restoreDest, err)
+		exit(1)
+	}
+
+	prefix := strings.TrimSuffix(restorePrefix, "/") + "/"
+	objects := make(chan *storage.ObjectAttrs)
+
+	wg.Add(conf.Concurrency)
+
+	for i := 0; i < conf.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for attrs := range objects {
+				target, err := restoreTarget(prefix, restoreDest, attrs)
+
+				if err == nil {
+					var restored bool
+
+					restored, err = restoreObject(ctx, dest, attrs, target)
+
+					if err == nil && !restored {
+						logEvent(levelWarning, logFields{File: target, Object: attrs.Name},
+							fmt.Sprintf("File \"%s\" already exists, use -force to overwrite it", target))
+
+						mutex.Lock()
+						totalSkipped++
+						mutex.Unlock()
+
+						continue
+					}
+				}
+
+				if err != nil {
+					logEvent(levelError, logFields{File: target, Object: attrs.Name, Error: err.Error()},
+						fmt.Sprintf("Object \"%s\": %v", attrs.Name, err))
+
+					mutex.Lock()
+					totalFailed++
+					mutex.Unlock()
+
+					continue
+				}
+
+				logEvent(levelOK, logFields{File: target, Object: attrs.Name},
+					fmt.Sprintf("Object \"%s\" restored to \"%s\"", attrs.Name, target))
+
+				mutex.Lock()
+				totalRestored++
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	it := dest.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+feed:
+	for {
+		attrs, err := it.Next()
+
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			logError("Listing objects: %s", err)
+
+			mutex.Lock()
+			totalFailed++
+			mutex.Unlock()
+
+			break
+		}
+
+		// The manifest, checksums, summary and run log describe the backup,
+		// they're not some of its files
+		switch strings.TrimPrefix(attrs.Name, prefix) {
+		case manifestName, checksumsName, summaryName, runLogName:
+			continue
+		}
+
+		select {
+		case objects <- attrs:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(objects)
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		logWarning("Restore interrupted: %s", ctx.Err())
+	}
+
+	logSummary("Restore finished", []summaryField{
+		{"Total files restored", "filesRestored", totalRestored},
+		{"Total files skipped", "filesSkipped", totalSkipped},
+		{"Total files with errors", "filesError", totalFailed},
+		{"Restore took", "elapsed", time.Since(currentTime).String()},
+	}, nil)
+
+	return totalFailed
+}
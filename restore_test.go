@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// backUp copies the files of dir with the settings of extra to testBucket
+// and returns the prefix of the backup
+func backUp(t *testing.T, f *fakeGCS, dir string, extra ...string) string {
+	t.Helper()
+
+	loadTestConf(t, backupConf(dir, extra...))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	return backupPrefixOf(f, testBucket)
+}
+
+// checkTree checks that the files of paths, relative to dir, hold their
+// path as makeTree wrote them
+func checkTree(t *testing.T, dir string, paths ...string) {
+	t.Helper()
+
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+
+		if err != nil {
+			t.Errorf("restored file: %v", err)
+		} else if string(data) != p {
+			t.Errorf("restored %s holds %q", p, data)
+		}
+	}
+}
+
+func TestRestoreFiles(t *testing.T) {
+	for _, compress := range []string{"none", "gzip", "zstd"} {
+		t.Run(compress, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			src := t.TempDir()
+			paths := []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"}
+
+			makeTree(t, src, paths...)
+
+			prefix := backUp(t, f, src, "pathMode: relative", "compress: "+compress)
+			base := filepath.Base(src)
+
+			restorePrefix = prefix
+			restoreDest = filepath.Join(t.TempDir(), "missing", "dest")
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles = %d failures, want 0", failed)
+			}
+
+			checkTree(t, filepath.Join(restoreDest, base), paths...)
+
+			// Without -force the files are left as they are
+			changed := filepath.Join(restoreDest, base, "a.txt")
+
+			if err := ioutil.WriteFile(changed, []byte("changed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles again = %d failures, want 0", failed)
+			}
+
+			if data, _ := ioutil.ReadFile(changed); string(data) != "changed" {
+				t.Errorf("file overwritten without -force: %q", data)
+			}
+
+			force = true
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles -force = %d failures, want 0", failed)
+			}
+
+			checkTree(t, filepath.Join(restoreDest, base), paths...)
+		})
+	}
+}
+
+func TestRestoreTargetOutsideDest(t *testing.T) {
+	dest := t.TempDir()
+
+	for _, name := range []string{"p/../../etc/passwd", "p/"} {
+		if target, err := restoreTarget("p/", dest, &storage.ObjectAttrs{Name: name}); err == nil {
+			t.Errorf("restoreTarget(%q) = %q, want an error", name, target)
+		}
+	}
+}
+
+func TestRestoreTarget(t *testing.T) {
+	tests := []struct {
+		dest, name, want string
+	}{
+		{"/restore", "p/home/user/a.txt", "/restore/home/user/a.txt"},
+		{"/", "p/home/user/a.txt", "/home/user/a.txt"},
+		{".", "p/home/user/a.txt", "home/user/a.txt"},
+		{"restore", "p/a.txt", "restore/a.txt"},
+		{"/restore", "p/..a.txt", "/restore/..a.txt"},
+		{"/restore", "p/../../etc/passwd", ""},
+		{".", "p/../a.txt", ""},
+		{".", "p/", ""},
+		{"/restore", "p/../restore2/a.txt", ""},
+	}
+
+	for _, test := range tests {
+		target, err := restoreTarget("p/", test.dest, &storage.ObjectAttrs{Name: test.name})
+
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("restoreTarget(%q, %q) = %q, want an error", test.dest, test.name, target)
+			}
+
+			continue
+		}
+
+		if err != nil || target != filepath.FromSlash(test.want) {
+			t.Errorf("restoreTarget(%q, %q) = %q, %v, want %q", test.dest, test.name, target, err, test.want)
+		}
+	}
+}
+
+func TestUnixMode(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		bits uint32
+	}{
+		{0644, 0644},
+		{0400, 0400},
+		{0755 | os.ModeSetuid, 04755},
+		{0750 | os.ModeSetgid, 02750},
+		{0777 | os.ModeSticky, 01777},
+	}
+
+	for _, test := range tests {
+		if got := unixMode(test.mode); got != test.bits {
+			t.Errorf("unixMode(%v) = %04o, want %04o", test.mode, got, test.bits)
+		}
+
+		if got := fileMode(test.bits); got != test.mode {
+			t.Errorf("fileMode(%04o) = %v, want %v", test.bits, got, test.mode)
+		}
+	}
+}
+
+func TestModeAndMtimeRoundTrip(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	src := t.TempDir()
+	paths := []string{"private.txt", "script.sh"}
+	modes := []os.FileMode{0600, 0750 | os.ModeSetgid}
+	mtime := time.Date(2020, 5, 17, 10, 30, 0, 123456789, time.UTC)
+
+	makeTree(t, src, paths...)
+
+	for i, p := range paths {
+		file := filepath.Join(src, p)
+
+		if err := os.Chmod(file, modes[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefix := backUp(t, f, src, "pathMode: relative")
+	base := filepath.Base(src)
+
+	obj := f.object(testBucket, prefix+"/"+base+"/script.sh")
+
+	if obj == nil {
+		t.Fatal("no object of script.sh")
+	}
+
+	if obj.Metadata["x-mode"] != "2750" || obj.Metadata["x-mtime"] != "2020-05-17T10:30:00.123456789Z" {
+		t.Errorf("metadata = %v", obj.Metadata)
+	}
+
+	restorePrefix = prefix
+	restoreDest = t.TempDir()
+
+	if failed := restoreFiles(context.Background()); failed != 0 {
+		t.Fatalf("restoreFiles = %d failures, want 0", failed)
+	}
+
+	for i, p := range paths {
+		info, err := os.Stat(filepath.Join(restoreDest, base, p))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode() != modes[i] {
+			t.Errorf("%s restored with mode %v, want %v", p, info.Mode(), modes[i])
+		}
+
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s restored with mtime %v, want %v", p, info.ModTime(), mtime)
+		}
+	}
+}
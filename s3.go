@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables with the credentials of the S3 destinations
+const (
+	s3AccessKeyEnv    = "AWS_ACCESS_KEY_ID"
+	s3SecretKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	s3SessionTokenEnv = "AWS_SESSION_TOKEN"
+)
+
+// SHA-256 of an empty payload, sent by the requests without a body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Error is an error response of S3
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("S3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// s3Backend is the Backend of the S3-compatible destinations. Requests are
+// signed with AWS Signature Version 4 and address the bucket in the path,
+// which every S3-compatible store accepts
+type s3Backend struct {
+	endpoint string
+	bucket   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// s3Endpoint returns the endpoint of d, the AWS one of its region by default
+func s3Endpoint(d Destination) string {
+	if d.Endpoint != "" {
+		return strings.TrimSuffix(d.Endpoint, "/")
+	}
+
+	return fmt.Sprintf("https://s3.%s.amazonaws.com", d.Region)
+}
+
+// newS3Backend returns the backend of the S3 destination d, with the
+// credentials of the environment
+func newS3Backend(d Destination) *s3Backend {
+	return &s3Backend{
+		endpoint:     s3Endpoint(d),
+		bucket:       d.NameBucket,
+		region:       d.Region,
+		accessKey:    os.Getenv(s3AccessKeyEnv),
+		secretKey:    os.Getenv(s3SecretKeyEnv),
+		sessionToken: os.Getenv(s3SessionTokenEnv),
+		client:       &http.Client{},
+	}
+}
+
+// s3Escape percent-encodes s as SigV4 wants it, keeping the slashes when
+// it's a path
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Query returns the canonical query string of query
+func s3Query(query url.Values) string {
+	var pairs []string
+
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// s3SigningKey derives the SigV4 key of the day date, as 20060102, for
+// service in region
+func s3SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign adds the SigV4 Authorization header to req, whose body has the
+// SHA-256 payloadHash, signing the host, Content-MD5, Content-Type and
+// x-amz-* headers
+func (s *s3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+
+		if strings.HasPrefix(k, "x-amz-") || k == "content-md5" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	var names []string
+
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	signature := hex.EncodeToString(hmacSHA256(s3SigningKey(s.secretKey, date, s.region, "s3"), toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request for the object key, the bucket itself when key
+// is "", and returns the response when its status is 2xx, or else the
+// s3Error in it
+func (s *s3Backend) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := s.endpoint + "/" + s3Escape(s.bucket, false)
+
+	if key != "" {
+		u += "/" + s3Escape(key, true)
+	}
+
+	if len(query) > 0 {
+		u += "?" + s3Query(query)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	s3Err := &s3Error{StatusCode: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, s3Err)
+
+	return nil, s3Err
+}
+
+// s3HeaderValue returns v as a header value, RFC 2047 encoded when it
+// isn't plain ASCII
+func s3HeaderValue(v string) string {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return mime.QEncoding.Encode("utf-8", v)
+		}
+	}
+
+	return v
+}
+
+// Upload spools r to a temporary file, as S3 needs the length and the
+// checksums of the body up front, then puts it in a single request. S3
+// checks the MD5 of what it got, objects are up to 5 GiB
+func (s *s3Backend) Upload(ctx context.Context, name string, r io.Reader, opts objectOptions) (uint32, error) {
+	tmp, err := createTemp("s3-*")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	crc := crc32.New(crc32cTable)
+	md5sum := md5.New()
+	sha := sha256.New()
+
+	var w io.Writer = io.MultiWriter(tmp, crc, md5sum, sha)
+	var tw io.WriteCloser
+
+	if len(opts.Transforms) > 0 {
+		if tw, err = opts.Transforms.writer(w); err != nil {
+			return 0, err
+		}
+
+		w = tw
+	}
+
+	if opts.Hash != nil {
+		r = io.TeeReader(r, opts.Hash)
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return 0, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	if tw != nil {
+		if err := tw.Close(); err != nil {
+			return 0, fmt.Errorf("closing the transforms: %w", err)
+		}
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return 0, fmt.Errorf("Seek: %w", err)
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("Seek: %w", err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum.Sum(nil)))
+
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+
+	if encoding := opts.Transforms.encoding(); encoding != "" {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	for k, v := range opts.Transforms.metadata(opts.Metadata) {
+		header.Set("X-Amz-Meta-"+k, s3HeaderValue(v))
+	}
+
+	// The body was read up front, so only the request itself is timed
+	ctx, done, err := startUpload(ctx, opts)
+	defer done()
+
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, name, nil, header, ioutil.NopCloser(tmp), size, hex.EncodeToString(sha.Sum(nil)))
+
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	return crc.Sum32(), nil
+}
+
+// s3ListResult is a page of ListObjectsV2
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (s *s3Backend) List(ctx context.Context, prefix, delimiter string, fn func(obj objectInfo) error) error {
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0, emptyPayloadHash)
+
+		if err != nil {
+			return err
+		}
+
+		var page s3ListResult
+
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+
+		if err != nil {
+			return fmt.Errorf("decoding the object list: %w", err)
+		}
+
+		for _, c := range page.Contents {
+			if err := fn(objectInfo{Name: c.Key, Size: c.Size}); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range page.CommonPrefixes {
+			if err := fn(objectInfo{Name: p.Prefix}); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Backend) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil, nil, 0, emptyPayloadHash)
+
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *s3Backend) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil, nil, nil, 0, emptyPayloadHash)
+
+	var s3Err *s3Error
+
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	resp.Body.Close()
+
+	return true, nil
+}
@@ -0,0 +1,177 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSpecialKind(t *testing.T) {
+	tests := []struct {
+		mode os.FileMode
+		want string
+	}{
+		{os.ModeNamedPipe | 0644, "named pipe"},
+		{os.ModeSocket | 0755, "socket"},
+		{os.ModeDevice | os.ModeCharDevice | 0620, "character device"},
+		{os.ModeDevice | 0660, "device"},
+		{os.ModeIrregular, "special file"},
+	}
+
+	for _, test := range tests {
+		if got := specialKind(test.mode); got != test.want {
+			t.Errorf("specialKind(%v) = %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+// makeFIFO creates a named pipe at path, nothing ever writes to it so
+// opening it for reading blocks
+func makeFIFO(t *testing.T, path string) {
+	t.Helper()
+
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		t.Skipf("Mkfifo: %v", err)
+	}
+}
+
+func TestSpecialFilesSkipped(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 2)
+
+	fifo := filepath.Join(dir, "fifo")
+	makeFIFO(t, fifo)
+
+	// Short, unix socket paths have a length limit
+	socketDir, err := os.MkdirTemp("", "sock")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(socketDir)
+
+	socket := filepath.Join(socketDir, "s")
+	l, err := net.Listen("unix", socket)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	loadTestConf(t, fmt.Sprintf("directories:\n  - %q\n  - %q\ngoogleCloud:\n  nameBucket: %s\n", dir, socketDir, testBucket))
+
+	var log bytes.Buffer
+	logThreshold = levelWarning
+	runLog = &log
+
+	// Opening the FIFO would block the run
+	done := make(chan int)
+
+	go func() {
+		done <- copyFiles(context.Background())
+	}()
+
+	select {
+	case errs := <-done:
+		if errs != 0 {
+			t.Fatalf("copyFiles = %d errors, want 0", errs)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("copyFiles blocked on the named pipe")
+	}
+
+	if got, want := backedUp(f, testBucket), objectPathsOf(files); !equalStrings(got, want) {
+		t.Errorf("backed up %v, want %v", got, want)
+	}
+
+	if totalFilesSpecial != 2 {
+		t.Errorf("totalFilesSpecial = %d, want 2", totalFilesSpecial)
+	}
+
+	for _, want := range []string{"Skipping the named pipe \"" + fifo + "\"", "Skipping the socket \"" + socket + "\"", "[WARNING]"} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("log without %q:\n%s", want, log.String())
+		}
+	}
+}
+
+func TestFileReplacedByFIFO(t *testing.T) {
+	newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 1)
+
+	loadTestConf(t, backupConf(dir))
+
+	ctx := context.Background()
+	dest := newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	// Found as a file by the walk, a named pipe by the upload
+	if err := os.Remove(files[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	makeFIFO(t, files[0])
+
+	done := make(chan manifestEntry)
+
+	go func() {
+		done <- backupFile(ctx, dest, "prefix", files[0])
+	}()
+
+	select {
+	case entry := <-done:
+		if entry.Status != statusSkipped || !strings.Contains(entry.Error, "named pipe, not a regular file") {
+			t.Errorf("entry = %+v, want skipped as a named pipe", entry)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("backupFile blocked on the named pipe")
+	}
+}
+
+func TestPlanListsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, 1)
+
+	fifo := filepath.Join(dir, "fifo")
+	makeFIFO(t, fifo)
+
+	loadTestConf(t, backupConf(dir))
+	planOnly = true
+
+	plan, err := buildPlan(context.Background())
+
+	if err != nil {
+		t.Fatalf("buildPlan: %v", err)
+	}
+
+	found := false
+
+	for _, entry := range plan {
+		if entry.File != fifo {
+			continue
+		}
+
+		found = true
+
+		if entry.Action != planSkip || entry.Reason != "special" {
+			t.Errorf("plan entry of the named pipe = %+v", entry)
+		}
+	}
+
+	if !found {
+		t.Errorf("plan %+v without the named pipe", plan)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// stageFile copies the open file f of path to a temporary file and checks
+// that path didn't change meanwhile, so the copy is a consistent snapshot
+// of it. A file that keeps changing is copied again up to conf.MaxRetries
+// times. It returns the copy, rewound, the info of path it matches and
+// the SHA-256 of its content in hex and its CRC32C
+func stageFile(f *os.File, path string, info os.FileInfo) (*os.File, os.FileInfo, string, uint32, error) {
+	tmp, err := createTemp("stage-*")
+
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		h := sha256.New()
+		crc := crc32.New(crc32cTable)
+		n, err := io.Copy(io.MultiWriter(tmp, h, crc), f)
+
+		if err != nil {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("staging: %w", err)
+		}
+
+		changed := fileChanged(path, info, n)
+
+		if changed == "" {
+			if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+				removeStaged(tmp)
+				return nil, nil, "", 0, fmt.Errorf("Seek: %w", err)
+			}
+
+			return tmp, info, hex.EncodeToString(h.Sum(nil)), crc.Sum32(), nil
+		}
+
+		if attempt >= conf.MaxRetries {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("file kept changing while it was staged (%s)", changed)
+		}
+
+		logEvent(levelWarning, logFields{File: path},
+			fmt.Sprintf("File \"%s\" changed while it was staged (%s), staging it again", path, changed))
+
+		if info, err = os.Stat(path); err != nil {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("os.Stat: %w", err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("Seek: %w", err)
+		}
+
+		if err := tmp.Truncate(0); err != nil {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("File.Truncate: %w", err)
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			removeStaged(tmp)
+			return nil, nil, "", 0, fmt.Errorf("Seek: %w", err)
+		}
+	}
+}
+
+// removeStaged closes and deletes the staged copy tmp
+func removeStaged(tmp *os.File) {
+	tmp.Close()
+
+	if err := os.Remove(tmp.Name()); err != nil {
+		logWarning("Removing the staged copy \"%s\": %s", tmp.Name(), err)
+	}
+}
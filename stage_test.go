@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stagedFiles returns the staged copies in the temporary directory
+func stagedFiles(t *testing.T) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(conf.TempDir, "gcs-backup-*", "stage-*"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func TestStageFile(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 1)
+
+	loadTestConf(t, backupConf(dir))
+
+	f, err := os.Open(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, _, sum, crc, err := stageFile(f, files[0], info)
+
+	if err != nil {
+		t.Fatalf("stageFile: %v", err)
+	}
+
+	if tmp.Name() == files[0] || filepath.Dir(filepath.Dir(tmp.Name())) != conf.TempDir {
+		t.Errorf("staged to %s, want a copy under %s", tmp.Name(), conf.TempDir)
+	}
+
+	// The copy is rewound, ready for the upload
+	data, err := ioutil.ReadAll(tmp)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sha256.Sum256([]byte(files[0]))
+
+	if string(data) != files[0] || sum != hex.EncodeToString(want[:]) || crc != crc32.Checksum(data, crc32cTable) {
+		t.Errorf("staged %q with SHA-256 %s and CRC32C %08x, want the file", data, sum, crc)
+	}
+
+	removeStaged(tmp)
+
+	if staged := stagedFiles(t); len(staged) != 0 {
+		t.Errorf("staged copies left: %v", staged)
+	}
+}
+
+func TestStagedUpload(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		name := "upload"
+
+		if fail {
+			name = "failed upload"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			dir := t.TempDir()
+			files := writeFiles(t, dir, 3)
+
+			loadTestConf(t, backupConf(dir, "stage: true", "concurrency: 1", "maxRetries: 0"))
+
+			// The staged copies there while each file is uploaded
+			var mutex sync.Mutex
+			var stagedDuring []int
+
+			f.failUpload = func(bucket, name string) int {
+				if !strings.HasPrefix(filepath.Base(name), "file-") {
+					return 0
+				}
+
+				mutex.Lock()
+				stagedDuring = append(stagedDuring, len(stagedFiles(t)))
+				mutex.Unlock()
+
+				if fail {
+					return http.StatusForbidden
+				}
+
+				return 0
+			}
+
+			want := 0
+
+			if fail {
+				want = len(files)
+			}
+
+			if errs := copyFiles(context.Background()); errs != want {
+				t.Fatalf("copyFiles = %d errors, want %d", errs, want)
+			}
+
+			if len(stagedDuring) != len(files) {
+				t.Errorf("%d uploads of the files, want %d", len(stagedDuring), len(files))
+			}
+
+			for i, n := range stagedDuring {
+				if n != 1 {
+					t.Errorf("%d staged copies during upload %d, want 1", n, i)
+				}
+			}
+
+			// Removed whatever happened to the upload
+			if staged := stagedFiles(t); len(staged) != 0 {
+				t.Errorf("staged copies left: %v", staged)
+			}
+		})
+	}
+}
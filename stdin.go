@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// uploadStdin streams stdin to the object objectName of the backup prefix
+// in every destination and returns the number of destinations that failed.
+// Stdin can't be read twice, so it's fanned out to all of them at once and
+// a failure in one of them stops the others too. The backup ends like the
+// one of the directories, with the manifest, the checksums, the summary,
+// the run log and the events of a single file
+func uploadStdin(ctx context.Context) int {
+	var dests []*bucketClient
+
+	for _, d := range conf.GoogleCloud {
+		dest := newClient(ctx, d)
+		defer dest.Close()
+
+		dests = append(dests, dest)
+	}
+
+	preflightAll(ctx, dests)
+
+	currentTime := time.Now()
+	pathBase := backupPrefix(currentTime)
+	object := pathBase + "/" + strings.TrimLeft(objectName, "/") + pipelineOf(conf.Compress).suffix()
+
+	events.OnStart(pathBase)
+
+	var r io.Reader = os.Stdin
+
+	if uploadLimiter != nil {
+		r = &rateLimitedReader{ctx: ctx, r: r, limiter: uploadLimiter}
+	}
+
+	counter := &countingReader{r: r}
+	readers := make([]*io.PipeReader, len(dests))
+	writers := make([]io.Writer, len(dests))
+	pipes := make([]*io.PipeWriter, len(dests))
+
+	for i := range dests {
+		readers[i], pipes[i] = io.Pipe()
+		writers[i] = pipes[i]
+	}
+
+	copyDone := make(chan struct{})
+
+	go func() {
+		_, err := io.Copy(io.MultiWriter(writers...), counter)
+
+		for _, pw := range pipes {
+			pw.CloseWithError(err)
+		}
+
+		close(copyDone)
+	}()
+
+	var wg sync.WaitGroup
+
+	entries := make([]manifestEntry, len(dests))
+
+	for i, dest := range dests {
+		wg.Add(1)
+
+		go func(i int, dest *bucketClient) {
+			defer wg.Done()
+
+			opts := dest.objectOptions()
+			opts.Metadata = customMetadata
+			opts.ContentType = stdinContentType
+			opts.Transforms = pipelineOf(conf.Compress)
+			opts.ChunkSize = conf.ChunkSizeMB << 20
+			opts.NoTimeout = true
+			opts.Hash = sha256.New()
+
+			crc, err := dest.backend.Upload(ctx, object, readers[i], opts)
+
+			// Unblocks the copy from stdin when this upload stopped first
+			readers[i].CloseWithError(err)
+			entries[i] = manifestEntry{File: "stdin", Object: object, Status: statusCopied, CRC32C: fmt.Sprintf("%08x", crc),
+				SHA256: hex.EncodeToString(opts.Hash.Sum(nil))}
+
+			if err != nil {
+				entries[i].fail(err)
+				entries[i].CRC32C, entries[i].SHA256 = "", ""
+			}
+
+			holdObject(ctx, dest, &entries[i])
+		}(i, dest)
+	}
+
+	wg.Wait()
+	<-copyDone
+
+	failed := 0
+
+	for i, dest := range dests {
+		entries[i].Size = counter.n
+		fileEvent(dest.NameBucket, entries[i])
+
+		dest.entries = entries[i : i+1]
+
+		if entries[i].Status == statusError {
+			dest.filesError++
+			failed++
+		} else {
+			dest.filesOK++
+		}
+	}
+
+	writeManifests(ctx, dests, pathBase, currentTime, failed == 0 && ctx.Err() == nil)
+
+	// stdin counts as a single file in the summary
+	totalFilesToCopy, totalBytesToCopy = 1, counter.n
+
+	if failed > 0 {
+		totalFilesError.inc()
+		totalBytesError.add(counter.n)
+	} else {
+		totalFilesOK.inc()
+		totalBytesOK.add(counter.n)
+	}
+
+	elapsed := time.Since(currentTime)
+
+	logSummary("Backup finished", []summaryField{
+		{"Total bytes read from stdin", "bytesCopied", byteCount(counter.n)},
+		{"Average throughput per second", "bytesPerSecond", throughput(counter.n, elapsed)},
+		{"Copy files took", "elapsed", elapsed.String()},
+	}, destinationSummaries(dests))
+
+	report := runReport{
+		Prefix:      pathBase,
+		Started:     currentTime.Format(time.RFC3339),
+		Duration:    elapsed.Round(time.Second).String(),
+		FilesToCopy: 1,
+		FilesCopied: int(totalFilesOK.get()),
+		FilesError:  int(totalFilesError.get()),
+		BytesCopied: totalBytesOK.get(),
+		Failed:      failed > 0 || ctx.Err() != nil,
+	}
+
+	finishRun(ctx, dests, currentTime, elapsed, report, "")
+
+	return failed
+}
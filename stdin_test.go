@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setStdin makes data the content of os.Stdin until the test ends
+func setStdin(t *testing.T, data []byte) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "stdin")
+
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := os.Stdin
+	os.Stdin = f
+
+	t.Cleanup(func() {
+		os.Stdin = saved
+		f.Close()
+	})
+}
+
+func TestUploadStdin(t *testing.T) {
+	const drBucket = "dr-bucket"
+
+	// Over a chunk, so it takes a resumable upload of unknown length
+	data := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	f := newFakeGCS(t, testBucket, drBucket)
+
+	loadTestConf(t, fmt.Sprintf("googleCloud:\n  - nameBucket: %s\n  - nameBucket: %s\nchunkSizeMB: 1\n", testBucket, drBucket))
+	setStdin(t, data)
+
+	fromStdin, objectName = true, "/db/dump.sql"
+	stdinContentType = "application/sql"
+
+	if failed := uploadStdin(context.Background()); failed != 0 {
+		t.Fatalf("uploadStdin = %d failed, want 0", failed)
+	}
+
+	for _, bucket := range []string{testBucket, drBucket} {
+		prefix := backupPrefixOf(f, bucket)
+		obj := f.object(bucket, prefix+"/db/dump.sql")
+
+		if obj == nil {
+			t.Fatalf("no %s/db/dump.sql in %s: %v", prefix, bucket, f.names(bucket, ""))
+		}
+
+		if !bytes.Equal(obj.Data, data) {
+			t.Errorf("object in %s holds %d bytes, want the %d of stdin", bucket, len(obj.Data), len(data))
+		}
+
+		if obj.ContentType != "application/sql" {
+			t.Errorf("content type = %q, want application/sql", obj.ContentType)
+		}
+
+		entries := readManifest(t, f, bucket, prefix).Files
+
+		if len(entries) != 1 || entries[0].File != "stdin" || entries[0].Size != int64(len(data)) || entries[0].Status != statusCopied {
+			t.Errorf("manifest of %s = %+v", bucket, entries)
+		}
+	}
+
+	// One to each bucket
+	if n := f.count("RESUMABLE", backupPrefixOf(f, testBucket)+"/db/dump.sql"); n != 2 {
+		t.Errorf("%d resumable uploads of stdin, want 2", n)
+	}
+
+	if totalFilesOK.get() != 1 || totalBytesOK.get() != int64(len(data)) {
+		t.Errorf("counted %d files and %d bytes, want 1 and %d", totalFilesOK.get(), totalBytesOK.get(), len(data))
+	}
+}
+
+func TestUploadStdinCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 1000)
+
+	f := newFakeGCS(t, testBucket)
+
+	loadTestConf(t, backupConf(t.TempDir(), "compress: gzip"))
+	setStdin(t, data)
+
+	fromStdin, objectName = true, "dump.sql"
+
+	if failed := uploadStdin(context.Background()); failed != 0 {
+		t.Fatalf("uploadStdin = %d failed, want 0", failed)
+	}
+
+	name := backupPrefixOf(f, testBucket) + "/dump.sql" + pipelineOf(conf.Compress).suffix()
+	obj := f.object(testBucket, name)
+
+	if obj == nil {
+		t.Fatalf("no %s: %v", name, f.names(testBucket, ""))
+	}
+
+	if len(obj.Data) >= len(data) {
+		t.Errorf("object holds %d bytes, want less than the %d of stdin", len(obj.Data), len(data))
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(obj.Data))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(restored, data) {
+		t.Errorf("object doesn't decompress to stdin: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Name of the result of the run under the backup prefix
+const summaryName = "summary.json"
+
+// Version of the runSummary schema, raised on changes that break readers
+const summarySchemaVersion = 1
+
+// runSummary is the machine readable result of a backup, written to
+// summaryName and to -summary-out
+type runSummary struct {
+	SchemaVersion   int     `json:"schemaVersion"`
+	Version         string  `json:"version"`
+	Prefix          string  `json:"prefix"`
+	Started         string  `json:"started"`
+	Finished        string  `json:"finished"`
+	DurationSeconds float64 `json:"durationSeconds"`
+
+	FilesToCopy    int   `json:"filesToCopy"`
+	FilesCopied    int64 `json:"filesCopied"`
+	FilesError     int64 `json:"filesError"`
+	FilesUnchanged int64 `json:"filesUnchanged"`
+	FilesChanged   int64 `json:"filesChanged"`
+	FilesEmpty     int   `json:"filesEmpty"`
+	FilesSpecial   int   `json:"filesSpecial"`
+	FilesFiltered  int   `json:"filesFiltered"`
+	BytesToCopy    int64 `json:"bytesToCopy"`
+	BytesCopied    int64 `json:"bytesCopied"`
+	BytesError     int64 `json:"bytesError"`
+	Concurrency    int   `json:"concurrency"`
+
+	Truncated   bool   `json:"truncated"`
+	Interrupted bool   `json:"interrupted"`
+	AbortReason string `json:"abortReason,omitempty"`
+	ExitStatus  int    `json:"exitStatus"`
+
+	Destinations []destinationSummary `json:"destinations"`
+}
+
+// newRunSummary collects the result of the backup pathBase started at
+// started, whose run ended with ctx
+func newRunSummary(ctx context.Context, pathBase string, started time.Time, dests []*bucketClient, abortErr string) runSummary {
+	finished := time.Now()
+
+	s := runSummary{
+		SchemaVersion:   summarySchemaVersion,
+		Version:         version,
+		Prefix:          pathBase,
+		Started:         started.Format(time.RFC3339),
+		Finished:        finished.Format(time.RFC3339),
+		DurationSeconds: finished.Sub(started).Seconds(),
+		FilesToCopy:     totalFilesToCopy,
+		FilesCopied:     totalFilesOK.get(),
+		FilesError:      totalFilesError.get(),
+		FilesUnchanged:  totalFilesSkipped.get(),
+		FilesChanged:    totalFilesChanged.get(),
+		FilesEmpty:      totalFilesEmpty,
+		FilesSpecial:    totalFilesSpecial,
+		FilesFiltered:   totalFilesFilterSize + totalFilesFilterAge + totalFilesFilterExt + totalFilesFilterContent,
+		BytesToCopy:     totalBytesToCopy,
+		BytesCopied:     totalBytesOK.get(),
+		BytesError:      totalBytesError.get(),
+		Concurrency:     concurrencyUsed,
+		Truncated:       errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Interrupted:     errors.Is(ctx.Err(), context.Canceled),
+		AbortReason:     abortErr,
+		ExitStatus:      exitCode(ctx, int(totalFilesError.get())),
+	}
+
+	for _, dest := range dests {
+		s.Destinations = append(s.Destinations, destinationSummary{
+			Bucket:      dest.NameBucket,
+			FilesCopied: dest.filesOK,
+			FilesError:  dest.filesError,
+		})
+	}
+
+	return s
+}
+
+// writeSummary uploads s to <prefix>/summary.json of every destination when
+// summary is set, and writes it to -summary-out when given
+func writeSummary(ctx context.Context, dests []*bucketClient, s runSummary) {
+	data, err := json.MarshalIndent(s, "", "  ")
+
+	if err != nil {
+		logError("Encoding summary: %s", err)
+		return
+	}
+
+	if conf.Summary {
+		for _, dest := range dests {
+			opts := dest.objectOptions()
+			opts.ContentType = "application/json"
+
+			if _, err := dest.backend.Upload(ctx, s.Prefix+"/"+summaryName, bytes.NewReader(data), opts); err != nil {
+				logError("Writing summary to \"%s\": %s", dest.NameBucket, err)
+			}
+		}
+	}
+
+	if summaryOut != "" {
+		if err := ioutil.WriteFile(summaryOut, append(data, '\n'), 0644); err != nil {
+			logError("Writing summary: %s", fmt.Errorf("ioutil.WriteFile: %w", err))
+		}
+	}
+}
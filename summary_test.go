@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryOfAPartialFailure(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	files := writeFiles(t, dir, 5)
+
+	f.failUpload = func(bucket, name string) int {
+		if strings.HasSuffix(name, absoluteObjectPath(files[2])) {
+			return http.StatusForbidden
+		}
+
+		return 0
+	}
+
+	loadTestConf(t, backupConf(dir, "summary: true"))
+	summaryOut = filepath.Join(t.TempDir(), "summary.json")
+	started := time.Now().Truncate(time.Second)
+
+	if errs := copyFiles(context.Background()); errs != 1 {
+		t.Fatalf("copyFiles = %d errors, want 1", errs)
+	}
+
+	prefix := backupPrefixOf(f, testBucket)
+	obj := f.object(testBucket, prefix+"/"+summaryName)
+
+	if obj == nil {
+		t.Fatalf("no %s in the bucket, got %v", summaryName, f.names(testBucket, ""))
+	}
+
+	if obj.ContentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", obj.ContentType)
+	}
+
+	local, err := ioutil.ReadFile(summaryOut)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(bytes.TrimSpace(local), bytes.TrimSpace(obj.Data)) {
+		t.Errorf("-summary-out differs from the object:\n%s\n%s", local, obj.Data)
+	}
+
+	// Every field of the schema is there, whatever its value
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(obj.Data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"schemaVersion", "version", "prefix", "started", "finished", "durationSeconds",
+		"filesToCopy", "filesCopied", "filesError", "filesUnchanged", "filesChanged",
+		"filesEmpty", "filesSpecial", "filesFiltered", "bytesToCopy", "bytesCopied",
+		"bytesError", "concurrency", "truncated", "interrupted", "exitStatus", "destinations",
+	} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("summary without %s", key)
+		}
+	}
+
+	var s runSummary
+
+	if err := json.Unmarshal(obj.Data, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.SchemaVersion != summarySchemaVersion || s.Prefix != prefix || s.ExitStatus != 2 {
+		t.Errorf("schema %d, prefix %q and exit status %d, want %d, %q and 2", s.SchemaVersion, s.Prefix, s.ExitStatus, summarySchemaVersion, prefix)
+	}
+
+	if s.FilesToCopy != 5 || s.FilesCopied != 4 || s.FilesError != 1 || s.BytesError != int64(len(files[2])) {
+		t.Errorf("summary counts %+v", s)
+	}
+
+	if s.Truncated || s.Interrupted || s.AbortReason != "" {
+		t.Errorf("summary of a run that ended: %+v", s)
+	}
+
+	begun, err := time.Parse(time.RFC3339, s.Started)
+
+	if err != nil || begun.Before(started) {
+		t.Errorf("started = %q, want the start of the run", s.Started)
+	}
+
+	if finished, err := time.Parse(time.RFC3339, s.Finished); err != nil || finished.Before(begun) {
+		t.Errorf("finished = %q, want after %q", s.Finished, s.Started)
+	}
+
+	want := []destinationSummary{{Bucket: testBucket, FilesCopied: 4, FilesError: 1}}
+
+	if len(s.Destinations) != 1 || s.Destinations[0] != want[0] {
+		t.Errorf("destinations = %+v, want %+v", s.Destinations, want)
+	}
+}
+
+func TestSummaryOnlyWhenAsked(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 2)
+
+	loadTestConf(t, backupConf(dir))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	if obj := f.object(testBucket, backupPrefixOf(f, testBucket)+"/"+summaryName); obj != nil {
+		t.Errorf("%s written without summary", summaryName)
+	}
+}
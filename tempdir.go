@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	// Directory of the temporary files of this run, made under tempDir by
+	// the first createTemp and removed by exit
+	scratchDir   string
+	scratchMutex sync.Mutex
+)
+
+// createTemp creates a temporary file named after pattern, as with
+// os.CreateTemp, in the directory of the temporary files of this run
+func createTemp(pattern string) (*os.File, error) {
+	scratchMutex.Lock()
+
+	if scratchDir == "" {
+		dir, err := os.MkdirTemp(conf.TempDir, "gcs-backup-*")
+
+		if err != nil {
+			scratchMutex.Unlock()
+			return nil, fmt.Errorf("os.MkdirTemp: %w", err)
+		}
+
+		scratchDir = dir
+	}
+
+	dir := scratchDir
+	scratchMutex.Unlock()
+
+	f, err := os.CreateTemp(dir, pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("os.CreateTemp: %w", err)
+	}
+
+	return f, nil
+}
+
+// removeScratchDir removes the temporary files of this run left behind,
+// e.g. by an upload in progress when the run was aborted
+func removeScratchDir() {
+	scratchMutex.Lock()
+	defer scratchMutex.Unlock()
+
+	if scratchDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(scratchDir); err != nil {
+		logWarning("Removing the temporary files: %s", err)
+	}
+
+	scratchDir = ""
+}
+
+// exit removes the temporary files of this run and exits with code. The
+// program exits through it, since os.Exit skips the deferred calls
+func exit(code int) {
+	removeScratchDir()
+	os.Exit(code)
+}
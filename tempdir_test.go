@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scratchDirs returns the directories of the temporary files of the runs
+// left in dir
+func scratchDirs(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "gcs-backup-*"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return matches
+}
+
+func TestCreateTemp(t *testing.T) {
+	resetState(t)
+	conf.TempDir = t.TempDir()
+
+	a, err := createTemp("a-*")
+
+	if err != nil {
+		t.Fatalf("createTemp: %v", err)
+	}
+
+	defer a.Close()
+
+	b, err := createTemp("b-*")
+
+	if err != nil {
+		t.Fatalf("createTemp: %v", err)
+	}
+
+	defer b.Close()
+
+	// Both in the directory of this run, under tempDir
+	dirs := scratchDirs(t, conf.TempDir)
+
+	if len(dirs) != 1 || filepath.Dir(a.Name()) != dirs[0] || filepath.Dir(b.Name()) != dirs[0] {
+		t.Fatalf("temporary files %s and %s, directories %v", a.Name(), b.Name(), dirs)
+	}
+
+	if !strings.HasPrefix(filepath.Base(a.Name()), "a-") {
+		t.Errorf("temporary file %s not named after its pattern", a.Name())
+	}
+
+	removeScratchDir()
+
+	if dirs := scratchDirs(t, conf.TempDir); len(dirs) != 0 {
+		t.Errorf("directories %v left", dirs)
+	}
+
+	// The next one gets a directory again
+	c, err := createTemp("c-*")
+
+	if err != nil {
+		t.Fatalf("createTemp after the cleanup: %v", err)
+	}
+
+	c.Close()
+
+	if _, err := os.Stat(c.Name()); err != nil {
+		t.Error(err)
+	}
+
+	conf.TempDir = filepath.Join(conf.TempDir, "missing")
+	scratchDir = ""
+
+	if _, err := createTemp("d-*"); err == nil {
+		t.Error("createTemp under a missing tempDir succeeded")
+	}
+}
+
+func TestTempDirValidation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Checked directly, parseTestConf sets a tempDir of its own
+	for path, want := range map[string]string{
+		filepath.Join(dir, "missing"): "tempDir: stat",
+		file:                          "is not a directory",
+	} {
+		resetState(t)
+		conf = Configuration{Directories: []Directory{{Path: dir}}, TempDir: path}
+
+		found := false
+
+		for _, err := range validateConf() {
+			found = found || strings.Contains(err.Error(), want)
+		}
+
+		if !found {
+			t.Errorf("tempDir %s: no error with %q", path, want)
+		}
+	}
+}
+
+func TestTempFilesRemovedOnExit(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		f := newFakeGCS(t, testBucket)
+		dir := t.TempDir()
+		files := writeFiles(t, dir, 3)
+
+		// The staged copies are in tempDir while they're uploaded. The
+		// hooks are set before the configuration is written, which the
+		// requests of the run come after
+		var mutex sync.Mutex
+		var tempDir string
+		staged := 0
+
+		f.onUpload = func(name string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			matches, _ := filepath.Glob(filepath.Join(tempDir, "gcs-backup-*", "stage-*"))
+			staged += len(matches)
+		}
+
+		f.failUpload = func(bucket, name string) int {
+			if fail && strings.HasSuffix(name, absoluteObjectPath(files[1])) {
+				return 403
+			}
+
+			return 0
+		}
+
+		if err := parseTestConf(t, backupConf(dir, "stage: true")); err != nil {
+			t.Fatal(err)
+		}
+
+		mutex.Lock()
+		tempDir = conf.TempDir
+		mutex.Unlock()
+
+		want := 0
+
+		if fail {
+			want = 2
+		}
+
+		if out, code := runMain(t, "-config", fileConf, "-concurrency", "1"); code != want {
+			t.Fatalf("failing %v: exit status %d, want %d: %s", fail, code, want, out)
+		}
+
+		mutex.Lock()
+		n := staged
+		mutex.Unlock()
+
+		if n == 0 {
+			t.Errorf("failing %v: no staged copy in tempDir during the uploads", fail)
+		}
+
+		if dirs := scratchDirs(t, tempDir); len(dirs) != 0 {
+			t.Errorf("failing %v: directories %v left in tempDir", fail, dirs)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Stages of transforms
+const (
+	transformCompress = "compress"
+	transformEncrypt  = "encrypt"
+)
+
+// Environment variable with the base64 key of the encrypt stage, which
+// takes precedence over clientKey
+const clientKeyEnv = "GCS_BACKUP_CLIENT_KEY"
+
+// Key of the encrypt stage, set by validateConf
+var clientKey *[32]byte
+
+// transform is a stage the content of a file goes through before the
+// upload, reversed on restore
+type transform interface {
+	// name is the stage in the x-transforms metadata
+	name() string
+	// suffix is added to the object name
+	suffix() string
+	// writer returns a writer applying the stage to what is written into
+	// w, which must be closed to flush it
+	writer(w io.Writer) (io.WriteCloser, error)
+	// reader returns the content r had before the stage
+	reader(r io.Reader) (io.ReadCloser, error)
+}
+
+func (c compression) name() string {
+	return string(c)
+}
+
+func (c compression) writer(w io.Writer) (io.WriteCloser, error) {
+	return c.newWriter(w)
+}
+
+func (c compression) reader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case compressGzip:
+		return gzip.NewReader(r)
+	case compressZstd:
+		d, err := zstd.NewReader(r)
+
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader: %w", err)
+		}
+
+		return d.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("no reader for compression \"%s\"", c)
+}
+
+// pipeline is the transforms of a file, applied in order
+type pipeline []transform
+
+// pipelineOf returns the stages of transforms, or the compression c alone
+// without them. The compress stage is c, and is left out when c is none
+func pipelineOf(c compression) pipeline {
+	names := conf.Transforms
+
+	if len(names) == 0 {
+		names = []string{transformCompress}
+	}
+
+	var p pipeline
+
+	for _, name := range names {
+		switch name {
+		case transformCompress:
+			if c.encoding() != "" {
+				p = append(p, c)
+			}
+		case transformEncrypt:
+			p = append(p, encryption{key: clientKey})
+		}
+	}
+
+	return p
+}
+
+// pipelineFor returns the transforms of the file path
+func pipelineFor(path string) pipeline {
+	return pipelineOf(compressionFor(path))
+}
+
+// suffix returns the suffixes of the stages, in order
+func (p pipeline) suffix() string {
+	var b strings.Builder
+
+	for _, t := range p {
+		b.WriteString(t.suffix())
+	}
+
+	return b.String()
+}
+
+// encoding returns the Content-Encoding of the objects made by p. Only a
+// lone compression is told to GCS, which then decompresses gzip objects
+// on download; the other pipelines are recorded in x-transforms
+func (p pipeline) encoding() string {
+	if len(p) == 1 {
+		if c, ok := p[0].(compression); ok {
+			return c.encoding()
+		}
+	}
+
+	return ""
+}
+
+// metadata returns metadata with x-transforms added when p needs it
+func (p pipeline) metadata(metadata map[string]string) map[string]string {
+	if len(p) == 0 || p.encoding() != "" {
+		return metadata
+	}
+
+	var names []string
+
+	for _, t := range p {
+		names = append(names, t.name())
+	}
+
+	m := map[string]string{"x-transforms": strings.Join(names, ",")}
+
+	for k, v := range metadata {
+		m[k] = v
+	}
+
+	return m
+}
+
+// transformWriter runs what's written through every stage of a pipeline
+type transformWriter struct {
+	io.Writer
+	stages []io.WriteCloser
+}
+
+// Close flushes the stages from the first one, each into the next
+func (t *transformWriter) Close() error {
+	for _, s := range t.stages {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writer returns a writer applying the stages of p, in order, to what is
+// written into w. It must be closed to flush them
+func (p pipeline) writer(w io.Writer) (io.WriteCloser, error) {
+	t := &transformWriter{Writer: w}
+
+	for i := len(p) - 1; i >= 0; i-- {
+		s, err := p[i].writer(t.Writer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.Writer = s
+		t.stages = append([]io.WriteCloser{s}, t.stages...)
+	}
+
+	return t, nil
+}
+
+// transformReader reverses the stages of a pipeline
+type transformReader struct {
+	io.Reader
+	stages []io.ReadCloser
+}
+
+func (t *transformReader) Close() error {
+	for _, s := range t.stages {
+		s.Close()
+	}
+
+	return nil
+}
+
+// reader returns the content r had before the stages of p
+func (p pipeline) reader(r io.Reader) (io.ReadCloser, error) {
+	t := &transformReader{Reader: r}
+
+	for i := len(p) - 1; i >= 0; i-- {
+		s, err := p[i].reader(t.Reader)
+
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+
+		t.Reader = s
+		t.stages = append(t.stages, s)
+	}
+
+	return t, nil
+}
+
+// objectTransforms returns the transforms recorded in the x-transforms
+// metadata of an object, none when it has no such metadata
+func objectTransforms(metadata map[string]string) (pipeline, error) {
+	recorded, ok := metadata["x-transforms"]
+
+	if !ok {
+		return nil, nil
+	}
+
+	var p pipeline
+
+	for _, name := range strings.Split(recorded, ",") {
+		switch name {
+		case transformEncrypt:
+			if clientKey == nil {
+				return nil, fmt.Errorf("the object is encrypted, clientKey or %s is needed", clientKeyEnv)
+			}
+
+			p = append(p, encryption{key: clientKey})
+		case string(compressGzip), string(compressZstd):
+			p = append(p, compression(name))
+		default:
+			return nil, fmt.Errorf("unknown transform \"%s\" in x-transforms", name)
+		}
+	}
+
+	return p, nil
+}
+
+// objectSuffix returns the suffix the transforms of an object added to its
+// name
+func objectSuffix(metadata map[string]string, encoding string) string {
+	if p, err := objectTransforms(metadata); err == nil && len(p) > 0 {
+		return p.suffix()
+	}
+
+	return encodingCompression(encoding).suffix()
+}
+
+// downloadReader returns the original content of an object with metadata
+// and the Content-Encoding encoding read from r
+func downloadReader(r io.Reader, metadata map[string]string, encoding string) (io.ReadCloser, error) {
+	p, err := objectTransforms(metadata)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p) > 0 {
+		return p.reader(r)
+	}
+
+	return decompressReader(r, encoding)
+}
+
+// parseClientKey returns the key of the encrypt stage: the environment
+// variable or else s, 32 bytes in base64
+func parseClientKey(s string) (*[32]byte, error) {
+	if env := os.Getenv(clientKeyEnv); env != "" {
+		s = env
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, fmt.Errorf("clientKey is not valid base64: %w", err)
+	}
+
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("clientKey must be 32 bytes, got %d", len(raw))
+	}
+
+	var key [32]byte
+	copy(key[:], raw)
+
+	return &key, nil
+}
+
+// Format of the encrypt stage: the magic, a random nonce prefix, then the
+// content in chunks sealed with NaCl secretbox. The nonce of each chunk is
+// the prefix, its number and a flag on the last one, so chunks can't be
+// reordered, dropped or cut off at the end without it being noticed
+const (
+	encryptMagic     = "GCSBENC1"
+	encryptPrefixLen = 16
+	encryptChunkSize = 64 << 10
+	encryptLastChunk = 1 << 63
+)
+
+// encryption is the encrypt stage
+type encryption struct {
+	key *[32]byte
+}
+
+func (e encryption) name() string {
+	return transformEncrypt
+}
+
+func (e encryption) suffix() string {
+	return ".enc"
+}
+
+// chunkNonce returns the nonce of the chunk n
+func chunkNonce(prefix []byte, n uint64, last bool) *[24]byte {
+	var nonce [24]byte
+
+	copy(nonce[:], prefix)
+
+	if last {
+		n |= encryptLastChunk
+	}
+
+	binary.BigEndian.PutUint64(nonce[encryptPrefixLen:], n)
+
+	return &nonce
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	key    *[32]byte
+	prefix []byte
+	chunk  []byte
+	n      uint64
+}
+
+func (e encryption) writer(w io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, encryptPrefixLen)
+
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("rand.Read: %w", err)
+	}
+
+	if _, err := w.Write(append([]byte(encryptMagic), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, key: e.key, prefix: prefix, chunk: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+// seal writes the pending chunk
+func (e *encryptWriter) seal(last bool) error {
+	_, err := e.w.Write(secretbox.Seal(nil, e.chunk, chunkNonce(e.prefix, e.n, last), e.key))
+	e.chunk = e.chunk[:0]
+	e.n++
+
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it's not the last
+		if len(e.chunk) == encryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.chunk[len(e.chunk):cap(e.chunk)], p)
+		e.chunk = e.chunk[:len(e.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+type decryptReader struct {
+	r      *bufio.Reader
+	key    *[32]byte
+	prefix []byte
+	sealed []byte
+	buf    []byte
+	plain  []byte
+	n      uint64
+	done   bool
+}
+
+func (e encryption) reader(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, len(encryptMagic)+encryptPrefixLen)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading the encryption header: %w", err)
+	}
+
+	if string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("the object wasn't encrypted by gcs-backup")
+	}
+
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		key:    e.key,
+		prefix: header[len(encryptMagic):],
+		sealed: make([]byte, encryptChunkSize+secretbox.Overhead),
+	}, nil
+}
+
+// open decrypts the next chunk into plain
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+
+	if errors.Is(err, io.EOF) {
+		return errors.New("decrypting: the object is cut off")
+	}
+
+	last := errors.Is(err, io.ErrUnexpectedEOF)
+
+	if err != nil && !last {
+		return err
+	}
+
+	if !last {
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, ok := secretbox.Open(d.buf[:0], d.sealed[:n], chunkNonce(d.prefix, d.n, last), d.key)
+
+	if !ok {
+		return errors.New("decrypting: wrong key or damaged object")
+	}
+
+	d.buf, d.plain, d.done = plain, plain, last
+	d.n++
+
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// testClientKey returns a new base64 key of the encrypt stage
+func testClientKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// transformed returns data through the stages of p
+func transformed(t *testing.T, p pipeline, data []byte) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+
+	w, err := p.writer(&out)
+
+	if err != nil {
+		t.Fatalf("pipeline.writer: %v", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return out.Bytes()
+}
+
+// restored returns data with the stages of p reversed
+func restored(p pipeline, data []byte) ([]byte, error) {
+	r, err := p.reader(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+func TestPipelineRoundTrip(t *testing.T) {
+	key, err := parseClientKey(testClientKey(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := encryption{key: key}
+
+	tests := []struct {
+		name   string
+		p      pipeline
+		suffix string
+	}{
+		{"compress", pipeline{compressGzip}, ".gz"},
+		{"encrypt", pipeline{encrypt}, ".enc"},
+		{"compress then encrypt", pipeline{compressZstd, encrypt}, ".zst.enc"},
+		{"encrypt then compress", pipeline{encrypt, compressGzip}, ".enc.gz"},
+	}
+
+	random := make([]byte, 2*encryptChunkSize+7)
+
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := map[string][]byte{
+		"empty":          nil,
+		"short":          []byte("the plaintext of a short file"),
+		"a single chunk": bytes.Repeat([]byte("x"), encryptChunkSize),
+		"several chunks": random,
+	}
+
+	for _, test := range tests {
+		if got := test.p.suffix(); got != test.suffix {
+			t.Errorf("%s: suffix = %q, want %q", test.name, got, test.suffix)
+		}
+
+		for name, data := range contents {
+			stored := transformed(t, test.p, data)
+			got, err := restored(test.p, stored)
+
+			if err != nil {
+				t.Errorf("%s of %s: %v", test.name, name, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s of %s: got %d bytes back, want %d", test.name, name, len(got), len(data))
+			}
+
+			if name == "short" && strings.Contains(test.suffix, ".enc") && bytes.Contains(stored, data) {
+				t.Errorf("%s: the plaintext is stored", test.name)
+			}
+		}
+	}
+
+	// Only a lone compression is told to GCS
+	if pipeline(nil).encoding() != "" || (pipeline{compressGzip}).encoding() != "gzip" || (pipeline{compressGzip, encrypt}).encoding() != "" {
+		t.Error("encoding of a pipeline other than a lone compression")
+	}
+
+	if got := (pipeline{compressGzip, encrypt}).metadata(map[string]string{"x-size": "1"}); got["x-transforms"] != "gzip,encrypt" || got["x-size"] != "1" {
+		t.Errorf("metadata = %v", got)
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key, _ := parseClientKey(testClientKey(t))
+	other, _ := parseClientKey(testClientKey(t))
+
+	data := bytes.Repeat([]byte("x"), 2*encryptChunkSize)
+	stored := transformed(t, pipeline{encryption{key: key}}, data)
+
+	// Two full chunks, the second one the last
+	header := len(encryptMagic) + encryptPrefixLen
+	sealed := encryptChunkSize + secretbox.Overhead
+
+	if len(stored) != header+2*sealed {
+		t.Fatalf("%d bytes stored, want the header and 2 chunks", len(stored))
+	}
+
+	swapped := append(append(append([]byte(nil), stored[:header]...), stored[header+sealed:]...), stored[header:header+sealed]...)
+
+	flipped := append([]byte(nil), stored...)
+	flipped[header+10] ^= 1
+
+	tests := map[string]struct {
+		key    *[32]byte
+		stored []byte
+	}{
+		"wrong key":          {other, stored},
+		"cut off at a chunk": {key, stored[:header+sealed]},
+		"cut off mid chunk":  {key, stored[:len(stored)-5]},
+		"chunks reordered":   {key, swapped},
+		"flipped bit":        {key, flipped},
+		"not encrypted":      {key, data},
+		"empty":              {key, nil},
+	}
+
+	for name, test := range tests {
+		if got, err := restored(pipeline{encryption{key: test.key}}, test.stored); err == nil {
+			t.Errorf("%s: decrypted %d bytes", name, len(got))
+		}
+	}
+}
+
+func TestTransformsBackupRestore(t *testing.T) {
+	key := testClientKey(t)
+	t.Setenv(clientKeyEnv, "")
+
+	tests := []struct {
+		name   string
+		extra  []string
+		suffix string
+	}{
+		{"encrypt only", []string{"transforms: [encrypt]", "clientKey: " + key}, ".enc"},
+		{"compress only", []string{"transforms: [compress]", "compress: zstd"}, ".zst"},
+		{"compress then encrypt", []string{"transforms: [compress, encrypt]", "compress: gzip", "clientKey: " + key}, ".gz.enc"},
+	}
+
+	paths := []string{"a.txt", "sub/b.txt"}
+	large := make([]byte, 3*encryptChunkSize/2)
+
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			src := t.TempDir()
+
+			makeTree(t, src, paths...)
+
+			if err := ioutil.WriteFile(filepath.Join(src, "large.bin"), large, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			prefix := backUp(t, f, src, append(test.extra, "pathMode: relative")...)
+			base := filepath.Base(src)
+
+			for _, p := range paths {
+				obj := f.object(testBucket, prefix+"/"+base+"/"+p+test.suffix)
+
+				if obj == nil {
+					t.Fatalf("no object %s%s in %v", p, test.suffix, f.names(testBucket, prefix))
+				}
+
+				if !strings.HasSuffix(test.suffix, ".enc") {
+					continue
+				}
+
+				if bytes.Contains(obj.Data, []byte(p)) {
+					t.Errorf("object of %s holds the plaintext", p)
+				}
+
+				if obj.Metadata["x-transforms"] == "" {
+					t.Errorf("object of %s without x-transforms: %v", p, obj.Metadata)
+				}
+			}
+
+			restorePrefix = prefix
+			restoreDest = t.TempDir()
+
+			if failed := restoreFiles(context.Background()); failed != 0 {
+				t.Fatalf("restoreFiles = %d failures, want 0", failed)
+			}
+
+			checkTree(t, filepath.Join(restoreDest, base), paths...)
+
+			if data, err := ioutil.ReadFile(filepath.Join(restoreDest, base, "large.bin")); err != nil || !bytes.Equal(data, large) {
+				t.Errorf("large.bin restored with %d bytes, %v", len(data), err)
+			}
+
+			if !strings.HasSuffix(test.suffix, ".enc") {
+				return
+			}
+
+			// Nor without the key
+			loadTestConf(t, backupConf(src))
+
+			restorePrefix = prefix
+			restoreDest = t.TempDir()
+
+			if failed := restoreFiles(context.Background()); failed != len(paths)+1 {
+				t.Errorf("restoreFiles without the key = %d failures, want %d", failed, len(paths)+1)
+			}
+		})
+	}
+}
+
+func TestTransformsConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(clientKeyEnv, "")
+
+	tests := []struct {
+		extra []string
+		want  string
+	}{
+		{[]string{"transforms: [zip]"}, "unknown transform \"zip\""},
+		{[]string{"transforms: [compress, compress]"}, "given twice"},
+		{[]string{"transforms: [encrypt]"}, "the encrypt transform needs clientKey"},
+		{[]string{"transforms: [encrypt]", "clientKey: c2hvcnQ="}, "clientKey must be 32 bytes"},
+		{[]string{"transforms: [encrypt]", "clientKey: '!!'"}, "not valid base64"},
+		{[]string{"transforms: [encrypt]", "compress: gzip", "clientKey: " + testClientKey(t)}, "compress is set but transforms has no compress stage"},
+	}
+
+	for _, test := range tests {
+		wantConfError(t, parseTestConf(t, backupConf(dir, test.extra...)), test.want)
+	}
+
+	// The variable takes precedence over clientKey
+	t.Setenv(clientKeyEnv, testClientKey(t))
+
+	if err := parseTestConf(t, backupConf(dir, "transforms: [encrypt]", "clientKey: c2hvcnQ=")); err != nil {
+		t.Errorf("parseFileConf with %s: %v", clientKeyEnv, err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Settings of autoConcurrency
+const (
+	tuneInterval = 10 * time.Second
+	tuneStart    = 2
+
+	// Smallest change of the throughput that counts as one
+	tuneGain = 0.05
+)
+
+// tuner bounds the workers busy at once and moves the bound by hill
+// climbing: one more worker while the throughput improves, back to the
+// last level when a raise didn't pay off, and a quarter less when files
+// fail, which is what an overloaded network or bucket looks like. A nil
+// tuner doesn't bound anything
+type tuner struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	active  int
+	limit   int
+	max     int
+	stopped bool
+
+	// Best throughput since the last change of conditions, in bytes per
+	// second, and whether the last decision was a raise
+	best   float64
+	raised bool
+
+	// Totals at the last sample
+	lastBytes  int64
+	lastFailed int64
+}
+
+// newTuner returns a tuner of up to max workers, starting with a few
+func newTuner(max int) *tuner {
+	t := &tuner{limit: tuneStart, max: max}
+	t.cond = sync.NewCond(&t.mutex)
+
+	if t.limit > max {
+		t.limit = max
+	}
+
+	return t
+}
+
+// acquire waits until the worker can take a file
+func (t *tuner) acquire() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for t.active >= t.limit && !t.stopped {
+		t.cond.Wait()
+	}
+
+	t.active++
+}
+
+// release frees the place taken by acquire
+func (t *tuner) release() {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	t.active--
+	t.mutex.Unlock()
+
+	t.cond.Signal()
+}
+
+// decide returns the next bound after an interval with the throughput, in
+// bytes per second, and the number of files that failed
+func (t *tuner) decide(throughput float64, failed int64) int {
+	switch {
+	case failed > 0:
+		step := t.limit / 4
+
+		if step < 1 {
+			step = 1
+		}
+
+		t.limit -= step
+		t.best, t.raised = 0, false
+	case throughput > t.best*(1+tuneGain):
+		t.best = throughput
+		t.raised = t.limit < t.max
+
+		if t.raised {
+			t.limit++
+		}
+	case t.raised:
+		t.limit--
+		t.raised = false
+	case throughput < t.best*(1-tuneGain):
+		// Slower at the same level, gains are measured from here on
+		t.best = throughput
+	}
+
+	if t.limit < 1 {
+		t.limit = 1
+	}
+
+	return t.limit
+}
+
+// run samples the throughput every tuneInterval and adjusts the bound
+// until ctx is done. The waiting workers are let through then, so they can
+// see that the backup stopped
+func (t *tuner) run(ctx context.Context) {
+	ticker := time.NewTicker(tuneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.mutex.Lock()
+			t.stopped = true
+			t.mutex.Unlock()
+
+			t.cond.Broadcast()
+
+			return
+		case <-ticker.C:
+		}
+
+		bytes := totalBytesOK.get() + totalBytesError.get()
+		failed := totalFilesError.get()
+
+		// Nothing finished, e.g. large files in progress, tells nothing
+		if bytes == t.lastBytes && failed == t.lastFailed {
+			continue
+		}
+
+		throughput := float64(bytes-t.lastBytes) / tuneInterval.Seconds()
+
+		t.mutex.Lock()
+		previous := t.limit
+		limit := t.decide(throughput, failed-t.lastFailed)
+		t.mutex.Unlock()
+
+		t.cond.Broadcast()
+
+		t.lastBytes, t.lastFailed = bytes, failed
+
+		if limit != previous {
+			logDebug("Concurrency %d -> %d at %s/s", previous, limit, byteCount(int64(throughput)))
+		}
+	}
+}
+
+// concurrency returns the current bound
+func (t *tuner) concurrency() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.limit
+}
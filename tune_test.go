@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTunerDecide(t *testing.T) {
+	type sample struct {
+		throughput float64
+		failed     int64
+		want       int
+	}
+
+	tests := []struct {
+		name    string
+		max     int
+		limit   int
+		samples []sample
+	}{
+		{"climbs while it pays off", 8, 0, []sample{
+			{100, 0, 3},
+			{150, 0, 4},
+			{200, 0, 5},
+			// No gain from the last raise, back to where it was
+			{205, 0, 4},
+			{200, 0, 4},
+			{196, 0, 4},
+		}},
+		{"slower at the same level", 8, 0, []sample{
+			{100, 0, 3},
+			{104, 0, 2},
+			// The network got slower, measured from here
+			{50, 0, 2},
+			{60, 0, 3},
+		}},
+		{"backs off on failures", 8, 12, []sample{
+			{100, 2, 9},
+			{100, 1, 7},
+			// Starts over from what it sees now
+			{10, 0, 8},
+		}},
+		{"never over max", 3, 0, []sample{
+			{100, 0, 3},
+			{200, 0, 3},
+			{400, 0, 3},
+		}},
+		{"never under one", 8, 1, []sample{
+			{100, 5, 1},
+			{0, 3, 1},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tune := newTuner(test.max)
+
+			if test.limit > 0 {
+				tune.limit = test.limit
+			}
+
+			for i, s := range test.samples {
+				if got := tune.decide(s.throughput, s.failed); got != s.want {
+					t.Fatalf("sample %d of %.0f B/s and %d failed: concurrency %d, want %d", i, s.throughput, s.failed, got, s.want)
+				}
+			}
+		})
+	}
+
+	if got := newTuner(1).concurrency(); got != 1 {
+		t.Errorf("tuner of up to 1 worker starts with %d", got)
+	}
+}
+
+func TestTunerBoundsWorkers(t *testing.T) {
+	tune := newTuner(8)
+
+	for i := 0; i < tuneStart; i++ {
+		tune.acquire()
+	}
+
+	third := make(chan struct{})
+
+	go func() {
+		tune.acquire()
+		close(third)
+	}()
+
+	select {
+	case <-third:
+		t.Fatal("a worker got past the bound")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tune.release()
+
+	select {
+	case <-third:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker still waits after a release")
+	}
+
+	// A nil tuner bounds nothing
+	var none *tuner
+	none.acquire()
+	none.release()
+}
+
+func TestTunerLetsTheWorkersGoWhenStopped(t *testing.T) {
+	resetState(t)
+
+	tune := newTuner(1)
+	tune.acquire()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan struct{})
+
+	go func() {
+		tune.run(ctx)
+		close(ran)
+	}()
+
+	waiting := make(chan struct{})
+
+	go func() {
+		tune.acquire()
+		close(waiting)
+	}()
+
+	cancel()
+
+	for _, done := range []chan struct{}{ran, waiting} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("still waiting after the cancel")
+		}
+	}
+}
+
+func TestAutoConcurrencySummary(t *testing.T) {
+	newFakeGCS(t, testBucket)
+	dir := t.TempDir()
+	writeFiles(t, dir, 5)
+
+	loadTestConf(t, backupConf(dir, "autoConcurrency: true", "concurrency: 16"))
+
+	if errs := copyFiles(context.Background()); errs != 0 {
+		t.Fatalf("copyFiles = %d errors, want 0", errs)
+	}
+
+	// Too short a run for a sample, so it stays where it started
+	if concurrencyUsed != tuneStart {
+		t.Errorf("concurrency in the summary = %d, want %d", concurrencyUsed, tuneStart)
+	}
+}
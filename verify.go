@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Outcomes of checking an object against its file
+const (
+	verifyOK          = "ok"
+	verifyMismatch    = "mismatch"
+	verifyMissingFile = "missing file"
+	verifySkipped     = "skipped"
+)
+
+// verifyObject checks the object obj against the local file it was made
+// of, found in its x-source-path metadata, and returns the outcome and
+// what it's based on. The CRC32C of a compressed or encrypted object is
+// the one of the stored bytes, so those are only checked by size and mtime
+func verifyObject(obj objectInfo) (string, string) {
+	if _, ok := obj.Metadata["x-archive"]; ok {
+		return verifySkipped, "archives hold several files"
+	}
+
+	path, ok := obj.Metadata["x-source-path"]
+
+	if !ok {
+		return verifySkipped, "no x-source-path metadata"
+	}
+
+	if link, ok := obj.Metadata["x-symlink"]; ok {
+		target, err := os.Readlink(path)
+
+		if os.IsNotExist(err) {
+			return verifyMissingFile, path
+		}
+
+		if err != nil || target != link {
+			return verifyMismatch, fmt.Sprintf("symlink \"%s\" doesn't point to \"%s\"", path, link)
+		}
+
+		return verifyOK, "symlink target"
+	}
+
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return verifyMissingFile, path
+	}
+
+	if err != nil {
+		return verifyMismatch, fmt.Sprintf("os.Open: %v", err)
+	}
+
+	defer f.Close()
+
+	if _, transformed := obj.Metadata["x-transforms"]; transformed || obj.ContentEncoding != "" {
+		info, err := f.Stat()
+
+		if err != nil {
+			return verifyMismatch, fmt.Sprintf("File.Stat: %v", err)
+		}
+
+		current := fileMetadata(info)
+
+		if obj.Metadata["x-size"] != current["x-size"] || obj.Metadata["x-mtime"] != current["x-mtime"] {
+			return verifyMismatch, fmt.Sprintf("\"%s\" has another size or modification time", path)
+		}
+
+		return verifyOK, "size and mtime of a compressed object"
+	}
+
+	crc := crc32.New(crc32cTable)
+
+	if _, err := io.Copy(crc, f); err != nil {
+		return verifyMismatch, fmt.Sprintf("reading \"%s\": %v", path, err)
+	}
+
+	if crc.Sum32() != obj.CRC32C {
+		return verifyMismatch, fmt.Sprintf("\"%s\" has crc32c %08x, the object %08x", path, crc.Sum32(), obj.CRC32C)
+	}
+
+	return verifyOK, "crc32c"
+}
+
+// verifyBackup checks every object of the backup restorePrefix in the first
+// destination against the local files, then that every object listed by
+// its manifest is there, and returns the number of problems found
+func verifyBackup(ctx context.Context) int {
+	var totalOK, totalMismatch, totalMissingFile, totalMissingObject, totalSkipped int
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	dest := newClient(ctx, conf.GoogleCloud[0])
+	defer dest.Close()
+
+	currentTime := time.Now()
+	prefix := strings.TrimSuffix(restorePrefix, "/") + "/"
+
+	entries, err := readManifestObject(ctx, dest, prefix+manifestName)
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		logWarning("No manifest under \"%s\", only the objects found are checked", prefix)
+	} else if err != nil {
+		logError("Reading the manifest: %s", err)
+		return 1
+	}
+
+	listed := map[string]bool{}
+	objects := make(chan objectInfo)
+
+	wg.Add(conf.Concurrency)
+
+	for i := 0; i < conf.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for obj := range objects {
+				outcome, detail := verifyObject(obj)
+				fields := logFields{File: obj.Metadata["x-source-path"], Object: obj.Name}
+
+				mutex.Lock()
+
+				switch outcome {
+				case verifyOK:
+					totalOK++
+					logEvent(levelOK, fields, fmt.Sprintf("Object \"%s\" matches its file (%s)", obj.Name, detail))
+				case verifySkipped:
+					totalSkipped++
+					logEvent(levelInfo, fields, fmt.Sprintf("Object \"%s\" skipped: %s", obj.Name, detail))
+				case verifyMissingFile:
+					totalMissingFile++
+					logEvent(levelWarning, fields, fmt.Sprintf("Object \"%s\": file \"%s\" not found", obj.Name, detail))
+				default:
+					totalMismatch++
+					logEvent(levelError, fields, fmt.Sprintf("Object \"%s\" doesn't match: %s", obj.Name, detail))
+				}
+
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	err = dest.backend.List(ctx, prefix, "", func(obj objectInfo) error {
+		listed[obj.Name] = true
+
+		// The objects that describe the backup have no file
+		switch strings.TrimPrefix(obj.Name, prefix) {
+		case manifestName, checksumsName, summaryName, runLogName:
+			return nil
+		}
+
+		select {
+		case objects <- obj:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	close(objects)
+
+	wg.Wait()
+
+	if err != nil && ctx.Err() == nil {
+		logError("Listing objects: %s", err)
+		return 1
+	}
+
+	// Files kept from a previous backup by onlyChanged point to its objects
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if entry.Status != statusCopied && entry.Status != statusChanged && entry.Status != statusUnchanged {
+			continue
+		}
+
+		found := listed[entry.Object]
+
+		if !found && !strings.HasPrefix(entry.Object, prefix) {
+			if found, err = dest.backend.Exists(ctx, entry.Object); err != nil {
+				logError("Object \"%s\": %s", entry.Object, err)
+				totalMismatch++
+
+				continue
+			}
+		}
+
+		if !found {
+			logEvent(levelError, logFields{File: entry.File, Object: entry.Object},
+				fmt.Sprintf("Object \"%s\" of \"%s\" is in the manifest but not in the bucket", entry.Object, entry.File))
+
+			totalMissingObject++
+		}
+	}
+
+	if ctx.Err() != nil {
+		logWarning("Verify interrupted: %s", ctx.Err())
+	}
+
+	logSummary("Verify finished", []summaryField{
+		{"Total objects matching", "objectsOK", totalOK},
+		{"Total objects not matching", "objectsMismatch", totalMismatch},
+		{"Total objects missing", "objectsMissing", totalMissingObject},
+		{"Total files missing", "filesMissing", totalMissingFile},
+		{"Total objects skipped", "objectsSkipped", totalSkipped},
+		{"Verify took", "elapsed", time.Since(currentTime).String()},
+	}, nil)
+
+	return totalMismatch + totalMissingObject + totalMissingFile
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the backup or its files after it's made
+		change   func(t *testing.T, f *fakeGCS, src, prefix string)
+		want     int
+		wantLogs []string
+	}{
+		{
+			name: "matching",
+			want: 0,
+		},
+		{
+			name: "mismatching file",
+			change: func(t *testing.T, f *fakeGCS, src, prefix string) {
+				if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("changed"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:     1,
+			wantLogs: []string{"a.txt\" has crc32c"},
+		},
+		{
+			name: "missing file",
+			change: func(t *testing.T, f *fakeGCS, src, prefix string) {
+				if err := os.Remove(filepath.Join(src, "sub", "b.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:     1,
+			wantLogs: []string{"b.txt\" not found", "Total files missing: 1"},
+		},
+		{
+			name: "missing object",
+			change: func(t *testing.T, f *fakeGCS, src, prefix string) {
+				f.mutex.Lock()
+				defer f.mutex.Unlock()
+
+				for name := range f.buckets[testBucket].objects {
+					if strings.HasSuffix(name, "/c.txt") {
+						delete(f.buckets[testBucket].objects, name)
+					}
+				}
+			},
+			want:     1,
+			wantLogs: []string{"c.txt\" is in the manifest but not in the bucket", "Total objects missing: 1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGCS(t, testBucket)
+			src := t.TempDir()
+
+			makeTree(t, src, "a.txt", "sub/b.txt", "sub/c.txt")
+
+			prefix := backUp(t, f, src)
+
+			if test.change != nil {
+				test.change(t, f, src, prefix)
+			}
+
+			var log bytes.Buffer
+			logThreshold = levelInfo
+			runLog = &log
+			restorePrefix = prefix
+
+			if got := verifyBackup(context.Background()); got != test.want {
+				t.Errorf("verifyBackup = %d, want %d: %s", got, test.want, log.String())
+			}
+
+			for _, want := range test.wantLogs {
+				if !strings.Contains(log.String(), want) {
+					t.Errorf("log without %q: %s", want, log.String())
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyCompressedBackup(t *testing.T) {
+	f := newFakeGCS(t, testBucket)
+	src := t.TempDir()
+
+	makeTree(t, src, "a.txt", "b.txt")
+
+	restorePrefix = backUp(t, f, src, "compress: gzip")
+
+	if got := verifyBackup(context.Background()); got != 0 {
+		t.Errorf("verifyBackup = %d, want 0", got)
+	}
+
+	// The stored bytes aren't the ones of the file, the size tells it changed
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("much longer than before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := verifyBackup(context.Background()); got != 1 {
+		t.Errorf("verifyBackup of a changed file = %d, want 1", got)
+	}
+}